@@ -59,6 +59,7 @@ import (
 	"github.com/awslabs/soci-snapshotter/service/resolver"
 	"github.com/awslabs/soci-snapshotter/version"
 	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
 	"github.com/containerd/containerd/contrib/snapshotservice"
 	"github.com/containerd/containerd/defaults"
@@ -125,6 +126,10 @@ func main() {
 		log.G(ctx).WithError(err).Fatal(err)
 	}
 
+	if err := compression.SetGzipImplementation(compression.GzipImplementation(cfg.GzipImplementation)); err != nil {
+		log.G(ctx).WithError(err).Fatalf("invalid gzip implementation")
+	}
+
 	if err := service.Supported(*rootDir); err != nil {
 		log.G(ctx).WithError(err).Fatalf("snapshotter is not supported")
 	}
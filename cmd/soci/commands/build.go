@@ -0,0 +1,206 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/urfave/cli"
+)
+
+const (
+	buildToolIdentifier = "AWS SOCI CLI v0.1"
+	spanSizeFlag        = "span-size"
+	spanStrategyFlag    = "span-strategy"
+	spanToleranceFlag   = "span-tolerance"
+	ztocVersionFlag     = "ztoc-version"
+	minLayerSizeFlag    = "min-layer-size"
+	forceRebuildFlag    = "force-rebuild"
+	maxConcurrencyFlag  = "max-concurrency"
+	tempDirFlag         = "temp-dir"
+	diskBudgetFlag      = "disk-budget"
+	prefetchListFlag    = "prefetch-list"
+	createdFlag         = "created"
+)
+
+// buildFlags are the flags of the commands building SOCI indices.
+var buildFlags = []cli.Flag{
+	cli.Int64Flag{
+		Name:  spanSizeFlag,
+		Usage: "Span size that soci index uses to segment layer data. Default is 4 MiB",
+		Value: 1 << 22,
+	},
+	cli.StringFlag{
+		Name: spanStrategyFlag,
+		Usage: "Strategy used to place spans in layers. 'fixed' cuts spans every span-size bytes. " +
+			"'adaptive' picks the span size of each layer (within a factor of 4 of span-size) based on the layer size and file count, " +
+			"and moves span boundaries to file boundaries so that small files don't straddle spans",
+		Value: string(ztoc.SpanStrategyFixed),
+	},
+	cli.Float64Flag{
+		Name:  spanToleranceFlag,
+		Usage: "Fraction of the span size by which the adaptive span strategy can move a span boundary. Must be between 0 and 0.5",
+		Value: ztoc.DefaultSpanTolerance,
+	},
+	cli.StringFlag{
+		Name: ztocVersionFlag,
+		Usage: "Version of the zTOCs to build. '1.1' compresses the checkpoints of gzip layers, which makes zTOCs much smaller, " +
+			"but can't be read by snapshotters that only support '1.0'. '1.2' is needed to index layers made of multiple gzip members " +
+			"or with sparse files, which are skipped with earlier versions",
+		Value: string(ztoc.DefaultVersion),
+	},
+	cli.Int64Flag{
+		Name:  minLayerSizeFlag,
+		Usage: "Minimum layer size to build zTOC for. Smaller layers won't have zTOC and not lazy pulled. Default is 10 MiB.",
+		Value: 10 << 20,
+	},
+	cli.BoolFlag{
+		Name: forceRebuildFlag,
+		Usage: "Build zTOCs of all layers. By default, layers which already have a zTOC built with the same span size " +
+			"(e.g. layers shared with images indexed before) reuse it",
+	},
+	cli.Int64Flag{
+		Name:  maxConcurrencyFlag,
+		Usage: "Maximum number of layers whose zTOCs are built at the same time. 0 builds zTOCs of all layers at the same time",
+		Value: 0,
+	},
+	cli.StringFlag{
+		Name: tempDirFlag,
+		Usage: "Directory of the temp files layers are copied to when their zTOCs can't be built while streaming them " +
+			"(e.g. with the adaptive span strategy). Default is the default directory for temporary files",
+	},
+	cli.Int64Flag{
+		Name: diskBudgetFlag,
+		Usage: "Maximum number of bytes of layers copied to temp files at the same time. " +
+			"Layers wait for room before being copied, and a layer larger than the budget waits for the whole budget. 0 means no limit",
+		Value: 0,
+	},
+	cli.StringFlag{
+		Name: createdFlag,
+		Usage: "Creation time recorded in the SOCI index, which the 'newest' index selection policy of the snapshotter uses. " +
+			"Either an RFC 3339 time, seconds since the Unix epoch or 'now'. By default no creation time is recorded, " +
+			"so that the SOCI indices of an image built with the same options are identical",
+		EnvVar: "SOURCE_DATE_EPOCH",
+	},
+	cli.StringFlag{
+		Name: prefetchListFlag,
+		Usage: "File with the paths of the files fetched when the image is mounted, before the container reads them, one per line in the order they are read. " +
+			"Empty lines and lines starting with '#' are ignored",
+	},
+}
+
+// buildOptions returns the options to build SOCI indices specified by `buildFlags`.
+func buildOptions(cliContext *cli.Context) ([]soci.BuildOption, error) {
+	spanStrategy, err := ztoc.ParseSpanStrategy(cliContext.String(spanStrategyFlag))
+	if err != nil {
+		return nil, err
+	}
+	ztocVersion, err := ztoc.ParseVersion(cliContext.String(ztocVersionFlag))
+	if err != nil {
+		return nil, err
+	}
+	created, err := parseCreated(cliContext.String(createdFlag))
+	if err != nil {
+		return nil, err
+	}
+	var prefetchPaths []string
+	if path := cliContext.String(prefetchListFlag); path != "" {
+		prefetchPaths, err = readPrefetchList(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []soci.BuildOption{
+		soci.WithMinLayerSize(cliContext.Int64(minLayerSizeFlag)),
+		soci.WithSpanSize(cliContext.Int64(spanSizeFlag)),
+		soci.WithSpanStrategy(spanStrategy),
+		soci.WithSpanTolerance(cliContext.Float64(spanToleranceFlag)),
+		soci.WithZtocVersion(ztocVersion),
+		soci.WithBuildToolIdentifier(buildToolIdentifier),
+		soci.WithCreated(created),
+		soci.WithForceRebuild(cliContext.Bool(forceRebuildFlag)),
+		soci.WithMaxConcurrency(cliContext.Int64(maxConcurrencyFlag)),
+		soci.WithTempDir(cliContext.String(tempDirFlag)),
+		soci.WithDiskBudget(cliContext.Int64(diskBudgetFlag)),
+		soci.WithPrefetchPaths(prefetchPaths),
+	}, nil
+}
+
+// parseCreated parses the creation time of SOCI indices given as an RFC 3339 time,
+// seconds since the Unix epoch (like `SOURCE_DATE_EPOCH`) or "now".
+// An empty value is the zero time, which records no creation time.
+func parseCreated(s string) (time.Time, error) {
+	switch s {
+	case "":
+		return time.Time{}, nil
+	case "now":
+		return time.Now(), nil
+	}
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	created, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid creation time %q: expected an RFC 3339 time, seconds since the Unix epoch or 'now'", s)
+	}
+	return created, nil
+}
+
+// readPrefetchList reads the paths of a prefetch list file, one per line.
+func readPrefetchList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open prefetch list: %w", err)
+	}
+	defer f.Close()
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read prefetch list: %w", err)
+	}
+	return paths, nil
+}
+
+// createSociRootPath creates the snapshotter's root path if it does not exist.
+func createSociRootPath() error {
+	// Creating the snapshotter's root path first if it does not exist, since this ensures, that
+	// it has the limited permission set as drwx--x--x.
+	// The subsequent oci.New creates a root path dir with too broad permission set.
+	if _, err := os.Stat(config.SociSnapshotterRootPath); os.IsNotExist(err) {
+		if err = os.Mkdir(config.SociSnapshotterRootPath, 0711); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
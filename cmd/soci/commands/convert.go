@@ -0,0 +1,122 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/urfave/cli"
+)
+
+// ConvertCommand creates SOCI indices for an image and a new image whose image index lists
+// them next to the image manifests, so that the snapshotter finds them without the Referrers API.
+// The new image can be pushed like any other image, e.g. with `nerdctl push`.
+var ConvertCommand = cli.Command{
+	Name:      "convert",
+	Usage:     "convert an image to an image whose image index contains its SOCI indices",
+	ArgsUsage: "[flags] <image_ref> <converted_image_ref>",
+	Flags:     append(internal.PlatformFlags, buildFlags...),
+	Action: func(cliContext *cli.Context) error {
+		srcRef := cliContext.Args().Get(0)
+		dstRef := cliContext.Args().Get(1)
+		if srcRef == "" || dstRef == "" {
+			return errors.New("source and converted images need to be specified")
+		}
+
+		client, ctx, cancel, err := internal.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		// the content of the converted image is written in a lease, so that it isn't
+		// garbage collected before the converted image is created.
+		ctx, done, err := client.WithLease(ctx)
+		if err != nil {
+			return err
+		}
+		defer done(ctx)
+
+		cs := client.ContentStore()
+		srcImg, err := client.ImageService().Get(ctx, srcRef)
+		if err != nil {
+			return err
+		}
+		builderOpts, err := buildOptions(cliContext)
+		if err != nil {
+			return err
+		}
+		if err := createSociRootPath(); err != nil {
+			return err
+		}
+
+		ctx, blobStore, err := store.NewContentStore(ctx, internal.ContentStoreOptions(cliContext)...)
+		if err != nil {
+			return err
+		}
+
+		ps, err := internal.GetPlatforms(ctx, cliContext, srcImg, cs)
+		if err != nil {
+			return err
+		}
+
+		artifactsDb, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+
+		var indices []*soci.IndexWithMetadata
+		for _, plat := range ps {
+			builder, err := soci.NewIndexBuilder(cs, blobStore, artifactsDb, append(builderOpts, soci.WithPlatform(plat))...)
+			if err != nil {
+				return err
+			}
+			sociIndexWithMetadata, err := builder.Build(ctx, srcImg)
+			if err != nil {
+				return err
+			}
+			err = soci.WriteSociIndex(ctx, sociIndexWithMetadata, blobStore, builder.ArtifactsDb)
+			if err != nil {
+				return err
+			}
+			indices = append(indices, sociIndexWithMetadata)
+		}
+
+		target, err := soci.ConvertImage(ctx, cs, srcImg, indices, blobStore)
+		if err != nil {
+			return err
+		}
+		img := images.Image{Name: dstRef, Target: target, Labels: srcImg.Labels}
+		is := client.ImageService()
+		if _, err := is.Create(ctx, img); err != nil {
+			if !errdefs.IsAlreadyExists(err) {
+				return err
+			}
+			if _, err := is.Update(ctx, img, "target"); err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("converted image %s -> %s (%s)\n", srcRef, dstRef, target.Digest)
+		return nil
+	},
+}
@@ -17,71 +17,162 @@
 package commands
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"os"
 
 	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
-	"github.com/awslabs/soci-snapshotter/config"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
 	"github.com/urfave/cli"
 )
 
 const (
-	buildToolIdentifier = "AWS SOCI CLI v0.1"
-	spanSizeFlag        = "span-size"
-	minLayerSizeFlag    = "min-layer-size"
+	remoteFlag        = "remote"
+	ociLayoutFlag     = "oci-layout"
+	dockerArchiveFlag = "docker-archive"
+	outputFlag        = "output"
 )
 
 // CreateCommand creates SOCI index for an image
 // Output of this command is SOCI layers and SOCI index stored in a local directory
 // SOCI layer is named as <image-layer-digest>.soci.layer
 // SOCI index is named as <image-manifest-digest>.soci.index
+// With --remote, the image is read from its registry instead of containerd's content store
+// With --oci-layout or --docker-archive, the image is read from an OCI layout or a docker save tarball
 var CreateCommand = cli.Command{
 	Name:      "create",
 	Usage:     "create SOCI index",
 	ArgsUsage: "[flags] <image_ref>",
 	Flags: append(
-		internal.PlatformFlags,
-		cli.Int64Flag{
-			Name:  spanSizeFlag,
-			Usage: "Span size that soci index uses to segment layer data. Default is 4 MiB",
-			Value: 1 << 22,
+		append(internal.PlatformFlags, buildFlags...),
+		cli.BoolFlag{
+			Name: remoteFlag,
+			Usage: "Read the image from its registry instead of containerd's content store, so that it doesn't need to be pulled. " +
+				"Layers are streamed from the registry and aren't stored",
 		},
-		cli.Int64Flag{
-			Name:  minLayerSizeFlag,
-			Usage: "Minimum layer size to build zTOC for. Smaller layers won't have zTOC and not lazy pulled. Default is 10 MiB.",
-			Value: 10 << 20,
+		cli.StringFlag{
+			Name:  "user,u",
+			Usage: "User[:password] Registry user and password, used with --remote",
+		},
+		cli.BoolFlag{
+			Name:  "plain-http",
+			Usage: "Allow connections to the registry using plain HTTP, used with --remote",
+		},
+		cli.StringFlag{
+			Name: ociLayoutFlag,
+			Usage: "Read the image from an OCI image layout directory instead of containerd's content store. " +
+				"The SOCI index and zTOCs are also written into the layout. The image reference is optional if the layout contains a single image",
+		},
+		cli.StringFlag{
+			Name: dockerArchiveFlag,
+			Usage: "Read the image from a docker-archive tarball (as written by 'docker save') instead of containerd's content store. " +
+				"The image reference is optional if the archive contains a single image",
+		},
+		cli.StringFlag{
+			Name: outputFlag,
+			Usage: "Output format, 'text' or 'json'. 'text' prints the layers as their zTOCs are built. " +
+				"'json' prints a summary of the created SOCI indices once they are all created",
+			Value: outputText,
 		},
 	),
 	Action: func(cliContext *cli.Context) error {
 		srcRef := cliContext.Args().Get(0)
-		if srcRef == "" {
-			return errors.New("source image needs to be specified")
+		sources := 0
+		for _, flag := range []string{remoteFlag, ociLayoutFlag, dockerArchiveFlag} {
+			if cliContext.IsSet(flag) {
+				sources++
+			}
 		}
-
-		client, ctx, cancel, err := internal.NewClient(cliContext)
-		if err != nil {
-			return err
+		if sources > 1 {
+			return fmt.Errorf("only one of --%s, --%s and --%s can be specified", remoteFlag, ociLayoutFlag, dockerArchiveFlag)
+		}
+		output := cliContext.String(outputFlag)
+		if output != outputText && output != outputJSON {
+			return fmt.Errorf("unsupported output format %q, expected %q or %q", output, outputText, outputJSON)
 		}
-		defer cancel()
 
-		cs := client.ContentStore()
-		is := client.ImageService()
-		srcImg, err := is.Get(ctx, srcRef)
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+			cs     content.Provider
+			srcImg images.Image
+			layout *soci.OCILayout
+			err    error
+		)
+		switch {
+		case cliContext.IsSet(ociLayoutFlag):
+			ctx, cancel = internal.AppContext(cliContext)
+			defer cancel()
+
+			layout, err = soci.OpenOCILayout(cliContext.String(ociLayoutFlag))
+			if err != nil {
+				return err
+			}
+			srcImg, err = layout.Resolve(srcRef)
+			if err != nil {
+				return err
+			}
+			cs = layout
+		case cliContext.IsSet(dockerArchiveFlag):
+			ctx, cancel = internal.AppContext(cliContext)
+			defer cancel()
+
+			f, err := os.Open(cliContext.String(dockerArchiveFlag))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			archive, err := soci.ImportDockerArchive(ctx, f)
+			if err != nil {
+				return err
+			}
+			defer archive.Close()
+			srcImg, err = archive.Resolve(srcRef)
+			if err != nil {
+				return err
+			}
+			cs = archive
+		case cliContext.Bool(remoteFlag):
+			if srcRef == "" {
+				return errors.New("source image needs to be specified")
+			}
+			ctx, cancel = internal.AppContext(cliContext)
+			defer cancel()
+
+			resolver, err := internal.NewRemoteResolver(ctx, cliContext, srcRef)
+			if err != nil {
+				return err
+			}
+			srcImg, cs, err = soci.ResolveRemoteImage(ctx, resolver, srcRef)
+			if err != nil {
+				return err
+			}
+		default:
+			if srcRef == "" {
+				return errors.New("source image needs to be specified")
+			}
+			client, clientCtx, clientCancel, err := internal.NewClient(cliContext)
+			if err != nil {
+				return err
+			}
+			ctx, cancel = clientCtx, clientCancel
+			defer cancel()
+
+			cs = client.ContentStore()
+			srcImg, err = client.ImageService().Get(ctx, srcRef)
+			if err != nil {
+				return err
+			}
+		}
+		builderOpts, err := buildOptions(cliContext)
 		if err != nil {
 			return err
 		}
-		spanSize := cliContext.Int64(spanSizeFlag)
-		minLayerSize := cliContext.Int64(minLayerSizeFlag)
-		// Creating the snapshotter's root path first if it does not exist, since this ensures, that
-		// it has the limited permission set as drwx--x--x.
-		// The subsequent oci.New creates a root path dir with too broad permission set.
-		if _, err := os.Stat(config.SociSnapshotterRootPath); os.IsNotExist(err) {
-			if err = os.Mkdir(config.SociSnapshotterRootPath, 0711); err != nil {
-				return err
-			}
-		} else if err != nil {
+		if err := createSociRootPath(); err != nil {
 			return err
 		}
 
@@ -100,14 +191,14 @@ var CreateCommand = cli.Command{
 			return err
 		}
 
-		builderOpts := []soci.BuildOption{
-			soci.WithMinLayerSize(minLayerSize),
-			soci.WithSpanSize(spanSize),
-			soci.WithBuildToolIdentifier(buildToolIdentifier),
-		}
-
+		var createOutput CreateOutput
 		for _, plat := range ps {
-			builder, err := soci.NewIndexBuilder(cs, blobStore, artifactsDb, append(builderOpts, soci.WithPlatform(plat))...)
+			opts := append(builderOpts, soci.WithPlatform(plat))
+			recorder := newBuildEventRecorder()
+			if output == outputJSON {
+				opts = append(opts, soci.WithProgress(recorder.record))
+			}
+			builder, err := soci.NewIndexBuilder(cs, blobStore, artifactsDb, opts...)
 
 			if err != nil {
 				return err
@@ -122,8 +213,26 @@ var CreateCommand = cli.Command{
 			if err != nil {
 				return err
 			}
+
+			if layout != nil {
+				err = layout.WriteSociIndex(ctx, sociIndexWithMetadata, blobStore)
+				if err != nil {
+					return err
+				}
+			}
+
+			if output == outputJSON {
+				indexOutput, err := recorder.summarize(sociIndexWithMetadata)
+				if err != nil {
+					return err
+				}
+				createOutput.Indices = append(createOutput.Indices, indexOutput)
+			}
 		}
 
+		if output == outputJSON {
+			return printCreateOutput(createOutput)
+		}
 		return nil
 	},
 }
@@ -0,0 +1,133 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// CreateOutput is the summary of the SOCI indices created by `soci create --output json`.
+type CreateOutput struct {
+	Indices []IndexOutput `json:"indices"`
+}
+
+// IndexOutput is the summary of a SOCI index created for a platform of an image.
+type IndexOutput struct {
+	Digest        string               `json:"digest"`
+	Size          int64                `json:"size"`
+	ImageDigest   string               `json:"image_digest"`
+	Platform      string               `json:"platform"`
+	Ztocs         []ZtocOutput         `json:"ztocs"`
+	SkippedLayers []SkippedLayerOutput `json:"skipped_layers"`
+}
+
+// ZtocOutput is a ztoc of a SOCI index.
+type ZtocOutput struct {
+	Digest         string `json:"digest"`
+	Size           int64  `json:"size"`
+	LayerDigest    string `json:"layer_digest"`
+	LayerMediaType string `json:"layer_media_type"`
+	SpanCount      int    `json:"span_count"`
+	Reused         bool   `json:"reused"`
+}
+
+// SkippedLayerOutput is a layer of an image without ztoc.
+type SkippedLayerOutput struct {
+	LayerDigest string `json:"layer_digest"`
+	Reason      string `json:"reason"`
+}
+
+// buildEventRecorder records the events of a build, to summarize the index it builds.
+type buildEventRecorder struct {
+	built   map[digest.Digest]soci.BuildEvent
+	skipped []soci.BuildEvent
+}
+
+func newBuildEventRecorder() *buildEventRecorder {
+	return &buildEventRecorder{built: make(map[digest.Digest]soci.BuildEvent)}
+}
+
+func (r *buildEventRecorder) record(e soci.BuildEvent) {
+	switch e.Type {
+	case soci.BuildEventLayerBuilt:
+		r.built[e.Layer.Digest] = e
+	case soci.BuildEventLayerSkipped:
+		r.skipped = append(r.skipped, e)
+	}
+}
+
+// summarize returns the summary of `index`, built with the events recorded by `r`.
+func (r *buildEventRecorder) summarize(index *soci.IndexWithMetadata) (IndexOutput, error) {
+	manifest, err := soci.MarshalIndex(index.Index)
+	if err != nil {
+		return IndexOutput{}, err
+	}
+	out := IndexOutput{
+		Digest:        digest.FromBytes(manifest).String(),
+		Size:          int64(len(manifest)),
+		ImageDigest:   index.ImageDigest.String(),
+		Platform:      platforms.Format(*index.Platform),
+		Ztocs:         []ZtocOutput{},
+		SkippedLayers: []SkippedLayerOutput{},
+	}
+	for _, blob := range index.Index.Blobs {
+		layerDigest := blob.Annotations[soci.IndexAnnotationImageLayerDigest]
+		e, ok := r.built[digest.Digest(layerDigest)]
+		if !ok {
+			return IndexOutput{}, fmt.Errorf("no build event for layer %s", layerDigest)
+		}
+		out.Ztocs = append(out.Ztocs, ZtocOutput{
+			Digest:         blob.Digest.String(),
+			Size:           blob.Size,
+			LayerDigest:    layerDigest,
+			LayerMediaType: blob.Annotations[soci.IndexAnnotationImageLayerMediaType],
+			SpanCount:      e.SpanCount,
+			Reused:         e.Reused,
+		})
+	}
+	// layers are built concurrently, so skipped layers are sorted to be listed in a stable order.
+	sort.Slice(r.skipped, func(i, j int) bool {
+		return r.skipped[i].Layer.Digest < r.skipped[j].Layer.Digest
+	})
+	for _, e := range r.skipped {
+		out.SkippedLayers = append(out.SkippedLayers, SkippedLayerOutput{
+			LayerDigest: e.Layer.Digest.String(),
+			Reason:      e.Reason,
+		})
+	}
+	return out, nil
+}
+
+func printCreateOutput(out CreateOutput) error {
+	j, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(j))
+	return nil
+}
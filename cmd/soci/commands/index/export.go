@@ -0,0 +1,110 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+var exportCommand = cli.Command{
+	Name:      "export",
+	Usage:     "export the indices of an image to a tarball",
+	ArgsUsage: "[flags] <image_ref>",
+	Description: `Export the SOCI indices of an image, their ztocs and their metadata to a tarball of an OCI image layout.
+
+The tarball can be loaded with "soci index import" on hosts that cannot reach the registry the indices were
+pushed to, e.g. to push the indices to an offline registry alongside the image.
+`,
+	Flags: append(internal.PlatformFlags,
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "Path of the tarball to write",
+		},
+	),
+	Action: func(cliContext *cli.Context) error {
+		ref := cliContext.Args().First()
+		if ref == "" {
+			return fmt.Errorf("please provide an image reference to export the indices of")
+		}
+		output := cliContext.String("output")
+		if output == "" {
+			return fmt.Errorf("please provide the path of the tarball to write with --output")
+		}
+
+		client, ctx, cancel, err := internal.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		cs := client.ContentStore()
+		img, err := client.ImageService().Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		ps, err := internal.GetPlatforms(ctx, cliContext, img, cs)
+		if err != nil {
+			return err
+		}
+		db, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+		ctx, blobStore, err := store.NewContentStore(ctx, internal.ContentStoreOptions(cliContext)...)
+		if err != nil {
+			return fmt.Errorf("cannot create local content store: %w", err)
+		}
+
+		var indexDescs []specs.Descriptor
+		for _, platform := range ps {
+			descs, _, err := soci.GetIndexDescriptorCollection(ctx, cs, db, img, []specs.Platform{platform})
+			if err != nil {
+				return err
+			}
+			for _, desc := range descs {
+				indexDescs = append(indexDescs, desc.Descriptor)
+			}
+		}
+		if len(indexDescs) == 0 {
+			return fmt.Errorf("could not find any soci indices to export")
+		}
+
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		err = soci.ExportIndices(ctx, f, blobStore, db, indexDescs)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(output)
+			return err
+		}
+		for _, desc := range indexDescs {
+			fmt.Printf("exported index %s\n", desc.Digest)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,68 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/urfave/cli"
+)
+
+var importCommand = cli.Command{
+	Name:      "import",
+	Usage:     "import indices from a tarball",
+	ArgsUsage: "<file>",
+	Description: `Import the SOCI indices, ztocs and metadata of a tarball written by "soci index export" into the content store.
+
+The imported indices can be listed, pushed and used like indices created locally.
+`,
+	Action: func(cliContext *cli.Context) error {
+		path := cliContext.Args().First()
+		if path == "" {
+			return fmt.Errorf("please provide the tarball to import")
+		}
+		ctx, cancel := internal.AppContext(cliContext)
+		defer cancel()
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		db, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+		ctx, contentStore, err := store.NewContentStore(ctx, internal.ContentStoreOptions(cliContext)...)
+		if err != nil {
+			return fmt.Errorf("cannot create local content store: %w", err)
+		}
+		imported, err := soci.ImportIndices(ctx, f, contentStore, db)
+		if err != nil {
+			return err
+		}
+		for _, desc := range imported {
+			fmt.Printf("imported index %s\n", desc.Digest)
+		}
+		return nil
+	},
+}
@@ -27,5 +27,8 @@ var Command = cli.Command{
 		listCommand,
 		infoCommand,
 		rmCommand,
+		verifyCommand,
+		exportCommand,
+		importCommand,
 	},
 }
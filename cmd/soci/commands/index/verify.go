@@ -0,0 +1,128 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/platforms"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+var errVerificationFailed = errors.New("verification failed")
+
+var verifyCommand = cli.Command{
+	Name:      "verify",
+	Usage:     "verify the indices of an image",
+	ArgsUsage: "[flags] <image_ref>",
+	Description: `Verify that the SOCI indices of an image are consistent with the image.
+
+The subject of every index must be the image manifest, and every ztoc must exist, be valid, and be for
+a layer of the image. When a layer is available in the content store, the span digests and the files
+of its ztoc are checked against the layer too. The command fails if any index or ztoc fails verification.
+`,
+	Flags: internal.PlatformFlags,
+	Action: func(cliContext *cli.Context) error {
+		ref := cliContext.Args().First()
+		if ref == "" {
+			return fmt.Errorf("please provide an image reference to verify")
+		}
+
+		client, ctx, cancel, err := internal.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		cs := client.ContentStore()
+		img, err := client.ImageService().Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		ps, err := internal.GetPlatforms(ctx, cliContext, img, cs)
+		if err != nil {
+			return err
+		}
+		db, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+		ctx, blobStore, err := store.NewContentStore(ctx, internal.ContentStoreOptions(cliContext)...)
+		if err != nil {
+			return fmt.Errorf("cannot create local content store: %w", err)
+		}
+
+		var verified int
+		failed := false
+		writer := tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
+		writer.Write([]byte("INDEX\tPLATFORM\tLAYER\tZTOC\tLAYER CHECKED\tRESULT\t\n"))
+		for _, platform := range ps {
+			indexDescs, manifestDesc, err := soci.GetIndexDescriptorCollection(ctx, cs, db, img, []specs.Platform{platform})
+			if err != nil {
+				return err
+			}
+			for _, indexDesc := range indexDescs {
+				v, err := soci.VerifyIndex(ctx, cs, blobStore, *manifestDesc, indexDesc.Descriptor)
+				if err != nil {
+					return err
+				}
+				verified++
+				failed = failed || v.Failed()
+				writeIndexVerification(writer, indexDesc.Descriptor, platform, v)
+			}
+		}
+		writer.Flush()
+
+		if verified == 0 {
+			return fmt.Errorf("could not find any soci indices to verify")
+		}
+		if failed {
+			return errVerificationFailed
+		}
+		return nil
+	},
+}
+
+func writeIndexVerification(w *tabwriter.Writer, indexDesc specs.Descriptor, platform specs.Platform, v *soci.IndexVerification) {
+	if v.Err != nil {
+		fmt.Fprintf(w, "%s\t%s\t\t\t\t%s\t\n", indexDesc.Digest, platforms.Format(platform), verificationResult(v.Err))
+	}
+	for _, l := range v.Layers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\t\n",
+			indexDesc.Digest,
+			platforms.Format(platform),
+			l.Layer,
+			l.Ztoc.Digest,
+			l.LayerChecked,
+			verificationResult(l.Err),
+		)
+	}
+}
+
+func verificationResult(err error) string {
+	if err != nil {
+		return fmt.Sprintf("FAIL: %v", err)
+	}
+	return "PASS"
+}
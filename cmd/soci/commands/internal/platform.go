@@ -50,7 +50,7 @@ var PlatformFlags = []cli.Flag{
 // 3) the default platform
 //
 // This method is not suitable for situations where the default should be all supported platforms (e.g. the `soci index list` command)
-func GetPlatforms(ctx context.Context, cliContext *cli.Context, img images.Image, cs content.Store) ([]ocispec.Platform, error) {
+func GetPlatforms(ctx context.Context, cliContext *cli.Context, img images.Image, cs content.Provider) ([]ocispec.Platform, error) {
 	if cliContext.Bool(AllPlatformsFlagKey) {
 		return images.Platforms(ctx, cs, img.Target)
 	}
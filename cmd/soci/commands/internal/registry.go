@@ -33,6 +33,15 @@
 package internal
 
 import (
+	"context"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
 	"github.com/urfave/cli"
 )
 
@@ -79,3 +88,35 @@ var RegistryFlags = []cli.Flag{
 		Usage: "Enable HTTP tracing for registry interactions",
 	},
 }
+
+// NewRemoteResolver returns a resolver of `ref` in its registry. The registry hosts are configured
+// like the snapshotter's, with credentials from the `user` flag or from the docker config file.
+func NewRemoteResolver(ctx context.Context, cliContext *cli.Context, ref string) (remotes.Resolver, error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	creds := []resolver.Credential{dockerconfig.NewDockerConfigKeychain(ctx)}
+	if cliContext.IsSet("user") {
+		username, secret, _ := strings.Cut(cliContext.String("user"), ":")
+		creds = append([]resolver.Credential{func(_ reference.Spec, _ string) (string, string, error) {
+			return username, secret, nil
+		}}, creds...)
+	}
+	hosts := resolver.NewRegistryManager(config.DefaultRetryableHTTPClientConfig(), config.ResolverConfig{}, creds).AsRegistryHosts()
+	plainHTTP := cliContext.Bool("plain-http")
+	return docker.NewResolver(docker.ResolverOptions{
+		Hosts: func(string) ([]docker.RegistryHost, error) {
+			registryHosts, err := hosts(refspec)
+			if err != nil || !plainHTTP {
+				return registryHosts, err
+			}
+			plainHTTPHosts := make([]docker.RegistryHost, len(registryHosts))
+			for i, h := range registryHosts {
+				h.Scheme = "http"
+				plainHTTPHosts[i] = h
+			}
+			return plainHTTPHosts, nil
+		},
+	}), nil
+}
@@ -17,7 +17,9 @@
 package commands
 
 import (
+	"bytes"
 	"context"
+	"crypto"
 	"errors"
 	"fmt"
 	"io"
@@ -31,6 +33,7 @@ import (
 	"github.com/awslabs/soci-snapshotter/soci/store"
 	"github.com/containerd/containerd/reference"
 	dockercliconfig "github.com/docker/cli/cli/config"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli"
 	oraslib "oras.land/oras-go/v2"
@@ -38,6 +41,8 @@ import (
 	"oras.land/oras-go/v2/registry/remote/auth"
 )
 
+const signKeyFlag = "sign-key"
+
 // PushCommand is a command to push an image artifacts from local content store to the remote repository
 var PushCommand = cli.Command{
 	Name:      "push",
@@ -63,6 +68,11 @@ if they are available in the snapshotter's local content store.
 			Name:  "quiet, q",
 			Usage: "quiet mode",
 		},
+		cli.StringFlag{
+			Name: signKeyFlag,
+			Usage: "Path to a PEM encoded PKCS #8 private key (ed25519, ECDSA or RSA) to sign the SOCI index with. " +
+				"The signature is pushed as an artifact referring to the SOCI index",
+		},
 	),
 	Action: func(cliContext *cli.Context) error {
 		ref := cliContext.Args().First()
@@ -144,6 +154,14 @@ if they are available in the snapshotter's local content store.
 		} else {
 			dst.Client = authClient
 		}
+		var signer crypto.Signer
+		if cliContext.IsSet(signKeyFlag) {
+			signer, err = soci.LoadSigningKey(cliContext.String(signKeyFlag))
+			if err != nil {
+				return err
+			}
+		}
+
 		existingIndexOption := cliContext.String(internal.ExistingIndexFlagName)
 		if !internal.SupportedArg(existingIndexOption, internal.SupportedExistingIndexOptions) {
 			return fmt.Errorf("unexpected value for flag %s: %s, expected types %v",
@@ -226,11 +244,50 @@ if they are available in the snapshotter's local content store.
 				return fmt.Errorf("error pushing graph to remote: %w", err)
 			}
 
+			if signer != nil {
+				sigDesc, err := pushSignature(ctx, dst, signer, indexDesc.Descriptor)
+				if err != nil {
+					return fmt.Errorf("error pushing signature to remote: %w", err)
+				}
+				if !quiet {
+					fmt.Printf("pushed signature of soci index with digest: %v\n", sigDesc.Digest)
+				}
+			}
+
 		}
 		return nil
 	},
 }
 
+// pushSignature signs the SOCI index `indexDesc` with `signer`, and pushes the signature to `dst`.
+func pushSignature(ctx context.Context, dst *remote.Repository, signer crypto.Signer, indexDesc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	manifest, err := soci.SignIndex(signer, indexDesc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	// the signature manifest's config and layer are the empty JSON blob.
+	exists, err := dst.Exists(ctx, ocispec.DescriptorEmptyJSON)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if !exists {
+		err = dst.Push(ctx, ocispec.DescriptorEmptyJSON, bytes.NewReader(ocispec.DescriptorEmptyJSON.Data))
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	sigDesc := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: soci.SignatureArtifactType,
+		Digest:       digest.FromBytes(manifest),
+		Size:         int64(len(manifest)),
+	}
+	if err := dst.Push(ctx, sigDesc, bytes.NewReader(manifest)); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return sigDesc, nil
+}
+
 type debugClient struct {
 	client remote.Client
 }
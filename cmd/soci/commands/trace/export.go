@@ -0,0 +1,117 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package trace
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/platforms"
+	"github.com/urfave/cli"
+)
+
+var exportCommand = cli.Command{
+	Name:      "export",
+	Usage:     "export the access trace of an image",
+	ArgsUsage: "[flags] <image_ref>",
+	Description: `Export the access trace of an image as JSON.
+
+Access traces are recorded by the snapshotter when [access_trace] is enabled in its config. They list
+the files and spans of each layer of the image in the order they were first read after the image was
+mounted, and can be used to build the prefetch list of the image with "soci create --prefetch-list".
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "platform, p",
+			Usage: "platform of the image manifest whose access trace is exported",
+			Value: platforms.DefaultString(),
+		},
+		cli.StringFlag{
+			Name:  "root",
+			Usage: "root directory of the snapshotter",
+			Value: config.SociSnapshotterRootPath,
+		},
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "path of the file to write, defaults to stdout",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		ref := cliContext.Args().First()
+		if ref == "" {
+			return fmt.Errorf("please provide an image reference to export the access trace of")
+		}
+		platform, err := platforms.Parse(cliContext.String("platform"))
+		if err != nil {
+			return fmt.Errorf("could not parse platform %s: %w", cliContext.String("platform"), err)
+		}
+
+		client, ctx, cancel, err := internal.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		cs := client.ContentStore()
+		img, err := client.ImageService().Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		manifestDesc, err := soci.GetImageManifestDescriptor(ctx, cs, img.Target, platforms.OnlyStrict(platform))
+		if err != nil {
+			return err
+		}
+
+		// the snapshotter's filesystem lives in the "soci" directory of its root.
+		traceDir := filepath.Join(cliContext.String("root"), "soci", "traces")
+		trace, err := layer.ReadAccessTrace(traceDir, manifestDesc.Digest)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("no access trace recorded for image manifest %s", manifestDesc.Digest)
+			}
+			return err
+		}
+
+		output := cliContext.String("output")
+		if output == "" {
+			return writeAccessTrace(os.Stdout, trace)
+		}
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		err = writeAccessTrace(f, trace)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	},
+}
+
+func writeAccessTrace(w io.Writer, trace *layer.AccessTrace) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(trace)
+}
@@ -19,7 +19,6 @@ package ztoc
 import (
 	"context"
 	"errors"
-	"fmt"
 	"io"
 	"os"
 
@@ -35,12 +34,12 @@ import (
 
 var getFileCommand = cli.Command{
 	Name:      "get-file",
-	Usage:     "retrieve a file from a local image layer using a specified ztoc",
+	Usage:     "retrieve a file or a directory from a local image layer using a specified ztoc",
 	ArgsUsage: "<digest> <file>",
 	Flags: []cli.Flag{
 		cli.StringFlag{
 			Name:  "output, o",
-			Usage: "the file to write the extracted content. Defaults to stdout",
+			Usage: "the file to write the extracted content. Defaults to stdout. Required to extract a directory, which is extracted to this path",
 		},
 	},
 	Action: func(cliContext *cli.Context) error {
@@ -71,21 +70,41 @@ var getFileCommand = cli.Command{
 		}
 		defer layerReader.Close()
 
-		data, err := toc.ExtractFile(io.NewSectionReader(layerReader, 0, int64(toc.CompressedArchiveSize)), file)
+		sr := io.NewSectionReader(layerReader, 0, int64(toc.CompressedArchiveSize))
+		outfile := cliContext.String("output")
+		if isDir(toc, file) {
+			if outfile == "" {
+				return errors.New("please provide an output path to extract a directory")
+			}
+			return toc.ExtractDir(sr, file, outfile)
+		}
+
+		fr, err := toc.OpenFile(sr, file)
 		if err != nil {
 			return err
 		}
+		defer fr.Close()
 
-		outfile := cliContext.String("output")
+		var w io.Writer = os.Stdout
 		if outfile != "" {
-			os.WriteFile(outfile, data, 0)
-			return nil
+			f, err := os.Create(outfile)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
 		}
-		fmt.Println(string(data))
-		return nil
+		_, err = io.Copy(w, fr)
+		return err
 	},
 }
 
+// isDir returns whether `name` is a directory in the ztoc.
+func isDir(toc *ztoc.Ztoc, name string) bool {
+	_, err := toc.PathIndex().ListDir(name)
+	return err == nil
+}
+
 func getZtoc(ctx context.Context, cliContext *cli.Context, d digest.Digest) (*ztoc.Ztoc, error) {
 	ctx, blobStore, err := store.NewContentStore(ctx, internal.ContentStoreOptions(cliContext)...)
 	if err != nil {
@@ -49,12 +49,19 @@ type FileInfo struct {
 	Type      string             `json:"type"`
 	StartSpan compression.SpanID `json:"start_span"`
 	EndSpan   compression.SpanID `json:"end_span"`
+	Digest    string             `json:"digest,omitempty"`
 }
 
 var infoCommand = cli.Command{
 	Name:      "info",
 	Usage:     "get detailed info about a ztoc",
 	ArgsUsage: "<digest>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "path",
+			Usage: "only list the files whose path matches this glob pattern, e.g. '/usr/lib/*.so'",
+		},
+	},
 	Action: func(cliContext *cli.Context) error {
 		digest, err := digest.Parse(cliContext.Args().First())
 		if err != nil {
@@ -102,9 +109,15 @@ var infoCommand = cli.Command{
 			NumSpans:  ztoc.MaxSpanID + 1,
 			NumFiles:  len(ztoc.FileMetadata),
 		}
-		for _, v := range ztoc.FileMetadata {
+		files := ztoc.FileMetadata
+		if pattern := cliContext.String("path"); pattern != "" {
+			if files, err = ztoc.PathIndex().Glob(pattern); err != nil {
+				return fmt.Errorf("invalid path pattern %q: %w", pattern, err)
+			}
+		}
+		for _, v := range files {
 			startSpan := gzInfo.UncompressedOffsetToSpanID(v.UncompressedOffset)
-			endSpan := gzInfo.UncompressedOffsetToSpanID(v.UncompressedOffset + v.UncompressedSize)
+			endSpan := gzInfo.UncompressedOffsetToSpanID(v.UncompressedOffset + v.DataSize())
 			if startSpan != endSpan {
 				multiSpanFiles++
 			}
@@ -115,6 +128,7 @@ var infoCommand = cli.Command{
 				Type:      v.Type,
 				StartSpan: startSpan,
 				EndSpan:   endSpan,
+				Digest:    v.Digest.String(),
 			})
 		}
 		zinfo.NumMultiSpanFiles = multiSpanFiles
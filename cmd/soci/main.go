@@ -38,9 +38,11 @@ import (
 
 	"github.com/awslabs/soci-snapshotter/cmd/soci/commands"
 	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/index"
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/trace"
 	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/ztoc"
 	"github.com/awslabs/soci-snapshotter/config"
 	"github.com/awslabs/soci-snapshotter/version"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	"github.com/containerd/containerd/defaults"
 	"github.com/containerd/containerd/namespaces"
 
@@ -83,6 +85,15 @@ func main() {
 			Usage: "use a specific content store (soci or containerd)",
 			Value: config.DefaultContentStoreType,
 		},
+		cli.StringFlag{
+			Name:  "gzip-implementation",
+			Usage: "implementation used for gzip zinfo (cgo or go). zinfo built while streaming a layer or with adaptive spans is always built by go",
+			Value: string(compression.DefaultGzipImplementation),
+		},
+	}
+
+	app.Before = func(cliContext *cli.Context) error {
+		return compression.SetGzipImplementation(compression.GzipImplementation(cliContext.GlobalString("gzip-implementation")))
 	}
 
 	app.Version = fmt.Sprintf("%s %s", version.Version, version.Revision)
@@ -90,7 +101,9 @@ func main() {
 	app.Commands = []cli.Command{
 		index.Command,
 		ztoc.Command,
+		trace.Command,
 		commands.CreateCommand,
+		commands.ConvertCommand,
 		commands.PushCommand,
 		commands.RebuildDBCommand,
 	}
@@ -69,6 +69,10 @@ type Config struct {
 
 	// MetadataStore is the type of the metadata store to use.
 	MetadataStore string `toml:"metadata_store" default:"db"`
+
+	// GzipImplementation is the implementation used to read gzip zinfo ("cgo" or "go").
+	// If empty, the default for the build is used.
+	GzipImplementation string `toml:"gzip_implementation"`
 }
 type configParser func(*Config)
 
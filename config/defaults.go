@@ -68,12 +68,21 @@ const (
 	// defaultBgMetricEmitPeriodSec is the default amount of interval at which the background fetcher emits metrics
 	defaultBgMetricEmitPeriodSec = 10
 
+	// defaultReadAheadMaxSpans is the default max number of spans fetched ahead of the sequential reads of a file.
+	defaultReadAheadMaxSpans = 8
+
+	// defaultReadAheadMaxConcurrentFetches is the default max number of spans fetched by read-ahead at once.
+	defaultReadAheadMaxConcurrentFetches = 16
+
 	// defaultMountTimeoutSec is the amount of time Mount will time out if a layer can't be resolved.
 	defaultMountTimeoutSec = 30
 
 	// defaultFuseMetricsEmitWaitDurationSec is the amount of time the snapshotter will wait before emitting the metrics for FUSE operation.
 	defaultFuseMetricsEmitWaitDurationSec = 60
 
+	// defaultAccessTraceWindowSec is the amount of time after an image is mounted during which its reads are traced.
+	defaultAccessTraceWindowSec = 60
+
 	// defaultMaxConcurrency is the maximum number of layers allowed to be pulled at once
 	defaultMaxConcurrency = 100
 
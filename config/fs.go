@@ -66,7 +66,15 @@ type FSConfig struct {
 
 	BackgroundFetchConfig `toml:"background_fetch"`
 
+	ReadAheadConfig `toml:"read_ahead"`
+
 	ContentStoreConfig `toml:"content_store"`
+
+	IndexSignatureConfig `toml:"index_signature"`
+
+	IndexSelectionConfig `toml:"index_selection"`
+
+	AccessTraceConfig `toml:"access_trace"`
 }
 
 // BlobConfig is config for layer blob management.
@@ -106,6 +114,12 @@ type FuseConfig struct {
 	// for debugging purposes only. This option may emit sensitive information,
 	// e.g. filenames and paths within an image
 	LogFuseOperations bool `toml:"log_fuse_operations"`
+
+	// VerifyFileDigests enables verification of file contents against the digests
+	// recorded in the ztoc once all bytes of a file have been served. Reads that complete
+	// a file with mismatching content fail with EIO. Files without a recorded digest
+	// (e.g. from ztoc version 0.9) are not verified.
+	VerifyFileDigests bool `toml:"verify_file_digests"`
 }
 
 type BackgroundFetchConfig struct {
@@ -127,6 +141,34 @@ type BackgroundFetchConfig struct {
 	// EmitMetricPeriodSec is the amount of interval (in second) at which the background
 	// fetcher emits metrics
 	EmitMetricPeriodSec int64 `toml:"emit_metric_period_sec"`
+
+	// MaxBandwidthBytesPerSec limits the bytes per second fetched by the background fetcher.
+	// The limit is lowered while on-demand reads take longer than usual. Unlimited if not positive.
+	MaxBandwidthBytesPerSec int64 `toml:"max_bandwidth_bytes_per_sec"`
+
+	// MaxConcurrentFetches limits the number of spans fetched at once by the background fetcher.
+	// Unlimited if not positive.
+	MaxConcurrentFetches int `toml:"max_concurrent_fetches"`
+
+	// LabelWeights are the weights of images by their labels. Layers of images with a higher
+	// weight, i.e. the sum of the weights of their labels, are background fetched first.
+	// A weight keyed by "key" matches any value of the label "key", and one keyed by
+	// "key=value" only matches that value.
+	LabelWeights map[string]int `toml:"label_weights"`
+}
+
+// ReadAheadConfig configures the read-ahead of the files read sequentially. Spans following the
+// sequential reads of a file are fetched before they are read, in a window which grows while the
+// file is read sequentially.
+type ReadAheadConfig struct {
+	Enable bool `toml:"enable"`
+
+	// MaxSpans is the max number of spans fetched ahead of the sequential reads of a file.
+	MaxSpans int `toml:"max_spans"`
+
+	// MaxConcurrentFetches is the max number of spans fetched by the read-ahead of all files at once.
+	// Spans fetched ahead of the reads also count against the limits of the background fetcher.
+	MaxConcurrentFetches int `toml:"max_concurrent_fetches"`
 }
 
 // RetryConfig represents the settings for retries in a retryable http client.
@@ -179,6 +221,66 @@ type ContentStoreConfig struct {
 	Namespace string `toml:"namespace"`
 }
 
+// IndexSignaturePolicy is what happens when the SOCI index of an image has no valid signature,
+// as set by the `policy` of `[index_signature]`. It is one of the values below.
+type IndexSignaturePolicy string
+
+const (
+	// NoIndexSignaturePolicy ("none") doesn't verify signatures of SOCI indices. It is the default.
+	NoIndexSignaturePolicy IndexSignaturePolicy = "none"
+	// FallbackIndexSignaturePolicy ("fallback") pulls images whose SOCI index has no valid signature
+	// locally instead of lazily.
+	FallbackIndexSignaturePolicy IndexSignaturePolicy = "fallback"
+	// EnforceIndexSignaturePolicy ("enforce") fails to pull images whose SOCI index has no valid signature.
+	EnforceIndexSignaturePolicy IndexSignaturePolicy = "enforce"
+)
+
+// IndexSignatureConfig configures the verification of signatures of SOCI indices,
+// attached to them by `soci push --sign-key`.
+type IndexSignatureConfig struct {
+	// Policy is what happens when the SOCI index of an image has no signature
+	// by one of PublicKeys, or an invalid one.
+	Policy IndexSignaturePolicy `toml:"policy"`
+
+	// PublicKeys are paths to PEM encoded public keys trusted to sign SOCI indices.
+	PublicKeys []string `toml:"public_keys"`
+}
+
+// IndexSelectionPolicyName is the name of the policy choosing which SOCI index of an image is used,
+// as set by the `policy` of `[index_selection]`. It is one of the values below.
+type IndexSelectionPolicyName string
+
+const (
+	// FirstIndexSelectionPolicy ("first") uses SOCI indices in the order the registry lists them. It is the default.
+	FirstIndexSelectionPolicy IndexSelectionPolicyName = "first"
+	// NewestIndexSelectionPolicy ("newest") prefers the most recently created SOCI indices.
+	NewestIndexSelectionPolicy IndexSelectionPolicyName = "newest"
+	// BuildToolIndexSelectionPolicy ("build_tool") prefers SOCI indices created by the build tool
+	// IndexSelectionConfig.BuildToolIdentifier.
+	BuildToolIndexSelectionPolicy IndexSelectionPolicyName = "build_tool"
+	// LayerCoverageIndexSelectionPolicy ("layer_coverage") prefers the SOCI indices with ztocs for the most layers.
+	LayerCoverageIndexSelectionPolicy IndexSelectionPolicyName = "layer_coverage"
+)
+
+// IndexSelectionConfig chooses which SOCI index of an image is used when the registry has several.
+// If the artifacts of the chosen SOCI index cannot be fetched, the next preferred one is used.
+type IndexSelectionConfig struct {
+	Policy IndexSelectionPolicyName `toml:"policy"`
+
+	// BuildToolIdentifier is the build tool identifier preferred by the build_tool policy.
+	BuildToolIdentifier string `toml:"build_tool_identifier"`
+}
+
+// AccessTraceConfig configures the recording of the order in which the files and spans of images
+// are first read after they are mounted, to build prefetch lists. Traces have the paths of the files
+// read, and are persisted under the snapshotter root directory, so they are disabled by default.
+type AccessTraceConfig struct {
+	Enable bool `toml:"enable"`
+
+	// WindowSec is the time (in seconds) after an image is mounted during which its reads are recorded.
+	WindowSec int64 `toml:"window_sec"`
+}
+
 func parseFSConfig(cfg *Config) {
 	// Parse top level fs config
 	if cfg.MountTimeoutSec == 0 {
@@ -195,7 +297,7 @@ func parseFSConfig(cfg *Config) {
 		cfg.MaxConcurrency = 0
 	}
 	// Parse nested fs configs
-	parsers := []configParser{parseFuseConfig, parseBackgroundFetchConfig, parseRetryableHTTPClientConfig, parseBlobConfig, parseContentStoreConfig}
+	parsers := []configParser{parseFuseConfig, parseBackgroundFetchConfig, parseRetryableHTTPClientConfig, parseBlobConfig, parseContentStoreConfig, parseIndexSignatureConfig, parseIndexSelectionConfig, parseAccessTraceConfig, parseReadAheadConfig}
 	for _, p := range parsers {
 		p(cfg)
 	}
@@ -258,6 +360,14 @@ func parseRetryableHTTPClientConfig(cfg *Config) {
 	}
 }
 
+// DefaultRetryableHTTPClientConfig returns the config of a retryable http client
+// used when the snapshotter's config file doesn't set any.
+func DefaultRetryableHTTPClientConfig() RetryableHTTPClientConfig {
+	cfg := &Config{}
+	parseRetryableHTTPClientConfig(cfg)
+	return cfg.RetryableHTTPClientConfig
+}
+
 func parseBlobConfig(cfg *Config) {
 	if cfg.BlobConfig.ValidInterval == 0 {
 		cfg.BlobConfig.ValidInterval = defaultValidIntervalSec
@@ -291,3 +401,30 @@ func parseContentStoreConfig(cfg *Config) {
 		cfg.ContentStoreConfig.Namespace = namespaces.Default
 	}
 }
+
+func parseIndexSignatureConfig(cfg *Config) {
+	if cfg.IndexSignatureConfig.Policy == "" {
+		cfg.IndexSignatureConfig.Policy = NoIndexSignaturePolicy
+	}
+}
+
+func parseIndexSelectionConfig(cfg *Config) {
+	if cfg.IndexSelectionConfig.Policy == "" {
+		cfg.IndexSelectionConfig.Policy = FirstIndexSelectionPolicy
+	}
+}
+
+func parseAccessTraceConfig(cfg *Config) {
+	if cfg.AccessTraceConfig.WindowSec == 0 {
+		cfg.AccessTraceConfig.WindowSec = defaultAccessTraceWindowSec
+	}
+}
+
+func parseReadAheadConfig(cfg *Config) {
+	if cfg.ReadAheadConfig.MaxSpans == 0 {
+		cfg.ReadAheadConfig.MaxSpans = defaultReadAheadMaxSpans
+	}
+	if cfg.ReadAheadConfig.MaxConcurrentFetches <= 0 {
+		cfg.ReadAheadConfig.MaxConcurrentFetches = defaultReadAheadMaxConcurrentFetches
+	}
+}
@@ -30,6 +30,7 @@ import (
 	"github.com/awslabs/soci-snapshotter/util/ioutils"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"golang.org/x/sync/errgroup"
 	"oras.land/oras-go/v2/content"
@@ -132,12 +133,21 @@ func (f *artifactFetcher) Store(ctx context.Context, desc ocispec.Descriptor, re
 	return nil
 }
 
-func FetchSociArtifacts(ctx context.Context, refspec reference.Spec, indexDesc ocispec.Descriptor, localStore store.Store, remoteStore resolverStorage) (*soci.Index, error) {
+// FetchSociArtifacts fetches the SOCI index `indexDesc` and its ztocs to `localStore`. If `verifier`
+// isn't nil, the SOCI index is verified with it before being used, and an error wrapping ErrUnverifiedIndex
+// is returned if it cannot be verified.
+func FetchSociArtifacts(ctx context.Context, refspec reference.Spec, indexDesc ocispec.Descriptor, localStore store.Store, remoteStore resolverStorage, verifier IndexVerifier) (*soci.Index, error) {
 	fetcher, err := newArtifactFetcher(refspec, localStore, remoteStore)
 	if err != nil {
 		return nil, fmt.Errorf("could not create an artifact fetcher: %w", err)
 	}
 
+	if verifier != nil {
+		if err := verifier.VerifyIndex(ctx, indexDesc); err != nil {
+			return nil, fmt.Errorf("%w %s: %w", ErrUnverifiedIndex, indexDesc.Digest, err)
+		}
+	}
+
 	log.G(ctx).WithField("digest", indexDesc.Digest).Infof("fetching SOCI index from remote registry")
 
 	indexReader, local, err := fetcher.Fetch(ctx, indexDesc)
@@ -148,12 +158,24 @@ func FetchSociArtifacts(ctx context.Context, refspec reference.Spec, indexDesc o
 
 	cw := new(ioutils.CountWriter)
 	tee := io.TeeReader(indexReader, cw)
+	// the signature is of the digest of the SOCI index, so the fetched SOCI index must match it.
+	var digestVerifier digest.Verifier
+	if verifier != nil && !local {
+		if err := indexDesc.Digest.Validate(); err != nil {
+			return nil, fmt.Errorf("%w %s: %w", ErrUnverifiedIndex, indexDesc.Digest, err)
+		}
+		digestVerifier = indexDesc.Digest.Verifier()
+		tee = io.TeeReader(indexReader, io.MultiWriter(cw, digestVerifier))
+	}
 
 	var index soci.Index
 	err = soci.DecodeIndex(tee, &index)
 	if err != nil {
 		return nil, fmt.Errorf("cannot deserialize byte data to index: %w", err)
 	}
+	if digestVerifier != nil && !digestVerifier.Verified() {
+		return nil, fmt.Errorf("%w %s: content doesn't match digest", ErrUnverifiedIndex, indexDesc.Digest)
+	}
 
 	desc := ocispec.Descriptor{
 		Digest: indexDesc.Digest,
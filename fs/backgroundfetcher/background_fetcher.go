@@ -19,6 +19,7 @@ package backgroundfetcher
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
@@ -56,6 +57,37 @@ func WithEmitMetricPeriod(period time.Duration) Option {
 	}
 }
 
+// WithMaxBandwidth limits the bytes per second fetched in the background to `bytesPerSec`.
+// The bandwidth is lowered while spans fetched on demand take longer, see `ObserveOnDemandFetch`.
+// The bandwidth isn't limited if `bytesPerSec` isn't positive.
+func WithMaxBandwidth(bytesPerSec int64) Option {
+	return func(bf *BackgroundFetcher) error {
+		if bytesPerSec > 0 {
+			bf.bandwidth = newBandwidthLimiter(bytesPerSec)
+		}
+		return nil
+	}
+}
+
+// WithMaxConcurrentFetches limits the number of spans fetched in the background at once to `n`.
+// The number of concurrent fetches isn't limited if `n` isn't positive.
+func WithMaxConcurrentFetches(n int) Option {
+	return func(bf *BackgroundFetcher) error {
+		if n > 0 {
+			bf.fetchSlots = make(chan struct{}, n)
+		}
+		return nil
+	}
+}
+
+// WithLabelWeights sets the weights of images by their labels. See `Image.Labels`.
+func WithLabelWeights(weights map[string]int) Option {
+	return func(bf *BackgroundFetcher) error {
+		bf.labelWeights = weights
+		return nil
+	}
+}
+
 // An interface for a type to "pause" the background fetcher.
 // Useful for mocking in unit tests.
 type pauser interface {
@@ -75,14 +107,25 @@ type BackgroundFetcher struct {
 	fetchPeriod      time.Duration
 	maxQueueSize     int
 	emitMetricPeriod time.Duration
+	labelWeights     map[string]int
 
 	rateLimiter *rate.Limiter
+	// bandwidth limits the bytes per second fetched. It's nil if the bandwidth isn't limited.
+	bandwidth *bandwidthLimiter
+	// fetchSlots has an element for each span being fetched. It's nil if the number of
+	// concurrent fetches isn't limited.
+	fetchSlots chan struct{}
 
 	bfPauser pauser
 
-	// All span managers are added to the channel and picked up in Run().
-	// If a span manager is still able to fetch, it is reinserted into the chanel.
-	workQueue chan Resolver
+	// All resolvers are added to the work queue and picked up in Run() in order of priority.
+	// A resolver stays in the work queue until it has nothing left to fetch.
+	workQueue   map[Resolver]*entry
+	workQueueMu sync.Mutex
+	// slots has an element for each resolver in the work queue, so that `Add` blocks
+	// while the work queue is full. It's nil if the size of the work queue isn't limited.
+	slots     chan struct{}
+	nextSeq   uint64
 	closeChan chan struct{}
 	pauseChan chan struct{}
 }
@@ -98,7 +141,10 @@ func NewBackgroundFetcher(opts ...Option) (*BackgroundFetcher, error) {
 	// with a burst capacity of 1 (i.e., it will never invoke more than 1 bg-fetch
 	// within bf.fetchPeriod)
 	bf.rateLimiter = rate.NewLimiter(rate.Every(bf.fetchPeriod), 1)
-	bf.workQueue = make(chan Resolver, bf.maxQueueSize)
+	bf.workQueue = make(map[Resolver]*entry)
+	if bf.maxQueueSize > 0 {
+		bf.slots = make(chan struct{}, bf.maxQueueSize)
+	}
 	bf.closeChan = make(chan struct{})
 	bf.pauseChan = make(chan struct{}, bf.maxQueueSize)
 
@@ -109,10 +155,170 @@ func NewBackgroundFetcher(opts ...Option) (*BackgroundFetcher, error) {
 	return bf, nil
 }
 
-// Add a new Resolver to be background fetched from.
-// Sends the resolver through the channel, which will be received in the Run() method.
+// Add a new Resolver to be background fetched from, for an image mounted now without labels.
+// Blocks while the work queue is full.
 func (bf *BackgroundFetcher) Add(resolver Resolver) {
-	bf.workQueue <- resolver
+	bf.AddForImage(resolver, Image{MountedAt: time.Now()})
+}
+
+// AddForImage adds a new Resolver to be background fetched from, for the layer of image `img`.
+// The resolvers of images with a higher weight, then of layers read on demand recently, and then
+// of the most recently mounted images are fetched from first. Blocks while the work queue is full.
+func (bf *BackgroundFetcher) AddForImage(resolver Resolver, img Image) {
+	if bf.promote(resolver, img) {
+		return
+	}
+	if bf.slots != nil {
+		bf.slots <- struct{}{}
+	}
+	bf.workQueueMu.Lock()
+	defer bf.workQueueMu.Unlock()
+	// the resolver may have been added while waiting for a slot.
+	if e, ok := bf.workQueue[resolver]; ok {
+		e.promote(img, bf.weight(img))
+		bf.release()
+		return
+	}
+	bf.workQueue[resolver] = &entry{
+		resolver:  resolver,
+		image:     img.Digest,
+		weight:    bf.weight(img),
+		mountedAt: img.MountedAt,
+		seq:       bf.nextSeq,
+	}
+	bf.nextSeq++
+}
+
+// Promote raises the priority of `resolver` to that of image `img` if it's higher,
+// e.g. when a newly mounted image shares the layer of `resolver`.
+// Noop if `resolver` isn't in the work queue.
+func (bf *BackgroundFetcher) Promote(resolver Resolver, img Image) {
+	bf.promote(resolver, img)
+}
+
+// promote promotes `resolver`, returning whether it's in the work queue.
+func (bf *BackgroundFetcher) promote(resolver Resolver, img Image) bool {
+	bf.workQueueMu.Lock()
+	defer bf.workQueueMu.Unlock()
+	e, ok := bf.workQueue[resolver]
+	if ok {
+		e.promote(img, bf.weight(img))
+	}
+	return ok
+}
+
+// release frees the slot of a resolver removed from the work queue.
+func (bf *BackgroundFetcher) release() {
+	if bf.slots != nil {
+		<-bf.slots
+	}
+}
+
+// next returns the entry of the work queue to fetch from next, or nil if there is none.
+// The entry is marked as being fetched from until `done` is called.
+func (bf *BackgroundFetcher) next() *entry {
+	bf.workQueueMu.Lock()
+	defer bf.workQueueMu.Unlock()
+	var (
+		best *entry
+		now  = time.Now()
+	)
+	for resolver, e := range bf.workQueue {
+		if resolver.Closed() {
+			delete(bf.workQueue, resolver)
+			bf.release()
+			continue
+		}
+		if e.fetching {
+			continue
+		}
+		if best == nil || e.before(best, now) {
+			best = e
+		}
+	}
+	if best != nil {
+		best.fetching = true
+	}
+	return best
+}
+
+// done marks the entry as no longer being fetched from,
+// and removes it from the work queue unless there is more to fetch.
+func (bf *BackgroundFetcher) done(e *entry, more bool) {
+	bf.workQueueMu.Lock()
+	defer bf.workQueueMu.Unlock()
+	e.fetching = false
+	if !more {
+		delete(bf.workQueue, e.resolver)
+		bf.release()
+	}
+}
+
+// ObserveOnDemandFetch adapts the bandwidth of the background fetcher to the latency of a span
+// fetched on demand, so that background fetches slow down while they delay on-demand fetches.
+// Noop if the bandwidth isn't limited.
+func (bf *BackgroundFetcher) ObserveOnDemandFetch(latency time.Duration) {
+	if bf.bandwidth != nil {
+		bf.bandwidth.observe(latency)
+	}
+}
+
+// fetchSizer is implemented by resolvers which know how many bytes their next Resolve call fetches.
+type fetchSizer interface {
+	nextFetchSize() int64
+}
+
+// waitBandwidth blocks until the bandwidth allows the next Resolve call of `resolver`.
+func (bf *BackgroundFetcher) waitBandwidth(ctx context.Context, resolver Resolver) error {
+	if bf.bandwidth == nil {
+		return nil
+	}
+	fs, ok := resolver.(fetchSizer)
+	if !ok {
+		return nil
+	}
+	return bf.bandwidth.wait(ctx, fs.nextFetchSize())
+}
+
+// acquireFetchSlot returns whether a span can be fetched without exceeding
+// the max number of concurrent fetches. The slot must be freed by `releaseFetchSlot`.
+func (bf *BackgroundFetcher) acquireFetchSlot() bool {
+	if bf.fetchSlots == nil {
+		return true
+	}
+	select {
+	case bf.fetchSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (bf *BackgroundFetcher) releaseFetchSlot() {
+	if bf.fetchSlots != nil {
+		<-bf.fetchSlots
+	}
+}
+
+// TryAcquireFetch returns whether a span of `size` bytes can be fetched now outside of the
+// background fetcher, e.g. ahead of its read, within the max number of concurrent fetches and
+// the bandwidth of the background fetcher. If so, the returned func must be called once the span
+// is fetched.
+func (bf *BackgroundFetcher) TryAcquireFetch(size int64) (func(), bool) {
+	if !bf.acquireFetchSlot() {
+		return nil, false
+	}
+	if bf.bandwidth != nil && !bf.bandwidth.allow(size) {
+		bf.releaseFetchSlot()
+		return nil, false
+	}
+	return bf.releaseFetchSlot, true
+}
+
+func (bf *BackgroundFetcher) workQueueSize() int {
+	bf.workQueueMu.Lock()
+	defer bf.workQueueMu.Unlock()
+	return len(bf.workQueue)
 }
 
 func (bf *BackgroundFetcher) Close() error {
@@ -161,20 +367,23 @@ func (bf *BackgroundFetcher) Run(ctx context.Context) error {
 		default:
 		}
 
-		select {
-		case lr := <-bf.workQueue:
-			if lr.Closed() {
-				continue
+		if bf.acquireFetchSlot() {
+			if e := bf.next(); e != nil {
+				go func() {
+					defer bf.releaseFetchSlot()
+					if err := bf.waitBandwidth(ctx, e.resolver); err != nil {
+						bf.done(e, true)
+						return
+					}
+					more, err := e.resolver.Resolve(ctx)
+					if !more && err != nil {
+						log.G(ctx).WithError(err).WithField("image", e.image).Warn("error trying to resolve layer, removing it from the queue")
+					}
+					bf.done(e, more)
+				}()
+			} else {
+				bf.releaseFetchSlot()
 			}
-			go func() {
-				more, err := lr.Resolve(ctx)
-				if more {
-					bf.workQueue <- lr
-				} else if err != nil {
-					log.G(ctx).WithError(err).Warn("error trying to resolve layer, removing it from the queue")
-				}
-			}()
-		default:
 		}
 
 		if err := bf.rateLimiter.Wait(ctx); err != nil {
@@ -192,7 +401,7 @@ func (bf *BackgroundFetcher) emitWorkQueueMetric(ctx context.Context, ticker *ti
 			return
 		case <-ticker.C:
 			// background fetcher is at the snapshotter's fs level, so no image digest as key
-			commonmetrics.AddImageOperationCount(commonmetrics.BackgroundFetchWorkQueueSize, "", int32(len(bf.workQueue)))
+			commonmetrics.AddImageOperationCount(commonmetrics.BackgroundFetchWorkQueueSize, "", int32(bf.workQueueSize()))
 		}
 	}
 }
@@ -19,6 +19,7 @@ package backgroundfetcher
 import (
 	"compress/gzip"
 	"context"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -148,6 +149,156 @@ func TestBackgroundFetcherRun(t *testing.T) {
 	}
 }
 
+// fakeResolver is a Resolver whose layer was last read on demand at lastRead.
+type fakeResolver struct {
+	name     string
+	lastRead time.Time
+	closed   bool
+}
+
+func (r *fakeResolver) Resolve(context.Context) (bool, error) { return false, nil }
+func (r *fakeResolver) Close() error                          { r.closed = true; return nil }
+func (r *fakeResolver) Closed() bool                          { return r.closed }
+func (r *fakeResolver) LastRead() time.Time                   { return r.lastRead }
+
+func TestBackgroundFetcherPriority(t *testing.T) {
+	now := time.Now()
+	var (
+		oldImage     = Image{Digest: digest.FromString("old"), MountedAt: now.Add(-time.Hour)}
+		newImage     = Image{Digest: digest.FromString("new"), MountedAt: now}
+		labeledImage = Image{Digest: digest.FromString("labeled"), MountedAt: now.Add(-time.Hour), Labels: map[string]string{"tier": "critical"}}
+		otherLabel   = Image{Digest: digest.FromString("other"), MountedAt: now.Add(-time.Hour), Labels: map[string]string{"tier": "batch"}}
+	)
+	type add struct {
+		resolver *fakeResolver
+		image    Image
+		promote  bool
+	}
+	testCases := []struct {
+		name          string
+		labelWeights  map[string]int
+		adds          func() []add
+		expectedOrder []string
+	}{
+		{
+			name: "resolvers of the same image are fetched from in FIFO order",
+			adds: func() []add {
+				return []add{
+					{resolver: &fakeResolver{name: "a"}, image: oldImage},
+					{resolver: &fakeResolver{name: "b"}, image: oldImage},
+					{resolver: &fakeResolver{name: "c"}, image: oldImage},
+				}
+			},
+			expectedOrder: []string{"a", "b", "c"},
+		},
+		{
+			name: "newly mounted images are favored",
+			adds: func() []add {
+				return []add{
+					{resolver: &fakeResolver{name: "old"}, image: oldImage},
+					{resolver: &fakeResolver{name: "new"}, image: newImage},
+				}
+			},
+			expectedOrder: []string{"new", "old"},
+		},
+		{
+			name: "layers read recently are favored over newly mounted images",
+			adds: func() []add {
+				return []add{
+					{resolver: &fakeResolver{name: "new"}, image: newImage},
+					{resolver: &fakeResolver{name: "read long ago", lastRead: now.Add(-time.Hour)}, image: oldImage},
+					{resolver: &fakeResolver{name: "read", lastRead: now.Add(-2 * time.Second)}, image: oldImage},
+					{resolver: &fakeResolver{name: "read last", lastRead: now.Add(-time.Second)}, image: oldImage},
+				}
+			},
+			expectedOrder: []string{"read last", "read", "new", "read long ago"},
+		},
+		{
+			name:         "images are weighted by labels",
+			labelWeights: map[string]int{"tier=critical": 10, "tier": 1},
+			adds: func() []add {
+				return []add{
+					{resolver: &fakeResolver{name: "read", lastRead: now}, image: newImage},
+					{resolver: &fakeResolver{name: "other label"}, image: otherLabel},
+					{resolver: &fakeResolver{name: "labeled"}, image: labeledImage},
+				}
+			},
+			expectedOrder: []string{"labeled", "other label", "read"},
+		},
+		{
+			name: "layers shared with a newly mounted image are promoted",
+			adds: func() []add {
+				shared := &fakeResolver{name: "shared"}
+				return []add{
+					{resolver: shared, image: oldImage},
+					{resolver: &fakeResolver{name: "old"}, image: oldImage},
+					{resolver: shared, image: newImage, promote: true},
+					{resolver: &fakeResolver{name: "not added"}, image: newImage, promote: true},
+				}
+			},
+			expectedOrder: []string{"shared", "old"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			bf, err := NewBackgroundFetcher(WithMaxQueueSize(10), WithLabelWeights(tc.labelWeights))
+			if err != nil {
+				t.Fatalf("unable to construct background fetcher: %v", err)
+			}
+			for _, a := range tc.adds() {
+				if a.promote {
+					bf.Promote(a.resolver, a.image)
+				} else {
+					bf.AddForImage(a.resolver, a.image)
+				}
+			}
+			var order []string
+			for e := bf.next(); e != nil; e = bf.next() {
+				order = append(order, e.resolver.(*fakeResolver).name)
+			}
+			if !reflect.DeepEqual(order, tc.expectedOrder) {
+				t.Fatalf("unexpected fetch order %v, expected %v", order, tc.expectedOrder)
+			}
+		})
+	}
+}
+
+func TestBackgroundFetcherQueueSize(t *testing.T) {
+	bf, err := NewBackgroundFetcher(WithMaxQueueSize(1))
+	if err != nil {
+		t.Fatalf("unable to construct background fetcher: %v", err)
+	}
+	first := &fakeResolver{name: "first"}
+	bf.Add(first)
+
+	added := make(chan struct{})
+	go func() {
+		bf.Add(&fakeResolver{name: "second"})
+		close(added)
+	}()
+	select {
+	case <-added:
+		t.Fatalf("resolver was added to a full work queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// the slot of a resolver is freed once it has nothing left to fetch.
+	e := bf.next()
+	if e == nil || e.resolver != first {
+		t.Fatalf("unexpected entry %v, expected the first resolver", e)
+	}
+	bf.done(e, false)
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatalf("resolver wasn't added after a slot was freed")
+	}
+	if size := bf.workQueueSize(); size != 1 {
+		t.Fatalf("unexpected work queue size %d, expected 1", size)
+	}
+}
+
 // countingCache is an implementation of cache.BlobCache
 // which counts the number of times `cache.Add` was invoked
 // and the number of bytes added to the cache.
@@ -0,0 +1,127 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package backgroundfetcher
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// latencyIncreaseFactor is how many times the baseline latency of on-demand fetches their
+	// average latency must reach for the bandwidth of background fetches to be decreased.
+	latencyIncreaseFactor = 2
+	// bandwidthSteps is the number of steps of the max bandwidth in which the bandwidth of
+	// background fetches increases back, and the lowest fraction of the max bandwidth it decreases to.
+	bandwidthSteps = 16
+	// latencySmoothing is the weight of previous on-demand fetches in their average latency.
+	latencySmoothing = 0.875
+	// baselineDrift is the rate at which the baseline latency of on-demand fetches follows
+	// their average latency when it's higher, so that the baseline adapts to slower networks.
+	baselineDrift = 1.0 / 64
+)
+
+// bandwidthLimiter is a token bucket limiting the bytes per second fetched in the background.
+// It adapts to the latency of on-demand fetches: its bandwidth is halved whenever their average
+// latency rises to latencyIncreaseFactor times their baseline latency, and increases back to the
+// max bandwidth in bandwidthSteps steps while it doesn't.
+type bandwidthLimiter struct {
+	mu       sync.Mutex
+	limiter  *rate.Limiter
+	max      rate.Limit
+	latency  float64 // average latency of on-demand fetches, in seconds
+	baseline float64 // baseline latency of on-demand fetches, in seconds
+}
+
+// newBandwidthLimiter returns a bandwidthLimiter of at most `bytesPerSec` bytes per second.
+func newBandwidthLimiter(bytesPerSec int64) *bandwidthLimiter {
+	// the bucket holds up to a second of bandwidth.
+	burst := bytesPerSec
+	if burst > math.MaxInt32 {
+		burst = math.MaxInt32
+	}
+	return &bandwidthLimiter{
+		limiter: rate.NewLimiter(rate.Limit(bytesPerSec), int(burst)),
+		max:     rate.Limit(bytesPerSec),
+	}
+}
+
+// wait blocks until `n` bytes can be fetched.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int64) error {
+	burst := int64(l.limiter.Burst())
+	for n > 0 {
+		// spans larger than the bucket are fetched once the bucket was filled as many times.
+		chunk := n
+		if chunk > burst {
+			chunk = burst
+		}
+		if err := l.limiter.WaitN(ctx, int(chunk)); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// allow returns whether `n` bytes can be fetched now, and takes them from the bucket if so.
+// More bytes than the bucket holds can be fetched once it's full.
+func (l *bandwidthLimiter) allow(n int64) bool {
+	if burst := int64(l.limiter.Burst()); n > burst {
+		n = burst
+	}
+	return l.limiter.AllowN(time.Now(), int(n))
+}
+
+// observe adapts the bandwidth to the latency of a span fetched on demand.
+func (l *bandwidthLimiter) observe(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sec := latency.Seconds()
+	if l.latency == 0 {
+		l.latency = sec
+	} else {
+		l.latency = latencySmoothing*l.latency + (1-latencySmoothing)*sec
+	}
+	if l.baseline == 0 || l.latency < l.baseline {
+		l.baseline = l.latency
+	} else {
+		l.baseline += (l.latency - l.baseline) * baselineDrift
+	}
+
+	limit := l.limiter.Limit()
+	if l.latency >= latencyIncreaseFactor*l.baseline {
+		limit /= 2
+		if limit < l.max/bandwidthSteps {
+			limit = l.max / bandwidthSteps
+		}
+	} else {
+		limit += l.max / bandwidthSteps
+		if limit > l.max {
+			limit = l.max
+		}
+	}
+	l.limiter.SetLimit(limit)
+}
+
+// limit returns the current bandwidth in bytes per second.
+func (l *bandwidthLimiter) limit() rate.Limit {
+	return l.limiter.Limit()
+}
@@ -0,0 +1,184 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package backgroundfetcher
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestBandwidthLimiterObserve(t *testing.T) {
+	const maxBandwidth = 1600
+	repeat := func(latency time.Duration, n int) []time.Duration {
+		latencies := make([]time.Duration, n)
+		for i := range latencies {
+			latencies[i] = latency
+		}
+		return latencies
+	}
+	testCases := []struct {
+		name          string
+		latencies     []time.Duration
+		expectedLimit rate.Limit
+	}{
+		{
+			name:          "steady latency keeps the max bandwidth",
+			latencies:     repeat(10*time.Millisecond, 20),
+			expectedLimit: maxBandwidth,
+		},
+		{
+			name:          "rising latency halves the bandwidth",
+			latencies:     append(repeat(10*time.Millisecond, 20), 100*time.Millisecond),
+			expectedLimit: maxBandwidth / 2,
+		},
+		{
+			name:          "bandwidth doesn't decrease below its lowest step",
+			latencies:     append(repeat(10*time.Millisecond, 20), repeat(100*time.Millisecond, 10)...),
+			expectedLimit: maxBandwidth / bandwidthSteps,
+		},
+		{
+			name: "bandwidth increases back once latency is back to its baseline",
+			latencies: append(append(repeat(10*time.Millisecond, 20), repeat(100*time.Millisecond, 2)...),
+				repeat(10*time.Millisecond, 50)...),
+			expectedLimit: maxBandwidth,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := newBandwidthLimiter(maxBandwidth)
+			for _, latency := range tc.latencies {
+				l.observe(latency)
+			}
+			if l.limit() != tc.expectedLimit {
+				t.Fatalf("unexpected bandwidth %v, expected %v", l.limit(), tc.expectedLimit)
+			}
+		})
+	}
+}
+
+func TestBandwidthLimiterWait(t *testing.T) {
+	l := newBandwidthLimiter(10000)
+	ctx := context.Background()
+	start := time.Now()
+	// a full bucket of bytes can be fetched right away.
+	if err := l.wait(ctx, 10000); err != nil {
+		t.Fatalf("cannot wait for bandwidth: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("waited %v for a full bucket", elapsed)
+	}
+	// more bytes than the bucket holds are fetched once it's filled as many times.
+	if err := l.wait(ctx, 15000); err != nil {
+		t.Fatalf("cannot wait for bandwidth: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 1400*time.Millisecond {
+		t.Fatalf("waited %v for 1.5s of bandwidth", elapsed)
+	}
+}
+
+// blockingResolver is a Resolver whose Resolve calls block until `unblock` is closed.
+type blockingResolver struct {
+	fakeResolver
+	unblock  chan struct{}
+	mu       *sync.Mutex
+	inFlight *int
+	maxSeen  *int
+}
+
+func (r *blockingResolver) Resolve(context.Context) (bool, error) {
+	r.mu.Lock()
+	*r.inFlight++
+	if *r.inFlight > *r.maxSeen {
+		*r.maxSeen = *r.inFlight
+	}
+	r.mu.Unlock()
+	<-r.unblock
+	r.mu.Lock()
+	*r.inFlight--
+	r.mu.Unlock()
+	return false, nil
+}
+
+func TestBackgroundFetcherConcurrency(t *testing.T) {
+	const maxConcurrentFetches = 2
+	bf, err := NewBackgroundFetcher(WithFetchPeriod(0), WithEmitMetricPeriod(time.Second),
+		WithMaxQueueSize(10), WithMaxConcurrentFetches(maxConcurrentFetches))
+	if err != nil {
+		t.Fatalf("unable to construct background fetcher: %v", err)
+	}
+	var (
+		mu       sync.Mutex
+		inFlight int
+		maxSeen  int
+		unblock  = make(chan struct{})
+	)
+	for i := 0; i < 5; i++ {
+		bf.Add(&blockingResolver{unblock: unblock, mu: &mu, inFlight: &inFlight, maxSeen: &maxSeen})
+	}
+	go bf.Run(context.Background())
+	defer bf.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if inFlight != maxConcurrentFetches {
+		mu.Unlock()
+		t.Fatalf("unexpected number of concurrent fetches %d, expected %d", inFlight, maxConcurrentFetches)
+	}
+	mu.Unlock()
+
+	close(unblock)
+	deadline := time.Now().Add(time.Second)
+	for bf.workQueueSize() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if size := bf.workQueueSize(); size != 0 {
+		t.Fatalf("unexpected work queue size %d after all fetches completed", size)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if maxSeen > maxConcurrentFetches {
+		t.Fatalf("%d concurrent fetches exceeded the max of %d", maxSeen, maxConcurrentFetches)
+	}
+}
+
+func TestBackgroundFetcherTryAcquireFetch(t *testing.T) {
+	bf, err := NewBackgroundFetcher(WithMaxConcurrentFetches(1), WithMaxBandwidth(10000))
+	if err != nil {
+		t.Fatalf("unable to construct background fetcher: %v", err)
+	}
+	release, ok := bf.TryAcquireFetch(5000)
+	if !ok {
+		t.Fatalf("cannot acquire a fetch within the limits")
+	}
+	if _, ok := bf.TryAcquireFetch(1); ok {
+		t.Fatalf("acquired a fetch beyond the max number of concurrent fetches")
+	}
+	release()
+	if _, ok := bf.TryAcquireFetch(10000); ok {
+		t.Fatalf("acquired a fetch beyond the bandwidth")
+	}
+	// a refused fetch doesn't keep its slot.
+	release, ok = bf.TryAcquireFetch(1000)
+	if !ok {
+		t.Fatalf("cannot acquire a fetch within the limits")
+	}
+	release()
+}
@@ -0,0 +1,109 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package backgroundfetcher
+
+import (
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// recentReadPeriod is how long after an on-demand read a layer is favored by the background fetcher.
+const recentReadPeriod = 10 * time.Second
+
+// Image is the image a layer is background fetched for.
+type Image struct {
+	Digest digest.Digest
+	// MountedAt is the time the image was first mounted.
+	MountedAt time.Time
+	// Labels are the labels of the image. The weight of the image is the sum of the weights
+	// of its labels, where a label weight keyed by "key" matches any value of the label "key",
+	// and one keyed by "key=value" only matches that value.
+	Labels map[string]string
+}
+
+// weight returns the weight of image `img`.
+func (bf *BackgroundFetcher) weight(img Image) int {
+	var weight int
+	for key, w := range bf.labelWeights {
+		k, v, hasValue := strings.Cut(key, "=")
+		if value, ok := img.Labels[k]; ok && (!hasValue || value == v) {
+			weight += w
+		}
+	}
+	return weight
+}
+
+// lastReader is implemented by resolvers which know when their layer was last read on demand.
+type lastReader interface {
+	LastRead() time.Time
+}
+
+// entry is a resolver in the work queue of the background fetcher.
+type entry struct {
+	resolver Resolver
+	image    digest.Digest
+	// weight and mountedAt are those of the image with the highest priority among
+	// the images sharing the layer.
+	weight    int
+	mountedAt time.Time
+	// seq is the order in which the entry was added, to fetch from entries in FIFO order otherwise.
+	seq uint64
+	// fetching is whether a span is being fetched from the resolver.
+	fetching bool
+}
+
+// promote raises the priority of the entry to that of image `img` with weight `weight`, if higher.
+func (e *entry) promote(img Image, weight int) {
+	if weight > e.weight || (weight == e.weight && img.MountedAt.After(e.mountedAt)) {
+		e.image = img.Digest
+		e.weight = weight
+		e.mountedAt = img.MountedAt
+	}
+}
+
+// lastRead returns the time of the last on-demand read of the layer, or the zero time
+// if it's unknown or the layer was never read.
+func (e *entry) lastRead() time.Time {
+	if lr, ok := e.resolver.(lastReader); ok {
+		return lr.LastRead()
+	}
+	return time.Time{}
+}
+
+// before returns whether the entry should be fetched from before `other` at time `now`.
+// Entries are ordered by image weight, then by recent on-demand reads of their layer,
+// then by the time their image was mounted (newest first), and then in FIFO order.
+func (e *entry) before(other *entry, now time.Time) bool {
+	if e.weight != other.weight {
+		return e.weight > other.weight
+	}
+	read, otherRead := e.lastRead(), other.lastRead()
+	recent := now.Sub(read) < recentReadPeriod
+	otherRecent := now.Sub(otherRead) < recentReadPeriod
+	if recent != otherRecent {
+		return recent
+	}
+	if recent && !read.Equal(otherRead) {
+		return read.After(otherRead)
+	}
+	if !e.mountedAt.Equal(other.mountedAt) {
+		return e.mountedAt.After(other.mountedAt)
+	}
+	return e.seq < other.seq
+}
@@ -80,6 +80,11 @@ func NewSequentialResolver(layerDigest digest.Digest, spanManager *sm.SpanManage
 	}
 }
 
+// nextFetchSize returns the number of bytes the next call to Resolve fetches.
+func (lr *sequentialLayerResolver) nextFetchSize() int64 {
+	return int64(lr.UnfetchedSpanSize(lr.nextSpanFetchID))
+}
+
 func (lr *sequentialLayerResolver) Resolve(ctx context.Context) (bool, error) {
 	log.G(ctx).WithFields(logrus.Fields{
 		"layer":  lr.layerDigest,
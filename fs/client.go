@@ -18,32 +18,22 @@ package fs
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 
 	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/images"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"oras.land/oras-go/v2/content"
 )
 
 var (
 	ErrNoReferrers = errors.New("no existing referrers")
+	// ErrNoEmbeddedIndices is returned when an image index has no SOCI index of an image manifest.
+	ErrNoEmbeddedIndices = errors.New("no SOCI index embedded in the image index")
 )
 
-// Determines which index will be selected from a list of index descriptors
-type IndexSelectionPolicy func([]ocispec.Descriptor) (ocispec.Descriptor, error)
-
-func SelectFirstPolicy(descs []ocispec.Descriptor) (ocispec.Descriptor, error) {
-	return descs[0], nil
-}
-
-// Responsible for making Referrers API calls to remote registry to fetch list of referrers.
-type ReferrersClient interface {
-	/// Takes in an manifest descriptor and IndexSelectionPolicy and returns a single artifact descriptor.
-	/// Returns an error (ErrNoReferrers) if the manifest descriptor has no referrers.
-	SelectReferrer(context.Context, ocispec.Descriptor, IndexSelectionPolicy) (ocispec.Descriptor, error)
-}
-
 // Interface for oras-go's Repository.Referrers call, for mocking
 type ReferrersCaller interface {
 	Referrers(ctx context.Context, desc ocispec.Descriptor, artifactType string, fn func(referrers []ocispec.Descriptor) error) error
@@ -51,6 +41,7 @@ type ReferrersCaller interface {
 
 type Inner interface {
 	content.Storage
+	content.Resolver
 	ReferrersCaller
 }
 
@@ -64,17 +55,8 @@ func NewOCIArtifactClient(inner Inner) *OCIArtifactClient {
 	}
 }
 
-func (c *OCIArtifactClient) SelectReferrer(ctx context.Context, desc ocispec.Descriptor, fn IndexSelectionPolicy) (ocispec.Descriptor, error) {
-	descs, err := c.AllReferrers(ctx, desc)
-	if err != nil {
-		return ocispec.Descriptor{}, fmt.Errorf("unable to fetch referrers: %w", err)
-	}
-	if len(descs) == 0 {
-		return ocispec.Descriptor{}, ErrNoReferrers
-	}
-	return fn(descs)
-}
-
+// AllReferrers returns the SOCI indices of the image manifest `desc` listed by the Referrers API,
+// in the order the registry lists them.
 func (c *OCIArtifactClient) AllReferrers(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
 	descs := []ocispec.Descriptor{}
 	err := c.Referrers(ctx, desc, soci.SociIndexArtifactType, func(referrers []ocispec.Descriptor) error {
@@ -83,3 +65,29 @@ func (c *OCIArtifactClient) AllReferrers(ctx context.Context, desc ocispec.Descr
 	})
 	return descs, err
 }
+
+// AllEmbeddedIndices resolves `ref` and, if it's an image index converted by `soci convert`, returns all
+// the SOCI indices of the image manifest `desc` embedded in it. It returns ErrNoEmbeddedIndices if `ref`
+// isn't an image index or if the image index has no SOCI index of `desc`.
+func (c *OCIArtifactClient) AllEmbeddedIndices(ctx context.Context, ref string, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	root, err := c.Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve %s: %w", ref, err)
+	}
+	if !images.IsIndexType(root.MediaType) {
+		return nil, ErrNoEmbeddedIndices
+	}
+	b, err := content.FetchAll(ctx, c, root)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch image index %s: %w", root.Digest, err)
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, fmt.Errorf("unable to parse image index %s: %w", root.Digest, err)
+	}
+	descs := soci.EmbeddedSociIndices(index, desc.Digest)
+	if len(descs) == 0 {
+		return nil, ErrNoEmbeddedIndices
+	}
+	return descs, nil
+}
@@ -17,18 +17,25 @@
 package fs
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"io"
 	"testing"
 
+	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/google/go-cmp/cmp"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/errdef"
 )
 
 type fakeInner struct {
 	descs []ocispec.Descriptor
+	// root is the descriptor references resolve to, and blobs are the content fetched by digest.
+	root  ocispec.Descriptor
+	blobs map[digest.Digest][]byte
 }
 
 func newFakeInner(descs []ocispec.Descriptor) *fakeInner {
@@ -44,7 +51,17 @@ func (f *fakeInner) Exists(ctx context.Context, desc ocispec.Descriptor) (bool,
 }
 
 func (f *fakeInner) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
-	return nil, nil
+	if b, ok := f.blobs[desc.Digest]; ok {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	return nil, errdef.ErrNotFound
+}
+
+func (f *fakeInner) Resolve(ctx context.Context, reference string) (ocispec.Descriptor, error) {
+	if f.root.Digest == "" {
+		return ocispec.Descriptor{}, errdef.ErrNotFound
+	}
+	return f.root, nil
 }
 
 func (f *fakeInner) Push(ctx context.Context, expected ocispec.Descriptor, content io.Reader) error {
@@ -55,21 +72,17 @@ func (f *fakeInner) Referrers(ctx context.Context, desc ocispec.Descriptor, arti
 	return fn(f.descs)
 }
 
-func TestOCIArtifactClientSelectReferrer(t *testing.T) {
+func TestOCIArtifactClientAllReferrers(t *testing.T) {
 	testCases := []struct {
-		name            string
-		descs           []ocispec.Descriptor
-		expectedErr     error
-		expectedDesc    ocispec.Descriptor
-		selectionPolicy IndexSelectionPolicy
+		name  string
+		descs []ocispec.Descriptor
 	}{
 		{
-			name:        "empty referrers list returns ErrNoReferrers",
-			descs:       make([]ocispec.Descriptor, 0),
-			expectedErr: ErrNoReferrers,
+			name:  "empty referrers list",
+			descs: []ocispec.Descriptor{},
 		},
 		{
-			name: "SelectFirstPolicy returns the first descriptor",
+			name: "referrers in the order the registry lists them",
 			descs: []ocispec.Descriptor{
 				{
 					Digest: digest.FromBytes([]byte("foo")),
@@ -80,11 +93,6 @@ func TestOCIArtifactClientSelectReferrer(t *testing.T) {
 					Size:   4,
 				},
 			},
-			expectedDesc: ocispec.Descriptor{
-				Digest: digest.FromBytes([]byte("foo")),
-				Size:   3,
-			},
-			selectionPolicy: SelectFirstPolicy,
 		},
 	}
 
@@ -93,12 +101,79 @@ func TestOCIArtifactClientSelectReferrer(t *testing.T) {
 			inner := newFakeInner(tc.descs)
 			client := NewOCIArtifactClient(inner)
 
-			desc, err := client.SelectReferrer(context.Background(), ocispec.Descriptor{}, tc.selectionPolicy)
-			if err != nil && !errors.Is(err, tc.expectedErr) {
-				t.Fatalf("unexpected error getting descriptor: %v", err)
+			descs, err := client.AllReferrers(context.Background(), ocispec.Descriptor{})
+			if err != nil {
+				t.Fatalf("unexpected error getting referrers: %v", err)
 			}
 
-			if diff := cmp.Diff(desc, tc.expectedDesc); diff != "" {
+			if diff := cmp.Diff(descs, tc.descs); diff != "" {
+				t.Fatalf("unexpected referrers; diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestOCIArtifactClientAllEmbeddedIndices(t *testing.T) {
+	manifestDigest := digest.FromBytes([]byte("manifest"))
+	sociIndex := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: soci.SociIndexArtifactType,
+		Digest:       digest.FromBytes([]byte("soci index")),
+		Size:         10,
+		Annotations:  map[string]string{soci.IndexAnnotationImageManifestDigest: manifestDigest.String()},
+	}
+	otherSociIndex := sociIndex
+	otherSociIndex.Digest = digest.FromBytes([]byte("other soci index"))
+	otherSociIndex.Annotations = map[string]string{soci.IndexAnnotationImageManifestDigest: digest.FromBytes([]byte("other")).String()}
+	manifest := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      8,
+		Platform:  &ocispec.Platform{OS: "linux", Architecture: "amd64"},
+	}
+
+	testCases := []struct {
+		name          string
+		root          string
+		manifests     []ocispec.Descriptor
+		expectedErr   error
+		expectedDescs []ocispec.Descriptor
+	}{
+		{
+			name:          "SOCI index of the image manifest",
+			root:          ocispec.MediaTypeImageIndex,
+			manifests:     []ocispec.Descriptor{manifest, otherSociIndex, sociIndex},
+			expectedDescs: []ocispec.Descriptor{sociIndex},
+		},
+		{
+			name:        "no SOCI index of the image manifest",
+			root:        ocispec.MediaTypeImageIndex,
+			manifests:   []ocispec.Descriptor{manifest, otherSociIndex},
+			expectedErr: ErrNoEmbeddedIndices,
+		},
+		{
+			name:        "image manifest",
+			root:        ocispec.MediaTypeImageManifest,
+			expectedErr: ErrNoEmbeddedIndices,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := json.Marshal(ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: tc.manifests})
+			if err != nil {
+				t.Fatalf("cannot marshal image index: %v", err)
+			}
+			inner := newFakeInner(nil)
+			inner.root = ocispec.Descriptor{MediaType: tc.root, Digest: digest.FromBytes(b), Size: int64(len(b))}
+			inner.blobs = map[digest.Digest][]byte{inner.root.Digest: b}
+			client := NewOCIArtifactClient(inner)
+
+			descs, err := client.AllEmbeddedIndices(context.Background(), "example.com/image:latest", ocispec.Descriptor{Digest: manifestDigest})
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected error %v, got %v", tc.expectedErr, err)
+			}
+			if diff := cmp.Diff(descs, tc.expectedDescs); diff != "" {
 				t.Fatalf("unexpected descriptor; diff = %v", diff)
 			}
 		})
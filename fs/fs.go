@@ -44,10 +44,12 @@ package fs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	golog "log"
 	"net/http"
 	"os/exec"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
@@ -78,9 +80,8 @@ import (
 )
 
 var (
-	defaultIndexSelectionPolicy = SelectFirstPolicy
-	fusermountBin               = "fusermount"
-	preresolverQueueBufferSize  = 1024 // arbitrarily chosen buffer size
+	fusermountBin              = "fusermount"
+	preresolverQueueBufferSize = 1024 // arbitrarily chosen buffer size
 )
 
 // Preresolver will resolve a number of layers in parallel,
@@ -201,6 +202,9 @@ func NewFilesystem(ctx context.Context, root string, cfg config.FSConfig, opts .
 		bgSilencePeriod             = time.Duration(cfg.BackgroundFetchConfig.SilencePeriodMsec) * time.Millisecond
 		bgEmitMetricPeriod          = time.Duration(cfg.BackgroundFetchConfig.EmitMetricPeriodSec) * time.Second
 		bgMaxQueueSize              = cfg.BackgroundFetchConfig.MaxQueueSize
+		bgMaxBandwidth              = cfg.BackgroundFetchConfig.MaxBandwidthBytesPerSec
+		bgMaxConcurrentFetches      = cfg.BackgroundFetchConfig.MaxConcurrentFetches
+		accessTraceWindow           time.Duration
 	)
 
 	metadataStore := fsOpts.metadataStore
@@ -224,16 +228,21 @@ func NewFilesystem(ctx context.Context, root string, cfg config.FSConfig, opts .
 
 	if !cfg.BackgroundFetchConfig.Disable {
 		log.G(context.Background()).WithFields(logrus.Fields{
-			"fetchPeriod":      bgFetchPeriod,
-			"silencePeriod":    bgSilencePeriod,
-			"maxQueueSize":     bgMaxQueueSize,
-			"emitMetricPeriod": bgEmitMetricPeriod,
+			"fetchPeriod":          bgFetchPeriod,
+			"silencePeriod":        bgSilencePeriod,
+			"maxQueueSize":         bgMaxQueueSize,
+			"emitMetricPeriod":     bgEmitMetricPeriod,
+			"maxBandwidth":         bgMaxBandwidth,
+			"maxConcurrentFetches": bgMaxConcurrentFetches,
 		}).Info("constructing background fetcher")
 
 		bgFetcher, err = bf.NewBackgroundFetcher(bf.WithFetchPeriod(bgFetchPeriod),
 			bf.WithSilencePeriod(bgSilencePeriod),
 			bf.WithMaxQueueSize(bgMaxQueueSize),
-			bf.WithEmitMetricPeriod(bgEmitMetricPeriod))
+			bf.WithEmitMetricPeriod(bgEmitMetricPeriod),
+			bf.WithLabelWeights(cfg.BackgroundFetchConfig.LabelWeights),
+			bf.WithMaxBandwidth(bgMaxBandwidth),
+			bf.WithMaxConcurrentFetches(bgMaxConcurrentFetches))
 
 		if err != nil {
 			return nil, fmt.Errorf("cannot create background fetcher: %w", err)
@@ -243,6 +252,15 @@ func NewFilesystem(ctx context.Context, root string, cfg config.FSConfig, opts .
 		log.G(context.Background()).Info("background fetch is disabled")
 	}
 
+	indexSignaturePolicy, err := newIndexSignaturePolicy(cfg.IndexSignatureConfig)
+	if err != nil {
+		return nil, fmt.Errorf("cannot configure index signature verification: %w", err)
+	}
+	indexSelectionPolicy, err := NewIndexSelectionPolicy(cfg.IndexSelectionConfig)
+	if err != nil {
+		return nil, fmt.Errorf("cannot configure index selection: %w", err)
+	}
+
 	r, err := layer.NewResolver(root, cfg, fsOpts.resolveHandlers, metadataStore, store, fsOpts.overlayOpaqueType, bgFetcher)
 	if err != nil {
 		return nil, fmt.Errorf("failed to setup resolver: %w", err)
@@ -263,6 +281,10 @@ func NewFilesystem(ctx context.Context, root string, cfg config.FSConfig, opts .
 
 	go commonmetrics.ListenForFuseFailure(ctx)
 
+	if cfg.AccessTraceConfig.Enable {
+		accessTraceWindow = time.Duration(cfg.AccessTraceConfig.WindowSec) * time.Second
+	}
+
 	return &filesystem{
 		// it's generally considered bad practice to store a context in a struct,
 		// however `filesystem` has it's own lifecycle as well as a per-request lifecycle.
@@ -287,6 +309,10 @@ func NewFilesystem(ctx context.Context, root string, cfg config.FSConfig, opts .
 		mountTimeout:                mountTimeout,
 		fuseMetricsEmitWaitDuration: fuseMetricsEmitWaitDuration,
 		pr:                          pr,
+		indexSignaturePolicy:        indexSignaturePolicy,
+		indexSelectionPolicy:        indexSelectionPolicy,
+		accessTraceDir:              filepath.Join(root, "traces"),
+		accessTraceWindow:           accessTraceWindow,
 	}, nil
 }
 
@@ -294,13 +320,16 @@ type sociContext struct {
 	cachedErr            error
 	cachedErrMu          sync.RWMutex
 	bgFetchPauseOnce     sync.Once
+	bgFetchImageOnce     sync.Once
+	bgFetchImage         bf.Image
 	fetchOnce            sync.Once
 	sociIndex            *soci.Index
 	imageLayerToSociDesc map[string]ocispec.Descriptor
 	fuseOperationCounter *layer.FuseOperationCounter
+	accessTracer         *layer.AccessTracer
 }
 
-func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef, indexDigest, imageManifestDigest string, store store.Store, fuseOpEmitWaitDuration time.Duration, client *http.Client) error {
+func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef, indexDigest, imageManifestDigest string, store store.Store, fuseOpEmitWaitDuration time.Duration, client *http.Client, sigPolicy *indexSignaturePolicy, selectionPolicy IndexSelectionPolicy, accessTraceDir string, accessTraceWindow time.Duration) error {
 	var retErr error
 	c.fetchOnce.Do(func() {
 		defer func() {
@@ -324,30 +353,55 @@ func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef,
 		}
 
 		client := NewOCIArtifactClient(remoteStore)
-		indexDesc := ocispec.Descriptor{
-			Digest: digest.Digest(indexDigest),
-		}
+		candidates := []ocispec.Descriptor{{Digest: digest.Digest(indexDigest)}}
 
 		if indexDigest == "" {
-			log.G(ctx).Info("index digest not provided, making a Referrers API call to fetch list of indices")
 			imgDigest, err := digest.Parse(imageManifestDigest)
 			if err != nil {
 				retErr = fmt.Errorf("unable to parse image digest: %w", err)
+				return
 			}
 
-			desc, err := client.SelectReferrer(ctx, ocispec.Descriptor{Digest: imgDigest}, defaultIndexSelectionPolicy)
+			// images converted by `soci convert` list their SOCI indices in their image index.
+			log.G(ctx).Info("index digest not provided, looking for SOCI indices in the image index")
+			candidates, err = client.AllEmbeddedIndices(ctx, refspec.String(), ocispec.Descriptor{Digest: imgDigest})
 			if err != nil {
-				retErr = fmt.Errorf("cannot fetch list of referrers: %w", err)
+				if !errors.Is(err, ErrNoEmbeddedIndices) {
+					log.G(ctx).WithError(err).Warn("cannot look for SOCI indices in the image index")
+				}
+				log.G(ctx).Info("no SOCI index found in the image index, making a Referrers API call to fetch list of indices")
+				candidates, err = client.AllReferrers(ctx, ocispec.Descriptor{Digest: imgDigest})
+				if err != nil {
+					retErr = fmt.Errorf("cannot fetch list of referrers: unable to fetch referrers: %w", err)
+					return
+				}
+				if len(candidates) == 0 {
+					retErr = fmt.Errorf("cannot fetch list of referrers: %w", ErrNoReferrers)
+					return
+				}
+			}
+			if err := selectionPolicy(ctx, client, candidates); err != nil {
+				retErr = fmt.Errorf("cannot sort SOCI indices: %w", err)
 				return
 			}
-			indexDesc = desc
 		}
 
-		log.G(ctx).WithField("digest", indexDesc.Digest.String()).Infof("fetching SOCI artifacts using index descriptor")
-
-		index, err := FetchSociArtifacts(fsCtx, refspec, indexDesc, store, remoteStore)
-		if err != nil {
-			retErr = fmt.Errorf("error trying to fetch SOCI artifacts: %w", err)
+		// if the artifacts of a SOCI index cannot be fetched, those of the next one are.
+		var (
+			index *soci.Index
+			errs  []error
+		)
+		for _, indexDesc := range candidates {
+			log.G(ctx).WithField("digest", indexDesc.Digest.String()).Infof("fetching SOCI artifacts using index descriptor")
+			index, err = FetchSociArtifacts(fsCtx, refspec, indexDesc, store, remoteStore, sigPolicy.verifier(remoteStore))
+			if err == nil {
+				break
+			}
+			log.G(ctx).WithError(err).WithField("digest", indexDesc.Digest.String()).Warn("cannot fetch SOCI artifacts")
+			errs = append(errs, err)
+		}
+		if index == nil {
+			retErr = sigPolicy.apply(fmt.Errorf("error trying to fetch SOCI artifacts: %w", errors.Join(errs...)))
 			return
 		}
 		c.sociIndex = index
@@ -357,6 +411,12 @@ func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef,
 		// Metrics are emitted after a wait time of fuseOpEmitWaitDuration.
 		c.fuseOperationCounter = layer.NewFuseOperationCounter(digest.Digest(imageManifestDigest), fuseOpEmitWaitDuration)
 		go c.fuseOperationCounter.Run(fsCtx)
+
+		// Reads are only traced if access traces are enabled, i.e. they have a time window.
+		if accessTraceWindow > 0 {
+			c.accessTracer = layer.NewAccessTracer(digest.Digest(imageManifestDigest), accessTraceDir, accessTraceWindow)
+			go c.accessTracer.Run(fsCtx)
+		}
 	})
 	c.cachedErrMu.RLock()
 	retErr = c.cachedErr
@@ -364,6 +424,30 @@ func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef,
 	return retErr
 }
 
+// prefetchList returns the prefetch list of the ztoc `sociDesc`, or nil if it has none or it
+// cannot be parsed.
+func prefetchList(ctx context.Context, sociDesc ocispec.Descriptor) *soci.PrefetchList {
+	p, err := soci.ZtocPrefetchList(sociDesc)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("digest", sociDesc.Digest).Warn("cannot read prefetch list, layer won't be prefetched")
+		return nil
+	}
+	return p
+}
+
+// backgroundFetchImage returns the image the layers of the context are background fetched for,
+// i.e. the image as it was first mounted with labels `labels`.
+func (c *sociContext) backgroundFetchImage(imgDigest string, labels map[string]string) bf.Image {
+	c.bgFetchImageOnce.Do(func() {
+		c.bgFetchImage = bf.Image{
+			Digest:    digest.Digest(imgDigest),
+			MountedAt: time.Now(),
+			Labels:    labels,
+		}
+	})
+	return c.bgFetchImage
+}
+
 func (c *sociContext) populateImageLayerToSociMapping(sociIndex *soci.Index) {
 	c.imageLayerToSociDesc = make(map[string]ocispec.Descriptor, len(sociIndex.Blobs))
 	for _, desc := range sociIndex.Blobs {
@@ -391,6 +475,12 @@ type filesystem struct {
 	mountTimeout                time.Duration
 	fuseMetricsEmitWaitDuration time.Duration
 	pr                          *preresolver
+	indexSignaturePolicy        *indexSignaturePolicy
+	indexSelectionPolicy        IndexSelectionPolicy
+	accessTraceDir              string
+	// accessTraceWindow is the time after an image is mounted during which its reads are traced.
+	// Reads aren't traced if it's zero.
+	accessTraceWindow time.Duration
 }
 
 func (fs *filesystem) MountLocal(ctx context.Context, mountpoint string, labels map[string]string, mounts []mount.Mount) error {
@@ -451,7 +541,7 @@ func (fs *filesystem) getSociContext(ctx context.Context, imageRef, indexDigest,
 	if !ok {
 		return nil, fmt.Errorf("could not load index: fs soci context is invalid type for %s", indexDigest)
 	}
-	err := c.Init(fs.ctx, ctx, imageRef, indexDigest, imageManifestDigest, fs.contentStore, fs.fuseMetricsEmitWaitDuration, client)
+	err := c.Init(fs.ctx, ctx, imageRef, indexDigest, imageManifestDigest, fs.contentStore, fs.fuseMetricsEmitWaitDuration, client, fs.indexSignaturePolicy, fs.indexSelectionPolicy, fs.accessTraceDir, fs.accessTraceWindow)
 	return c, err
 }
 
@@ -484,6 +574,7 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	if err != nil {
 		return fmt.Errorf("unable to fetch SOCI artifacts: %w", err)
 	}
+	bgImage := c.backgroundFetchImage(imgDigest, labels)
 
 	// Resolve the target layer
 	var (
@@ -503,7 +594,8 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 				break
 			}
 
-			l, err := fs.resolver.Resolve(ctx, s.Hosts, s.Name, s.Target, sociDesc, c.fuseOperationCounter, fs.disableVerification)
+			prefetch := prefetchList(ctx, sociDesc)
+			l, err := fs.resolver.Resolve(ctx, s.Hosts, s.Name, s.Target, sociDesc, prefetch, c.fuseOperationCounter, bgImage, fs.disableVerification)
 			if err == nil {
 				resultChan <- l
 				return
@@ -526,7 +618,9 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 				return imgNameAndDigest
 			}
 
-			l, err := fs.resolver.Resolve(ctx, preResolve.Hosts, preResolve.Name, desc, sociDesc, c.fuseOperationCounter, fs.disableVerification)
+			// the prefetch list is resolved with the layer, so that it's prefetched when the layer is mounted.
+			prefetch := prefetchList(ctx, sociDesc)
+			l, err := fs.resolver.Resolve(ctx, preResolve.Hosts, preResolve.Name, desc, sociDesc, prefetch, c.fuseOperationCounter, bgImage, fs.disableVerification)
 			if err != nil {
 				log.G(ctx).WithError(err).Debug("failed to pre-resolve")
 				return imgNameAndDigest
@@ -566,7 +660,7 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	// Maybe we should reword the log here or remove it entirely,
 	// since the old Verify() function no longer serves any purpose.
 
-	node, err := l.RootNode(0)
+	node, err := l.RootNode(0, c.accessTracer)
 	if err != nil {
 		log.G(ctx).WithError(err).Warnf("Failed to get root node")
 		retErr = fmt.Errorf("failed to get root node: %w", err)
@@ -625,7 +719,26 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		}
 	})
 
-	return server.WaitMount()
+	if err := server.WaitMount(); err != nil {
+		return err
+	}
+
+	// Fetch the spans of the prefetch list of the layer before the container starts reading it.
+	fs.prefetch(ctx, l)
+	return nil
+}
+
+// prefetch fetches the spans of the prefetch list of `l`. The layer is read on demand
+// if they cannot be fetched within the mount timeout.
+func (fs *filesystem) prefetch(ctx context.Context, l layer.Layer) {
+	ctx, cancel := context.WithTimeout(ctx, fs.mountTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := l.Prefetch(ctx); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to prefetch layer")
+		return
+	}
+	log.G(ctx).WithField("duration", time.Since(start).String()).Debug("prefetched layer")
 }
 
 func (fs *filesystem) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
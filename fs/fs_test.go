@@ -78,12 +78,15 @@ type breakableLayer struct {
 	success bool
 }
 
-func (l *breakableLayer) Info() layer.Info                                    { return layer.Info{} }
-func (l *breakableLayer) RootNode(uint32) (fusefs.InodeEmbedder, error)       { return nil, nil }
+func (l *breakableLayer) Info() layer.Info { return layer.Info{} }
+func (l *breakableLayer) RootNode(uint32, *layer.AccessTracer) (fusefs.InodeEmbedder, error) {
+	return nil, nil
+}
 func (l *breakableLayer) Verify(tocDigest digest.Digest) error                { return nil }
 func (l *breakableLayer) SkipVerify()                                         {}
 func (l *breakableLayer) ReadAt([]byte, int64, ...remote.Option) (int, error) { return 0, nil }
 func (l *breakableLayer) BackgroundFetch() error                              { return fmt.Errorf("fail") }
+func (l *breakableLayer) Prefetch(context.Context) error                      { return nil }
 func (l *breakableLayer) Check() error {
 	if !l.success {
 		return fmt.Errorf("failed")
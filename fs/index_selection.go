@@ -0,0 +1,113 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+)
+
+// IndexSelectionPolicy chooses which SOCI index of an image is used, by sorting the candidate SOCI
+// indices of the image from the most to the least preferred. The artifacts of the candidates are
+// fetched in this order until those of one of them are fetched.
+// Candidates are descriptors returned by the Referrers API or embedded in an image index, so they have
+// the annotations of the SOCI indices.
+type IndexSelectionPolicy func(ctx context.Context, c *OCIArtifactClient, descs []ocispec.Descriptor) error
+
+// FirstIndexPolicy keeps the candidates in the order the registry lists them.
+func FirstIndexPolicy(ctx context.Context, c *OCIArtifactClient, descs []ocispec.Descriptor) error {
+	return nil
+}
+
+// NewestIndexPolicy prefers the most recently created SOCI indices, according to their creation
+// annotation. SOCI indices without a creation annotation are the least preferred.
+func NewestIndexPolicy(ctx context.Context, c *OCIArtifactClient, descs []ocispec.Descriptor) error {
+	created := make(map[string]time.Time, len(descs))
+	for _, desc := range descs {
+		// unparsable creation times are the zero time.
+		t, _ := time.Parse(time.RFC3339, desc.Annotations[ocispec.AnnotationCreated])
+		created[desc.Digest.String()] = t
+	}
+	sort.SliceStable(descs, func(i, j int) bool {
+		return created[descs[i].Digest.String()].After(created[descs[j].Digest.String()])
+	})
+	return nil
+}
+
+// BuildToolIndexPolicy returns a policy preferring SOCI indices created by the build tool `identifier`.
+func BuildToolIndexPolicy(identifier string) IndexSelectionPolicy {
+	return func(ctx context.Context, c *OCIArtifactClient, descs []ocispec.Descriptor) error {
+		sort.SliceStable(descs, func(i, j int) bool {
+			return descs[i].Annotations[soci.IndexAnnotationBuildToolIdentifier] == identifier &&
+				descs[j].Annotations[soci.IndexAnnotationBuildToolIdentifier] != identifier
+		})
+		return nil
+	}
+}
+
+// LayerCoverageIndexPolicy prefers the SOCI indices with ztocs for the most layers. Unlike the other
+// policies, it fetches the SOCI indices to count their ztocs. SOCI indices which cannot be fetched
+// are the least preferred.
+func LayerCoverageIndexPolicy(ctx context.Context, c *OCIArtifactClient, descs []ocispec.Descriptor) error {
+	coverage := make(map[string]int, len(descs))
+	for _, desc := range descs {
+		coverage[desc.Digest.String()] = -1
+		b, err := content.FetchAll(ctx, c, desc)
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("digest", desc.Digest).Warn("cannot fetch SOCI index to count its ztocs")
+			continue
+		}
+		var index soci.Index
+		if err := soci.UnmarshalIndex(b, &index); err != nil {
+			log.G(ctx).WithError(err).WithField("digest", desc.Digest).Warn("cannot parse SOCI index to count its ztocs")
+			continue
+		}
+		coverage[desc.Digest.String()] = len(index.Blobs)
+	}
+	sort.SliceStable(descs, func(i, j int) bool {
+		return coverage[descs[i].Digest.String()] > coverage[descs[j].Digest.String()]
+	})
+	return nil
+}
+
+// NewIndexSelectionPolicy returns the IndexSelectionPolicy configured by `cfg`.
+func NewIndexSelectionPolicy(cfg config.IndexSelectionConfig) (IndexSelectionPolicy, error) {
+	switch cfg.Policy {
+	case config.FirstIndexSelectionPolicy, "":
+		return FirstIndexPolicy, nil
+	case config.NewestIndexSelectionPolicy:
+		return NewestIndexPolicy, nil
+	case config.BuildToolIndexSelectionPolicy:
+		if cfg.BuildToolIdentifier == "" {
+			return nil, errors.New("index selection policy build_tool requires a build tool identifier")
+		}
+		return BuildToolIndexPolicy(cfg.BuildToolIdentifier), nil
+	case config.LayerCoverageIndexSelectionPolicy:
+		return LayerCoverageIndexPolicy, nil
+	default:
+		return nil, fmt.Errorf("unsupported index selection policy %q", cfg.Policy)
+	}
+}
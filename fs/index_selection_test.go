@@ -0,0 +1,143 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testIndexCandidate returns the descriptor of a SOCI index with `ztocs` ztocs and `annotations`,
+// and adds the SOCI index to `inner`. If `ztocs` is negative, the SOCI index isn't added.
+func testIndexCandidate(t *testing.T, inner *fakeInner, ztocs int, annotations map[string]string) ocispec.Descriptor {
+	var blobs []ocispec.Descriptor
+	for i := 0; i < ztocs; i++ {
+		blobs = append(blobs, ocispec.Descriptor{
+			MediaType: soci.SociLayerMediaType,
+			Digest:    digest.FromString(fmt.Sprintf("ztoc %d", i)),
+			Size:      10,
+		})
+	}
+	subject := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("manifest"), Size: 8}
+	b, err := soci.MarshalIndex(soci.NewIndex(blobs, &subject, annotations))
+	if err != nil {
+		t.Fatalf("cannot marshal index: %v", err)
+	}
+	desc := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: soci.SociIndexArtifactType,
+		Digest:       digest.FromBytes(b),
+		Size:         int64(len(b)),
+		Annotations:  annotations,
+	}
+	if ztocs >= 0 {
+		inner.blobs[desc.Digest] = b
+	}
+	return desc
+}
+
+func TestIndexSortPolicies(t *testing.T) {
+	inner := newFakeInner(nil)
+	inner.blobs = make(map[digest.Digest][]byte)
+	old := testIndexCandidate(t, inner, 3, map[string]string{
+		ocispec.AnnotationCreated:               "2023-01-01T00:00:00Z",
+		soci.IndexAnnotationBuildToolIdentifier: "AWS SOCI CLI v0.1",
+	})
+	newest := testIndexCandidate(t, inner, 1, map[string]string{
+		ocispec.AnnotationCreated:               "2024-01-01T00:00:00Z",
+		soci.IndexAnnotationBuildToolIdentifier: "other tool",
+	})
+	undated := testIndexCandidate(t, inner, 5, nil)
+	missing := testIndexCandidate(t, inner, -1, map[string]string{
+		ocispec.AnnotationCreated: "2023-06-01T00:00:00Z",
+	})
+	candidates := []ocispec.Descriptor{undated, missing, old, newest}
+
+	testCases := []struct {
+		name     string
+		cfg      config.IndexSelectionConfig
+		expected []ocispec.Descriptor
+	}{
+		{
+			name:     "first keeps the registry's order",
+			cfg:      config.IndexSelectionConfig{Policy: config.FirstIndexSelectionPolicy},
+			expected: []ocispec.Descriptor{undated, missing, old, newest},
+		},
+		{
+			name:     "newest prefers recently created indices",
+			cfg:      config.IndexSelectionConfig{Policy: config.NewestIndexSelectionPolicy},
+			expected: []ocispec.Descriptor{newest, missing, old, undated},
+		},
+		{
+			name:     "build tool prefers indices of the build tool",
+			cfg:      config.IndexSelectionConfig{Policy: config.BuildToolIndexSelectionPolicy, BuildToolIdentifier: "other tool"},
+			expected: []ocispec.Descriptor{newest, undated, missing, old},
+		},
+		{
+			name:     "layer coverage prefers indices with the most ztocs",
+			cfg:      config.IndexSelectionConfig{Policy: config.LayerCoverageIndexSelectionPolicy},
+			expected: []ocispec.Descriptor{undated, old, newest, missing},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := NewIndexSelectionPolicy(tc.cfg)
+			if err != nil {
+				t.Fatalf("cannot create policy: %v", err)
+			}
+			descs := append([]ocispec.Descriptor(nil), candidates...)
+			if err := policy(context.Background(), NewOCIArtifactClient(inner), descs); err != nil {
+				t.Fatalf("cannot sort candidates: %v", err)
+			}
+			if diff := cmp.Diff(tc.expected, descs); diff != "" {
+				t.Fatalf("unexpected order; diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestNewIndexSelectionPolicyErrors(t *testing.T) {
+	testCases := []struct {
+		name string
+		cfg  config.IndexSelectionConfig
+	}{
+		{
+			name: "build tool without identifier",
+			cfg:  config.IndexSelectionConfig{Policy: config.BuildToolIndexSelectionPolicy},
+		},
+		{
+			name: "unsupported policy",
+			cfg:  config.IndexSelectionConfig{Policy: "largest"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewIndexSelectionPolicy(tc.cfg); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
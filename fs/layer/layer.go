@@ -58,9 +58,11 @@ import (
 
 	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
 	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/awslabs/soci-snapshotter/util/lrucache"
 	"github.com/awslabs/soci-snapshotter/util/namedmutex"
 	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/containerd/log"
@@ -68,6 +70,7 @@ import (
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
 	"oras.land/oras-go/v2/content"
 )
 
@@ -76,6 +79,8 @@ const (
 	defaultMaxLRUCacheEntry   = 10
 	defaultMaxCacheFds        = 10
 	memoryCacheType           = "memory"
+	// prefetchConcurrency is the number of spans of a prefetch list fetched at the same time.
+	prefetchConcurrency = 4
 )
 
 // Layer represents a layer.
@@ -84,7 +89,8 @@ type Layer interface {
 	Info() Info
 
 	// RootNode returns the root node of this layer.
-	RootNode(baseInode uint32) (fusefs.InodeEmbedder, error)
+	// Reads of the files of the layer are recorded by `tracer` if it isn't nil.
+	RootNode(baseInode uint32, tracer *AccessTracer) (fusefs.InodeEmbedder, error)
 
 	// Check checks if the layer is still connectable.
 	Check() error
@@ -104,6 +110,10 @@ type Layer interface {
 	// ReadAt reads this layer.
 	ReadAt([]byte, int64, ...remote.Option) (int, error)
 
+	// Prefetch fetches the spans of the prefetch list of this layer, in the order of the list.
+	// Nop if the layer has no prefetch list or its spans were already fetched.
+	Prefetch(ctx context.Context) error
+
 	// Done releases the reference to this layer. The resources related to this layer will be
 	// discarded sooner or later. Queries after calling this function won't be serviced.
 	Done()
@@ -115,6 +125,8 @@ type Info struct {
 	Size        int64     // layer size in bytes
 	FetchedSize int64     // layer fetched size in bytes
 	ReadTime    time.Time // last time the layer was read
+	// ReadAhead are the statistics of the read-ahead of the files of the layer.
+	ReadAhead spanmanager.ReadAheadStats
 }
 
 // Resolver resolves the layer location and provieds the handler of that layer.
@@ -131,6 +143,8 @@ type Resolver struct {
 	artifactStore     content.Storage
 	overlayOpaqueType OverlayOpaqueType
 	bgFetcher         *backgroundfetcher.BackgroundFetcher
+	// readAheadSlots has an element for each span being fetched by read-ahead, in all layers.
+	readAheadSlots chan struct{}
 }
 
 // NewResolver returns a new layer resolver.
@@ -178,9 +192,34 @@ func NewResolver(root string, cfg config.FSConfig, resolveHandlers map[string]re
 		artifactStore:     artifactStore,
 		overlayOpaqueType: overlayOpaqueType,
 		bgFetcher:         bgFetcher,
+		readAheadSlots:    make(chan struct{}, cfg.ReadAheadConfig.MaxConcurrentFetches),
 	}, nil
 }
 
+// acquireReadAhead is the `spanmanager.ReadAheadLimiter` of all layers. A span of `size` bytes
+// is fetched ahead of its read if fewer than the max number of spans are fetched by read-ahead,
+// and the background fetcher, if any, can fetch it now.
+func (r *Resolver) acquireReadAhead(size compression.Offset) (func(), bool) {
+	select {
+	case r.readAheadSlots <- struct{}{}:
+	default:
+		return nil, false
+	}
+	releaseSlot := func() { <-r.readAheadSlots }
+	if r.bgFetcher == nil {
+		return releaseSlot, true
+	}
+	releaseFetch, ok := r.bgFetcher.TryAcquireFetch(int64(size))
+	if !ok {
+		releaseSlot()
+		return nil, false
+	}
+	return func() {
+		releaseFetch()
+		releaseSlot()
+	}, true
+}
+
 func newCache(root string, cacheType string, cfg config.FSConfig) (cache.BlobCache, error) {
 	if cacheType == memoryCacheType {
 		return cache.NewMemoryCache(), nil
@@ -230,7 +269,7 @@ func newCache(root string, cacheType string, cfg config.FSConfig) (cache.BlobCac
 }
 
 // Resolve resolves a layer based on the passed layer blob information.
-func (r *Resolver) Resolve(ctx context.Context, hosts []docker.RegistryHost, refspec reference.Spec, desc, sociDesc ocispec.Descriptor, opCounter *FuseOperationCounter, disableVerification bool, metadataOpts ...metadata.Option) (_ Layer, retErr error) {
+func (r *Resolver) Resolve(ctx context.Context, hosts []docker.RegistryHost, refspec reference.Spec, desc, sociDesc ocispec.Descriptor, prefetch *soci.PrefetchList, opCounter *FuseOperationCounter, bgImage backgroundfetcher.Image, disableVerification bool, metadataOpts ...metadata.Option) (_ Layer, retErr error) {
 	name := refspec.String() + "/" + desc.Digest.String()
 
 	// Wait if resolving this layer is already running. The result
@@ -247,6 +286,10 @@ func (r *Resolver) Resolve(ctx context.Context, hosts []docker.RegistryHost, ref
 	if ok {
 		if l := c.(*layer); l.Check() == nil {
 			log.G(ctx).Debugf("hit layer cache %q", name)
+			// the layer may be shared with an image with a higher background fetch priority.
+			if r.bgFetcher != nil && l.bgResolver != nil {
+				r.bgFetcher.Promote(l.bgResolver, bgImage)
+			}
 			return &layerRef{l, done}, nil
 		}
 		// Cached layer is invalid
@@ -310,6 +353,15 @@ func (r *Resolver) Resolve(ctx context.Context, hosts []docker.RegistryHost, ref
 	// continue with resolving the layer presuming we handle ZTOC
 	// ztoc will belong to a layer
 
+	// The spans of the prefetch list are resolved before the file metadata of the ztoc is dropped.
+	var prefetchSpans []compression.SpanID
+	if prefetch != nil {
+		prefetchSpans, err = prefetch.Spans(ztoc)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("cannot resolve the spans of the prefetch list, layer won't be prefetched")
+		}
+	}
+
 	// Get a reader for the layer files
 	// Each file's read operation is a prioritized task and all background tasks
 	// will be stopped during the execution so this can avoid being disturbed for
@@ -333,16 +385,27 @@ func (r *Resolver) Resolve(ctx context.Context, hosts []docker.RegistryHost, ref
 	spanManager := spanmanager.New(ztoc, sr, spanCache, r.config.BlobConfig.MaxSpanVerificationRetries, cache.Direct())
 	var bgLayerResolver backgroundfetcher.Resolver
 	if r.bgFetcher != nil {
+		// background fetches slow down while they delay the spans fetched on demand.
+		spanManager.SetOnDemandFetchObserver(r.bgFetcher.ObserveOnDemandFetch)
 		bgLayerResolver = backgroundfetcher.NewSequentialResolver(desc.Digest, spanManager)
-		r.bgFetcher.Add(bgLayerResolver)
+		r.bgFetcher.AddForImage(bgLayerResolver, bgImage)
+	}
+	var readerOpts []reader.Option
+	if r.config.FuseConfig.VerifyFileDigests {
+		readerOpts = append(readerOpts, reader.WithFileDigestVerification())
 	}
-	vr, err := reader.NewReader(meta, desc.Digest, spanManager, disableVerification)
+	if r.config.ReadAheadConfig.Enable {
+		// read-ahead is bounded across layers, and shares the limits of the background fetcher.
+		spanManager.SetReadAheadLimiter(r.acquireReadAhead)
+		readerOpts = append(readerOpts, reader.WithReadAhead(r.config.ReadAheadConfig.MaxSpans))
+	}
+	vr, err := reader.NewReader(meta, desc.Digest, spanManager, disableVerification, readerOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read layer: %w", err)
 	}
 
 	// Combine layer information together and cache it.
-	l := newLayer(r, desc, blobR, vr, bgLayerResolver, opCounter)
+	l := newLayer(r, desc, blobR, vr, bgLayerResolver, opCounter, spanManager, prefetchSpans)
 	r.layerCacheMu.Lock()
 	cachedL, done2, added := r.layerCache.Add(name, l)
 	r.layerCacheMu.Unlock()
@@ -404,6 +467,8 @@ func newLayer(
 	vr *reader.VerifiableReader,
 	bgResolver backgroundfetcher.Resolver,
 	opCounter *FuseOperationCounter,
+	spanManager *spanmanager.SpanManager,
+	prefetchSpans []compression.SpanID,
 ) *layer {
 	return &layer{
 		resolver:             resolver,
@@ -412,6 +477,8 @@ func newLayer(
 		verifiableReader:     vr,
 		bgResolver:           bgResolver,
 		fuseOperationCounter: opCounter,
+		spanManager:          spanManager,
+		prefetchSpans:        prefetchSpans,
 	}
 }
 
@@ -427,6 +494,9 @@ type layer struct {
 
 	fuseOperationCounter *FuseOperationCounter
 
+	spanManager   *spanmanager.SpanManager
+	prefetchSpans []compression.SpanID
+
 	closed   bool
 	closedMu sync.Mutex
 }
@@ -441,6 +511,7 @@ func (l *layer) Info() Info {
 		Size:        l.blob.Size(),
 		FetchedSize: l.blob.FetchedSize(),
 		ReadTime:    readTime,
+		ReadAhead:   l.spanManager.ReadAheadStats(),
 	}
 }
 
@@ -481,20 +552,41 @@ func (l *layerRef) Done() {
 	l.done()
 }
 
-func (l *layer) RootNode(baseInode uint32) (fusefs.InodeEmbedder, error) {
+func (l *layer) RootNode(baseInode uint32, tracer *AccessTracer) (fusefs.InodeEmbedder, error) {
 	if l.isClosed() {
 		return nil, fmt.Errorf("layer is already closed")
 	}
 	if l.r == nil {
 		return nil, fmt.Errorf("layer hasn't been verified yet")
 	}
-	return newNode(l.desc.Digest, l.r, l.blob, baseInode, l.resolver.overlayOpaqueType, l.resolver.config.LogFuseOperations, l.fuseOperationCounter)
+	return newNode(l.desc.Digest, l.r, l.blob, baseInode, l.resolver.overlayOpaqueType, l.resolver.config.LogFuseOperations, l.fuseOperationCounter, tracer, l.spanManager)
 }
 
 func (l *layer) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
 	return l.blob.ReadAt(p, offset, opts...)
 }
 
+func (l *layer) Prefetch(ctx context.Context) error {
+	if l.isClosed() {
+		return fmt.Errorf("layer is already closed")
+	}
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(prefetchConcurrency)
+	for _, id := range l.prefetchSpans {
+		id := id
+		eg.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := l.spanManager.FetchSingleSpan(id); err != nil {
+				return fmt.Errorf("cannot prefetch span %d: %w", id, err)
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
 func (l *layer) close() error {
 	l.closedMu.Lock()
 	defer l.closedMu.Unlock()
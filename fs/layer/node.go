@@ -56,7 +56,9 @@ import (
 	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
 	"github.com/awslabs/soci-snapshotter/fs/reader"
 	"github.com/awslabs/soci-snapshotter/fs/remote"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
 	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	"github.com/containerd/log"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -189,7 +191,8 @@ func (f *FuseOperationCounter) Run(ctx context.Context) {
 
 // logFSOperations may cause sensitive information to be emitted to logs
 // e.g. filenames and paths within an image
-func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseInode uint32, opaque OverlayOpaqueType, logFSOperations bool, opCounter *FuseOperationCounter) (fusefs.InodeEmbedder, error) {
+// tracer records the files and spans read if it isn't nil. spanManager is only used to map reads to spans.
+func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseInode uint32, opaque OverlayOpaqueType, logFSOperations bool, opCounter *FuseOperationCounter, tracer *AccessTracer, spanManager *spanmanager.SpanManager) (fusefs.InodeEmbedder, error) {
 	rootID := r.Metadata().RootID()
 	rootAttr, err := r.Metadata().GetAttr(rootID)
 	if err != nil {
@@ -207,6 +210,8 @@ func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseIno
 		opaqueXattrs:     opq,
 		logFSOperations:  logFSOperations,
 		operationCounter: opCounter,
+		tracer:           tracer,
+		spanManager:      spanManager,
 	}
 	ffs.s = ffs.newState(layerDgst, blob)
 	return &node{
@@ -226,6 +231,8 @@ type fs struct {
 	opaqueXattrs     []string
 	logFSOperations  bool
 	operationCounter *FuseOperationCounter
+	tracer           *AccessTracer
+	spanManager      *spanmanager.SpanManager
 }
 
 func (fs *fs) inodeOfState() uint64 {
@@ -250,6 +257,16 @@ func (fs *fs) logAndIncrementOpCounter(ctx context.Context, operationName string
 	}
 }
 
+// traceRead records a read of `n` bytes at `off` of file `f` in the access tracer.
+func (fs *fs) traceRead(f *file, off int64, n int) {
+	fs.tracer.RecordFile(fs.layerDigest, f.n.Path(nil))
+	if fs.spanManager == nil || f.fr == nil || n == 0 {
+		return
+	}
+	start := compression.Offset(off)
+	fs.tracer.RecordSpans(fs.layerDigest, fs.spanManager.SpanIDs(f.fr.GetUncompressedOffset(), f.fr.SparseMap(), start, start+compression.Offset(n)))
+}
+
 // reportFailure handles telemetry operations pertaining to FUSE failures
 // as well as writing an error to the state file.
 func (fs *fs) reportFailure(operationName string, stateError error) {
@@ -479,10 +496,17 @@ func (n *node) Open(ctx context.Context, flags uint32) (fh fusefs.FileHandle, fu
 		n.fs.reportFailure(fuseOpOpen, fmt.Errorf("%s: %v", fuseOpOpen, err))
 		return nil, 0, syscall.EIO
 	}
-	return &file{
+	f := &file{
 		n:  n,
 		ra: ra,
-	}, fuse.FOPEN_KEEP_CACHE, 0
+	}
+	if n.fs.tracer != nil {
+		// the spans of the reads are only traced if the location of the file is known.
+		if fr, err := n.fs.r.Metadata().OpenFile(n.id); err == nil {
+			f.fr = fr
+		}
+	}
+	return f, fuse.FOPEN_KEEP_CACHE, 0
 }
 
 var _ = (fusefs.NodeGetattrer)((*node)(nil))
@@ -567,6 +591,9 @@ func (n *node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
 type file struct {
 	n  *node
 	ra io.ReaderAt
+	// fr is the metadata of the file used to trace the spans read.
+	// It's only set if the access tracer is enabled.
+	fr metadata.File
 }
 
 var _ = (fusefs.FileReader)((*file)(nil))
@@ -581,6 +608,9 @@ func (f *file) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResul
 		f.n.fs.reportFailure(fuseOpFileRead, fmt.Errorf("%s: %v", fuseOpFileRead, err))
 		return nil, syscall.EIO
 	}
+	if f.n.fs.tracer != nil {
+		f.n.fs.traceRead(f, off, n)
+	}
 	return fuse.ReadResultData(dest[:n]), 0
 }
 
@@ -0,0 +1,218 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/log"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// AccessTraceVersion is the version of the format of `AccessTrace`.
+const AccessTraceVersion = "v1"
+
+// AccessTrace is the order in which the files and spans of the layers of an image were first read
+// after the image was mounted. It's persisted as JSON, so its format only changes with its version.
+type AccessTrace struct {
+	Version     string        `json:"version"`
+	ImageDigest digest.Digest `json:"imageDigest"`
+	// MountedAt is the time the image was mounted, from which reads are recorded.
+	MountedAt time.Time `json:"mountedAt"`
+	// WindowSeconds is the time after the image was mounted during which reads are recorded.
+	WindowSeconds int64 `json:"windowSeconds"`
+	// Files are the files read, in the order they were first read.
+	Files []FileAccess `json:"files"`
+	// Spans are the spans read, in the order they were first read.
+	Spans []SpanAccess `json:"spans"`
+}
+
+// FileAccess is the first read of a file of a layer.
+type FileAccess struct {
+	Layer digest.Digest `json:"layer"`
+	// Path is the path of the file in the layer.
+	Path string `json:"path"`
+	// ElapsedMs is the time between the mount and the read, in milliseconds.
+	ElapsedMs int64 `json:"elapsedMs"`
+}
+
+// SpanAccess is the first read of a span of a layer.
+type SpanAccess struct {
+	Layer  digest.Digest      `json:"layer"`
+	SpanID compression.SpanID `json:"spanID"`
+	// ElapsedMs is the time between the mount and the read, in milliseconds.
+	ElapsedMs int64 `json:"elapsedMs"`
+}
+
+type fileKey struct {
+	layer digest.Digest
+	path  string
+}
+
+type spanKey struct {
+	layer digest.Digest
+	id    compression.SpanID
+}
+
+// AccessTracer records the `AccessTrace` of an image, and persists it once the time window after
+// the image was mounted is over. The trace has the paths of the files read from the image, so it's
+// only recorded when enabled.
+type AccessTracer struct {
+	dir   string
+	mu    sync.Mutex
+	trace AccessTrace
+	files map[fileKey]struct{}
+	spans map[spanKey]struct{}
+	done  bool
+}
+
+// NewAccessTracer constructs an AccessTracer for an image with digest imgDigest, which records the
+// reads during `window` from now. The trace is persisted in `dir`.
+func NewAccessTracer(imgDigest digest.Digest, dir string, window time.Duration) *AccessTracer {
+	return &AccessTracer{
+		dir: dir,
+		trace: AccessTrace{
+			Version:       AccessTraceVersion,
+			ImageDigest:   imgDigest,
+			MountedAt:     time.Now(),
+			WindowSeconds: int64(window / time.Second),
+			Files:         []FileAccess{},
+			Spans:         []SpanAccess{},
+		},
+		files: make(map[fileKey]struct{}),
+		spans: make(map[spanKey]struct{}),
+	}
+}
+
+// elapsedMs returns the time since the image was mounted in milliseconds, and whether it's still
+// in the time window. It must be called with t.mu held.
+func (t *AccessTracer) elapsedMs() (int64, bool) {
+	elapsed := time.Since(t.trace.MountedAt)
+	return elapsed.Milliseconds(), !t.done && elapsed < time.Duration(t.trace.WindowSeconds)*time.Second
+}
+
+// RecordFile records a read of the file `path` of layer `layer`.
+// Noop if the file was already read or the time window is over.
+func (t *AccessTracer) RecordFile(layer digest.Digest, path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elapsed, ok := t.elapsedMs()
+	if !ok {
+		return
+	}
+	key := fileKey{layer, path}
+	if _, ok := t.files[key]; ok {
+		return
+	}
+	t.files[key] = struct{}{}
+	t.trace.Files = append(t.trace.Files, FileAccess{Layer: layer, Path: path, ElapsedMs: elapsed})
+}
+
+// RecordSpans records a read of the spans `ids` of layer `layer`.
+// Spans which were already read are skipped, and it's a noop if the time window is over.
+func (t *AccessTracer) RecordSpans(layer digest.Digest, ids []compression.SpanID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elapsed, ok := t.elapsedMs()
+	if !ok {
+		return
+	}
+	for _, id := range ids {
+		key := spanKey{layer, id}
+		if _, ok := t.spans[key]; ok {
+			continue
+		}
+		t.spans[key] = struct{}{}
+		t.trace.Spans = append(t.trace.Spans, SpanAccess{Layer: layer, SpanID: id, ElapsedMs: elapsed})
+	}
+}
+
+// Run waits for the time window to pass before persisting the trace. The trace is persisted
+// early if ctx is done. Should be started in different goroutine so that it doesn't block the
+// current goroutine.
+func (t *AccessTracer) Run(ctx context.Context) {
+	t.mu.Lock()
+	remaining := time.Until(t.trace.MountedAt.Add(time.Duration(t.trace.WindowSeconds) * time.Second))
+	t.mu.Unlock()
+	select {
+	case <-ctx.Done():
+	case <-time.After(remaining):
+	}
+	if err := t.persist(); err != nil {
+		log.G(ctx).WithError(err).Warnf("cannot persist access trace of image %s", t.trace.ImageDigest)
+		return
+	}
+	log.G(ctx).Infof("persisted access trace of image %s", t.trace.ImageDigest)
+}
+
+// persist stops recording and writes the trace to its file in t.dir.
+func (t *AccessTracer) persist() error {
+	t.mu.Lock()
+	t.done = true
+	b, err := json.MarshalIndent(t.trace, "", "  ")
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	path := AccessTracePath(t.dir, t.trace.ImageDigest)
+	// traces have paths within images, so they're only readable by the snapshotter's user.
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".trace-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// AccessTracePath returns the path of the file of the access trace of image `imgDigest` in `dir`.
+func AccessTracePath(dir string, imgDigest digest.Digest) string {
+	return filepath.Join(dir, imgDigest.Algorithm().String(), imgDigest.Encoded()+".json")
+}
+
+// ReadAccessTrace reads the access trace of image `imgDigest` from `dir`.
+func ReadAccessTrace(dir string, imgDigest digest.Digest) (*AccessTrace, error) {
+	b, err := os.ReadFile(AccessTracePath(dir, imgDigest))
+	if err != nil {
+		return nil, err
+	}
+	var trace AccessTrace
+	if err := json.Unmarshal(b, &trace); err != nil {
+		return nil, fmt.Errorf("cannot parse access trace of image %s: %w", imgDigest, err)
+	}
+	if trace.Version != AccessTraceVersion {
+		return nil, fmt.Errorf("unsupported access trace version %q", trace.Version)
+	}
+	return &trace, nil
+}
@@ -0,0 +1,136 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestAccessTracer(t *testing.T) {
+	var (
+		imgDigest = digest.FromString("image")
+		layer1    = digest.FromString("layer1")
+		layer2    = digest.FromString("layer2")
+	)
+	tests := []struct {
+		name          string
+		record        func(*AccessTracer)
+		expectedFiles []FileAccess
+		expectedSpans []SpanAccess
+	}{
+		{
+			name:          "nothing read",
+			record:        func(*AccessTracer) {},
+			expectedFiles: []FileAccess{},
+			expectedSpans: []SpanAccess{},
+		},
+		{
+			name: "first reads are recorded in order",
+			record: func(tracer *AccessTracer) {
+				tracer.RecordFile(layer1, "b")
+				tracer.RecordSpans(layer1, []compression.SpanID{2, 1})
+				tracer.RecordFile(layer1, "a")
+				tracer.RecordFile(layer1, "b")
+				tracer.RecordSpans(layer1, []compression.SpanID{1, 0})
+			},
+			expectedFiles: []FileAccess{{Layer: layer1, Path: "b"}, {Layer: layer1, Path: "a"}},
+			expectedSpans: []SpanAccess{{Layer: layer1, SpanID: 2}, {Layer: layer1, SpanID: 1}, {Layer: layer1, SpanID: 0}},
+		},
+		{
+			name: "reads of different layers are recorded separately",
+			record: func(tracer *AccessTracer) {
+				tracer.RecordFile(layer1, "a")
+				tracer.RecordFile(layer2, "a")
+				tracer.RecordSpans(layer2, []compression.SpanID{0})
+				tracer.RecordSpans(layer1, []compression.SpanID{0})
+			},
+			expectedFiles: []FileAccess{{Layer: layer1, Path: "a"}, {Layer: layer2, Path: "a"}},
+			expectedSpans: []SpanAccess{{Layer: layer2, SpanID: 0}, {Layer: layer1, SpanID: 0}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tracer := NewAccessTracer(imgDigest, dir, time.Hour)
+			tc.record(tracer)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			tracer.Run(ctx)
+			// reads after the trace is persisted aren't recorded.
+			tracer.RecordFile(layer1, "late")
+
+			trace, err := ReadAccessTrace(dir, imgDigest)
+			if err != nil {
+				t.Fatalf("cannot read access trace: %v", err)
+			}
+			if trace.ImageDigest != imgDigest || trace.WindowSeconds != 3600 {
+				t.Fatalf("unexpected access trace %+v", trace)
+			}
+			for i := range trace.Files {
+				trace.Files[i].ElapsedMs = 0
+			}
+			for i := range trace.Spans {
+				trace.Spans[i].ElapsedMs = 0
+			}
+			if !reflect.DeepEqual(trace.Files, tc.expectedFiles) {
+				t.Fatalf("unexpected files %v, expected %v", trace.Files, tc.expectedFiles)
+			}
+			if !reflect.DeepEqual(trace.Spans, tc.expectedSpans) {
+				t.Fatalf("unexpected spans %v, expected %v", trace.Spans, tc.expectedSpans)
+			}
+		})
+	}
+}
+
+func TestAccessTracerWindow(t *testing.T) {
+	dir := t.TempDir()
+	imgDigest := digest.FromString("image")
+	tracer := NewAccessTracer(imgDigest, dir, 0)
+	tracer.RecordFile(digest.FromString("layer"), "a")
+	tracer.Run(context.Background())
+
+	trace, err := ReadAccessTrace(dir, imgDigest)
+	if err != nil {
+		t.Fatalf("cannot read access trace: %v", err)
+	}
+	if len(trace.Files) != 0 {
+		t.Fatalf("reads after the time window were recorded: %v", trace.Files)
+	}
+}
+
+func TestReadAccessTraceVersion(t *testing.T) {
+	dir := t.TempDir()
+	imgDigest := digest.FromString("image")
+	tracer := NewAccessTracer(imgDigest, dir, 0)
+	tracer.trace.Version = "v0"
+	if err := tracer.persist(); err != nil {
+		t.Fatalf("cannot persist access trace: %v", err)
+	}
+	if _, err := ReadAccessTrace(dir, imgDigest); err == nil {
+		t.Fatalf("expected an error for an unsupported access trace version")
+	}
+	if _, err := ReadAccessTrace(dir, digest.FromString("other")); !os.IsNotExist(err) {
+		t.Fatalf("expected a not exist error for an image without access trace, got %v", err)
+	}
+}
@@ -65,4 +65,42 @@ var layerMetrics = []*metric{
 			}
 		},
 	},
+	{
+		name: "layer_read_ahead_spans",
+		help: "Total number of spans of the layer fetched by read-ahead",
+		unit: metrics.Total,
+		vt:   prometheus.CounterValue,
+		getValues: func(l layer.Layer) []value {
+			return []value{
+				{
+					v: float64(l.Info().ReadAhead.Spans),
+				},
+			}
+		},
+	},
+	{
+		name: "layer_read_ahead_hits",
+		help: "Total number of spans of the layer fetched by read-ahead which were read since",
+		unit: metrics.Total,
+		vt:   prometheus.CounterValue,
+		getValues: func(l layer.Layer) []value {
+			return []value{
+				{
+					v: float64(l.Info().ReadAhead.Hits),
+				},
+			}
+		},
+	},
+	{
+		name: "layer_read_ahead_waste",
+		help: "Number of spans of the layer fetched by read-ahead which weren't read since",
+		vt:   prometheus.GaugeValue,
+		getValues: func(l layer.Layer) []value {
+			return []value{
+				{
+					v: float64(l.Info().ReadAhead.Waste()),
+				},
+			}
+		},
+	},
 }
@@ -0,0 +1,148 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// ErrFileDigestMismatch is returned when the content of a file doesn't match
+// the digest recorded in the ztoc.
+var ErrFileDigestMismatch = errors.New("file content does not match digest")
+
+// byteRange is a half-open range [start, end) of a file.
+type byteRange struct {
+	start, end int64
+}
+
+// fileDigestVerifier keeps track of the bytes of a file that have been served
+// and verifies the file content against its expected digest once the whole file
+// has been served.
+//
+// Content that is served in order is hashed as it goes. If the file is read out
+// of order, the part that couldn't be hashed along the way is read again when
+// the last missing byte has been served.
+type fileDigestVerifier struct {
+	expected digest.Digest
+	size     int64
+
+	mu       sync.Mutex
+	digester digest.Digester
+	// hashed is the size of the prefix of the file written to the digester.
+	hashed int64
+	// served is the sorted list of disjoint ranges that have been served.
+	served   []byteRange
+	verified bool
+	err      error
+}
+
+func newFileDigestVerifier(expected digest.Digest, size int64) *fileDigestVerifier {
+	return &fileDigestVerifier{
+		expected: expected,
+		size:     size,
+		digester: expected.Algorithm().Digester(),
+	}
+}
+
+// failure returns the verification error if the file content
+// has been found not to match the expected digest.
+func (v *fileDigestVerifier) failure() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.err
+}
+
+// record registers that `p` was served at `offset`. Once all bytes of the file
+// have been served, the content is verified. `contents` is used to read the parts
+// of the file that were served out of order.
+func (v *fileDigestVerifier) record(p []byte, offset int64, contents func(start, end int64) (io.ReadCloser, error)) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.verified || v.err != nil {
+		return v.err
+	}
+
+	end := offset + int64(len(p))
+	if offset <= v.hashed && end > v.hashed {
+		v.digester.Hash().Write(p[v.hashed-offset:])
+		v.hashed = end
+	}
+	v.served = addByteRange(v.served, byteRange{offset, end})
+	if v.hashed < v.size && !v.allServed() {
+		return nil
+	}
+
+	if v.hashed < v.size {
+		r, err := contents(v.hashed, v.size)
+		if err != nil {
+			return fmt.Errorf("failed to read file content for digest verification: %w", err)
+		}
+		defer r.Close()
+		n, err := io.Copy(v.digester.Hash(), r)
+		v.hashed += n
+		if err != nil {
+			return fmt.Errorf("failed to read file content for digest verification: %w", err)
+		}
+	}
+
+	if actual := v.digester.Digest(); actual != v.expected {
+		v.err = fmt.Errorf("%w: expected %s, got %s", ErrFileDigestMismatch, v.expected, actual)
+		return v.err
+	}
+	v.verified = true
+	v.served = nil
+	return nil
+}
+
+func (v *fileDigestVerifier) allServed() bool {
+	return len(v.served) == 1 && v.served[0].start <= 0 && v.served[0].end >= v.size
+}
+
+// addByteRange adds `r` to the sorted list of disjoint ranges `ranges`,
+// merging it with the ranges it overlaps or touches.
+func addByteRange(ranges []byteRange, r byteRange) []byteRange {
+	if r.start >= r.end {
+		return ranges
+	}
+	// i is the first range that ends at or after the start of r
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i].end >= r.start })
+	// j is the first range that starts after the end of r
+	j := i
+	for j < len(ranges) && ranges[j].start <= r.end {
+		if ranges[j].start < r.start {
+			r.start = ranges[j].start
+		}
+		if ranges[j].end > r.end {
+			r.end = ranges[j].end
+		}
+		j++
+	}
+	if i == j {
+		ranges = append(ranges, byteRange{})
+		copy(ranges[i+1:], ranges[i:])
+		ranges[i] = r
+		return ranges
+	}
+	ranges[i] = r
+	return append(ranges[:i+1], ranges[j:]...)
+}
@@ -0,0 +1,223 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestAddByteRange(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name     string
+		ranges   []byteRange
+		r        byteRange
+		expected []byteRange
+	}{
+		{
+			name:     "add to empty list",
+			r:        byteRange{10, 20},
+			expected: []byteRange{{10, 20}},
+		},
+		{
+			name:     "empty range is ignored",
+			ranges:   []byteRange{{10, 20}},
+			r:        byteRange{30, 30},
+			expected: []byteRange{{10, 20}},
+		},
+		{
+			name:     "disjoint range is inserted in order",
+			ranges:   []byteRange{{0, 5}, {30, 40}},
+			r:        byteRange{10, 20},
+			expected: []byteRange{{0, 5}, {10, 20}, {30, 40}},
+		},
+		{
+			name:     "adjacent ranges are merged",
+			ranges:   []byteRange{{0, 10}, {20, 30}},
+			r:        byteRange{10, 20},
+			expected: []byteRange{{0, 30}},
+		},
+		{
+			name:     "overlapping ranges are merged",
+			ranges:   []byteRange{{0, 10}, {15, 20}, {25, 30}, {40, 50}},
+			r:        byteRange{5, 27},
+			expected: []byteRange{{0, 30}, {40, 50}},
+		},
+		{
+			name:     "contained range doesn't change the list",
+			ranges:   []byteRange{{0, 100}},
+			r:        byteRange{10, 20},
+			expected: []byteRange{{0, 100}},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actual := addByteRange(tc.ranges, tc.r)
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Fatalf("unexpected ranges; expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestFileDigestVerifier(t *testing.T) {
+	t.Parallel()
+	content := testutil.RandomByteData(100)
+	type read struct {
+		offset, size int64
+	}
+	testCases := []struct {
+		name        string
+		expected    digest.Digest
+		reads       []read
+		expectError bool
+	}{
+		{
+			name:     "sequential reads verify the digest",
+			expected: digest.FromBytes(content),
+			reads:    []read{{0, 40}, {40, 40}, {80, 20}},
+		},
+		{
+			name:     "out of order reads verify the digest",
+			expected: digest.FromBytes(content),
+			reads:    []read{{50, 50}, {0, 10}, {5, 30}, {35, 15}},
+		},
+		{
+			name:        "sequential reads of mismatching content fail",
+			expected:    digest.FromString("foo"),
+			reads:       []read{{0, 50}, {50, 50}},
+			expectError: true,
+		},
+		{
+			name:        "out of order reads of mismatching content fail",
+			expected:    digest.FromString("foo"),
+			reads:       []read{{50, 50}, {0, 50}},
+			expectError: true,
+		},
+	}
+
+	contents := func(start, end int64) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(content[start:end])), nil
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			v := newFileDigestVerifier(tc.expected, int64(len(content)))
+			var err error
+			for i, r := range tc.reads {
+				err = v.record(content[r.offset:r.offset+r.size], r.offset, contents)
+				if i < len(tc.reads)-1 && err != nil {
+					t.Fatalf("unexpected error before the whole file was served: %v", err)
+				}
+			}
+			if tc.expectError != errors.Is(err, ErrFileDigestMismatch) {
+				t.Fatalf("expect error: %t, actual error: %v", tc.expectError, err)
+			}
+			if tc.expectError != (v.failure() != nil) {
+				t.Fatalf("expect failure: %t, actual failure: %v", tc.expectError, v.failure())
+			}
+		})
+	}
+}
+
+func TestReaderFileDigestVerification(t *testing.T) {
+	const testFileName = "test"
+	content := testutil.RandomByteData(1000)
+	tarEntry := []testutil.TarEntry{
+		testutil.File(testFileName, string(content)),
+	}
+	testCases := []struct {
+		name        string
+		digest      digest.Digest
+		expectError bool
+	}{
+		{
+			name:   "matching digest",
+			digest: digest.FromBytes(content),
+		},
+		{
+			name:        "mismatching digest",
+			digest:      digest.FromString("foo"),
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			zt, sr, err := ztoc.BuildZtocReader(t, tarEntry, gzip.DefaultCompression, 64)
+			if err != nil {
+				t.Fatalf("failed to build sample ztoc: %v", err)
+			}
+			for i := range zt.FileMetadata {
+				if zt.FileMetadata[i].Name == testFileName {
+					zt.FileMetadata[i].Digest = tc.digest
+				}
+			}
+			mr, err := metadata.NewTempDbStore(sr, zt.TOC)
+			if err != nil {
+				t.Fatalf("failed to create metadata reader: %v", err)
+			}
+			spanManager := spanmanager.New(zt, sr, cache.NewMemoryCache(), 0)
+			vr, err := NewReader(mr, digest.FromString(""), spanManager, false, WithFileDigestVerification())
+			if err != nil {
+				mr.Close()
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer vr.Close()
+			r := vr.GetReader()
+			id, _, err := mr.GetChild(mr.RootID(), testFileName)
+			if err != nil {
+				t.Fatalf("failed to get %q: %v", testFileName, err)
+			}
+			f, err := r.OpenFile(id)
+			if err != nil {
+				t.Fatalf("failed to open file: %v", err)
+			}
+
+			// read the second half first so the first half completes the file
+			half := int64(len(content) / 2)
+			p := make([]byte, half)
+			if _, err := f.ReadAt(p, half); err != nil {
+				t.Fatalf("unexpected error reading the second half: %v", err)
+			}
+			_, err = f.ReadAt(p, 0)
+			if tc.expectError != errors.Is(err, ErrFileDigestMismatch) {
+				t.Fatalf("expect error: %t, actual error: %v", tc.expectError, err)
+			}
+			// once the content is known to be invalid, every read fails
+			_, err = f.ReadAt(p, half)
+			if tc.expectError != errors.Is(err, ErrFileDigestMismatch) {
+				t.Fatalf("expect error: %t, actual error on subsequent read: %v", tc.expectError, err)
+			}
+		})
+	}
+}
@@ -124,8 +124,28 @@ func (vr *VerifiableReader) isClosed() bool {
 	return closed
 }
 
+// Option configures a Reader created by NewReader.
+type Option func(*reader)
+
+// WithFileDigestVerification makes the Reader verify the content of a file against
+// the digest recorded in the ztoc once all bytes of the file have been served.
+// Files without a recorded digest (e.g. from ztoc version 0.9) are not verified.
+func WithFileDigestVerification() Option {
+	return func(gr *reader) {
+		gr.verifyFileDigests = true
+	}
+}
+
+// WithReadAhead makes the Reader fetch up to `maxSpans` spans ahead of the sequential reads
+// of every opened file. Sparse files aren't read ahead.
+func WithReadAhead(maxSpans int) Option {
+	return func(gr *reader) {
+		gr.readAheadSpans = maxSpans
+	}
+}
+
 // NewReader creates a Reader based on the given soci blob and Span Manager.
-func NewReader(r metadata.Reader, layerSha digest.Digest, spanManager *spanmanager.SpanManager, disableVerification bool) (*VerifiableReader, error) {
+func NewReader(r metadata.Reader, layerSha digest.Digest, spanManager *spanmanager.SpanManager, disableVerification bool, opts ...Option) (*VerifiableReader, error) {
 	vr := &reader{
 		spanManager:         spanManager,
 		r:                   r,
@@ -133,6 +153,9 @@ func NewReader(r metadata.Reader, layerSha digest.Digest, spanManager *spanmanag
 		verifier:            digestVerifier,
 		disableVerification: disableVerification,
 	}
+	for _, o := range opts {
+		o(vr)
+	}
 	return &VerifiableReader{r: vr, verifier: digestVerifier}, nil
 }
 
@@ -150,6 +173,9 @@ type reader struct {
 	verify              bool
 	verifier            func(uint32, string) (digest.Verifier, error)
 	disableVerification bool
+	verifyFileDigests   bool
+	// readAheadSpans is the max number of spans fetched ahead of the sequential reads of a file.
+	readAheadSpans int
 }
 
 func (gr *reader) Metadata() metadata.Reader {
@@ -178,11 +204,18 @@ func (gr *reader) OpenFile(id uint32) (io.ReaderAt, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file %d: %w", id, err)
 	}
-	return &file{
+	f := &file{
 		id: id,
 		fr: fr,
 		gr: gr,
-	}, nil
+	}
+	if gr.verifyFileDigests && fr.Digest() != "" {
+		f.digestVerifier = newFileDigestVerifier(fr.Digest(), int64(fr.GetUncompressedFileSize()))
+	}
+	if fr.SparseMap() == nil {
+		f.readAhead = gr.spanManager.NewReadAhead(fr.GetUncompressedOffset(), fr.GetUncompressedFileSize(), gr.readAheadSpans)
+	}
+	return f, nil
 }
 
 func (gr *reader) Close() (retErr error) {
@@ -211,6 +244,14 @@ type file struct {
 	gr       *reader
 	verified atomic.Bool
 	lock     sync.Mutex
+
+	// digestVerifier verifies the file content once all of it has been served.
+	// It is nil if file digest verification is disabled or the file has no digest.
+	digestVerifier *fileDigestVerifier
+
+	// readAhead fetches the spans following the sequential reads of the file.
+	// It is nil if read-ahead is disabled or the file is sparse.
+	readAhead *spanmanager.ReadAhead
 }
 
 // ReadAt reads the file when the file is requested by the container
@@ -220,6 +261,11 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 			return 0, err
 		}
 	}
+	if sf.digestVerifier != nil {
+		if err := sf.digestVerifier.failure(); err != nil {
+			return 0, err
+		}
+	}
 	if len(p) == 0 {
 		return 0, nil
 	}
@@ -231,9 +277,7 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 	if expectedSize > compression.Offset(len(p)) {
 		expectedSize = compression.Offset(len(p))
 	}
-	fileOffsetStart := sf.fr.GetUncompressedOffset() + compression.Offset(offset)
-	fileOffsetEnd := fileOffsetStart + expectedSize
-	r, err := sf.gr.spanManager.GetContents(fileOffsetStart, fileOffsetEnd)
+	r, err := sf.contents(offset, offset+int64(expectedSize))
 	if err != nil {
 		return 0, fmt.Errorf("failed to read the file: %w", err)
 	}
@@ -250,9 +294,25 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 
 	commonmetrics.AddBytesCount(commonmetrics.SynchronousBytesServed, sf.gr.layerSha, int64(n)) // measure the number of bytes served synchronously
 
+	if sf.readAhead != nil {
+		sf.readAhead.Observe(compression.Offset(offset), compression.Offset(offset)+compression.Offset(n))
+	}
+
+	if sf.digestVerifier != nil {
+		if err := sf.digestVerifier.record(p[:n], offset, sf.contents); err != nil {
+			return 0, err
+		}
+	}
+
 	return n, nil
 }
 
+// contents returns a reader of the file content in the range [start, end).
+// The holes of sparse files read as zeros.
+func (sf *file) contents(start, end int64) (io.ReadCloser, error) {
+	return sf.gr.spanManager.GetSparseContents(sf.fr.GetUncompressedOffset(), sf.fr.SparseMap(), compression.Offset(start), compression.Offset(end))
+}
+
 // Verify verifies that the file's attributes match the tar header in the image layer
 func (sf *file) Verify() (retErr error) {
 	if sf.verified.Load() {
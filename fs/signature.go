@@ -0,0 +1,127 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/snapshot"
+	"github.com/awslabs/soci-snapshotter/soci"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+)
+
+// ErrUnverifiedIndex is returned by FetchSociArtifacts when a SOCI index cannot be verified.
+var ErrUnverifiedIndex = errors.New("SOCI index cannot be verified")
+
+// IndexVerifier verifies that a SOCI index can be trusted before its ztocs are used to mount layers.
+type IndexVerifier interface {
+	VerifyIndex(ctx context.Context, indexDesc ocispec.Descriptor) error
+}
+
+// signatureVerifier verifies that a SOCI index has a signature by one of its keys,
+// attached to the SOCI index by `soci push --sign-key`.
+type signatureVerifier struct {
+	repo Inner
+	keys []crypto.PublicKey
+}
+
+// NewSignatureVerifier returns an IndexVerifier checking that SOCI indices in `repo`
+// are signed by one of `keys`.
+func NewSignatureVerifier(repo Inner, keys []crypto.PublicKey) IndexVerifier {
+	return &signatureVerifier{
+		repo: repo,
+		keys: keys,
+	}
+}
+
+func (v *signatureVerifier) VerifyIndex(ctx context.Context, indexDesc ocispec.Descriptor) error {
+	var sigs []ocispec.Descriptor
+	err := v.repo.Referrers(ctx, ocispec.Descriptor{Digest: indexDesc.Digest}, soci.SignatureArtifactType, func(referrers []ocispec.Descriptor) error {
+		sigs = append(sigs, referrers...)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to fetch signatures: %w", err)
+	}
+	if len(sigs) == 0 {
+		return soci.ErrNoIndexSignature
+	}
+	var errs []error
+	for _, desc := range sigs {
+		b, err := content.FetchAll(ctx, v.repo, desc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to fetch signature %s: %w", desc.Digest, err))
+			continue
+		}
+		err = soci.VerifyIndexSignature(b, indexDesc.Digest, v.keys)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// indexSignaturePolicy decides how SOCI indices are verified, and what happens to images
+// whose SOCI index cannot be verified.
+type indexSignaturePolicy struct {
+	policy config.IndexSignaturePolicy
+	keys   []crypto.PublicKey
+}
+
+func newIndexSignaturePolicy(cfg config.IndexSignatureConfig) (*indexSignaturePolicy, error) {
+	switch cfg.Policy {
+	case config.NoIndexSignaturePolicy, "":
+		return &indexSignaturePolicy{policy: config.NoIndexSignaturePolicy}, nil
+	case config.FallbackIndexSignaturePolicy, config.EnforceIndexSignaturePolicy:
+	default:
+		return nil, fmt.Errorf("unsupported index signature policy %q", cfg.Policy)
+	}
+	if len(cfg.PublicKeys) == 0 {
+		return nil, fmt.Errorf("index signature policy %q requires public keys", cfg.Policy)
+	}
+	keys, err := soci.LoadVerificationKeys(cfg.PublicKeys)
+	if err != nil {
+		return nil, err
+	}
+	return &indexSignaturePolicy{
+		policy: cfg.Policy,
+		keys:   keys,
+	}, nil
+}
+
+// verifier returns the IndexVerifier of SOCI indices in `repo`, or nil if SOCI indices aren't verified.
+func (p *indexSignaturePolicy) verifier(repo Inner) IndexVerifier {
+	if p.policy == config.NoIndexSignaturePolicy {
+		return nil
+	}
+	return NewSignatureVerifier(repo, p.keys)
+}
+
+// apply returns the error to mount a layer with after `err` fetching its SOCI artifacts. Layers
+// whose SOCI index cannot be verified aren't pulled locally instead with the enforce policy.
+func (p *indexSignaturePolicy) apply(err error) error {
+	if p.policy == config.EnforceIndexSignaturePolicy && errors.Is(err, ErrUnverifiedIndex) {
+		return fmt.Errorf("%w: %w", snapshot.ErrNoLocalFallback, err)
+	}
+	return err
+}
@@ -0,0 +1,208 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/snapshot"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestSignatureVerifier(t *testing.T) {
+	trustedPub, trustedKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, untrustedKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes([]byte("soci index")),
+		Size:      10,
+	}
+
+	testCases := []struct {
+		name        string
+		signers     []crypto.Signer
+		expectedErr error
+	}{
+		{
+			name:    "signed by trusted key",
+			signers: []crypto.Signer{trustedKey},
+		},
+		{
+			name:    "signed by trusted and untrusted keys",
+			signers: []crypto.Signer{untrustedKey, trustedKey},
+		},
+		{
+			name:        "no signature",
+			expectedErr: soci.ErrNoIndexSignature,
+		},
+		{
+			name:        "signed by untrusted key",
+			signers:     []crypto.Signer{untrustedKey},
+			expectedErr: soci.ErrInvalidIndexSignature,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			inner := newFakeInner(nil)
+			inner.blobs = make(map[digest.Digest][]byte)
+			for _, signer := range tc.signers {
+				b, err := soci.SignIndex(signer, indexDesc)
+				if err != nil {
+					t.Fatalf("cannot sign index: %v", err)
+				}
+				desc := ocispec.Descriptor{
+					MediaType:    ocispec.MediaTypeImageManifest,
+					ArtifactType: soci.SignatureArtifactType,
+					Digest:       digest.FromBytes(b),
+					Size:         int64(len(b)),
+				}
+				inner.descs = append(inner.descs, desc)
+				inner.blobs[desc.Digest] = b
+			}
+
+			verifier := NewSignatureVerifier(inner, []crypto.PublicKey{trustedPub})
+			err := verifier.VerifyIndex(context.Background(), indexDesc)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("unexpected verification error, expected %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestIndexSignaturePolicy(t *testing.T) {
+	unverified := fmt.Errorf("%w: %w", ErrUnverifiedIndex, soci.ErrNoIndexSignature)
+	other := errors.New("other")
+
+	testCases := []struct {
+		name               string
+		policy             config.IndexSignaturePolicy
+		err                error
+		expectVerifier     bool
+		expectNoFallback   bool
+		expectConfigErr    bool
+		withoutPublicKeys  bool
+		expectedWrappedErr error
+	}{
+		{
+			name:               "none doesn't verify",
+			policy:             config.NoIndexSignaturePolicy,
+			err:                unverified,
+			withoutPublicKeys:  true,
+			expectedWrappedErr: unverified,
+		},
+		{
+			name:               "fallback pulls unverified images locally",
+			policy:             config.FallbackIndexSignaturePolicy,
+			err:                unverified,
+			expectVerifier:     true,
+			expectedWrappedErr: unverified,
+		},
+		{
+			name:               "enforce doesn't pull unverified images locally",
+			policy:             config.EnforceIndexSignaturePolicy,
+			err:                unverified,
+			expectVerifier:     true,
+			expectNoFallback:   true,
+			expectedWrappedErr: unverified,
+		},
+		{
+			name:               "enforce pulls images locally on other errors",
+			policy:             config.EnforceIndexSignaturePolicy,
+			err:                other,
+			expectVerifier:     true,
+			expectedWrappedErr: other,
+		},
+		{
+			name:              "enforce requires public keys",
+			policy:            config.EnforceIndexSignaturePolicy,
+			withoutPublicKeys: true,
+			expectConfigErr:   true,
+		},
+		{
+			name:            "unsupported policy",
+			policy:          "strict",
+			expectConfigErr: true,
+		},
+	}
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPath := writePublicKey(t, pub)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.IndexSignatureConfig{Policy: tc.policy}
+			if !tc.withoutPublicKeys {
+				cfg.PublicKeys = []string{pubPath}
+			}
+			p, err := newIndexSignaturePolicy(cfg)
+			if tc.expectConfigErr {
+				if err == nil {
+					t.Fatalf("expected config error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected config error: %v", err)
+			}
+			if v := p.verifier(newFakeInner(nil)); (v != nil) != tc.expectVerifier {
+				t.Fatalf("unexpected verifier %v", v)
+			}
+			err = p.apply(tc.err)
+			if !errors.Is(err, tc.expectedWrappedErr) {
+				t.Fatalf("expected %v to wrap %v", err, tc.expectedWrappedErr)
+			}
+			if errors.Is(err, snapshot.ErrNoLocalFallback) != tc.expectNoFallback {
+				t.Fatalf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func writePublicKey(t *testing.T, key crypto.PublicKey) string {
+	b, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("cannot marshal public key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pub")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}), 0644); err != nil {
+		t.Fatalf("cannot write public key: %v", err)
+	}
+	return path
+}
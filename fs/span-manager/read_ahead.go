@@ -0,0 +1,181 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// ReadAheadLimiter limits the spans fetched by read-ahead. It returns whether a span of `size`
+// compressed bytes can be fetched now and, if so, a func to call once the span is fetched.
+type ReadAheadLimiter func(size compression.Offset) (release func(), ok bool)
+
+// ReadAhead detects the sequential reads of an open file, and fetches the spans following them
+// asynchronously before they are read. The window of spans fetched ahead of the reads starts at
+// one span, and doubles up to a max every time the sequential reads reach a new span.
+// A read which doesn't start where the previous one ended resets the window.
+// Spans are only fetched ahead while the limiter of the SpanManager allows it, see `SetReadAheadLimiter`;
+// the others are fetched by later reads.
+type ReadAhead struct {
+	m          *SpanManager
+	maxWindow  int
+	dataOffset compression.Offset
+	size       compression.Offset
+
+	mu sync.Mutex
+	// nextOffset is the offset in the file where the next sequential read starts.
+	nextOffset compression.Offset
+	// window is the number of spans fetched ahead of the reads, or 0 if reads aren't sequential.
+	window int
+	// readSpan is the span of the end of the last sequential read.
+	readSpan compression.SpanID
+	// aheadSpan is the last span fetched ahead of the reads, if window isn't 0.
+	aheadSpan compression.SpanID
+}
+
+// NewReadAhead returns a ReadAhead for a file whose `size` bytes of data are stored from
+// `dataOffset` in the uncompressed layer. At most `maxWindow` spans are fetched ahead of the reads.
+// Returns nil if `maxWindow` isn't positive or the file is empty.
+func (m *SpanManager) NewReadAhead(dataOffset, size compression.Offset, maxWindow int) *ReadAhead {
+	if maxWindow <= 0 || size <= 0 {
+		return nil
+	}
+	return &ReadAhead{
+		m:          m,
+		maxWindow:  maxWindow,
+		dataOffset: dataOffset,
+		size:       size,
+	}
+}
+
+// Observe records a read of the range [start, end) of the file,
+// and fetches the spans following it if the file is read sequentially.
+func (ra *ReadAhead) Observe(start, end compression.Offset) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	sequential := start == ra.nextOffset && end > start
+	ra.nextOffset = end
+	if !sequential {
+		ra.window = 0
+		return
+	}
+
+	readSpan := ra.m.zinfo.UncompressedOffsetToSpanID(ra.dataOffset + end - 1)
+	switch {
+	case ra.window == 0:
+		ra.window = 1
+		ra.aheadSpan = readSpan
+	case readSpan != ra.readSpan:
+		ra.window *= 2
+		if ra.window > ra.maxWindow {
+			ra.window = ra.maxWindow
+		}
+	}
+	ra.readSpan = readSpan
+
+	lastSpan := ra.m.zinfo.UncompressedOffsetToSpanID(ra.dataOffset + ra.size - 1)
+	to := readSpan + compression.SpanID(ra.window)
+	if to > lastSpan {
+		to = lastSpan
+	}
+	from := readSpan + 1
+	if ra.aheadSpan >= from {
+		from = ra.aheadSpan + 1
+	}
+	for id := from; id <= to; id++ {
+		if !ra.m.startReadAhead(id) {
+			// the spans left are fetched ahead of the next reads, or when they're read.
+			to = id - 1
+			break
+		}
+	}
+	if to > ra.aheadSpan {
+		ra.aheadSpan = to
+	}
+}
+
+// SetReadAheadLimiter sets the limiter of the spans fetched by read-ahead.
+// It must be called before the SpanManager is used.
+func (m *SpanManager) SetReadAheadLimiter(l ReadAheadLimiter) {
+	m.readAheadLimiter = l
+}
+
+// startReadAhead starts fetching the span `spanID` ahead of its read, and returns whether
+// it did, i.e. whether the limiter allowed it. Spans already requested aren't fetched again.
+func (m *SpanManager) startReadAhead(spanID compression.SpanID) bool {
+	size := m.UnfetchedSpanSize(spanID)
+	if size == 0 {
+		return true
+	}
+	release := func() {}
+	if m.readAheadLimiter != nil {
+		var ok bool
+		if release, ok = m.readAheadLimiter(size); !ok {
+			return false
+		}
+	}
+	go func() {
+		defer release()
+		m.readAheadSpan(spanID)
+	}()
+	return true
+}
+
+// readAheadSpan fetches the span `spanID` ahead of its read.
+// Errors are ignored, since the span is fetched again when it's read.
+func (m *SpanManager) readAheadSpan(spanID compression.SpanID) {
+	s := m.spans[spanID]
+	// the span is marked before it's fetched, so that a read waiting for the fetch is a hit.
+	// It's counted before it can be hit, so that hits never exceed spans.
+	m.readAheadSpans.Add(1)
+	s.readAhead.Store(true)
+	fetched, err := m.fetchSingleSpan(spanID)
+	if err == nil && fetched {
+		return
+	}
+	// the span wasn't fetched by read-ahead, so neither it nor its read are counted.
+	// Its hit is uncounted before the span, so that hits never exceed spans.
+	if !s.readAhead.CompareAndSwap(true, false) {
+		m.readAheadHits.Add(^uint64(0))
+	}
+	m.readAheadSpans.Add(^uint64(0))
+}
+
+// ReadAheadStats are the statistics of the read-ahead of the files of a layer.
+type ReadAheadStats struct {
+	// Spans is the number of spans fetched, or being fetched, by read-ahead.
+	Spans uint64
+	// Hits is the number of spans fetched by read-ahead which were read since.
+	Hits uint64
+}
+
+// Waste returns the number of spans fetched by read-ahead which weren't read since.
+func (s ReadAheadStats) Waste() uint64 {
+	return s.Spans - s.Hits
+}
+
+// ReadAheadStats returns the statistics of the read-ahead of the files of the layer.
+func (m *SpanManager) ReadAheadStats() ReadAheadStats {
+	hits := m.readAheadHits.Load()
+	return ReadAheadStats{
+		// hits are loaded first, so that they never exceed spans.
+		Spans: m.readAheadSpans.Load(),
+		Hits:  hits,
+	}
+}
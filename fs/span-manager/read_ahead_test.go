@@ -0,0 +1,305 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// newReadAheadTestSpanManager returns a SpanManager of a layer with a file of `numSpans` spans,
+// and the offset and size of the data of the file in the uncompressed layer.
+func newReadAheadTestSpanManager(t *testing.T, numSpans int) (*SpanManager, compression.Offset, compression.Offset) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	fileName := "read-ahead-test"
+	tarEntries := []testutil.TarEntry{
+		testutil.File(fileName, string(testutil.RandomByteData(int64(numSpans)*int64(spanSize)))),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	entry, err := toc.GetMetadataEntry(fileName)
+	if err != nil {
+		t.Fatalf("cannot get metadata of %s: %v", fileName, err)
+	}
+	cache := cache.NewMemoryCache()
+	t.Cleanup(func() { cache.Close() })
+	return New(toc, r, cache, 0), entry.UncompressedOffset, entry.UncompressedSize
+}
+
+func TestReadAhead(t *testing.T) {
+	type read struct {
+		start, end compression.Offset
+	}
+	// spanEnd returns the offset in the file of the end of its span `i`.
+	spanEnd := func(m *SpanManager, dataOffset compression.Offset, i compression.SpanID) compression.Offset {
+		first := m.zinfo.UncompressedOffsetToSpanID(dataOffset)
+		return m.spans[first+i].endUncompOffset - dataOffset
+	}
+	testCases := []struct {
+		name      string
+		maxWindow int
+		reads     func(end func(compression.SpanID) compression.Offset, size compression.Offset) []read
+		// expected are the spans of the file read ahead, from its first span.
+		expected func(lastSpan compression.SpanID) (from, to compression.SpanID)
+	}{
+		{
+			name:      "first read fetches the next span",
+			maxWindow: 8,
+			reads: func(end func(compression.SpanID) compression.Offset, size compression.Offset) []read {
+				return []read{{0, 10}}
+			},
+			expected: func(compression.SpanID) (compression.SpanID, compression.SpanID) { return 1, 1 },
+		},
+		{
+			name:      "reads within a span don't grow the window",
+			maxWindow: 8,
+			reads: func(end func(compression.SpanID) compression.Offset, size compression.Offset) []read {
+				return []read{{0, 10}, {10, 20}, {20, 30}}
+			},
+			expected: func(compression.SpanID) (compression.SpanID, compression.SpanID) { return 1, 1 },
+		},
+		{
+			name:      "window doubles as sequential reads reach new spans",
+			maxWindow: 8,
+			reads: func(end func(compression.SpanID) compression.Offset, size compression.Offset) []read {
+				return []read{{0, end(0)}, {end(0), end(1)}, {end(1), end(2)}}
+			},
+			expected: func(compression.SpanID) (compression.SpanID, compression.SpanID) { return 1, 6 },
+		},
+		{
+			name:      "window is capped",
+			maxWindow: 2,
+			reads: func(end func(compression.SpanID) compression.Offset, size compression.Offset) []read {
+				return []read{{0, end(0)}, {end(0), end(1)}, {end(1), end(2)}}
+			},
+			expected: func(compression.SpanID) (compression.SpanID, compression.SpanID) { return 1, 4 },
+		},
+		{
+			name:      "non sequential read resets the window",
+			maxWindow: 8,
+			reads: func(end func(compression.SpanID) compression.Offset, size compression.Offset) []read {
+				return []read{{0, end(0)}, {end(0), end(1)}, {end(5), end(6)}}
+			},
+			expected: func(compression.SpanID) (compression.SpanID, compression.SpanID) { return 1, 3 },
+		},
+		{
+			name:      "spans after the file aren't fetched",
+			maxWindow: 8,
+			reads: func(end func(compression.SpanID) compression.Offset, size compression.Offset) []read {
+				return []read{{0, end(0)}, {end(0), end(1)}, {end(1), end(2)}, {end(2), end(3)}}
+			},
+			expected: func(lastSpan compression.SpanID) (compression.SpanID, compression.SpanID) { return 1, lastSpan },
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, dataOffset, size := newReadAheadTestSpanManager(t, 10)
+			first := m.zinfo.UncompressedOffsetToSpanID(dataOffset)
+			lastSpan := m.zinfo.UncompressedOffsetToSpanID(dataOffset+size-1) - first
+			ra := m.NewReadAhead(dataOffset, size, tc.maxWindow)
+			end := func(i compression.SpanID) compression.Offset { return spanEnd(m, dataOffset, i) }
+			for _, rd := range tc.reads(end, size) {
+				ra.Observe(rd.start, rd.end)
+			}
+			var expected []compression.SpanID
+			from, to := tc.expected(lastSpan)
+			for i := from; i <= to; i++ {
+				expected = append(expected, first+i)
+			}
+
+			fetched := func() []compression.SpanID {
+				var ids []compression.SpanID
+				for _, s := range m.spans {
+					if s.readAhead.Load() {
+						ids = append(ids, s.id)
+					}
+				}
+				return ids
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for len(fetched()) < len(expected) && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			// give unexpected fetches time to complete.
+			time.Sleep(50 * time.Millisecond)
+			if fmt.Sprint(fetched()) != fmt.Sprint(expected) {
+				t.Fatalf("unexpected spans read ahead %v, expected %v", fetched(), expected)
+			}
+			if stats := m.ReadAheadStats(); stats.Spans != uint64(len(expected)) || stats.Hits != 0 {
+				t.Fatalf("unexpected read-ahead stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestReadAheadDisabled(t *testing.T) {
+	m, dataOffset, size := newReadAheadTestSpanManager(t, 1)
+	if ra := m.NewReadAhead(dataOffset, size, 0); ra != nil {
+		t.Fatalf("expected no read-ahead without a window")
+	}
+	if ra := m.NewReadAhead(dataOffset, 0, 8); ra != nil {
+		t.Fatalf("expected no read-ahead for an empty file")
+	}
+}
+
+func TestReadAheadStats(t *testing.T) {
+	m, dataOffset, size := newReadAheadTestSpanManager(t, 4)
+	ra := m.NewReadAhead(dataOffset, size, 8)
+
+	ra.Observe(0, 1)
+	next := m.zinfo.UncompressedOffsetToSpanID(dataOffset) + 1
+	deadline := time.Now().Add(5 * time.Second)
+	for m.ReadAheadStats().Spans == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := m.ReadAheadStats(); stats.Spans != 1 || stats.Waste() != 1 {
+		t.Fatalf("unexpected read-ahead stats %+v before the span is read", stats)
+	}
+
+	// reading the span read ahead is a hit, reading it again isn't.
+	for i := 0; i < 2; i++ {
+		rc, err := m.GetContents(m.spans[next].startUncompOffset, m.spans[next].endUncompOffset)
+		if err != nil {
+			t.Fatalf("cannot read span %d: %v", next, err)
+		}
+		rc.Close()
+	}
+	if stats := m.ReadAheadStats(); stats.Spans != 1 || stats.Hits != 1 || stats.Waste() != 0 {
+		t.Fatalf("unexpected read-ahead stats %+v after the span is read", stats)
+	}
+}
+
+func TestReadAheadLimiter(t *testing.T) {
+	m, dataOffset, size := newReadAheadTestSpanManager(t, 10)
+	var (
+		mu       sync.Mutex
+		allowed  = 2
+		released int
+	)
+	m.SetReadAheadLimiter(func(compression.Offset) (func(), bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if allowed == 0 {
+			return nil, false
+		}
+		allowed--
+		return func() {
+			mu.Lock()
+			defer mu.Unlock()
+			released++
+		}, true
+	})
+	first := m.zinfo.UncompressedOffsetToSpanID(dataOffset)
+	end := func(i compression.SpanID) compression.Offset { return m.spans[first+i].endUncompOffset - dataOffset }
+	waitStats := func(spans uint64) ReadAheadStats {
+		deadline := time.Now().Add(5 * time.Second)
+		for m.ReadAheadStats().Spans < spans && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		// give unexpected fetches time to complete.
+		time.Sleep(50 * time.Millisecond)
+		return m.ReadAheadStats()
+	}
+
+	// the window covers spans 1 to 6, but the limiter only allows 2 of them.
+	ra := m.NewReadAhead(dataOffset, size, 8)
+	ra.Observe(0, end(0))
+	ra.Observe(end(0), end(1))
+	ra.Observe(end(1), end(2))
+	if stats := waitStats(2); stats.Spans != 2 {
+		t.Fatalf("unexpected number of spans read ahead %d, expected 2", stats.Spans)
+	}
+	mu.Lock()
+	if released != 2 {
+		mu.Unlock()
+		t.Fatalf("unexpected number of released spans %d, expected 2", released)
+	}
+	// spans refused by the limiter are fetched ahead of the next reads, i.e. all the spans
+	// after span 3 once it's read.
+	allowed = 10
+	mu.Unlock()
+	ra.Observe(end(2), end(2)+1)
+	lastSpan := m.zinfo.UncompressedOffsetToSpanID(dataOffset+size-1) - first
+	expected := 2 + uint64(lastSpan-3)
+	if stats := waitStats(expected); stats.Spans != expected {
+		t.Fatalf("unexpected number of spans read ahead %d, expected %d", stats.Spans, expected)
+	}
+}
+
+// blockingReaderAt is a layer whose reads block until `unblock` is closed.
+// `started` is closed when the first read starts.
+type blockingReaderAt struct {
+	r       io.ReaderAt
+	once    sync.Once
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (r *blockingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.once.Do(func() { close(r.started) })
+	<-r.unblock
+	return r.r.ReadAt(p, off)
+}
+
+func TestReadAheadHitDuringFetch(t *testing.T) {
+	toc, sr, err := ztoc.BuildZtocReader(t, []testutil.TarEntry{
+		testutil.File("read-ahead-test", string(testutil.RandomByteData(4*65536))),
+	}, gzip.BestCompression, 65536)
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	r := &blockingReaderAt{r: sr, started: make(chan struct{}), unblock: make(chan struct{})}
+	cache := cache.NewMemoryCache()
+	defer cache.Close()
+	m := New(toc, io.NewSectionReader(r, 0, sr.Size()), cache, 0)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.readAheadSpan(1)
+	}()
+	<-r.started
+	// the span is read while it's being fetched by read-ahead.
+	read := make(chan error)
+	go func() {
+		rc, err := m.GetContents(m.spans[1].startUncompOffset, m.spans[1].endUncompOffset)
+		if err == nil {
+			rc.Close()
+		}
+		read <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(r.unblock)
+	if err := <-read; err != nil {
+		t.Fatalf("cannot read span 1: %v", err)
+	}
+	<-done
+	if stats := m.ReadAheadStats(); stats.Spans != 1 || stats.Hits != 1 {
+		t.Fatalf("unexpected read-ahead stats %+v", stats)
+	}
+}
@@ -75,6 +75,8 @@ type span struct {
 	endUncompOffset   compression.Offset
 	state             atomic.Value
 	mu                sync.Mutex
+	// readAhead is whether the span is being or was fetched by read-ahead, and wasn't read since.
+	readAhead atomic.Bool
 }
 
 func (s *span) checkState(expected spanState) bool {
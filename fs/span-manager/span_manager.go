@@ -23,6 +23,8 @@ import (
 	"fmt"
 	"io"
 	"runtime"
+	"sync/atomic"
+	"time"
 
 	"github.com/awslabs/soci-snapshotter/cache"
 	"github.com/awslabs/soci-snapshotter/ztoc"
@@ -71,8 +73,21 @@ type SpanManager struct {
 	spans                             []*span
 	ztoc                              *ztoc.Ztoc
 	maxSpanVerificationFailureRetries int
+	// lastRead is the time of the last on-demand read, in nanoseconds since the epoch.
+	lastRead atomic.Int64
+	// onDemandFetchObserver is notified of the latency of the spans fetched on demand, if set.
+	onDemandFetchObserver OnDemandFetchObserver
+	// readAheadLimiter limits the spans fetched by read-ahead, if set.
+	readAheadLimiter ReadAheadLimiter
+	// readAheadSpans and readAheadHits count the spans fetched by read-ahead,
+	// and those of them read since.
+	readAheadSpans atomic.Uint64
+	readAheadHits  atomic.Uint64
 }
 
+// OnDemandFetchObserver is called with the latency of every span fetched and uncompressed on demand.
+type OnDemandFetchObserver func(latency time.Duration)
+
 type spanInfo struct {
 	// starting span id of the requested contents
 	spanStart compression.SpanID
@@ -135,25 +150,53 @@ func (m *SpanManager) buildAllSpans() {
 // the span without uncompressing. It is invoked by the BackgroundFetcher.
 // span state change: unrequested -> requested -> fetched.
 func (m *SpanManager) FetchSingleSpan(spanID compression.SpanID) error {
+	_, err := m.fetchSingleSpan(spanID)
+	return err
+}
+
+// fetchSingleSpan fetches and caches the span without uncompressing it,
+// and returns whether the span was fetched, i.e. it wasn't requested before.
+func (m *SpanManager) fetchSingleSpan(spanID compression.SpanID) (bool, error) {
 	if spanID > m.ztoc.MaxSpanID {
-		return ErrExceedMaxSpan
+		return false, ErrExceedMaxSpan
 	}
 
 	// return directly if span is not in `unrequested`
 	s := m.spans[spanID]
 	if !s.checkState(unrequested) {
-		return nil
+		return false, nil
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	// check again after acquiring Lock
 	if !s.checkState(unrequested) {
-		return nil
+		return false, nil
 	}
 
-	_, err := m.fetchAndCacheSpan(spanID, false)
-	return err
+	if _, err := m.fetchAndCacheSpan(spanID, false); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// UnfetchedSpanSize returns the compressed size of span `spanID` if it wasn't requested yet,
+// i.e. the number of bytes `FetchSingleSpan` fetches for it, or 0 otherwise.
+func (m *SpanManager) UnfetchedSpanSize(spanID compression.SpanID) compression.Offset {
+	if spanID > m.ztoc.MaxSpanID {
+		return 0
+	}
+	s := m.spans[spanID]
+	if !s.checkState(unrequested) {
+		return 0
+	}
+	return s.endCompOffset - s.startCompOffset
+}
+
+// SetOnDemandFetchObserver sets the observer of the spans fetched on demand.
+// It must be called before the SpanManager is used.
+func (m *SpanManager) SetOnDemandFetchObserver(o OnDemandFetchObserver) {
+	m.onDemandFetchObserver = o
 }
 
 // resolveSpan ensures the span exists in cache and is uncompressed by calling
@@ -171,6 +214,7 @@ func (m *SpanManager) resolveSpan(spanID compression.SpanID) error {
 // GetContents returns a reader for the requested contents. The contents may be
 // across multiple spans.
 func (m *SpanManager) GetContents(startUncompOffset, endUncompOffset compression.Offset) (io.ReadCloser, error) {
+	m.lastRead.Store(time.Now().UnixNano())
 	si := m.getSpanInfo(startUncompOffset, endUncompOffset)
 	numSpans := si.spanEnd - si.spanStart + 1
 	spanReaders := make([]io.Reader, numSpans)
@@ -197,6 +241,75 @@ func (m *SpanManager) GetContents(startUncompOffset, endUncompOffset compression
 	return &MultiReaderCloser{spanClosers, io.MultiReader(spanReaders...)}, nil
 }
 
+// LastRead returns the time of the last on-demand read of the layer's contents, or the zero time
+// if it was never read. Spans fetched by `FetchSingleSpan` aren't on-demand reads.
+func (m *SpanManager) LastRead() time.Time {
+	nsec := m.lastRead.Load()
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
+// GetSparseContents returns a reader for the range [start, end) of the content of a file whose
+// data is stored from `dataOffset` in the uncompressed layer. The holes of a sparse file, which
+// aren't stored in the layer, are read as zeros. A nil `sparseMap` is the map of a regular file.
+func (m *SpanManager) GetSparseContents(dataOffset compression.Offset, sparseMap []ztoc.SparseEntry, start, end compression.Offset) (io.ReadCloser, error) {
+	segments := ztoc.SparseSegments(sparseMap, start, end-start)
+	if len(segments) == 1 && !segments[0].Hole {
+		dataStart := dataOffset + segments[0].DataOffset
+		return m.GetContents(dataStart, dataStart+segments[0].Length)
+	}
+	readers := make([]io.Reader, 0, len(segments))
+	closers := make([]io.Closer, 0, len(segments))
+	for _, s := range segments {
+		if s.Hole {
+			readers = append(readers, io.LimitReader(zeroReader{}, int64(s.Length)))
+			continue
+		}
+		dataStart := dataOffset + s.DataOffset
+		r, err := m.GetContents(dataStart, dataStart+s.Length)
+		if err != nil {
+			(&MultiReaderCloser{c: closers}).Close()
+			return nil, err
+		}
+		readers = append(readers, r)
+		closers = append(closers, r)
+	}
+	return &MultiReaderCloser{closers, io.MultiReader(readers...)}, nil
+}
+
+// SpanIDs returns the IDs of the spans holding the range [start, end) of the content of a file
+// whose data is stored from `dataOffset` in the uncompressed layer, in order. The holes of a sparse
+// file aren't stored in any span. A nil `sparseMap` is the map of a regular file.
+func (m *SpanManager) SpanIDs(dataOffset compression.Offset, sparseMap []ztoc.SparseEntry, start, end compression.Offset) []compression.SpanID {
+	var ids []compression.SpanID
+	for _, s := range ztoc.SparseSegments(sparseMap, start, end-start) {
+		if s.Hole || s.Length == 0 {
+			continue
+		}
+		dataStart := dataOffset + s.DataOffset
+		first := m.zinfo.UncompressedOffsetToSpanID(dataStart)
+		last := m.zinfo.UncompressedOffsetToSpanID(dataStart + s.Length - 1)
+		for id := first; id <= last; id++ {
+			if len(ids) == 0 || ids[len(ids)-1] < id {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// zeroReader reads an infinite stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
 // getSpanInfo returns spanInfo from the offsets of the requested file
 func (m *SpanManager) getSpanInfo(offsetStart, offsetEnd compression.Offset) *spanInfo {
 	spanStart := m.zinfo.UncompressedOffsetToSpanID(offsetStart)
@@ -246,6 +359,10 @@ func (m *SpanManager) getSpanContent(spanID compression.SpanID, offsetStart, off
 	s := m.spans[spanID]
 	size := offsetEnd - offsetStart
 
+	if s.readAhead.CompareAndSwap(true, false) {
+		m.readAheadHits.Add(1)
+	}
+
 	// return from cache directly if cached and uncompressed
 	if s.checkState(uncompressed) {
 		return m.getSpanFromCache(s.id, offsetStart, size)
@@ -292,10 +409,14 @@ func (m *SpanManager) getSpanContent(spanID compression.SpanID, offsetStart, off
 
 	// fetch-uncompress-cache span: span state can only be `unrequested` since
 	// no goroutine will release span state lock in `requested` state
+	start := time.Now()
 	uncompBuf, err := m.fetchAndCacheSpan(s.id, true)
 	if err != nil {
 		return nil, err
 	}
+	if m.onDemandFetchObserver != nil {
+		m.onDemandFetchObserver(time.Since(start))
+	}
 	buf := bytes.NewBuffer(uncompBuf[offsetStart : offsetStart+size])
 	return io.NopCloser(buf), nil
 }
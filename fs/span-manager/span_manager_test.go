@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"io"
 	"testing"
+	"time"
 
 	"github.com/awslabs/soci-snapshotter/cache"
 	"github.com/awslabs/soci-snapshotter/util/testutil"
@@ -395,6 +396,115 @@ func (r *retryableReaderAt) ReadAt(buf []byte, off int64) (int, error) {
 	return n, err
 }
 
+func TestSpanIDs(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	fileName := "span-ids-test"
+	tarEntries := []testutil.TarEntry{
+		testutil.File(fileName, string(testutil.RandomByteData(int64(3*spanSize)))),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	entry, err := toc.GetMetadataEntry(fileName)
+	if err != nil {
+		t.Fatalf("cannot get metadata of %s: %v", fileName, err)
+	}
+	cache := cache.NewMemoryCache()
+	defer cache.Close()
+	m := New(toc, r, cache, 0)
+
+	// spansOf returns the spans overlapping [start, end) of the uncompressed layer.
+	spansOf := func(start, end compression.Offset) []compression.SpanID {
+		var ids []compression.SpanID
+		for _, s := range m.spans {
+			if s.startUncompOffset < end && s.endUncompOffset > start {
+				ids = append(ids, s.id)
+			}
+		}
+		return ids
+	}
+	dataOffset := entry.UncompressedOffset
+
+	testCases := []struct {
+		name       string
+		sparseMap  []ztoc.SparseEntry
+		start, end compression.Offset
+		expected   []compression.SpanID
+	}{
+		{
+			name:     "whole file",
+			start:    0,
+			end:      entry.UncompressedSize,
+			expected: spansOf(dataOffset, dataOffset+entry.UncompressedSize),
+		},
+		{
+			name:     "first byte",
+			start:    0,
+			end:      1,
+			expected: spansOf(dataOffset, dataOffset+1),
+		},
+		{
+			name:     "range across spans",
+			start:    spanSize - 1,
+			end:      spanSize + 1,
+			expected: spansOf(dataOffset+spanSize-1, dataOffset+spanSize+1),
+		},
+		{
+			name:  "empty range",
+			start: 10,
+			end:   10,
+		},
+		{
+			name:      "hole of a sparse file",
+			sparseMap: []ztoc.SparseEntry{{Offset: 0, Length: 1}, {Offset: 2 * spanSize, Length: 1}},
+			start:     1,
+			end:       2 * spanSize,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ids := m.SpanIDs(dataOffset, tc.sparseMap, tc.start, tc.end)
+			if fmt.Sprint(ids) != fmt.Sprint(tc.expected) {
+				t.Fatalf("unexpected spans %v, expected %v", ids, tc.expected)
+			}
+		})
+	}
+}
+
+func TestLastRead(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	tarEntries := []testutil.TarEntry{
+		testutil.File("last-read-test", string(testutil.RandomByteData(int64(2*spanSize)))),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	cache := cache.NewMemoryCache()
+	defer cache.Close()
+	m := New(toc, r, cache, 0)
+
+	if !m.LastRead().IsZero() {
+		t.Fatalf("unexpected last read %v before any read", m.LastRead())
+	}
+	if err := m.FetchSingleSpan(0); err != nil {
+		t.Fatalf("cannot fetch span: %v", err)
+	}
+	if !m.LastRead().IsZero() {
+		t.Fatalf("background fetch was recorded as an on-demand read")
+	}
+	before := time.Now()
+	rc, err := m.GetContents(0, spanSize+1)
+	if err != nil {
+		t.Fatalf("cannot get contents: %v", err)
+	}
+	rc.Close()
+	if m.LastRead().Before(before) {
+		t.Fatalf("last read %v is before the read at %v", m.LastRead(), before)
+	}
+}
+
 func getFileContentFromSpans(m *SpanManager, toc *ztoc.Ztoc, fileName string) ([]byte, error) {
 	metadata, err := toc.GetMetadataEntry(fileName)
 	if err != nil {
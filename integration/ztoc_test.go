@@ -379,11 +379,8 @@ func TestSociZtocGetFile(t *testing.T) {
 								break
 							}
 						}
-						if tt.toStdout {
-							output = output[:len(output)-1]
-						} else {
+						if !tt.toStdout {
 							output = sh.O("cat", tempOutputStream)
-
 						}
 						err = verifyOutputStream(contents, output)
 						if err != nil {
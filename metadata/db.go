@@ -40,7 +40,9 @@ import (
 	"sort"
 
 	"github.com/awslabs/soci-snapshotter/util/dbutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
 	bolt "go.etcd.io/bbolt"
 )
 
@@ -73,6 +75,8 @@ import (
 //         - uncompressedOffset : <varint>  : the offset in the uncompressed data, where the node is stored.
 //         - tarHeaderOffset : <varint>     : the offset of the tar header
 //         - tarHeaderSize : <varint>       : the size of the tar header
+//         - digest : <string>              : the digest of the file content (only if recorded in the ztoc)
+//         - sparseMap : <varint>...        : offset and length of the data fragments (only for sparse files)
 
 var (
 	bucketKeyFilesystems = []byte("filesystems")
@@ -100,6 +104,8 @@ var (
 	bucketKeyUncompressedOffset = []byte("uncompressedOffset")
 	bucketKeyTarHeaderOffset    = []byte("tarHeaderOffset")
 	bucketKeyTarHeaderSize      = []byte("tarHeaderSize")
+	bucketKeyDigest             = []byte("digest")
+	bucketKeySparseMap          = []byte("sparseMap")
 )
 
 type childEntry struct {
@@ -114,6 +120,8 @@ type metadataEntry struct {
 	TarName            string
 	TarHeaderOffset    compression.Offset
 	TarHeaderSize      compression.Offset
+	Digest             digest.Digest
+	SparseMap          []ztoc.SparseEntry
 }
 
 // getNodesBucket returns the top-level nodes bucket that contains each node
@@ -384,6 +392,16 @@ func writeMetadataEntry(md *bolt.Bucket, m *metadataEntry) error {
 	if err := putInt(md, bucketKeyUncompressedOffset, int64(m.UncompressedOffset)); err != nil {
 		return fmt.Errorf("failed to set UncompressedOffset value %d: %w", m.UncompressedOffset, err)
 	}
+	if m.Digest != "" {
+		if err := md.Put(bucketKeyDigest, []byte(m.Digest)); err != nil {
+			return fmt.Errorf("failed to set Digest value %s: %w", m.Digest, err)
+		}
+	}
+	if m.SparseMap != nil {
+		if err := md.Put(bucketKeySparseMap, encodeSparseMap(m.SparseMap)); err != nil {
+			return fmt.Errorf("failed to set SparseMap value: %w", err)
+		}
+	}
 	return nil
 }
 
@@ -392,12 +410,45 @@ func getMetadataEntry(md *bolt.Bucket) metadataEntry {
 	tarHeaderOffset, _ := binary.Varint(md.Get(bucketKeyTarHeaderOffset))
 	tarHeaderSize, _ := binary.Varint(md.Get(bucketKeyTarHeaderSize))
 	tarName := md.Get(bucketKeyName)
+	dgst := md.Get(bucketKeyDigest)
 	return metadataEntry{nil,
 		compression.Offset(ucompOffset),
 		0,
 		string(tarName),
 		compression.Offset(tarHeaderOffset),
-		compression.Offset(tarHeaderSize)}
+		compression.Offset(tarHeaderSize),
+		digest.Digest(dgst),
+		decodeSparseMap(md.Get(bucketKeySparseMap))}
+}
+
+// encodeSparseMap encodes a sparse map as the varints of the offset and length of every entry.
+func encodeSparseMap(sparseMap []ztoc.SparseEntry) []byte {
+	b := make([]byte, 0, 2*len(sparseMap)*binary.MaxVarintLen64)
+	for _, e := range sparseMap {
+		b = binary.AppendVarint(b, int64(e.Offset))
+		b = binary.AppendVarint(b, int64(e.Length))
+	}
+	return b
+}
+
+func decodeSparseMap(b []byte) []ztoc.SparseEntry {
+	if b == nil {
+		return nil
+	}
+	var sparseMap []ztoc.SparseEntry
+	for len(b) > 0 {
+		offset, n := binary.Varint(b)
+		if n <= 0 {
+			break
+		}
+		length, m := binary.Varint(b[n:])
+		if m <= 0 {
+			break
+		}
+		sparseMap = append(sparseMap, ztoc.SparseEntry{Offset: compression.Offset(offset), Length: compression.Offset(length)})
+		b = b[n+m:]
+	}
+	return sparseMap
 }
 
 func encodeID(id uint32) []byte {
@@ -39,6 +39,7 @@ import (
 
 	"github.com/awslabs/soci-snapshotter/ztoc"
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
 )
 
 // Attr reprensents the attributes of a node.
@@ -96,6 +97,12 @@ type File interface {
 	TarName() string
 	TarHeaderOffset() compression.Offset
 	TarHeaderSize() compression.Offset
+	// Digest returns the digest of the file content or an empty digest
+	// if the ztoc doesn't record one.
+	Digest() digest.Digest
+	// SparseMap returns the map of the data fragments of a sparse file,
+	// or nil if the file isn't sparse.
+	SparseMap() []ztoc.SparseEntry
 }
 
 type Options struct {
@@ -42,12 +42,12 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/awslabs/soci-snapshotter/ztoc"
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
 	"github.com/rs/xid"
 	bolt "go.etcd.io/bbolt"
 	"golang.org/x/sync/errgroup"
@@ -182,8 +182,8 @@ func (r *reader) initNodes(toc ztoc.TOC) error {
 				// TAR stores trailing path separator for directory entries. We clean
 				// the path to remove the trailing separator, so that we can recurse
 				// parent paths using `filepath.Split`.
-				cleanName := cleanEntryPath(ent.Name)
-				cleanLinkName := cleanEntryPath(ent.Linkname)
+				cleanName := ztoc.CleanEntryName(ent.Name)
+				cleanLinkName := ztoc.CleanEntryName(ent.Linkname)
 
 				isLink := ent.Type == "hardlink"
 				isDir := ent.Type == "dir"
@@ -255,6 +255,8 @@ func (r *reader) initNodes(toc ztoc.TOC) error {
 					md[id].UncompressedOffset = ent.UncompressedOffset
 					md[id].TarHeaderOffset = ent.TarHeaderOffset
 					md[id].TarHeaderSize = ent.UncompressedOffset - ent.TarHeaderOffset
+					md[id].Digest = ent.Digest
+					md[id].SparseMap = ent.SparseMap
 				}
 			}
 			return nil
@@ -309,7 +311,7 @@ func getIDByName(md map[uint32]*metadataEntry, path string, rootID uint32) (uint
 	if path == "" {
 		return rootID, nil
 	}
-	parentDirectory, base := filepath.Split(cleanEntryPath(path))
+	parentDirectory, base := filepath.Split(ztoc.CleanEntryName(path))
 	parentID, err := getIDByName(md, parentDirectory, rootID)
 	if err != nil {
 		return 0, err
@@ -357,7 +359,7 @@ func (r *reader) getOrCreateDir(nodes *bolt.Bucket, md map[uint32]*metadataEntry
 		return 0, nil, err
 	}
 
-	parentID, parentBucket, err := r.getOrCreateDir(nodes, md, parentDir(cleanEntryPath(dir)), rootID)
+	parentID, parentBucket, err := r.getOrCreateDir(nodes, md, parentDir(ztoc.CleanEntryName(dir)), rootID)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -386,11 +388,6 @@ func setChild(md map[uint32]*metadataEntry, parentBucket *bolt.Bucket, parentID
 	return nil
 }
 
-// cleanEntryPath returns a clean file path, with trailing path separators removed.
-func cleanEntryPath(path string) string {
-	return strings.TrimPrefix(filepath.Clean(string(os.PathSeparator)+path), string(os.PathSeparator))
-}
-
 // parentDir returns the parent directory of a path.
 func parentDir(path string) string {
 	parentDirectory, _ := filepath.Split(path)
@@ -632,7 +629,7 @@ func (r *reader) OpenFile(id uint32) (File, error) {
 	}); err != nil {
 		return nil, err
 	}
-	return &file{mde.TarName, mde.UncompressedOffset, compression.Offset(size), mde.TarHeaderOffset, mde.TarHeaderSize}, nil
+	return &file{mde.TarName, mde.UncompressedOffset, compression.Offset(size), mde.TarHeaderOffset, mde.TarHeaderSize, mde.Digest, mde.SparseMap}, nil
 }
 
 type file struct {
@@ -641,6 +638,8 @@ type file struct {
 	uncompressedSize   compression.Offset
 	tarHeaderOffset    compression.Offset
 	tarHeaderSize      compression.Offset
+	digest             digest.Digest
+	sparseMap          []ztoc.SparseEntry
 }
 
 func (fr *file) GetUncompressedFileSize() compression.Offset {
@@ -662,6 +661,14 @@ func (fr *file) TarHeaderSize() compression.Offset {
 	return fr.tarHeaderSize
 }
 
+func (fr *file) Digest() digest.Digest {
+	return fr.digest
+}
+
+func (fr *file) SparseMap() []ztoc.SparseEntry {
+	return fr.sparseMap
+}
+
 func attrFromZtocEntry(src *ztoc.FileMetadata, dst *Attr) *Attr {
 	dst.Size = int64(src.UncompressedSize)
 	dst.ModTime = src.ModTime
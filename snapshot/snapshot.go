@@ -79,6 +79,9 @@ const (
 var (
 	// Error returned by `fs.Mount` when there is no ztoc for a particular layer.
 	ErrNoZtoc = errors.New("no ztoc for layer")
+	// Error returned by `fs.Mount` when a layer that cannot be mounted must not be pulled locally instead,
+	// e.g. because the SOCI index of its image has no valid signature.
+	ErrNoLocalFallback = errors.New("cannot fall back to local snapshot")
 )
 
 // FileSystem is a backing filesystem abstraction.
@@ -327,6 +330,9 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 		if !errors.Is(err, ErrNoZtoc) {
 			commonmetrics.IncOperationCount(commonmetrics.FuseMountFailureCount, digest.Digest(""))
 		}
+		if errors.Is(err, ErrNoLocalFallback) {
+			return nil, err
+		}
 	}
 
 	// fall back to local snapshot
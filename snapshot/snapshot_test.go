@@ -35,6 +35,7 @@ package snapshot
 import (
 	"context"
 	_ "crypto/sha256"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -227,6 +228,26 @@ func TestRemoteCommit(t *testing.T) {
 	}
 }
 
+func TestNoLocalFallback(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root := t.TempDir()
+	fs := &noFallbackFs{}
+	sn, err := NewSnapshotter(context.TODO(), root, fs)
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+
+	labels := map[string]string{targetSnapshotLabel: "testTarget"}
+	_, err = sn.Prepare(ctx, "/tmp/prepareTarget", "", snapshots.WithLabels(labels))
+	if !errors.Is(err, ErrNoLocalFallback) {
+		t.Fatalf("expected %v, got %v", ErrNoLocalFallback, err)
+	}
+	if fs.mountedLocal {
+		t.Fatalf("layer was mounted locally")
+	}
+}
+
 func TestFailureDetection(t *testing.T) {
 	testutil.RequiresRoot(t)
 	tests := []struct {
@@ -437,6 +458,28 @@ func (fs *dummyFs) MountLocal(ctx context.Context, mountpoint string, labels map
 	return fmt.Errorf("dummy")
 }
 
+// noFallbackFs fails to mount layers remotely with ErrNoLocalFallback.
+type noFallbackFs struct {
+	mountedLocal bool
+}
+
+func (fs *noFallbackFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	return fmt.Errorf("untrusted index: %w", ErrNoLocalFallback)
+}
+
+func (fs *noFallbackFs) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
+	return nil
+}
+
+func (fs *noFallbackFs) Unmount(ctx context.Context, mountpoint string) error {
+	return nil
+}
+
+func (fs *noFallbackFs) MountLocal(ctx context.Context, mountpoint string, labels map[string]string, mounts []mount.Mount) error {
+	fs.mountedLocal = true
+	return nil
+}
+
 // =============================================================================
 // Tests backword-comaptibility of overlayfs snapshotter.
 
@@ -24,12 +24,14 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/awslabs/soci-snapshotter/config"
 	"github.com/awslabs/soci-snapshotter/soci/store"
 	"github.com/awslabs/soci-snapshotter/util/dbutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
@@ -50,6 +52,12 @@ import (
 //         - platform: <string>         : the platform for the index
 //         - location: <string>         : the location of the artifact
 //         - type: <string>             : the type of the artifact (can be either "soci_index" or "soci_layer")
+//         - spanSize: <varint>         : the span size of a soci layer built with spans of a fixed size
+//         - ztocVersion: <string>      : the ztoc version of a soci layer
+// - soci_layers
+//       - *layer_digest*               : bucket for each layer with soci layers built with spans of a fixed size.
+//         - *span_size*                : bucket for each span size, keyed by its decimal string.
+//           - *soci_artifact_digest* : <empty> : the soci layers of the layer with the span size.
 
 // ArtifactsDB is a store for SOCI artifact metadata
 type ArtifactsDb struct {
@@ -73,6 +81,9 @@ var (
 	bucketKeyType           = []byte("type")
 	bucketKeyMediaType      = []byte("media_type")
 	bucketKeyCreatedAt      = []byte("created_at")
+	bucketKeySpanSize       = []byte("span_size")
+	bucketKeyZtocVersion    = []byte("ztoc_version")
+	bucketKeySociLayers     = []byte("soci_layers")
 
 	// ArtifactEntryTypeIndex indicates that an ArtifactEntry is a SOCI index artifact
 	ArtifactEntryTypeIndex ArtifactEntryType = "soci_index"
@@ -114,6 +125,12 @@ type ArtifactEntry struct {
 	MediaType string
 	// Creation time of SOCI artifact.
 	CreatedAt time.Time
+	// SpanSize is the span size of a SOCI layer built with spans of a fixed size.
+	// It is 0 for SOCI indices, and for SOCI layers whose span size isn't known.
+	SpanSize int64
+	// ZtocVersion is the ztoc version of a SOCI layer. It is empty for SOCI indices, and for
+	// SOCI layers whose version isn't known.
+	ZtocVersion string
 }
 
 // NewDB returns an instance of an ArtifactsDB
@@ -195,7 +212,7 @@ func (db *ArtifactsDb) RemoveOldArtifacts(blobStore store.Store) error {
 		if err != nil {
 			return nil
 		}
-		var bucketsToRemove [][]byte
+		var bucketsToRemove []*ArtifactEntry
 		bucket.ForEachBucket(func(k []byte) error {
 			artifactBucket := bucket.Bucket(k)
 			ae, err := loadArtifact(artifactBucket, string(k))
@@ -208,13 +225,16 @@ func (db *ArtifactsDb) RemoveOldArtifacts(blobStore store.Store) error {
 				return err
 			}
 			if !existsInContentStore {
-				bucketsToRemove = append(bucketsToRemove, k)
+				bucketsToRemove = append(bucketsToRemove, ae)
 			}
 			return nil
 		})
 		// remove the buckets
-		for _, k := range bucketsToRemove {
-			if err := bucket.DeleteBucket(k); err != nil {
+		for _, ae := range bucketsToRemove {
+			if err := bucket.DeleteBucket([]byte(ae.Digest)); err != nil {
+				return err
+			}
+			if err := deleteLayerArtifactRef(tx, ae); err != nil {
 				return err
 			}
 		}
@@ -336,6 +356,40 @@ func (db *ArtifactsDb) GetArtifactEntry(digest string) (*ArtifactEntry, error) {
 	return &entry, nil
 }
 
+// GetLayerArtifactEntry returns the most recent SOCI layer ArtifactEntry of the layer `layerDigest`
+// built with spans of `spanSize` bytes and ztoc version `version`, or nil if there is none.
+func (db *ArtifactsDb) GetLayerArtifactEntry(layerDigest string, spanSize int64, version ztoc.Version) (*ArtifactEntry, error) {
+	if spanSize == 0 {
+		return nil, nil
+	}
+	var entry *ArtifactEntry
+	err := db.db.View(func(tx *bolt.Tx) error {
+		refs := layerArtifactRefs(tx, layerDigest, spanSize)
+		artifacts := tx.Bucket(bucketKeySociArtifacts)
+		if refs == nil || artifacts == nil {
+			return nil
+		}
+		return refs.ForEach(func(k, _ []byte) error {
+			artifactBkt := artifacts.Bucket(k)
+			if artifactBkt == nil {
+				return nil
+			}
+			ae, err := loadArtifact(artifactBkt, string(k))
+			if err != nil {
+				return err
+			}
+			if ae.Type != ArtifactEntryTypeLayer || ae.ZtocVersion != string(version) {
+				return nil
+			}
+			if entry == nil || ae.CreatedAt.After(entry.CreatedAt) {
+				entry = ae
+			}
+			return nil
+		})
+	})
+	return entry, err
+}
+
 // GetArtifactType gets Type of an ArtifactEntry from the ArtifactsDB by digest
 func (db *ArtifactsDb) GetArtifactType(digest string) (ArtifactEntryType, error) {
 	ae, err := db.GetArtifactEntry(digest)
@@ -409,12 +463,66 @@ func (db *ArtifactsDb) WriteArtifactEntry(entry *ArtifactEntry) error {
 		if err != nil {
 			return err
 		}
-		err = putArtifactEntry(bucket, entry)
-		return err
+		if err := putArtifactEntry(bucket, entry); err != nil {
+			return err
+		}
+		return putLayerArtifactRef(tx, entry)
 	})
 	return err
 }
 
+// spanSizeKey returns the key of the bucket of the SOCI layers built with spans of `spanSize` bytes.
+func spanSizeKey(spanSize int64) []byte {
+	return []byte(strconv.FormatInt(spanSize, 10))
+}
+
+// layerArtifactRefs returns the bucket of the SOCI layers of the layer `layerDigest`
+// built with spans of `spanSize` bytes, or nil if there is none.
+func layerArtifactRefs(tx *bolt.Tx, layerDigest string, spanSize int64) *bolt.Bucket {
+	layers := tx.Bucket(bucketKeySociLayers)
+	if layers == nil {
+		return nil
+	}
+	layer := layers.Bucket([]byte(layerDigest))
+	if layer == nil {
+		return nil
+	}
+	return layer.Bucket(spanSizeKey(spanSize))
+}
+
+// putLayerArtifactRef records the SOCI layer `ae` under its layer and span size,
+// so that it's found by `GetLayerArtifactEntry` without walking all the artifacts.
+func putLayerArtifactRef(tx *bolt.Tx, ae *ArtifactEntry) error {
+	if ae.Type != ArtifactEntryTypeLayer || ae.SpanSize == 0 {
+		return nil
+	}
+	layers, err := tx.CreateBucketIfNotExists(bucketKeySociLayers)
+	if err != nil {
+		return err
+	}
+	layer, err := layers.CreateBucketIfNotExists([]byte(ae.OriginalDigest))
+	if err != nil {
+		return err
+	}
+	refs, err := layer.CreateBucketIfNotExists(spanSizeKey(ae.SpanSize))
+	if err != nil {
+		return err
+	}
+	return refs.Put([]byte(ae.Digest), nil)
+}
+
+// deleteLayerArtifactRef removes the record of the SOCI layer `ae` under its layer and span size.
+func deleteLayerArtifactRef(tx *bolt.Tx, ae *ArtifactEntry) error {
+	if ae.Type != ArtifactEntryTypeLayer || ae.SpanSize == 0 {
+		return nil
+	}
+	refs := layerArtifactRefs(tx, ae.OriginalDigest, ae.SpanSize)
+	if refs == nil {
+		return nil
+	}
+	return refs.Delete([]byte(ae.Digest))
+}
+
 func getArtifactsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
 	artifacts := tx.Bucket(bucketKeySociArtifacts)
 	if artifacts == nil {
@@ -455,6 +563,14 @@ func loadArtifact(artifactBkt *bolt.Bucket, digest string) (*ArtifactEntry, erro
 	ae.Platform = string(artifactBkt.Get(bucketKeyPlatform))
 	ae.MediaType = string(artifactBkt.Get(bucketKeyMediaType))
 	ae.CreatedAt = createdAt
+	if encodedSpanSize := artifactBkt.Get(bucketKeySpanSize); encodedSpanSize != nil {
+		spanSize, err := dbutil.DecodeInt(encodedSpanSize)
+		if err != nil {
+			return nil, err
+		}
+		ae.SpanSize = spanSize
+	}
+	ae.ZtocVersion = string(artifactBkt.Get(bucketKeyZtocVersion))
 	return &ae, nil
 }
 
@@ -492,6 +608,23 @@ func putArtifactEntry(artifacts *bolt.Bucket, ae *ArtifactEntry) error {
 		{bucketKeyCreatedAt, createdAt},
 	}
 
+	if ae.SpanSize != 0 {
+		spanSize, err := dbutil.EncodeInt(ae.SpanSize)
+		if err != nil {
+			return err
+		}
+		updates = append(updates, struct {
+			key []byte
+			val []byte
+		}{bucketKeySpanSize, spanSize})
+	}
+	if ae.ZtocVersion != "" {
+		updates = append(updates, struct {
+			key []byte
+			val []byte
+		}{bucketKeyZtocVersion, []byte(ae.ZtocVersion)})
+	}
+
 	for _, update := range updates {
 		if err := artifactBkt.Put(update.key, update.val); err != nil {
 			return err
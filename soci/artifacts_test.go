@@ -19,7 +19,9 @@ package soci
 import (
 	"os"
 	"testing"
+	"time"
 
+	"github.com/awslabs/soci-snapshotter/ztoc"
 	bolt "go.etcd.io/bbolt"
 )
 
@@ -97,6 +99,106 @@ func TestGetIndexArtifactEntries(t *testing.T) {
 	}
 }
 
+func TestGetLayerArtifactEntry(t *testing.T) {
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	const (
+		layerDgst = "sha256:1236aec48c0a74635a5f3dc666628c1673afaa21ed6e1270a9a44de66e811111"
+		ztocDgst1 = "sha256:10d6aec48c0a74635a5f3dc555528c1673afaa21ed6e1270a9a44de66e8ffa55"
+		ztocDgst2 = "sha256:20d6a9c48c0a74635a5f3dc555528c1673afaa21ed6e1270a9a44de66e8ffa55"
+		ztocDgst3 = "sha256:80d6aec48caaaaaaaa5f3dc555528c1673afaa21ed6e1270a9a44de66e8ffa55"
+		ztocDgst4 = "sha256:40d6aec48caaaaaaaa5f3dc555528c1673afaa21ed6e1270a9a44de66e8ffa55"
+		indexDgst = "sha256:99d6aec48caaaaaaaa5f3dc555528c1673afaa21ed6e1270a9a44de66e8ffa55"
+	)
+	now := time.Now()
+	entries := []ArtifactEntry{
+		{Digest: ztocDgst1, OriginalDigest: layerDgst, Type: ArtifactEntryTypeLayer, SpanSize: 1 << 22, ZtocVersion: "1.0", CreatedAt: now.Add(-time.Hour)},
+		{Digest: ztocDgst2, OriginalDigest: layerDgst, Type: ArtifactEntryTypeLayer, SpanSize: 1 << 22, ZtocVersion: "1.0", CreatedAt: now},
+		{Digest: ztocDgst3, OriginalDigest: layerDgst, Type: ArtifactEntryTypeLayer, SpanSize: 1 << 20, ZtocVersion: "1.0", CreatedAt: now},
+		{Digest: ztocDgst4, OriginalDigest: layerDgst, Type: ArtifactEntryTypeLayer, SpanSize: 1 << 22, ZtocVersion: "1.1", CreatedAt: now.Add(time.Hour)},
+		{Digest: indexDgst, OriginalDigest: layerDgst, Type: ArtifactEntryTypeIndex, CreatedAt: now},
+	}
+	for _, entry := range entries {
+		entry := entry
+		if err := db.WriteArtifactEntry(&entry); err != nil {
+			t.Fatalf("can't put ArtifactEntry to a bucket")
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		layer    string
+		spanSize int64
+		version  ztoc.Version
+		expected string
+	}{
+		{
+			name:     "most recent ztoc",
+			layer:    layerDgst,
+			spanSize: 1 << 22,
+			version:  ztoc.Version10,
+			expected: ztocDgst2,
+		},
+		{
+			name:     "most recent ztoc of another version",
+			layer:    layerDgst,
+			spanSize: 1 << 22,
+			version:  ztoc.Version11,
+			expected: ztocDgst4,
+		},
+		{
+			name:     "no ztoc with version",
+			layer:    layerDgst,
+			spanSize: 1 << 22,
+			version:  ztoc.Version12,
+		},
+		{
+			name:     "span size",
+			layer:    layerDgst,
+			spanSize: 1 << 20,
+			version:  ztoc.Version10,
+			expected: ztocDgst3,
+		},
+		{
+			name:     "no ztoc with span size",
+			layer:    layerDgst,
+			spanSize: 1 << 21,
+			version:  ztoc.Version10,
+		},
+		{
+			name:    "unknown span size",
+			layer:   layerDgst,
+			version: ztoc.Version10,
+		},
+		{
+			name:     "no ztoc of layer",
+			layer:    ztocDgst1,
+			spanSize: 1 << 22,
+			version:  ztoc.Version10,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			entry, err := db.GetLayerArtifactEntry(tc.layer, tc.spanSize, tc.version)
+			if err != nil {
+				t.Fatalf("cannot get layer artifact entry: %v", err)
+			}
+			if tc.expected == "" {
+				if entry != nil {
+					t.Fatalf("unexpected artifact entry %s", entry.Digest)
+				}
+				return
+			}
+			if entry == nil || entry.Digest != tc.expected {
+				t.Fatalf("expected artifact entry %s, got %v", tc.expected, entry)
+			}
+		})
+	}
+}
+
 func TestArtifactDB_DoesNotExist(t *testing.T) {
 	_, err := NewDB(ArtifactsDbPath())
 	if err == nil {
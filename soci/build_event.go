@@ -0,0 +1,90 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"fmt"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// BuildEventType is the type of a `BuildEvent`.
+type BuildEventType string
+
+const (
+	// BuildEventLayerStarted is emitted when an `IndexBuilder` starts processing a layer.
+	BuildEventLayerStarted BuildEventType = "started"
+	// BuildEventLayerSkipped is emitted when no ztoc is built for a layer,
+	// e.g. because it's smaller than the min layer size.
+	BuildEventLayerSkipped BuildEventType = "skipped"
+	// BuildEventLayerBuilt is emitted when the ztoc of a layer is built, or reused.
+	BuildEventLayerBuilt BuildEventType = "built"
+	// BuildEventLayerFailed is emitted when the ztoc of a layer can't be built.
+	BuildEventLayerFailed BuildEventType = "failed"
+)
+
+// BuildEvent reports the progress of an `IndexBuilder` building the ztoc of an image layer.
+type BuildEvent struct {
+	Type BuildEventType
+	// Layer is the descriptor of the image layer.
+	Layer ocispec.Descriptor
+	// Reason is why no ztoc is built for a skipped layer.
+	Reason string
+	// Ztoc is the descriptor of the ztoc of a built layer.
+	Ztoc ocispec.Descriptor
+	// SpanCount is the number of spans of the ztoc of a built layer.
+	SpanCount int
+	// Reused is whether the ztoc of a built layer was built by a previous build. See `WithForceRebuild`.
+	Reused bool
+	// Err is why the ztoc of a failed layer can't be built.
+	Err error
+}
+
+// WithProgress specifies a function called with the events of builds, instead of printing
+// the built and skipped layers to stdout. Layers are built concurrently, but calls to
+// `progress` are serialized.
+func WithProgress(progress func(BuildEvent)) BuildOption {
+	return func(c *buildConfig) error {
+		c.progress = progress
+		return nil
+	}
+}
+
+// PrintProgress prints the built and skipped layers of a build to stdout.
+// It's the progress function of builds by default.
+func PrintProgress(e BuildEvent) {
+	switch e.Type {
+	case BuildEventLayerSkipped:
+		fmt.Printf("ztoc skipped - layer %s (%s) %s\n", e.Layer.Digest, e.Layer.MediaType, e.Reason)
+	case BuildEventLayerBuilt:
+		if e.Reused {
+			fmt.Printf("layer %s -> ztoc %s (reused)\n", e.Layer.Digest, e.Ztoc.Digest)
+		} else {
+			fmt.Printf("layer %s -> ztoc %s\n", e.Layer.Digest, e.Ztoc.Digest)
+		}
+	}
+}
+
+// emit calls the progress function of `b` with `e`.
+func (b *IndexBuilder) emit(e BuildEvent) {
+	if b.config.progress == nil {
+		return
+	}
+	b.progressMu.Lock()
+	defer b.progressMu.Unlock()
+	b.config.progress(e)
+}
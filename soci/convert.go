@@ -0,0 +1,187 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// IndexAnnotationImageManifestDigest is the annotation of a SOCI index embedded in an image index
+// by `ConvertImage` with the digest of the image manifest the SOCI index is for.
+const IndexAnnotationImageManifestDigest = "com.amazon.soci.image-manifest-digest"
+
+// ConvertImage writes to `cs` an image index listing the manifests of `img` and, next to them,
+// the SOCI indices built for them (`indices`), so that the SOCI indices are found by reading the
+// image index instead of calling the Referrers API. SOCI indices are listed with the `SociIndexArtifactType`
+// artifact type, the `IndexAnnotationImageManifestDigest` annotation, and no platform, so that clients
+// selecting a manifest by platform ignore them. The SOCI indices and their ztocs are copied from
+// `blobStore` to `cs`, so that pushing the image index pushes them too. It returns the descriptor of the
+// image index, which is labeled in `cs` to reference all of its content.
+func ConvertImage(ctx context.Context, cs content.Store, img images.Image, indices []*IndexWithMetadata, blobStore store.BasicStore) (ocispec.Descriptor, error) {
+	var index ocispec.Index
+	switch {
+	case images.IsIndexType(img.Target.MediaType):
+		b, err := content.ReadBlob(ctx, cs, img.Target)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if err := json.Unmarshal(b, &index); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("cannot parse image index %s: %w", img.Target.Digest, err)
+		}
+	case images.IsManifestType(img.Target.MediaType):
+		if len(indices) != 1 {
+			return ocispec.Descriptor{}, fmt.Errorf("expected a single SOCI index for image manifest %s, got %d", img.Target.Digest, len(indices))
+		}
+		manifest := img.Target
+		manifest.Platform = indices[0].Platform
+		index.Manifests = []ocispec.Descriptor{manifest}
+	default:
+		return ocispec.Descriptor{}, fmt.Errorf("unsupported image media type %s", img.Target.MediaType)
+	}
+	index.SchemaVersion = 2
+	index.MediaType = ocispec.MediaTypeImageIndex
+
+	// SOCI indices of a previous conversion are replaced.
+	manifests := make([]ocispec.Descriptor, 0, len(index.Manifests)+len(indices))
+	for _, desc := range index.Manifests {
+		if desc.ArtifactType != SociIndexArtifactType {
+			manifests = append(manifests, desc)
+		}
+	}
+	for _, idx := range indices {
+		desc, err := copySociIndex(ctx, cs, idx, blobStore)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		manifests = append(manifests, desc)
+	}
+	index.Manifests = manifests
+
+	b, err := json.Marshal(index)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	indexDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	labels := make(map[string]string)
+	for i, desc := range index.Manifests {
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.m.%d", i)] = desc.Digest.String()
+	}
+	if err := writeBlob(ctx, cs, indexDesc, b, labels); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("cannot write image index: %w", err)
+	}
+	return indexDesc, nil
+}
+
+// EmbeddedSociIndices returns the descriptors of the SOCI indices of the image manifest
+// `manifestDigest` embedded in `index` by `ConvertImage`.
+func EmbeddedSociIndices(index ocispec.Index, manifestDigest digest.Digest) []ocispec.Descriptor {
+	var descs []ocispec.Descriptor
+	for _, desc := range index.Manifests {
+		if desc.ArtifactType == SociIndexArtifactType && desc.Annotations[IndexAnnotationImageManifestDigest] == manifestDigest.String() {
+			descs = append(descs, desc)
+		}
+	}
+	return descs
+}
+
+// copySociIndex copies the SOCI index `idx` and its ztocs from `blobStore` to `cs`, and returns
+// the descriptor listing it in an image index.
+func copySociIndex(ctx context.Context, cs content.Store, idx *IndexWithMetadata, blobStore store.BasicStore) (ocispec.Descriptor, error) {
+	if idx.Index.Subject == nil {
+		return ocispec.Descriptor{}, errors.New("SOCI index has no subject")
+	}
+	labels := map[string]string{
+		"containerd.io/gc.ref.content.config": defaultConfigDescriptor.Digest.String(),
+	}
+	if err := writeBlob(ctx, cs, defaultConfigDescriptor, defaultConfigContent, nil); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("cannot write SOCI index config: %w", err)
+	}
+	for i, blob := range idx.Index.Blobs {
+		// ztocs are pushed to the blob store by digest and size only.
+		rc, err := blobStore.Fetch(ctx, ocispec.Descriptor{Digest: blob.Digest, Size: blob.Size})
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("cannot read ztoc %s: %w", blob.Digest, err)
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("cannot read ztoc %s: %w", blob.Digest, err)
+		}
+		if err := writeBlob(ctx, cs, blob, b, nil); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("cannot write ztoc %s: %w", blob.Digest, err)
+		}
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.l.%d", i)] = blob.Digest.String()
+	}
+
+	manifest, err := MarshalIndex(idx.Index)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	// like the Referrers API, the descriptor has the annotations of the SOCI index,
+	// so that SOCI indices can be selected without fetching them.
+	annotations := map[string]string{
+		IndexAnnotationImageManifestDigest: idx.Index.Subject.Digest.String(),
+	}
+	for k, v := range idx.Index.Annotations {
+		annotations[k] = v
+	}
+	desc := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: SociIndexArtifactType,
+		Digest:       digest.FromBytes(manifest),
+		Size:         int64(len(manifest)),
+		Annotations:  annotations,
+	}
+	if err := writeBlob(ctx, cs, desc, manifest, labels); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("cannot write SOCI index: %w", err)
+	}
+	return desc, nil
+}
+
+// writeBlob writes `b` to `cs` as the blob `desc` with `labels`. Labels are added to the blob
+// if it already exists.
+func writeBlob(ctx context.Context, cs content.Store, desc ocispec.Descriptor, b []byte, labels map[string]string) error {
+	_, err := cs.Info(ctx, desc.Digest)
+	if errdefs.IsNotFound(err) {
+		return content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(b), desc, content.WithLabels(labels))
+	}
+	if err != nil || len(labels) == 0 {
+		return err
+	}
+	fieldpaths := make([]string, 0, len(labels))
+	for k := range labels {
+		fieldpaths = append(fieldpaths, "labels."+k)
+	}
+	_, err = cs.Update(ctx, content.Info{Digest: desc.Digest, Labels: labels}, fieldpaths...)
+	return err
+}
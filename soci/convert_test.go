@@ -0,0 +1,182 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+func TestConvertImage(t *testing.T) {
+	ctx := context.Background()
+	// labels are updated when a SOCI index is written again, which the content
+	// store of containerd supports through its metadata store.
+	cs, err := local.NewLabeledStore(t.TempDir(), newMemoryLabelStore())
+	if err != nil {
+		t.Fatalf("cannot create content store: %v", err)
+	}
+	push := func(mediaType string, b []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(b), desc); err != nil {
+			t.Fatalf("cannot write %s: %v", desc.Digest, err)
+		}
+		return desc
+	}
+	var layers []ocispec.Descriptor
+	for _, layer := range buildTestLayers(t, 2) {
+		layers = append(layers, push(ocispec.MediaTypeImageLayerGzip, layer))
+	}
+	manifest, err := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    push(ocispec.MediaTypeImageConfig, []byte("{}")),
+		Layers:    layers,
+	})
+	if err != nil {
+		t.Fatalf("cannot marshal manifest: %v", err)
+	}
+	manifestDesc := push(ocispec.MediaTypeImageManifest, manifest)
+
+	artifactsDb, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	blobStore := memory.New()
+	builder, err := NewIndexBuilder(cs, blobStore, artifactsDb, WithSpanSize(65536), WithMinLayerSize(0))
+	if err != nil {
+		t.Fatalf("cannot create index builder: %v", err)
+	}
+	img := images.Image{Name: "example.com/image:latest", Target: manifestDesc}
+	index, err := builder.Build(ctx, img)
+	if err != nil {
+		t.Fatalf("cannot build index: %v", err)
+	}
+
+	// converting a converted image replaces its SOCI indices.
+	for i := 0; i < 2; i++ {
+		indexDesc, err := ConvertImage(ctx, cs, img, []*IndexWithMetadata{index}, blobStore)
+		if err != nil {
+			t.Fatalf("cannot convert image: %v", err)
+		}
+		b, err := content.ReadBlob(ctx, cs, indexDesc)
+		if err != nil {
+			t.Fatalf("cannot read converted image index: %v", err)
+		}
+		var converted ocispec.Index
+		if err := json.Unmarshal(b, &converted); err != nil {
+			t.Fatalf("cannot parse converted image index: %v", err)
+		}
+		if len(converted.Manifests) != 2 {
+			t.Fatalf("expected the image manifest and its SOCI index, got %d manifests", len(converted.Manifests))
+		}
+		if converted.Manifests[0].Digest != manifestDesc.Digest || converted.Manifests[0].Platform == nil {
+			t.Fatalf("image manifest not listed with its platform in converted image index")
+		}
+
+		embedded := EmbeddedSociIndices(converted, manifestDesc.Digest)
+		if len(embedded) != 1 || embedded[0].Platform != nil {
+			t.Fatalf("expected a SOCI index without platform, got %v", embedded)
+		}
+		b, err = content.ReadBlob(ctx, cs, embedded[0])
+		if err != nil {
+			t.Fatalf("cannot read SOCI index: %v", err)
+		}
+		var sociIndex Index
+		if err := UnmarshalIndex(b, &sociIndex); err != nil {
+			t.Fatalf("cannot parse SOCI index: %v", err)
+		}
+		if sociIndex.Subject == nil || sociIndex.Subject.Digest != manifestDesc.Digest {
+			t.Fatalf("unexpected subject of SOCI index: %v", sociIndex.Subject)
+		}
+		info, err := cs.Info(ctx, embedded[0].Digest)
+		if err != nil {
+			t.Fatalf("cannot get SOCI index info: %v", err)
+		}
+		for i, blob := range sociIndex.Blobs {
+			if _, err := cs.Info(ctx, blob.Digest); err != nil {
+				t.Fatalf("ztoc %s not copied to content store: %v", blob.Digest, err)
+			}
+			// ztocs are kept by the garbage collector as long as the SOCI index is.
+			if label := info.Labels[fmt.Sprintf("containerd.io/gc.ref.content.l.%d", i)]; label != blob.Digest.String() {
+				t.Fatalf("ztoc %s isn't referenced by the SOCI index labels: %v", blob.Digest, info.Labels)
+			}
+		}
+
+		// clients selecting a manifest by platform ignore the SOCI index.
+		selected, err := images.Manifest(ctx, cs, indexDesc, platforms.OnlyStrict(*index.Platform))
+		if err != nil {
+			t.Fatalf("cannot select image manifest: %v", err)
+		}
+		if len(selected.Layers) != len(layers) || selected.Layers[0].Digest != layers[0].Digest {
+			t.Fatalf("selected manifest isn't the image manifest")
+		}
+
+		img.Target = indexDesc
+	}
+}
+
+// memoryLabelStore is a `local.LabelStore` that keeps labels in memory.
+type memoryLabelStore struct {
+	mu     sync.Mutex
+	labels map[digest.Digest]map[string]string
+}
+
+func newMemoryLabelStore() *memoryLabelStore {
+	return &memoryLabelStore{labels: make(map[digest.Digest]map[string]string)}
+}
+
+func (s *memoryLabelStore) Get(dgst digest.Digest) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.labels[dgst], nil
+}
+
+func (s *memoryLabelStore) Set(dgst digest.Digest, labels map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.labels[dgst] = labels
+	return nil
+}
+
+func (s *memoryLabelStore) Update(dgst digest.Digest, update map[string]string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	labels := make(map[string]string)
+	for k, v := range s.labels[dgst] {
+		labels[k] = v
+	}
+	for k, v := range update {
+		if v == "" {
+			delete(labels, k)
+		} else {
+			labels[k] = v
+		}
+	}
+	s.labels[dgst] = labels
+	return labels, nil
+}
@@ -0,0 +1,88 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/archive"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DockerArchive is the content of a docker-archive tarball, as written by `docker save`, imported
+// into a temporary content store. It is a `content.Provider` of the images in the archive, which
+// can be given to `NewIndexBuilder`. The images are imported like containerd imports them, so the
+// manifests of images in the docker format are the ones containerd creates for them.
+type DockerArchive struct {
+	content.Store
+	dir   string
+	index ocispec.Index
+}
+
+// ImportDockerArchive imports the docker-archive tarball read from `r`. Tarballs of OCI image
+// layouts are supported too. The archive must be closed to remove the temporary content store.
+func ImportDockerArchive(ctx context.Context, r io.Reader) (*DockerArchive, error) {
+	dir, err := os.MkdirTemp("", "soci-docker-archive-")
+	if err != nil {
+		return nil, err
+	}
+	a, err := importDockerArchive(ctx, r, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return a, nil
+}
+
+func importDockerArchive(ctx context.Context, r io.Reader, dir string) (*DockerArchive, error) {
+	cs, err := local.NewStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	indexDesc, err := archive.ImportIndex(ctx, cs, r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot import docker archive: %w", err)
+	}
+	b, err := content.ReadBlob(ctx, cs, indexDesc)
+	if err != nil {
+		return nil, err
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, fmt.Errorf("cannot parse index of docker archive: %w", err)
+	}
+	return &DockerArchive{Store: cs, dir: dir, index: index}, nil
+}
+
+// Resolve returns the image `ref` of the archive, which is either the name (e.g. one of the tags
+// the image was saved with) or the digest of an image in the archive. If `ref` is empty, the archive
+// must contain a single image.
+func (a *DockerArchive) Resolve(ref string) (images.Image, error) {
+	return resolveIndexImage(a.index, ref)
+}
+
+// Close removes the temporary content store of the archive.
+func (a *DockerArchive) Close() error {
+	return os.RemoveAll(a.dir)
+}
@@ -0,0 +1,139 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+// buildDockerArchive returns a tarball in the format written by `docker save` of an image
+// with uncompressed `layers`, tagged with `repoTags`.
+func buildDockerArchive(t *testing.T, layers [][]byte, repoTags []string) []byte {
+	var (
+		buf        bytes.Buffer
+		layerFiles []string
+		tw         = tar.NewWriter(&buf)
+	)
+	writeFile := func(name string, b []byte) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(b)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("cannot write %s: %v", name, err)
+		}
+		if _, err := tw.Write(b); err != nil {
+			t.Fatalf("cannot write %s: %v", name, err)
+		}
+	}
+	var diffIDs []digest.Digest
+	for i, layer := range layers {
+		name := fmt.Sprintf("layer%d/layer.tar", i)
+		writeFile(name, layer)
+		layerFiles = append(layerFiles, name)
+		diffIDs = append(diffIDs, digest.FromBytes(layer))
+	}
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	if err != nil {
+		t.Fatalf("cannot marshal config: %v", err)
+	}
+	configFile := digest.FromBytes(config).Encoded() + ".json"
+	writeFile(configFile, config)
+	manifest, err := json.Marshal([]map[string]interface{}{
+		{"Config": configFile, "RepoTags": repoTags, "Layers": layerFiles},
+	})
+	if err != nil {
+		t.Fatalf("cannot marshal manifest: %v", err)
+	}
+	writeFile("manifest.json", manifest)
+	if err := tw.Close(); err != nil {
+		t.Fatalf("cannot write docker archive: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDockerArchive(t *testing.T) {
+	var layers [][]byte
+	for i := 0; i < 2; i++ {
+		layer, err := io.ReadAll(testutil.BuildTar([]testutil.TarEntry{
+			testutil.File(fmt.Sprintf("file%d", i), string(testutil.RandomByteData(100000))),
+		}))
+		if err != nil {
+			t.Fatalf("cannot build layer: %v", err)
+		}
+		layers = append(layers, layer)
+	}
+
+	ctx := context.Background()
+	archive, err := ImportDockerArchive(ctx, bytes.NewReader(buildDockerArchive(t, layers, []string{"example.com/image:v1", "example.com/image:latest"})))
+	if err != nil {
+		t.Fatalf("cannot import docker archive: %v", err)
+	}
+	img, err := archive.Resolve("")
+	if err != nil {
+		t.Fatalf("cannot resolve the image of the archive: %v", err)
+	}
+	if named, err := archive.Resolve("example.com/image:v1"); err != nil || named.Target.Digest != img.Target.Digest {
+		t.Fatalf("cannot resolve the image by tag: %v", err)
+	}
+	if !images.IsManifestType(img.Target.MediaType) {
+		t.Fatalf("unexpected media type of image %s", img.Target.MediaType)
+	}
+
+	artifactsDb, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	builder, err := NewIndexBuilder(archive, memory.New(), artifactsDb, WithSpanSize(65536), WithMinLayerSize(0))
+	if err != nil {
+		t.Fatalf("cannot create index builder: %v", err)
+	}
+	index, err := builder.Build(ctx, img)
+	if err != nil {
+		t.Fatalf("cannot build index: %v", err)
+	}
+	if index.Index.Subject.Digest != img.Target.Digest {
+		t.Fatalf("unexpected index subject %s", index.Index.Subject.Digest)
+	}
+	if len(index.Index.Blobs) != len(layers) {
+		t.Fatalf("expected %d ztocs, got %d", len(layers), len(index.Index.Blobs))
+	}
+	for i, blob := range index.Index.Blobs {
+		if blob.Annotations[IndexAnnotationImageLayerDigest] != digest.FromBytes(layers[i]).String() {
+			t.Fatalf("unexpected layer of ztoc %d", i)
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		t.Fatalf("cannot close docker archive: %v", err)
+	}
+	if _, err := os.Stat(archive.dir); !os.IsNotExist(err) {
+		t.Fatalf("temporary content store of docker archive not removed")
+	}
+}
@@ -0,0 +1,301 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images/archive"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// ExportAnnotationArtifactsMetadata is the annotation of the index.json of SOCI artifacts exported
+// by `ExportIndices` with the digest of the JSON blob holding the `ArtifactsDb` entries of the artifacts.
+const ExportAnnotationArtifactsMetadata = "com.amazon.soci.artifacts-metadata"
+
+// ExportIndices writes the SOCI indices `indexDescs` of `blobStore`, and their ztocs, to `w` as
+// a tarball of an OCI image layout. The index.json of the layout lists the SOCI indices, and points
+// to a blob with their `ArtifactsDb` entries and those of their ztocs, so that `ImportIndices` can
+// load them back as if they had been built locally.
+func ExportIndices(ctx context.Context, w io.Writer, blobStore store.BasicStore, artifactsDb *ArtifactsDb, indexDescs []ocispec.Descriptor) error {
+	tw := tar.NewWriter(w)
+	layout, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, ocispec.ImageLayoutFile, layout); err != nil {
+		return err
+	}
+
+	written := make(map[digest.Digest]bool)
+	addBlob := func(dgst digest.Digest, b []byte) error {
+		if written[dgst] {
+			return nil
+		}
+		written[dgst] = true
+		return writeTarFile(tw, path.Join(ocispec.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded()), b)
+	}
+
+	var (
+		entries   []ArtifactEntry
+		manifests []ocispec.Descriptor
+	)
+	for _, indexDesc := range indexDescs {
+		entry, err := artifactsDb.GetArtifactEntry(indexDesc.Digest.String())
+		if err != nil {
+			return err
+		}
+		if entry.Type != ArtifactEntryTypeIndex {
+			return fmt.Errorf("%s is not a SOCI index", indexDesc.Digest)
+		}
+		b, err := fetchBlob(ctx, blobStore, indexDesc)
+		if err != nil {
+			return fmt.Errorf("cannot read SOCI index %s: %w", indexDesc.Digest, err)
+		}
+		var index Index
+		if err := UnmarshalIndex(b, &index); err != nil {
+			return fmt.Errorf("cannot parse SOCI index %s: %w", indexDesc.Digest, err)
+		}
+		if err := addBlob(indexDesc.Digest, b); err != nil {
+			return err
+		}
+		if index.MediaType == ocispec.MediaTypeImageManifest {
+			if err := addBlob(defaultConfigDescriptor.Digest, defaultConfigContent); err != nil {
+				return err
+			}
+		}
+		for _, blob := range index.Blobs {
+			ztocEntry, err := artifactsDb.GetArtifactEntry(blob.Digest.String())
+			if err != nil {
+				return err
+			}
+			// ztocs are pushed to the blob store by digest and size only.
+			b, err := fetchBlob(ctx, blobStore, ocispec.Descriptor{Digest: blob.Digest, Size: blob.Size})
+			if err != nil {
+				return fmt.Errorf("cannot read ztoc %s: %w", blob.Digest, err)
+			}
+			if err := addBlob(blob.Digest, b); err != nil {
+				return err
+			}
+			entries = append(entries, *ztocEntry)
+		}
+		entries = append(entries, *entry)
+
+		manifest := ocispec.Descriptor{
+			MediaType:    entry.MediaType,
+			ArtifactType: SociIndexArtifactType,
+			Digest:       indexDesc.Digest,
+			Size:         entry.Size,
+			Annotations:  index.Annotations,
+		}
+		if p, err := platforms.Parse(entry.Platform); err == nil {
+			manifest.Platform = &p
+		}
+		manifests = append(manifests, manifest)
+	}
+
+	metadata, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	metadataDigest := digest.FromBytes(metadata)
+	if err := addBlob(metadataDigest, metadata); err != nil {
+		return err
+	}
+	index, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: manifests,
+		Annotations: map[string]string{
+			ExportAnnotationArtifactsMetadata: metadataDigest.String(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, ocispec.ImageIndexFile, index); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// ImportIndices loads the SOCI indices and ztocs exported by `ExportIndices` from the tarball `r`
+// into `contentStore`, and adds their entries to `artifactsDb`. It returns the descriptors of the
+// imported SOCI indices.
+func ImportIndices(ctx context.Context, r io.Reader, contentStore store.Store, artifactsDb *ArtifactsDb) ([]ocispec.Descriptor, error) {
+	dir, err := os.MkdirTemp("", "soci-import-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	cs, err := local.NewStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	layoutDesc, err := archive.ImportIndex(ctx, cs, r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read exported SOCI artifacts: %w", err)
+	}
+	b, err := content.ReadBlob(ctx, cs, layoutDesc)
+	if err != nil {
+		return nil, err
+	}
+	var layout ocispec.Index
+	if err := json.Unmarshal(b, &layout); err != nil {
+		return nil, fmt.Errorf("cannot parse index of exported SOCI artifacts: %w", err)
+	}
+	metadataDigest, err := digest.Parse(layout.Annotations[ExportAnnotationArtifactsMetadata])
+	if err != nil {
+		return nil, fmt.Errorf("OCI layout has no SOCI artifacts metadata: %w", err)
+	}
+	b, err = content.ReadBlob(ctx, cs, ocispec.Descriptor{Digest: metadataDigest})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read SOCI artifacts metadata: %w", err)
+	}
+	var metadata []ArtifactEntry
+	if err := json.Unmarshal(b, &metadata); err != nil {
+		return nil, fmt.Errorf("cannot parse SOCI artifacts metadata: %w", err)
+	}
+	entries := make(map[string]ArtifactEntry, len(metadata))
+	for _, entry := range metadata {
+		entries[entry.Digest] = entry
+	}
+
+	// batch will prevent content from being garbage collected in the middle of the following operations
+	ctx, batchDone, err := contentStore.BatchOpen(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer batchDone(ctx)
+
+	var imported []ocispec.Descriptor
+	for _, desc := range layout.Manifests {
+		if desc.ArtifactType != SociIndexArtifactType {
+			continue
+		}
+		entry, ok := entries[desc.Digest.String()]
+		if !ok || entry.Type != ArtifactEntryTypeIndex {
+			return nil, fmt.Errorf("no SOCI index metadata for %s", desc.Digest)
+		}
+		b, err := content.ReadBlob(ctx, cs, desc)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read SOCI index %s: %w", desc.Digest, err)
+		}
+		var index Index
+		if err := UnmarshalIndex(b, &index); err != nil {
+			return nil, fmt.Errorf("cannot parse SOCI index %s: %w", desc.Digest, err)
+		}
+
+		var ztocEntries []ArtifactEntry
+		for _, blob := range index.Blobs {
+			ztocEntry, ok := entries[blob.Digest.String()]
+			if !ok || ztocEntry.Type != ArtifactEntryTypeLayer {
+				return nil, fmt.Errorf("no ztoc metadata for %s", blob.Digest)
+			}
+			ztocEntries = append(ztocEntries, ztocEntry)
+			if err := copyBlob(ctx, cs, contentStore, ocispec.Descriptor{Digest: blob.Digest, Size: blob.Size}); err != nil {
+				return nil, fmt.Errorf("cannot import ztoc %s: %w", blob.Digest, err)
+			}
+		}
+		if index.MediaType == ocispec.MediaTypeImageManifest {
+			if err := contentStore.Push(ctx, defaultConfigDescriptor, bytes.NewReader(defaultConfigContent)); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+				return nil, fmt.Errorf("error creating OCI 1.0 empty config: %w", err)
+			}
+		}
+		indexDesc := ocispec.Descriptor{Digest: desc.Digest, Size: desc.Size}
+		if err := copyBlob(ctx, cs, contentStore, indexDesc); err != nil {
+			return nil, fmt.Errorf("cannot import SOCI index %s: %w", desc.Digest, err)
+		}
+		if err := labelSociIndex(ctx, contentStore, indexDesc, &index); err != nil {
+			return nil, err
+		}
+
+		for i := range ztocEntries {
+			if err := artifactsDb.WriteArtifactEntry(&ztocEntries[i]); err != nil {
+				return nil, err
+			}
+		}
+		if err := artifactsDb.WriteArtifactEntry(&entry); err != nil {
+			return nil, err
+		}
+		imported = append(imported, desc)
+	}
+	if len(imported) == 0 {
+		return nil, errors.New("no SOCI indices to import")
+	}
+	return imported, nil
+}
+
+// fetchBlob reads the blob `desc` from `blobStore`.
+func fetchBlob(ctx context.Context, blobStore store.BasicStore, desc ocispec.Descriptor) ([]byte, error) {
+	rc, err := blobStore.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// copyBlob copies the blob `desc` from `src` to `dst`, unless `dst` already has it.
+func copyBlob(ctx context.Context, src content.Provider, dst store.BasicStore, desc ocispec.Descriptor) error {
+	exists, err := dst.Exists(ctx, desc)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	ra, err := src.ReaderAt(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+	err = dst.Push(ctx, desc, io.NewSectionReader(ra, 0, ra.Size()))
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return err
+	}
+	return nil
+}
+
+// writeTarFile writes a regular file `name` with content `b` to `tw`.
+func writeTarFile(tw *tar.Writer, name string, b []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(b)),
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(b)
+	return err
+}
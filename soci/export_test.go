@@ -0,0 +1,164 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+func newTestSociStore(t *testing.T) *store.SociStore {
+	s, err := oci.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("cannot create OCI store: %v", err)
+	}
+	return &store.SociStore{Store: s}
+}
+
+func TestExportImportIndices(t *testing.T) {
+	ctx := context.Background()
+	cs, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("cannot create content store: %v", err)
+	}
+	push := func(mediaType string, b []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(b), desc); err != nil {
+			t.Fatalf("cannot write %s: %v", desc.Digest, err)
+		}
+		return desc
+	}
+	var layers []ocispec.Descriptor
+	for _, layer := range buildTestLayers(t, 2) {
+		layers = append(layers, push(ocispec.MediaTypeImageLayerGzip, layer))
+	}
+	manifest, err := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    push(ocispec.MediaTypeImageConfig, []byte("{}")),
+		Layers:    layers,
+	})
+	if err != nil {
+		t.Fatalf("cannot marshal manifest: %v", err)
+	}
+	manifestDesc := push(ocispec.MediaTypeImageManifest, manifest)
+
+	srcDb, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	src := newTestSociStore(t)
+	builder, err := NewIndexBuilder(cs, src, srcDb, WithSpanSize(65536), WithMinLayerSize(0))
+	if err != nil {
+		t.Fatalf("cannot create index builder: %v", err)
+	}
+	built, err := builder.Build(ctx, images.Image{Name: "example.com/image:latest", Target: manifestDesc})
+	if err != nil {
+		t.Fatalf("cannot build index: %v", err)
+	}
+	if err := WriteSociIndex(ctx, built, src, srcDb); err != nil {
+		t.Fatalf("cannot write index: %v", err)
+	}
+	b, err := MarshalIndex(built.Index)
+	if err != nil {
+		t.Fatalf("cannot marshal index: %v", err)
+	}
+	indexDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(b), Size: int64(len(b))}
+
+	var exported bytes.Buffer
+	if err := ExportIndices(ctx, &exported, src, srcDb, []ocispec.Descriptor{indexDesc}); err != nil {
+		t.Fatalf("cannot export index: %v", err)
+	}
+
+	dstDb, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	dst := newTestSociStore(t)
+	imported, err := ImportIndices(ctx, bytes.NewReader(exported.Bytes()), dst, dstDb)
+	if err != nil {
+		t.Fatalf("cannot import index: %v", err)
+	}
+	if len(imported) != 1 || imported[0].Digest != indexDesc.Digest || imported[0].Platform == nil {
+		t.Fatalf("unexpected imported indices %v", imported)
+	}
+
+	for _, dgst := range []digest.Digest{indexDesc.Digest, built.Index.Blobs[0].Digest, built.Index.Blobs[1].Digest} {
+		expected, err := srcDb.GetArtifactEntry(dgst.String())
+		if err != nil {
+			t.Fatalf("cannot get entry of %s: %v", dgst, err)
+		}
+		actual, err := dstDb.GetArtifactEntry(dgst.String())
+		if err != nil {
+			t.Fatalf("entry of %s not imported: %v", dgst, err)
+		}
+		if !actual.CreatedAt.Equal(expected.CreatedAt) {
+			t.Fatalf("unexpected creation time of %s: %v, expected %v", dgst, actual.CreatedAt, expected.CreatedAt)
+		}
+		actual.CreatedAt = expected.CreatedAt
+		if *actual != *expected {
+			t.Fatalf("unexpected entry of %s: %+v, expected %+v", dgst, actual, expected)
+		}
+	}
+
+	// the imported index can be used like one built locally.
+	v, err := VerifyIndex(ctx, cs, dst, manifestDesc, indexDesc)
+	if err != nil {
+		t.Fatalf("cannot verify imported index: %v", err)
+	}
+	if v.Failed() {
+		t.Fatalf("imported index failed verification: %+v", v)
+	}
+	descs, _, err := GetIndexDescriptorCollection(ctx, cs, dstDb, images.Image{Target: manifestDesc}, []ocispec.Platform{*built.Platform})
+	if err != nil {
+		t.Fatalf("cannot get imported index descriptors: %v", err)
+	}
+	if len(descs) != 1 || descs[0].Digest != indexDesc.Digest {
+		t.Fatalf("unexpected index descriptors %v", descs)
+	}
+}
+
+func TestImportIndicesWithoutMetadata(t *testing.T) {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	layout, _ := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	index, _ := json.Marshal(ocispec.Index{MediaType: ocispec.MediaTypeImageIndex})
+	for name, data := range map[string][]byte{ocispec.ImageLayoutFile: layout, ocispec.ImageIndexFile: index} {
+		if err := writeTarFile(tw, name, data); err != nil {
+			t.Fatalf("cannot write %s: %v", name, err)
+		}
+	}
+	tw.Close()
+
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	if _, err := ImportIndices(context.Background(), &b, newTestSociStore(t), db); err == nil {
+		t.Fatalf("expected an error importing an OCI layout without SOCI artifacts metadata")
+	}
+}
@@ -0,0 +1,186 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	refdocker "github.com/containerd/containerd/reference/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// OCILayout is an OCI image layout directory. It is a `content.Provider` of the images
+// in the layout, which can be given to `NewIndexBuilder`, and SOCI indices built for them
+// can be written back into the layout with `WriteSociIndex`.
+type OCILayout struct {
+	dir   string
+	index ocispec.Index
+	store *oci.Store
+}
+
+// OpenOCILayout opens the OCI image layout in directory `dir`.
+func OpenOCILayout(dir string) (*OCILayout, error) {
+	b, err := os.ReadFile(filepath.Join(dir, ocispec.ImageIndexFile))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read index of OCI layout %s: %w", dir, err)
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, fmt.Errorf("cannot parse index of OCI layout %s: %w", dir, err)
+	}
+	s, err := oci.New(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &OCILayout{dir: dir, index: index, store: s}, nil
+}
+
+// Resolve returns the image `ref` of the layout, which is either the name or the digest of an image
+// in the index of the layout. If `ref` is empty, the layout must contain a single image.
+func (l *OCILayout) Resolve(ref string) (images.Image, error) {
+	return resolveIndexImage(l.index, ref)
+}
+
+// ReaderAt returns a reader of the blob `desc` of the layout.
+func (l *OCILayout) ReaderAt(_ context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(l.dir, ocispec.ImageBlobsDir, desc.Digest.Algorithm().String(), desc.Digest.Encoded()))
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileReaderAt{File: f, size: fi.Size()}, nil
+}
+
+// WriteSociIndex writes a SOCI index written to `contentStore` by `soci.WriteSociIndex`, and its ztocs,
+// into the layout. The index is listed in the index of the layout, so it can be found as a referrer
+// of the image manifest it refers to.
+func (l *OCILayout) WriteSociIndex(ctx context.Context, indexWithMetadata *IndexWithMetadata, contentStore store.BasicStore) error {
+	for _, blob := range indexWithMetadata.Index.Blobs {
+		// ztocs are pushed to the content store by digest and size only.
+		rc, err := contentStore.Fetch(ctx, ocispec.Descriptor{Digest: blob.Digest, Size: blob.Size})
+		if err != nil {
+			return fmt.Errorf("cannot read ztoc %s: %w", blob.Digest, err)
+		}
+		err = l.store.Push(ctx, blob, rc)
+		rc.Close()
+		if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+			return fmt.Errorf("cannot write ztoc %s to OCI layout: %w", blob.Digest, err)
+		}
+	}
+
+	if indexWithMetadata.Index.MediaType == ocispec.MediaTypeImageManifest {
+		err := l.store.Push(ctx, defaultConfigDescriptor, bytes.NewReader(defaultConfigContent))
+		if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+			return fmt.Errorf("error creating OCI 1.0 empty config: %w", err)
+		}
+	}
+
+	manifest, err := MarshalIndex(indexWithMetadata.Index)
+	if err != nil {
+		return err
+	}
+	// the layout lists the manifests pushed with a manifest media type in its index.
+	desc := ocispec.Descriptor{
+		MediaType:    indexWithMetadata.Index.MediaType,
+		ArtifactType: SociIndexArtifactType,
+		Digest:       digest.FromBytes(manifest),
+		Size:         int64(len(manifest)),
+	}
+	err = l.store.Push(ctx, desc, bytes.NewReader(manifest))
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return fmt.Errorf("cannot write SOCI index to OCI layout: %w", err)
+	}
+	return nil
+}
+
+// fileReaderAt is a `content.ReaderAt` of a file.
+type fileReaderAt struct {
+	*os.File
+	size int64
+}
+
+func (r *fileReaderAt) Size() int64 {
+	return r.size
+}
+
+// resolveIndexImage returns the image `ref` of `index`, which is either the name or the digest of
+// one of its manifests. Names are matched against the image name and the reference name annotations,
+// and are normalized like docker references (e.g. alpine:latest is docker.io/library/alpine:latest).
+// If `ref` is empty, `index` must contain a single image, which may have several names.
+// SOCI indices in `index` aren't images.
+func resolveIndexImage(index ocispec.Index, ref string) (images.Image, error) {
+	var manifests []ocispec.Descriptor
+	for _, desc := range index.Manifests {
+		if desc.ArtifactType != SociIndexArtifactType {
+			manifests = append(manifests, desc)
+		}
+	}
+	if ref == "" {
+		if len(manifests) == 0 {
+			return images.Image{}, errors.New("no image found")
+		}
+		desc := manifests[0]
+		for _, m := range manifests[1:] {
+			if m.Digest != desc.Digest {
+				return images.Image{}, errors.New("found several images, the image needs to be specified")
+			}
+		}
+		return images.Image{Name: imageName(desc), Target: desc}, nil
+	}
+
+	refs := []string{ref}
+	if named, err := refdocker.ParseDockerRef(ref); err == nil {
+		refs = append(refs, named.String())
+	}
+	for _, desc := range manifests {
+		for _, r := range refs {
+			if r == desc.Digest.String() || r == desc.Annotations[images.AnnotationImageName] || r == desc.Annotations[ocispec.AnnotationRefName] {
+				return images.Image{Name: imageName(desc), Target: desc}, nil
+			}
+		}
+	}
+	return images.Image{}, fmt.Errorf("image %s not found", ref)
+}
+
+func imageName(desc ocispec.Descriptor) string {
+	if name, ok := desc.Annotations[images.AnnotationImageName]; ok {
+		return name
+	}
+	if name, ok := desc.Annotations[ocispec.AnnotationRefName]; ok {
+		return name
+	}
+	return desc.Digest.String()
+}
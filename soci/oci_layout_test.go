@@ -0,0 +1,248 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+func TestResolveIndexImage(t *testing.T) {
+	image1 := ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Digest:      digest.FromString("image1"),
+		Annotations: map[string]string{ocispec.AnnotationRefName: "latest"},
+	}
+	image2 := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("image2"),
+		Annotations: map[string]string{
+			images.AnnotationImageName: "docker.io/library/alpine:3",
+			ocispec.AnnotationRefName:  "3",
+		},
+	}
+	image2Tagged := image2
+	image2Tagged.Annotations = map[string]string{images.AnnotationImageName: "docker.io/library/alpine:latest"}
+	sociIndex := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: SociIndexArtifactType,
+		Digest:       digest.FromString("soci index"),
+	}
+
+	testCases := []struct {
+		name      string
+		manifests []ocispec.Descriptor
+		ref       string
+		expected  digest.Digest
+	}{
+		{
+			name:      "single image",
+			manifests: []ocispec.Descriptor{image1, sociIndex},
+			expected:  image1.Digest,
+		},
+		{
+			name:      "single image with several names",
+			manifests: []ocispec.Descriptor{image2, image2Tagged},
+			expected:  image2.Digest,
+		},
+		{
+			name:      "several images",
+			manifests: []ocispec.Descriptor{image1, image2},
+		},
+		{
+			name:      "reference name",
+			manifests: []ocispec.Descriptor{image1, image2},
+			ref:       "latest",
+			expected:  image1.Digest,
+		},
+		{
+			name:      "normalized image name",
+			manifests: []ocispec.Descriptor{image1, image2, image2Tagged},
+			ref:       "alpine:latest",
+			expected:  image2.Digest,
+		},
+		{
+			name:      "digest",
+			manifests: []ocispec.Descriptor{image1, image2},
+			ref:       image2.Digest.String(),
+			expected:  image2.Digest,
+		},
+		{
+			name:      "missing image",
+			manifests: []ocispec.Descriptor{image1, image2},
+			ref:       "missing",
+		},
+		{
+			name:      "SOCI index",
+			manifests: []ocispec.Descriptor{image1, sociIndex},
+			ref:       sociIndex.Digest.String(),
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			img, err := resolveIndexImage(ocispec.Index{Manifests: tc.manifests}, tc.ref)
+			if tc.expected == "" {
+				if err == nil {
+					t.Fatalf("expected error, got image %s", img.Target.Digest)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cannot resolve image: %v", err)
+			}
+			if img.Target.Digest != tc.expected {
+				t.Fatalf("expected image %s, got %s", tc.expected, img.Target.Digest)
+			}
+		})
+	}
+}
+
+// buildTestLayers returns `n` gzip compressed layers.
+func buildTestLayers(t *testing.T, n int) [][]byte {
+	var layers [][]byte
+	for i := 0; i < n; i++ {
+		layer, err := io.ReadAll(testutil.BuildTarGz([]testutil.TarEntry{
+			testutil.File(fmt.Sprintf("file%d", i), string(testutil.RandomByteData(100000))),
+		}, gzip.DefaultCompression))
+		if err != nil {
+			t.Fatalf("cannot build layer: %v", err)
+		}
+		layers = append(layers, layer)
+	}
+	return layers
+}
+
+func TestOCILayout(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	layoutStore, err := oci.New(dir)
+	if err != nil {
+		t.Fatalf("cannot create OCI layout: %v", err)
+	}
+	push := func(mediaType string, b []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		if err := layoutStore.Push(ctx, desc, bytes.NewReader(b)); err != nil {
+			t.Fatalf("cannot push %s to OCI layout: %v", desc.Digest, err)
+		}
+		return desc
+	}
+	var layers []ocispec.Descriptor
+	for _, layer := range buildTestLayers(t, 2) {
+		layers = append(layers, push(ocispec.MediaTypeImageLayerGzip, layer))
+	}
+	manifest, err := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    push(ocispec.MediaTypeImageConfig, []byte("{}")),
+		Layers:    layers,
+	})
+	if err != nil {
+		t.Fatalf("cannot marshal manifest: %v", err)
+	}
+	manifestDesc := push(ocispec.MediaTypeImageManifest, manifest)
+	if err := layoutStore.Tag(ctx, manifestDesc, "latest"); err != nil {
+		t.Fatalf("cannot tag image: %v", err)
+	}
+
+	layout, err := OpenOCILayout(dir)
+	if err != nil {
+		t.Fatalf("cannot open OCI layout: %v", err)
+	}
+	img, err := layout.Resolve("latest")
+	if err != nil {
+		t.Fatalf("cannot resolve image: %v", err)
+	}
+	if img.Target.Digest != manifestDesc.Digest {
+		t.Fatalf("unexpected image %s", img.Target.Digest)
+	}
+
+	sociStore, err := oci.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("cannot create soci store: %v", err)
+	}
+	blobStore := &store.SociStore{Store: sociStore}
+	artifactsDb, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	builder, err := NewIndexBuilder(layout, blobStore, artifactsDb, WithSpanSize(65536), WithMinLayerSize(0))
+	if err != nil {
+		t.Fatalf("cannot create index builder: %v", err)
+	}
+	index, err := builder.Build(ctx, img)
+	if err != nil {
+		t.Fatalf("cannot build index: %v", err)
+	}
+	if index.Index.Subject.Digest != manifestDesc.Digest {
+		t.Fatalf("unexpected index subject %s", index.Index.Subject.Digest)
+	}
+	if err := WriteSociIndex(ctx, index, blobStore, artifactsDb); err != nil {
+		t.Fatalf("cannot write index: %v", err)
+	}
+	if err := layout.WriteSociIndex(ctx, index, blobStore); err != nil {
+		t.Fatalf("cannot write index to OCI layout: %v", err)
+	}
+
+	// the index and the ztocs are in the layout, and the index is listed in the layout's index.
+	reopened, err := OpenOCILayout(dir)
+	if err != nil {
+		t.Fatalf("cannot reopen OCI layout: %v", err)
+	}
+	var indexDesc *ocispec.Descriptor
+	for _, desc := range reopened.index.Manifests {
+		if desc.ArtifactType == SociIndexArtifactType {
+			desc := desc
+			indexDesc = &desc
+		}
+	}
+	if indexDesc == nil {
+		t.Fatalf("SOCI index not listed in the index of the OCI layout")
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "blobs", "sha256", indexDesc.Digest.Encoded()))
+	if err != nil {
+		t.Fatalf("cannot read SOCI index from OCI layout: %v", err)
+	}
+	var written Index
+	if err := UnmarshalIndex(b, &written); err != nil {
+		t.Fatalf("cannot parse SOCI index: %v", err)
+	}
+	if written.Subject == nil || written.Subject.Digest != manifestDesc.Digest {
+		t.Fatalf("unexpected subject of SOCI index written to OCI layout: %v", written.Subject)
+	}
+	for _, blob := range written.Blobs {
+		if _, err := os.Stat(filepath.Join(dir, "blobs", "sha256", blob.Digest.Encoded())); err != nil {
+			t.Fatalf("ztoc %s not written to OCI layout: %v", blob.Digest, err)
+		}
+	}
+	if img, err := reopened.Resolve(""); err != nil || img.Target.Digest != manifestDesc.Digest {
+		t.Fatalf("the image can't be resolved after writing the SOCI index: %v", err)
+	}
+}
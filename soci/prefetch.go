@@ -0,0 +1,96 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// IndexAnnotationPrefetchList is the ztoc annotation holding the JSON-encoded prefetch list of the layer.
+const IndexAnnotationPrefetchList = "com.amazon.soci.prefetch-list"
+
+// PrefetchList is the list of the parts of a layer that are fetched when the layer is mounted,
+// before they are read. The prefetch list of a layer is carried by the `IndexAnnotationPrefetchList`
+// annotation of its ztoc, so that the blobs of a SOCI index are only ztocs.
+type PrefetchList struct {
+	// Paths are the paths of the files in the layer whose spans are prefetched, in order.
+	Paths []string `json:"paths,omitempty"`
+	// SpanIDs are the IDs of spans of the layer prefetched after those of `Paths`, in order.
+	SpanIDs []compression.SpanID `json:"spanIDs,omitempty"`
+}
+
+// Spans returns the IDs of the spans of the prefetch list in `zt`, in order and without duplicates.
+// Paths that aren't in `zt` are skipped.
+func (p *PrefetchList) Spans(zt *ztoc.Ztoc) ([]compression.SpanID, error) {
+	spans, err := zt.FileSpans(p.Paths)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[compression.SpanID]bool, len(spans))
+	for _, id := range spans {
+		seen[id] = true
+	}
+	for _, id := range p.SpanIDs {
+		if id > zt.MaxSpanID {
+			return nil, fmt.Errorf("span %d exceeds the max span ID %d of the ztoc", id, zt.MaxSpanID)
+		}
+		if !seen[id] {
+			seen[id] = true
+			spans = append(spans, id)
+		}
+	}
+	return spans, nil
+}
+
+// ZtocPrefetchList returns the prefetch list of the ztoc `ztocDesc`, or nil if it has none.
+func ZtocPrefetchList(ztocDesc ocispec.Descriptor) (*PrefetchList, error) {
+	data, ok := ztocDesc.Annotations[IndexAnnotationPrefetchList]
+	if !ok {
+		return nil, nil
+	}
+	var p PrefetchList
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		return nil, fmt.Errorf("cannot parse prefetch list of ztoc %s: %w", ztocDesc.Digest, err)
+	}
+	return &p, nil
+}
+
+// annotatePrefetchList annotates the ztoc `ztocDesc` of `toc` with the prefetch list of its layer.
+// The list has the paths of the build's prefetch list that are in the layer, and `ztocDesc` isn't
+// annotated if there are none.
+func (b *IndexBuilder) annotatePrefetchList(toc *ztoc.Ztoc, ztocDesc *ocispec.Descriptor) error {
+	var p PrefetchList
+	for _, path := range b.config.prefetchPaths {
+		if _, err := toc.GetMetadataEntry(path); err == nil {
+			p.Paths = append(p.Paths, path)
+		}
+	}
+	if len(p.Paths) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	ztocDesc.Annotations[IndexAnnotationPrefetchList] = string(data)
+	return nil
+}
@@ -0,0 +1,159 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestBuildPrefetchList(t *testing.T) {
+	ctx := context.Background()
+	cs, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("cannot create content store: %v", err)
+	}
+	push := func(mediaType string, b []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(b), desc); err != nil {
+			t.Fatalf("cannot write %s: %v", desc.Digest, err)
+		}
+		return desc
+	}
+	var layers []ocispec.Descriptor
+	for _, layer := range buildTestLayers(t, 2) {
+		layers = append(layers, push(ocispec.MediaTypeImageLayerGzip, layer))
+	}
+	manifest, err := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    push(ocispec.MediaTypeImageConfig, []byte("{}")),
+		Layers:    layers,
+	})
+	if err != nil {
+		t.Fatalf("cannot marshal manifest: %v", err)
+	}
+	manifestDesc := push(ocispec.MediaTypeImageManifest, manifest)
+
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	blobStore := newTestSociStore(t)
+	// build builds the index, and checks that every layer was built, reused or not, with the
+	// prefetch list annotation of the index.
+	build := func(reused bool) *Index {
+		var events []BuildEvent
+		builder, err := NewIndexBuilder(cs, blobStore, db, WithSpanSize(65536), WithMinLayerSize(0),
+			WithPrefetchPaths([]string{"missing", "file1"}), WithProgress(func(e BuildEvent) { events = append(events, e) }))
+		if err != nil {
+			t.Fatalf("cannot create index builder: %v", err)
+		}
+		built, err := builder.Build(ctx, images.Image{Name: "example.com/image:latest", Target: manifestDesc})
+		if err != nil {
+			t.Fatalf("cannot build index: %v", err)
+		}
+		for _, blob := range built.Index.Blobs {
+			var found bool
+			for _, e := range events {
+				if e.Ztoc.Digest != blob.Digest {
+					continue
+				}
+				if e.Type != BuildEventLayerBuilt || e.Reused != reused || !reflect.DeepEqual(e.Ztoc.Annotations, blob.Annotations) {
+					t.Fatalf("unexpected build event %+v of ztoc %v", e, blob)
+				}
+				found = true
+			}
+			if !found {
+				t.Fatalf("no build event of ztoc %s", blob.Digest)
+			}
+		}
+		return built.Index
+	}
+	index := build(false)
+	if reusedIndex := build(true); !reflect.DeepEqual(reusedIndex.Blobs, index.Blobs) {
+		t.Fatalf("unexpected ztocs %v of the index with reused ztocs, expected %v", reusedIndex.Blobs, index.Blobs)
+	}
+
+	if len(index.Blobs) != 2 {
+		t.Fatalf("expected 2 ztocs, got blobs %v", index.Blobs)
+	}
+	p, err := ZtocPrefetchList(index.Blobs[0])
+	if err != nil || p != nil {
+		t.Fatalf("layer without any file of the prefetch list has a prefetch list %v (err: %v)", p, err)
+	}
+	p, err = ZtocPrefetchList(index.Blobs[1])
+	if err != nil || p == nil {
+		t.Fatalf("expected a prefetch list for the layer, got %v (err: %v)", p, err)
+	}
+	if !reflect.DeepEqual(p.Paths, []string{"file1"}) {
+		t.Fatalf("unexpected prefetch list paths %v", p.Paths)
+	}
+
+	// consumers unaware of prefetch lists read every layer of the SOCI index manifest as a ztoc.
+	b, err := MarshalIndex(index)
+	if err != nil {
+		t.Fatalf("cannot marshal index: %v", err)
+	}
+	var indexManifest ocispec.Manifest
+	if err := json.Unmarshal(b, &indexManifest); err != nil {
+		t.Fatalf("cannot unmarshal index manifest: %v", err)
+	}
+	var zt *ztoc.Ztoc
+	for _, blob := range indexManifest.Layers {
+		if blob.MediaType != SociLayerMediaType {
+			t.Fatalf("unexpected media type %s of blob %s", blob.MediaType, blob.Digest)
+		}
+		rc, err := blobStore.Fetch(ctx, ocispec.Descriptor{Digest: blob.Digest, Size: blob.Size})
+		if err != nil {
+			t.Fatalf("cannot fetch ztoc %s: %v", blob.Digest, err)
+		}
+		zt, err = ztoc.Unmarshal(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("cannot parse blob %s as a ztoc: %v", blob.Digest, err)
+		}
+	}
+
+	expected, err := zt.FileSpans([]string{"file1"})
+	if err != nil {
+		t.Fatalf("cannot get file spans: %v", err)
+	}
+	p.SpanIDs = []compression.SpanID{0, zt.MaxSpanID}
+	spans, err := p.Spans(zt)
+	if err != nil {
+		t.Fatalf("cannot get prefetch list spans: %v", err)
+	}
+	// spans of the files come first, and spans are only listed once.
+	if !reflect.DeepEqual(spans[:len(expected)], expected) || len(spans) != int(zt.MaxSpanID)+1 {
+		t.Fatalf("unexpected prefetch list spans %v, expected %v first", spans, expected)
+	}
+	p.SpanIDs = []compression.SpanID{zt.MaxSpanID + 1}
+	if _, err := p.Spans(zt); err == nil {
+		t.Fatalf("expected an error for a span beyond the max span ID")
+	}
+}
@@ -0,0 +1,139 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var errBackwardRead = errors.New("cannot read backwards in a remote blob that doesn't support seeking")
+
+// sequentialReaderAt is a `content.ReaderAt` which may only support reading forwards.
+type sequentialReaderAt interface {
+	// sequential returns whether the blob can only be read forwards.
+	sequential() bool
+}
+
+// ResolveRemoteImage resolves the image `ref` in a registry with `resolver`. It returns the image and
+// a `content.Provider` reading its content from the registry, which can be given to `NewIndexBuilder`
+// to build SOCI indices for the image without pulling it.
+func ResolveRemoteImage(ctx context.Context, resolver remotes.Resolver, ref string) (images.Image, content.Provider, error) {
+	name, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return images.Image{}, nil, fmt.Errorf("cannot resolve %s: %w", ref, err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return images.Image{}, nil, fmt.Errorf("cannot fetch %s: %w", ref, err)
+	}
+	return images.Image{Name: name, Target: desc}, NewRemoteProvider(fetcher), nil
+}
+
+// NewRemoteProvider returns a `content.Provider` that reads blobs from a registry with `fetcher`.
+// Blobs aren't stored: they are streamed from the registry as they are read, which is cheap for
+// sequential reads. If the blob returned by `fetcher` supports seeking (as the blobs fetched from
+// registries by containerd do, with range requests), random reads are supported too.
+func NewRemoteProvider(fetcher remotes.Fetcher) content.Provider {
+	return &remoteProvider{fetcher: fetcher}
+}
+
+type remoteProvider struct {
+	fetcher remotes.Fetcher
+}
+
+func (p *remoteProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	rc, err := p.fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch %s: %w", desc.Digest, err)
+	}
+	return &remoteReaderAt{rc: rc, size: desc.Size}, nil
+}
+
+// remoteReaderAt reads a blob streamed from a registry at arbitrary offsets. Reads are served from
+// the stream where it is, so that sequential reads don't make new requests.
+type remoteReaderAt struct {
+	mu   sync.Mutex
+	rc   io.ReadCloser
+	size int64
+	// pos is the offset of the stream in the blob.
+	pos int64
+}
+
+func (r *remoteReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if err := r.seek(off); err != nil {
+		return 0, err
+	}
+	if remaining := r.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := io.ReadFull(r.rc, p)
+	r.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		return n, io.EOF
+	}
+	if err == nil && r.pos == r.size {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// seek moves the stream to `off`.
+func (r *remoteReaderAt) seek(off int64) error {
+	if off == r.pos {
+		return nil
+	}
+	if s, ok := r.rc.(io.Seeker); ok {
+		pos, err := s.Seek(off, io.SeekStart)
+		r.pos = pos
+		return err
+	}
+	if off < r.pos {
+		return errBackwardRead
+	}
+	n, err := io.CopyN(io.Discard, r.rc, off-r.pos)
+	r.pos += n
+	return err
+}
+
+// sequential returns whether the blob can only be read forwards, i.e. it doesn't support seeking.
+func (r *remoteReaderAt) sequential() bool {
+	_, ok := r.rc.(io.Seeker)
+	return !ok
+}
+
+func (r *remoteReaderAt) Size() int64 {
+	return r.size
+}
+
+func (r *remoteReaderAt) Close() error {
+	return r.rc.Close()
+}
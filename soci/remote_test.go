@@ -0,0 +1,244 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+// fakeRegistry serves blobs like a registry, and counts how many times each blob is fetched.
+// Blobs support seeking only if `seekable` is set.
+type fakeRegistry struct {
+	mu       sync.Mutex
+	blobs    map[digest.Digest][]byte
+	fetches  map[digest.Digest]int
+	ref      string
+	target   ocispec.Descriptor
+	seekable bool
+}
+
+// seekableBlob is a blob supporting range requests.
+type seekableBlob struct {
+	*bytes.Reader
+}
+
+func (seekableBlob) Close() error {
+	return nil
+}
+
+func (r *fakeRegistry) push(mediaType string, b []byte) ocispec.Descriptor {
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+	r.blobs[desc.Digest] = b
+	return desc
+}
+
+// pushImage pushes an image with gzip compressed `layers` tagged as `ref`, and returns the layer descriptors.
+func (r *fakeRegistry) pushImage(t *testing.T, ref string, layers [][]byte) []ocispec.Descriptor {
+	var descs []ocispec.Descriptor
+	for _, layer := range layers {
+		descs = append(descs, r.push(ocispec.MediaTypeImageLayerGzip, layer))
+	}
+	manifest, err := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    r.push(ocispec.MediaTypeImageConfig, []byte("{}")),
+		Layers:    descs,
+	})
+	if err != nil {
+		t.Fatalf("cannot marshal manifest: %v", err)
+	}
+	r.ref = ref
+	r.target = r.push(ocispec.MediaTypeImageManifest, manifest)
+	return descs
+}
+
+func (r *fakeRegistry) Resolve(_ context.Context, ref string) (string, ocispec.Descriptor, error) {
+	if ref != r.ref {
+		return "", ocispec.Descriptor{}, fmt.Errorf("%s not found", ref)
+	}
+	return ref, r.target, nil
+}
+
+func (r *fakeRegistry) Fetcher(context.Context, string) (remotes.Fetcher, error) {
+	return r, nil
+}
+
+func (r *fakeRegistry) Pusher(context.Context, string) (remotes.Pusher, error) {
+	return nil, errors.New("not supported")
+}
+
+func (r *fakeRegistry) Fetch(_ context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.blobs[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("blob %s not found", desc.Digest)
+	}
+	r.fetches[desc.Digest]++
+	if r.seekable {
+		return seekableBlob{bytes.NewReader(b)}, nil
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func newFakeRegistry(seekable bool) *fakeRegistry {
+	return &fakeRegistry{blobs: make(map[digest.Digest][]byte), fetches: make(map[digest.Digest]int), seekable: seekable}
+}
+
+func TestRemoteReaderAt(t *testing.T) {
+	data := testutil.RandomByteData(10000)
+	testCases := []struct {
+		name     string
+		seekable bool
+		reads    [][2]int64
+		err      error
+	}{
+		{
+			name:  "sequential reads",
+			reads: [][2]int64{{0, 1000}, {1000, 5000}, {6000, 4000}},
+		},
+		{
+			name:  "forward reads",
+			reads: [][2]int64{{100, 1000}, {5000, 10}, {9990, 100}},
+		},
+		{
+			name:  "backward reads",
+			reads: [][2]int64{{5000, 1000}, {0, 1000}},
+			err:   errBackwardRead,
+		},
+		{
+			name:     "backward reads of a seekable blob",
+			seekable: true,
+			reads:    [][2]int64{{9000, 1000}, {0, 1000}, {5000, 10}},
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			registry := newFakeRegistry(tc.seekable)
+			desc := registry.push(ocispec.MediaTypeImageLayer, data)
+			ra, err := NewRemoteProvider(registry).ReaderAt(context.Background(), desc)
+			if err != nil {
+				t.Fatalf("cannot fetch blob: %v", err)
+			}
+			defer ra.Close()
+			if ra.Size() != int64(len(data)) {
+				t.Fatalf("unexpected size %d", ra.Size())
+			}
+
+			for _, read := range tc.reads {
+				off, length := read[0], read[1]
+				p := make([]byte, length)
+				n, err := ra.ReadAt(p, off)
+				if err != nil && err != io.EOF {
+					if errors.Is(err, tc.err) {
+						return
+					}
+					t.Fatalf("cannot read %d bytes at %d: %v", length, off, err)
+				}
+				end := off + length
+				if end > int64(len(data)) {
+					end = int64(len(data))
+				}
+				if !bytes.Equal(p[:n], data[off:end]) {
+					t.Fatalf("unexpected data read at %d", off)
+				}
+			}
+			if tc.err != nil {
+				t.Fatalf("expected error %v", tc.err)
+			}
+		})
+	}
+}
+
+func TestBuildIndexFromRemoteImage(t *testing.T) {
+	for _, seekable := range []bool{true, false} {
+		seekable := seekable
+		t.Run(fmt.Sprintf("seekable=%t", seekable), func(t *testing.T) {
+			testBuildIndexFromRemoteImage(t, seekable)
+		})
+	}
+}
+
+// testBuildIndexFromRemoteImage builds an index of an image in a registry whose blobs
+// support seeking only if `seekable` is set. Each layer must be fetched once.
+func testBuildIndexFromRemoteImage(t *testing.T, seekable bool) {
+	registry := newFakeRegistry(seekable)
+	layers := registry.pushImage(t, "registry.example.com/image:latest", buildTestLayers(t, 3))
+
+	ctx := context.Background()
+	img, provider, err := ResolveRemoteImage(ctx, registry, registry.ref)
+	if err != nil {
+		t.Fatalf("cannot resolve remote image: %v", err)
+	}
+	if img.Target.Digest != registry.target.Digest {
+		t.Fatalf("unexpected image digest %s", img.Target.Digest)
+	}
+	if _, _, err := ResolveRemoteImage(ctx, registry, "registry.example.com/missing:latest"); err == nil {
+		t.Fatalf("expected error resolving a missing image")
+	}
+
+	artifactsDb, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	blobStore := memory.New()
+	builder, err := NewIndexBuilder(provider, blobStore, artifactsDb, WithSpanSize(65536), WithMinLayerSize(0))
+	if err != nil {
+		t.Fatalf("cannot create index builder: %v", err)
+	}
+	index, err := builder.Build(ctx, img)
+	if err != nil {
+		t.Fatalf("cannot build index of remote image: %v", err)
+	}
+	if index.Index.Subject.Digest != registry.target.Digest {
+		t.Fatalf("unexpected index subject %s", index.Index.Subject.Digest)
+	}
+	if len(index.Index.Blobs) != len(layers) {
+		t.Fatalf("expected %d ztocs, got %d", len(layers), len(index.Index.Blobs))
+	}
+	for i, blob := range index.Index.Blobs {
+		if blob.Annotations[IndexAnnotationImageLayerDigest] != layers[i].Digest.String() {
+			t.Fatalf("unexpected layer of ztoc %d: %s", i, blob.Annotations[IndexAnnotationImageLayerDigest])
+		}
+		if exists, err := blobStore.Exists(ctx, ocispec.Descriptor{Digest: blob.Digest, Size: blob.Size}); err != nil || !exists {
+			t.Fatalf("ztoc %s not stored", blob.Digest)
+		}
+		entry, err := artifactsDb.GetArtifactEntry(blob.Digest.String())
+		if err != nil {
+			t.Fatalf("no artifact entry for ztoc %s: %v", blob.Digest, err)
+		}
+		if entry.OriginalDigest != layers[i].Digest.String() {
+			t.Fatalf("unexpected layer of artifact entry %s", entry.OriginalDigest)
+		}
+		if n := registry.fetches[layers[i].Digest]; n != 1 {
+			t.Fatalf("layer %s fetched %d times", layers[i].Digest, n)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// SignatureArtifactType is the artifact type of a detached signature of a SOCI index.
+	// Signatures are OCI manifests whose subject is the SOCI index manifest.
+	SignatureArtifactType = "application/vnd.amazon.soci.signature.v1"
+
+	// SignatureAnnotation is the annotation of a signature manifest with the base64 encoded signature
+	// of the digest of its subject.
+	SignatureAnnotation = "com.amazon.soci.signature"
+)
+
+var (
+	// ErrNoIndexSignature is returned when a SOCI index has no signature.
+	ErrNoIndexSignature = errors.New("SOCI index has no signature")
+	// ErrInvalidIndexSignature is returned when no signature of a SOCI index is valid for the trusted keys.
+	ErrInvalidIndexSignature = errors.New("SOCI index has no valid signature")
+)
+
+// LoadSigningKey reads a PEM encoded PKCS #8 private key (ed25519, ECDSA or RSA) from `path`,
+// e.g. as generated by `openssl genpkey -algorithm ed25519`.
+func LoadSigningKey(path string) (crypto.Signer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse private key %s: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T in %s", key, path)
+	}
+	return signer, nil
+}
+
+// LoadVerificationKeys reads PEM encoded PKIX public keys from `paths`,
+// e.g. as generated by `openssl pkey -pubout`.
+func LoadVerificationKeys(paths []string) ([]crypto.PublicKey, error) {
+	keys := make([]crypto.PublicKey, 0, len(paths))
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data in %s", path)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse public key %s: %w", path, err)
+		}
+		switch key.(type) {
+		case ed25519.PublicKey, *ecdsa.PublicKey, *rsa.PublicKey:
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T in %s", key, path)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// SignIndex signs the digest of the SOCI index manifest `indexDesc` with `signer`, and returns
+// the signature manifest to push with the SOCI index.
+func SignIndex(signer crypto.Signer, indexDesc ocispec.Descriptor) ([]byte, error) {
+	payload := []byte(indexDesc.Digest.String())
+	var (
+		sig []byte
+		err error
+	)
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		sig, err = signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	} else {
+		h := sha256.Sum256(payload)
+		sig, err = signer.Sign(rand.Reader, h[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot sign SOCI index %s: %w", indexDesc.Digest, err)
+	}
+
+	subject := ocispec.Descriptor{
+		MediaType: indexDesc.MediaType,
+		Digest:    indexDesc.Digest,
+		Size:      indexDesc.Size,
+	}
+	manifest := ocispec.Manifest{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: SignatureArtifactType,
+		Config:       ocispec.DescriptorEmptyJSON,
+		Layers:       []ocispec.Descriptor{ocispec.DescriptorEmptyJSON},
+		Subject:      &subject,
+		Annotations: map[string]string{
+			SignatureAnnotation: base64.StdEncoding.EncodeToString(sig),
+		},
+	}
+	manifest.SchemaVersion = 2
+	return json.Marshal(manifest)
+}
+
+// VerifyIndexSignature checks that the signature manifest `b` holds a signature of the SOCI index
+// `indexDigest` by one of `keys`. It returns ErrInvalidIndexSignature if it doesn't.
+func VerifyIndexSignature(b []byte, indexDigest digest.Digest, keys []crypto.PublicKey) error {
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return fmt.Errorf("%w: cannot parse signature manifest: %v", ErrInvalidIndexSignature, err)
+	}
+	if manifest.ArtifactType != SignatureArtifactType {
+		return fmt.Errorf("%w: unexpected artifact type %q", ErrInvalidIndexSignature, manifest.ArtifactType)
+	}
+	if manifest.Subject == nil || manifest.Subject.Digest != indexDigest {
+		return fmt.Errorf("%w: signature isn't for SOCI index %s", ErrInvalidIndexSignature, indexDigest)
+	}
+	sig, err := base64.StdEncoding.DecodeString(manifest.Annotations[SignatureAnnotation])
+	if err != nil || len(sig) == 0 {
+		return fmt.Errorf("%w: signature manifest has no signature", ErrInvalidIndexSignature)
+	}
+
+	payload := []byte(indexDigest.String())
+	h := sha256.Sum256(payload)
+	for _, key := range keys {
+		var ok bool
+		switch key := key.(type) {
+		case ed25519.PublicKey:
+			ok = ed25519.Verify(key, payload, sig)
+		case *ecdsa.PublicKey:
+			ok = ecdsa.VerifyASN1(key, h[:], sig)
+		case *rsa.PublicKey:
+			ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], sig) == nil
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: signature of SOCI index %s doesn't match any trusted key", ErrInvalidIndexSignature, indexDigest)
+}
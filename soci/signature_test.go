@@ -0,0 +1,157 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// writeTestKeyPair writes `key` and its public key as PEM files to `dir`, and returns their paths.
+func writeTestKeyPair(t *testing.T, dir, name string, key crypto.Signer) (string, string) {
+	priv, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("cannot marshal private key: %v", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("cannot marshal public key: %v", err)
+	}
+	privPath := filepath.Join(dir, name+".key")
+	pubPath := filepath.Join(dir, name+".pub")
+	if err := os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: priv}), 0600); err != nil {
+		t.Fatalf("cannot write private key: %v", err)
+	}
+	if err := os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0644); err != nil {
+		t.Fatalf("cannot write public key: %v", err)
+	}
+	return privPath, pubPath
+}
+
+func TestIndexSignature(t *testing.T) {
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("index"),
+		Size:      5,
+	}
+	testCases := []struct {
+		name        string
+		key         crypto.Signer
+		trusted     []crypto.Signer
+		indexDigest digest.Digest
+		expectedErr error
+	}{
+		{
+			name:        "ed25519",
+			key:         ed25519Key,
+			trusted:     []crypto.Signer{ed25519Key},
+			indexDigest: indexDesc.Digest,
+		},
+		{
+			name:        "ecdsa",
+			key:         ecdsaKey,
+			trusted:     []crypto.Signer{ecdsaKey},
+			indexDigest: indexDesc.Digest,
+		},
+		{
+			name:        "rsa",
+			key:         rsaKey,
+			trusted:     []crypto.Signer{rsaKey},
+			indexDigest: indexDesc.Digest,
+		},
+		{
+			name:        "one of several trusted keys",
+			key:         ecdsaKey,
+			trusted:     []crypto.Signer{otherKey, ecdsaKey},
+			indexDigest: indexDesc.Digest,
+		},
+		{
+			name:        "untrusted key",
+			key:         ed25519Key,
+			trusted:     []crypto.Signer{otherKey, rsaKey},
+			indexDigest: indexDesc.Digest,
+			expectedErr: ErrInvalidIndexSignature,
+		},
+		{
+			name:        "signature of another index",
+			key:         ed25519Key,
+			trusted:     []crypto.Signer{ed25519Key},
+			indexDigest: digest.FromString("another index"),
+			expectedErr: ErrInvalidIndexSignature,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			signingKeyPath, _ := writeTestKeyPair(t, dir, "signing", tc.key)
+			var trustedPaths []string
+			for i, key := range tc.trusted {
+				_, pubPath := writeTestKeyPair(t, dir, fmt.Sprintf("trusted%d", i), key)
+				trustedPaths = append(trustedPaths, pubPath)
+			}
+
+			signer, err := LoadSigningKey(signingKeyPath)
+			if err != nil {
+				t.Fatalf("cannot load signing key: %v", err)
+			}
+			keys, err := LoadVerificationKeys(trustedPaths)
+			if err != nil {
+				t.Fatalf("cannot load verification keys: %v", err)
+			}
+			manifest, err := SignIndex(signer, indexDesc)
+			if err != nil {
+				t.Fatalf("cannot sign index: %v", err)
+			}
+			err = VerifyIndexSignature(manifest, tc.indexDigest, keys)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("unexpected verification error, expected %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
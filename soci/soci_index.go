@@ -23,7 +23,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
 	"strconv"
 	"sync"
 	"time"
@@ -37,6 +36,7 @@ import (
 	"github.com/containerd/log"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/semaphore"
 
 	orascontent "oras.land/oras-go/v2/content"
 	"oras.land/oras-go/v2/errdef"
@@ -202,10 +202,20 @@ func GetIndexDescriptorCollection(ctx context.Context, cs content.Store, artifac
 
 type buildConfig struct {
 	spanSize            int64
+	spanStrategy        ztoc.SpanStrategy
+	spanTolerance       float64
+	ztocVersion         ztoc.Version
 	minLayerSize        int64
 	buildToolIdentifier string
+	created             time.Time
 	artifactsDb         *ArtifactsDb
 	platform            ocispec.Platform
+	forceRebuild        bool
+	maxConcurrency      int64
+	tempDir             string
+	diskBudget          int64
+	prefetchPaths       []string
+	progress            func(BuildEvent)
 }
 
 // BuildOption specifies a config change to build soci indices.
@@ -219,6 +229,38 @@ func WithSpanSize(spanSize int64) BuildOption {
 	}
 }
 
+// WithSpanStrategy specifies how spans are placed in layers.
+func WithSpanStrategy(strategy ztoc.SpanStrategy) BuildOption {
+	return func(c *buildConfig) error {
+		if _, err := ztoc.ParseSpanStrategy(string(strategy)); err != nil {
+			return err
+		}
+		c.spanStrategy = strategy
+		return nil
+	}
+}
+
+// WithSpanTolerance specifies the fraction of the span size by which the adaptive
+// span strategy can move a span boundary to align it with a file boundary.
+func WithSpanTolerance(tolerance float64) BuildOption {
+	return func(c *buildConfig) error {
+		c.spanTolerance = tolerance
+		return nil
+	}
+}
+
+// WithZtocVersion specifies the version of the ztocs to build.
+func WithZtocVersion(version ztoc.Version) BuildOption {
+	return func(c *buildConfig) error {
+		v, err := ztoc.ParseVersion(string(version))
+		if err != nil {
+			return err
+		}
+		c.ztocVersion = v
+		return nil
+	}
+}
+
 // WithMinLayerSize specifies min layer size to build a ztoc for a layer.
 func WithMinLayerSize(minLayerSize int64) BuildOption {
 	return func(c *buildConfig) error {
@@ -235,6 +277,16 @@ func WithBuildToolIdentifier(tool string) BuildOption {
 	}
 }
 
+// WithCreated specifies the creation time recorded in the `org.opencontainers.image.created`
+// annotation of soci indices. By default no creation time is recorded, so that soci indices
+// built from the same image with the same options are identical.
+func WithCreated(created time.Time) BuildOption {
+	return func(c *buildConfig) error {
+		c.created = created
+		return nil
+	}
+}
+
 // WithPlatform specifies platform used to build soci indices.
 func WithPlatform(platform ocispec.Platform) BuildOption {
 	return func(c *buildConfig) error {
@@ -251,23 +303,84 @@ func WithArtifactsDb(db *ArtifactsDb) BuildOption {
 	}
 }
 
+// WithForceRebuild specifies whether to build ztocs of layers which already have a ztoc
+// with the same span size in the artifacts database, instead of reusing it.
+func WithForceRebuild(forceRebuild bool) BuildOption {
+	return func(c *buildConfig) error {
+		c.forceRebuild = forceRebuild
+		return nil
+	}
+}
+
+// WithMaxConcurrency specifies the maximum number of layers whose ztocs are built at the same time.
+// If it's 0 (the default), ztocs of all layers are built at the same time.
+func WithMaxConcurrency(maxConcurrency int64) BuildOption {
+	return func(c *buildConfig) error {
+		if maxConcurrency < 0 {
+			return fmt.Errorf("max concurrency must not be negative, got: %d", maxConcurrency)
+		}
+		c.maxConcurrency = maxConcurrency
+		return nil
+	}
+}
+
+// WithTempDir specifies the directory of the temp files that layers are copied to when their ztocs
+// can't be built while streaming them (e.g. with the adaptive span strategy).
+// By default, it's the default directory for temporary files.
+func WithTempDir(dir string) BuildOption {
+	return func(c *buildConfig) error {
+		c.tempDir = dir
+		return nil
+	}
+}
+
+// WithDiskBudget specifies the maximum number of bytes of layers copied to temp files at the same time.
+// Builds wait for room in the budget before copying a layer, and a layer larger than the budget waits
+// for the whole budget. If it's 0 (the default), there is no limit.
+func WithDiskBudget(diskBudget int64) BuildOption {
+	return func(c *buildConfig) error {
+		if diskBudget < 0 {
+			return fmt.Errorf("disk budget must not be negative, got: %d", diskBudget)
+		}
+		c.diskBudget = diskBudget
+		return nil
+	}
+}
+
+// WithPrefetchPaths specifies the paths of the files fetched when a layer is mounted, in order.
+// Every layer with some of the files gets a prefetch list with them in the index.
+func WithPrefetchPaths(paths []string) BuildOption {
+	return func(c *buildConfig) error {
+		c.prefetchPaths = paths
+		return nil
+	}
+}
+
 // IndexBuilder creates soci indices.
 type IndexBuilder struct {
-	contentStore content.Store
+	contentStore content.Provider
 	blobStore    orascontent.Storage
 	ArtifactsDb  *ArtifactsDb
 	config       *buildConfig
 	ztocBuilder  *ztoc.Builder
+	diskBudget   *semaphore.Weighted
+	progressMu   sync.Mutex
 }
 
 // NewIndexBuilder returns an `IndexBuilder` that is used to create soci indices.
-func NewIndexBuilder(contentStore content.Store, blobStore orascontent.Storage, artifactsDb *ArtifactsDb, opts ...BuildOption) (*IndexBuilder, error) {
+// Images and layers are read from `contentStore`, which is usually containerd's content store,
+// or a provider returned by `NewRemoteProvider` to read them from a registry.
+func NewIndexBuilder(contentStore content.Provider, blobStore orascontent.Storage, artifactsDb *ArtifactsDb, opts ...BuildOption) (*IndexBuilder, error) {
 	defaultPlatform := platforms.DefaultSpec()
 	config := &buildConfig{
 		spanSize:            defaultSpanSize,
+		spanStrategy:        ztoc.SpanStrategyFixed,
+		spanTolerance:       ztoc.DefaultSpanTolerance,
+		ztocVersion:         ztoc.DefaultVersion,
 		minLayerSize:        defaultMinLayerSize,
 		buildToolIdentifier: defaultBuildToolIdentifier,
 		platform:            defaultPlatform,
+		progress:            PrintProgress,
 	}
 
 	for _, opt := range opts {
@@ -276,13 +389,17 @@ func NewIndexBuilder(contentStore content.Store, blobStore orascontent.Storage,
 		}
 	}
 
-	return &IndexBuilder{
+	builder := &IndexBuilder{
 		contentStore: contentStore,
 		blobStore:    blobStore,
 		ArtifactsDb:  artifactsDb,
 		config:       config,
 		ztocBuilder:  ztoc.NewBuilder(config.buildToolIdentifier),
-	}, nil
+	}
+	if config.diskBudget > 0 {
+		builder.diskBudget = semaphore.NewWeighted(config.diskBudget)
+	}
+	return builder, nil
 }
 
 // Build builds a soci index for `img` and return the index with metadata.
@@ -303,14 +420,30 @@ func (b *IndexBuilder) Build(ctx context.Context, img images.Image) (*IndexWithM
 	sociLayersDesc := make([]*ocispec.Descriptor, len(manifest.Layers))
 	errChan := make(chan error)
 	go func() {
-		var wg sync.WaitGroup
+		var (
+			wg  sync.WaitGroup
+			smp *semaphore.Weighted
+		)
+		if b.config.maxConcurrency > 0 {
+			smp = semaphore.NewWeighted(b.config.maxConcurrency)
+		}
 		for i, l := range manifest.Layers {
+			if smp != nil {
+				if err := smp.Acquire(ctx, 1); err != nil {
+					errChan <- err
+					break
+				}
+			}
 			wg.Add(1)
 			go func(i int, l ocispec.Descriptor) {
 				defer wg.Done()
+				if smp != nil {
+					defer smp.Release(1)
+				}
 				desc, err := b.buildSociLayer(ctx, l)
 				if err != nil {
 					if err != errUnsupportedLayerFormat {
+						b.emit(BuildEvent{Type: BuildEventLayerFailed, Layer: l, Err: err})
 						errChan <- err
 					}
 					return
@@ -355,6 +488,9 @@ func (b *IndexBuilder) Build(ctx context.Context, img images.Image) (*IndexWithM
 	annotations := map[string]string{
 		IndexAnnotationBuildToolIdentifier: b.config.buildToolIdentifier,
 	}
+	if !b.config.created.IsZero() {
+		annotations[ocispec.AnnotationCreated] = b.config.created.UTC().Format(time.RFC3339)
+	}
 
 	refers := &ocispec.Descriptor{
 		MediaType: imgManifestDesc.MediaType,
@@ -377,9 +513,10 @@ func (b *IndexBuilder) buildSociLayer(ctx context.Context, desc ocispec.Descript
 	if !images.IsLayerType(desc.MediaType) {
 		return nil, errNotLayerType
 	}
+	b.emit(BuildEvent{Type: BuildEventLayerStarted, Layer: desc})
 	// check if we need to skip building the zTOC
 	if skip, reason := skipBuildingZtoc(desc, b.config); skip {
-		fmt.Printf("ztoc skipped - layer %s (%s) %s\n", desc.Digest, desc.MediaType, reason)
+		b.emit(BuildEvent{Type: BuildEventLayerSkipped, Layer: desc, Reason: reason})
 		return nil, nil
 	}
 
@@ -397,11 +534,24 @@ func (b *IndexBuilder) buildSociLayer(ctx context.Context, desc ocispec.Descript
 	}
 
 	if !b.ztocBuilder.CheckCompressionAlgorithm(compressionAlgo) {
-		fmt.Printf("ztoc skipped - layer %s (%s) is compressed in an unsupported format. expect: [tar, gzip, unknown] but got %q\n",
-			desc.Digest, desc.MediaType, compressionAlgo)
+		b.emit(BuildEvent{
+			Type:   BuildEventLayerSkipped,
+			Layer:  desc,
+			Reason: fmt.Sprintf("is compressed in an unsupported format. expect: [tar, gzip, zstd, unknown] but got %q", compressionAlgo),
+		})
 		return nil, errUnsupportedLayerFormat
 	}
 
+	if !b.config.forceRebuild {
+		ztocDesc, err := b.reuseZtoc(ctx, desc)
+		if err != nil {
+			return nil, err
+		}
+		if ztocDesc != nil {
+			return ztocDesc, nil
+		}
+	}
+
 	ra, err := b.contentStore.ReaderAt(ctx, desc)
 	if err != nil {
 		return nil, err
@@ -409,23 +559,48 @@ func (b *IndexBuilder) buildSociLayer(ctx context.Context, desc ocispec.Descript
 	defer ra.Close()
 	sr := io.NewSectionReader(ra, 0, desc.Size)
 
-	tmpFile, err := os.CreateTemp("", "tmp.*")
-	if err != nil {
-		return nil, err
+	opts := []ztoc.BuildOption{
+		ztoc.WithCompression(compressionAlgo),
+		ztoc.WithSpanStrategy(b.config.spanStrategy),
+		ztoc.WithSpanTolerance(b.config.spanTolerance),
+		ztoc.WithZtocVersion(b.config.ztocVersion),
+		ztoc.WithTempDir(b.config.tempDir),
+		ztoc.WithTempFileGate(b.tempFileGate(ctx, desc.Size)),
+	}
+	if s, ok := ra.(sequentialReaderAt); ok && s.sequential() {
+		// embedded TOCs are read from the end of the layer, after which
+		// a layer that can only be read forwards can't be read from the start.
+		opts = append(opts, ztoc.WithEmbeddedTOC(false))
+	}
+	toc, err := b.ztocBuilder.BuildZtocFromReader(sr, b.config.spanSize, opts...)
+	if errors.Is(err, ztoc.ErrVersionTooOld) {
+		// a ztoc of this version would be read incorrectly by the snapshotter.
+		b.emit(BuildEvent{
+			Type:   BuildEventLayerSkipped,
+			Layer:  desc,
+			Reason: fmt.Sprintf("needs a newer ztoc version: %v", err),
+		})
+		return nil, nil
 	}
-	defer os.Remove(tmpFile.Name())
-	n, err := io.Copy(tmpFile, sr)
 	if err != nil {
 		return nil, err
 	}
-	if n != desc.Size {
-		return nil, errors.New("the size of the temp file doesn't match that of the layer")
+	if int64(toc.CompressedArchiveSize) != desc.Size {
+		return nil, errors.New("the size of the layer read doesn't match that of the layer descriptor")
 	}
-
-	toc, err := b.ztocBuilder.BuildZtoc(tmpFile.Name(), b.config.spanSize, ztoc.WithCompression(compressionAlgo))
+	singleFrame, err := isSingleFrameZstd(toc)
 	if err != nil {
 		return nil, err
 	}
+	if singleFrame {
+		// the whole layer would be fetched on first access, like without a ztoc.
+		b.emit(BuildEvent{
+			Type:   BuildEventLayerSkipped,
+			Layer:  desc,
+			Reason: "is a single zstd frame, which can't be lazily loaded. Compress the layer in multiple zstd frames",
+		})
+		return nil, nil
+	}
 
 	ztocReader, ztocDesc, err := ztoc.Marshal(toc)
 	if err != nil {
@@ -447,22 +622,95 @@ func (b *IndexBuilder) buildSociLayer(ctx context.Context, desc ocispec.Descript
 		Location:       desc.Digest.String(),
 		MediaType:      SociLayerMediaType,
 		CreatedAt:      time.Now(),
+		SpanSize:       b.fixedSpanSize(),
+		ZtocVersion:    string(toc.Version),
 	}
 	err = b.ArtifactsDb.WriteArtifactEntry(entry)
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Printf("layer %s -> ztoc %s\n", desc.Digest, ztocDesc.Digest)
-
 	ztocDesc.MediaType = SociLayerMediaType
 	ztocDesc.Annotations = map[string]string{
 		IndexAnnotationImageLayerMediaType: desc.MediaType,
 		IndexAnnotationImageLayerDigest:    desc.Digest.String(),
 	}
+	if err := b.annotatePrefetchList(toc, &ztocDesc); err != nil {
+		return nil, err
+	}
+	b.emit(BuildEvent{Type: BuildEventLayerBuilt, Layer: desc, Ztoc: ztocDesc, SpanCount: int(toc.MaxSpanID) + 1})
 	return &ztocDesc, err
 }
 
+// tempFileGate returns a function that waits for room for a temp file of `size` bytes in the
+// disk budget of `b`, or nil if there is no disk budget.
+func (b *IndexBuilder) tempFileGate(ctx context.Context, size int64) func() (func(), error) {
+	if b.diskBudget == nil {
+		return nil
+	}
+	if size > b.config.diskBudget {
+		size = b.config.diskBudget
+	}
+	return func() (func(), error) {
+		if err := b.diskBudget.Acquire(ctx, size); err != nil {
+			return nil, err
+		}
+		return func() { b.diskBudget.Release(size) }, nil
+	}
+}
+
+// reuseZtoc returns the descriptor of a ztoc of the layer `desc` built by a previous build with the
+// same span size and ztoc version, or nil if there is none. A ztoc is reused only if it's still in
+// the blob store.
+func (b *IndexBuilder) reuseZtoc(ctx context.Context, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	spanSize := b.fixedSpanSize()
+	if spanSize == 0 {
+		return nil, nil
+	}
+	entry, err := b.ArtifactsDb.GetLayerArtifactEntry(desc.Digest.String(), spanSize, b.config.ztocVersion)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	dgst, err := digest.Parse(entry.Digest)
+	if err != nil {
+		return nil, err
+	}
+	// ztocs are pushed to the blob store by digest and size only.
+	ztocDesc := ocispec.Descriptor{Digest: dgst, Size: entry.Size}
+	exists, err := b.blobStore.Exists(ctx, ztocDesc)
+	if err != nil || !exists {
+		return nil, err
+	}
+	rc, err := b.blobStore.Fetch(ctx, ztocDesc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	toc, err := ztoc.Unmarshal(rc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse ztoc %s: %w", dgst, err)
+	}
+	ztocDesc.MediaType = SociLayerMediaType
+	ztocDesc.Annotations = map[string]string{
+		IndexAnnotationImageLayerMediaType: desc.MediaType,
+		IndexAnnotationImageLayerDigest:    desc.Digest.String(),
+	}
+	if err := b.annotatePrefetchList(toc, &ztocDesc); err != nil {
+		return nil, err
+	}
+	b.emit(BuildEvent{Type: BuildEventLayerBuilt, Layer: desc, Ztoc: ztocDesc, SpanCount: int(toc.MaxSpanID) + 1, Reused: true})
+	return &ztocDesc, nil
+}
+
+// fixedSpanSize returns the span size of the ztocs built by `b`, or 0 if their spans
+// aren't all of the same size, so they are neither recorded nor looked up by span size.
+func (b *IndexBuilder) fixedSpanSize() int64 {
+	if b.config.spanStrategy != ztoc.SpanStrategyFixed {
+		return 0
+	}
+	return b.config.spanSize
+}
+
 // NewIndex returns a new index.
 func NewIndex(blobs []ocispec.Descriptor, subject *ocispec.Descriptor, annotations map[string]string) *Index {
 	return &Index{
@@ -494,8 +742,23 @@ func skipBuildingZtoc(desc ocispec.Descriptor, cfg *buildConfig) (bool, string)
 	return false, ""
 }
 
+// isSingleFrameZstd reports whether `toc` is the ztoc of a zstd layer larger than a span that
+// has a single span. Spans of zstd layers only start at frame boundaries, so this is the case of
+// layers compressed in a single zstd frame, like the ones written by default by most tools.
+func isSingleFrameZstd(toc *ztoc.Ztoc) (bool, error) {
+	if toc.CompressionAlgorithm != compression.Zstd || toc.MaxSpanID > 0 {
+		return false, nil
+	}
+	zinfo, err := toc.Zinfo()
+	if err != nil {
+		return false, err
+	}
+	defer zinfo.Close()
+	return toc.UncompressedArchiveSize > zinfo.SpanSize(), nil
+}
+
 // GetImageManifestDescriptor gets the descriptor of image manifest
-func GetImageManifestDescriptor(ctx context.Context, cs content.Store, imageTarget ocispec.Descriptor, platform platforms.MatchComparer) (*ocispec.Descriptor, error) {
+func GetImageManifestDescriptor(ctx context.Context, cs content.Provider, imageTarget ocispec.Descriptor, platform platforms.MatchComparer) (*ocispec.Descriptor, error) {
 	if images.IsIndexType(imageTarget.MediaType) {
 		manifests, err := images.Children(ctx, cs, imageTarget)
 		if err != nil {
@@ -555,24 +818,8 @@ func WriteSociIndex(ctx context.Context, indexWithMetadata *IndexWithMetadata, c
 
 	log.G(ctx).WithField("digest", dgst.String()).Debugf("soci index has been written")
 
-	err = store.LabelGCRoot(ctx, contentStore, desc)
-	if err != nil {
-		return fmt.Errorf("cannot apply garbage collection label to index %s: %w", desc.Digest.String(), err)
-	}
-	err = store.LabelGCRefContent(ctx, contentStore, desc, "config", defaultConfigDescriptor.Digest.String())
-	if err != nil {
-		return fmt.Errorf("cannot apply garbage collection label to index %s referencing default config: %w", desc.Digest.String(), err)
-	}
-
-	var allErr error
-	for i, blob := range indexWithMetadata.Index.Blobs {
-		err = store.LabelGCRefContent(ctx, contentStore, desc, "ztoc."+strconv.Itoa(i), blob.Digest.String())
-		if err != nil {
-			errors.Join(allErr, err)
-		}
-	}
-	if allErr != nil {
-		return fmt.Errorf("cannot apply one or more garbage collection labels to index %s: %w", desc.Digest.String(), allErr)
+	if err := labelSociIndex(ctx, contentStore, desc, indexWithMetadata.Index); err != nil {
+		return err
 	}
 
 	refers := indexWithMetadata.Index.Subject
@@ -595,3 +842,28 @@ func WriteSociIndex(ctx context.Context, indexWithMetadata *IndexWithMetadata, c
 	}
 	return artifactsDb.WriteArtifactEntry(entry)
 }
+
+// labelSociIndex labels the SOCI index `desc` in `contentStore` as a garbage collection root
+// referencing its config and ztocs.
+func labelSociIndex(ctx context.Context, contentStore store.Store, desc ocispec.Descriptor, index *Index) error {
+	err := store.LabelGCRoot(ctx, contentStore, desc)
+	if err != nil {
+		return fmt.Errorf("cannot apply garbage collection label to index %s: %w", desc.Digest.String(), err)
+	}
+	err = store.LabelGCRefContent(ctx, contentStore, desc, "config", defaultConfigDescriptor.Digest.String())
+	if err != nil {
+		return fmt.Errorf("cannot apply garbage collection label to index %s referencing default config: %w", desc.Digest.String(), err)
+	}
+
+	var allErr error
+	for i, blob := range index.Blobs {
+		err = store.LabelGCRefContent(ctx, contentStore, desc, "ztoc."+strconv.Itoa(i), blob.Digest.String())
+		if err != nil {
+			allErr = errors.Join(allErr, err)
+		}
+	}
+	if allErr != nil {
+		return fmt.Errorf("cannot apply one or more garbage collection labels to index %s: %w", desc.Digest.String(), allErr)
+	}
+	return nil
+}
@@ -18,13 +18,22 @@ package soci
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
+	"io"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/images"
 	"github.com/google/go-cmp/cmp"
+	"github.com/klauspost/compress/zstd"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"oras.land/oras-go/v2/content/memory"
@@ -229,6 +238,438 @@ func TestBuildSociIndexWithLimits(t *testing.T) {
 	}
 }
 
+func TestBuildSociLayerReusesZtoc(t *testing.T) {
+	testcases := []struct {
+		name    string
+		opts    []BuildOption
+		rebuilt bool
+	}{
+		{
+			name: "same span size",
+			opts: []BuildOption{WithSpanSize(65536)},
+		},
+		{
+			name:    "force rebuild",
+			opts:    []BuildOption{WithSpanSize(65536), WithForceRebuild(true)},
+			rebuilt: true,
+		},
+		{
+			name:    "different span size",
+			opts:    []BuildOption{WithSpanSize(32768)},
+			rebuilt: true,
+		},
+		{
+			name:    "adaptive spans",
+			opts:    []BuildOption{WithSpanSize(65536), WithSpanStrategy(ztoc.SpanStrategyAdaptive)},
+			rebuilt: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			registry := newFakeRegistry(true)
+			desc := registry.push(ocispec.MediaTypeImageLayerGzip, buildTestLayers(t, 1)[0])
+			blobStore := memory.New()
+			artifactsDb, err := newTestableDb()
+			if err != nil {
+				t.Fatalf("can't create a test db")
+			}
+
+			builder, err := NewIndexBuilder(NewRemoteProvider(registry), blobStore, artifactsDb, WithSpanSize(65536), WithMinLayerSize(0))
+			if err != nil {
+				t.Fatalf("cannot create index builder: %v", err)
+			}
+			built, err := builder.buildSociLayer(ctx, desc)
+			if err != nil {
+				t.Fatalf("cannot build ztoc: %v", err)
+			}
+			entry, err := artifactsDb.GetArtifactEntry(built.Digest.String())
+			if err != nil {
+				t.Fatalf("no artifact entry for ztoc %s: %v", built.Digest, err)
+			}
+			if entry.SpanSize != 65536 {
+				t.Fatalf("unexpected span size of artifact entry %d", entry.SpanSize)
+			}
+
+			builder, err = NewIndexBuilder(NewRemoteProvider(registry), blobStore, artifactsDb, append(tc.opts, WithMinLayerSize(0))...)
+			if err != nil {
+				t.Fatalf("cannot create index builder: %v", err)
+			}
+			ztocDesc, err := builder.buildSociLayer(ctx, desc)
+			if err != nil {
+				t.Fatalf("cannot build ztoc: %v", err)
+			}
+			if rebuilt := registry.fetches[desc.Digest] == 2; rebuilt != tc.rebuilt {
+				t.Fatalf("expected rebuilt=%v, got %v", tc.rebuilt, rebuilt)
+			}
+			if diff := cmp.Diff(built, ztocDesc); !tc.rebuilt && diff != "" {
+				t.Fatalf("unexpected reused ztoc descriptor; diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestBuildSociLayerZstdFrames(t *testing.T) {
+	buildTar := func(size int64) []byte {
+		b, err := io.ReadAll(testutil.BuildTar([]testutil.TarEntry{
+			testutil.File("file", string(testutil.RandomByteData(size))),
+		}))
+		if err != nil {
+			t.Fatalf("cannot build tar: %v", err)
+		}
+		return b
+	}
+	tarball := buildTar(300000)
+	// zstdFrames compresses `b` in zstd frames of `frameSize` bytes of uncompressed data.
+	zstdFrames := func(b []byte, frameSize int) []byte {
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			t.Fatalf("cannot create zstd encoder: %v", err)
+		}
+		defer enc.Close()
+		var out []byte
+		for len(b) > 0 {
+			n := frameSize
+			if n > len(b) {
+				n = len(b)
+			}
+			out = enc.EncodeAll(b[:n], out)
+			b = b[n:]
+		}
+		return out
+	}
+
+	testCases := []struct {
+		name    string
+		layer   []byte
+		skipped bool
+	}{
+		{
+			name:  "multiple frames",
+			layer: zstdFrames(tarball, 65536),
+		},
+		{
+			name:    "single frame",
+			layer:   zstdFrames(tarball, len(tarball)),
+			skipped: true,
+		},
+		{
+			name:  "single frame smaller than a span",
+			layer: zstdFrames(buildTar(30000), 65536),
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			registry := newFakeRegistry(true)
+			desc := registry.push(ocispec.MediaTypeImageLayerZstd, tc.layer)
+			artifactsDb, err := newTestableDb()
+			if err != nil {
+				t.Fatalf("can't create a test db")
+			}
+			var events []BuildEvent
+			builder, err := NewIndexBuilder(NewRemoteProvider(registry), memory.New(), artifactsDb,
+				WithSpanSize(65536), WithMinLayerSize(0), WithProgress(func(e BuildEvent) { events = append(events, e) }))
+			if err != nil {
+				t.Fatalf("cannot create index builder: %v", err)
+			}
+			ztocDesc, err := builder.buildSociLayer(ctx, desc)
+			if err != nil {
+				t.Fatalf("cannot build ztoc: %v", err)
+			}
+			if skipped := ztocDesc == nil; skipped != tc.skipped {
+				t.Fatalf("expected skipped=%v, got %v", tc.skipped, skipped)
+			}
+			if last := events[len(events)-1]; tc.skipped && (last.Type != BuildEventLayerSkipped || last.Reason == "") {
+				t.Fatalf("expected layer to be skipped with a reason, got %v", last)
+			}
+		})
+	}
+}
+
+func TestBuildSociLayerMultiMemberGzip(t *testing.T) {
+	layer, err := io.ReadAll(testutil.BuildTarGz([]testutil.TarEntry{
+		testutil.File("file", string(testutil.RandomByteData(300000))),
+	}, gzip.DefaultCompression, testutil.WithGzipMemberSize(100000)))
+	if err != nil {
+		t.Fatalf("cannot build tar.gz: %v", err)
+	}
+
+	testCases := []struct {
+		name    string
+		version ztoc.Version
+		skipped bool
+	}{
+		{
+			name:    "default version",
+			version: ztoc.DefaultVersion,
+			skipped: true,
+		},
+		{
+			name:    "version 1.2",
+			version: ztoc.Version12,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			registry := newFakeRegistry(true)
+			desc := registry.push(ocispec.MediaTypeImageLayerGzip, layer)
+			artifactsDb, err := newTestableDb()
+			if err != nil {
+				t.Fatalf("can't create a test db")
+			}
+			var events []BuildEvent
+			builder, err := NewIndexBuilder(NewRemoteProvider(registry), memory.New(), artifactsDb,
+				WithSpanSize(65536), WithMinLayerSize(0), WithZtocVersion(tc.version), WithProgress(func(e BuildEvent) { events = append(events, e) }))
+			if err != nil {
+				t.Fatalf("cannot create index builder: %v", err)
+			}
+			ztocDesc, err := builder.buildSociLayer(ctx, desc)
+			if err != nil {
+				t.Fatalf("cannot build ztoc: %v", err)
+			}
+			if skipped := ztocDesc == nil; skipped != tc.skipped {
+				t.Fatalf("expected skipped=%v, got %v", tc.skipped, skipped)
+			}
+			if last := events[len(events)-1]; tc.skipped && (last.Type != BuildEventLayerSkipped || last.Reason == "") {
+				t.Fatalf("expected layer to be skipped with a reason, got %v", last)
+			}
+		})
+	}
+}
+
+// trackingProvider is a `content.Provider` that records the maximum number of blobs read at the same time.
+type trackingProvider struct {
+	content.Provider
+	mu        sync.Mutex
+	active    int
+	maxActive int
+}
+
+type trackedReaderAt struct {
+	content.ReaderAt
+	p *trackingProvider
+}
+
+func (p *trackingProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	ra, err := p.Provider.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	if images.IsLayerType(desc.MediaType) {
+		p.mu.Lock()
+		p.active++
+		if p.active > p.maxActive {
+			p.maxActive = p.active
+		}
+		p.mu.Unlock()
+		return &trackedReaderAt{ReaderAt: ra, p: p}, nil
+	}
+	return ra, nil
+}
+
+func (r *trackedReaderAt) Close() error {
+	r.p.mu.Lock()
+	r.p.active--
+	r.p.mu.Unlock()
+	return r.ReaderAt.Close()
+}
+
+func TestBuildSociIndexWithResourceLimits(t *testing.T) {
+	const numLayers = 4
+	testcases := []struct {
+		name           string
+		opts           []BuildOption
+		maxConcurrency int
+	}{
+		{
+			name:           "one layer at a time",
+			opts:           []BuildOption{WithMaxConcurrency(1)},
+			maxConcurrency: 1,
+		},
+		{
+			name:           "two layers at a time",
+			opts:           []BuildOption{WithMaxConcurrency(2)},
+			maxConcurrency: 2,
+		},
+		{
+			name:           "disk budget smaller than a layer",
+			opts:           []BuildOption{WithSpanStrategy(ztoc.SpanStrategyAdaptive), WithDiskBudget(1000)},
+			maxConcurrency: numLayers,
+		},
+		{
+			name:           "disk budget and max concurrency",
+			opts:           []BuildOption{WithSpanStrategy(ztoc.SpanStrategyAdaptive), WithDiskBudget(1 << 20), WithMaxConcurrency(2)},
+			maxConcurrency: 2,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			registry := newFakeRegistry(true)
+			registry.pushImage(t, "registry.example.com/image:latest", buildTestLayers(t, numLayers))
+			img, provider, err := ResolveRemoteImage(ctx, registry, registry.ref)
+			if err != nil {
+				t.Fatalf("cannot resolve image: %v", err)
+			}
+			tracker := &trackingProvider{Provider: provider}
+			artifactsDb, err := newTestableDb()
+			if err != nil {
+				t.Fatalf("can't create a test db")
+			}
+			tempDir := t.TempDir()
+			opts := append([]BuildOption{WithSpanSize(65536), WithMinLayerSize(0), WithTempDir(tempDir)}, tc.opts...)
+			builder, err := NewIndexBuilder(tracker, memory.New(), artifactsDb, opts...)
+			if err != nil {
+				t.Fatalf("cannot create index builder: %v", err)
+			}
+			index, err := builder.Build(ctx, img)
+			if err != nil {
+				t.Fatalf("cannot build index: %v", err)
+			}
+			if len(index.Index.Blobs) != numLayers {
+				t.Fatalf("expected %d ztocs, got %d", numLayers, len(index.Index.Blobs))
+			}
+			if tracker.maxActive > tc.maxConcurrency {
+				t.Fatalf("expected at most %d layers read at the same time, got %d", tc.maxConcurrency, tracker.maxActive)
+			}
+			if entries, err := os.ReadDir(tempDir); err != nil || len(entries) != 0 {
+				t.Fatalf("expected temp files to be removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestBuildEvents(t *testing.T) {
+	ctx := context.Background()
+	smallLayer, err := io.ReadAll(testutil.BuildTarGz([]testutil.TarEntry{testutil.File("small", "small")}, gzip.DefaultCompression))
+	if err != nil {
+		t.Fatalf("cannot build layer: %v", err)
+	}
+	registry := newFakeRegistry(true)
+	layers := registry.pushImage(t, "registry.example.com/image:latest", append(buildTestLayers(t, 2), smallLayer))
+	img, provider, err := ResolveRemoteImage(ctx, registry, registry.ref)
+	if err != nil {
+		t.Fatalf("cannot resolve image: %v", err)
+	}
+	artifactsDb, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	blobStore := memory.New()
+
+	build := func(opts ...BuildOption) (*IndexWithMetadata, map[digest.Digest][]BuildEvent, error) {
+		events := make(map[digest.Digest][]BuildEvent)
+		opts = append(opts, WithSpanSize(65536), WithMinLayerSize(1000), WithProgress(func(e BuildEvent) {
+			events[e.Layer.Digest] = append(events[e.Layer.Digest], e)
+		}))
+		builder, err := NewIndexBuilder(provider, blobStore, artifactsDb, opts...)
+		if err != nil {
+			t.Fatalf("cannot create index builder: %v", err)
+		}
+		index, err := builder.Build(ctx, img)
+		return index, events, err
+	}
+
+	for _, reused := range []bool{false, true} {
+		index, events, err := build()
+		if err != nil {
+			t.Fatalf("cannot build index: %v", err)
+		}
+		for i, layer := range layers {
+			e := events[layer.Digest]
+			if len(e) != 2 || e[0].Type != BuildEventLayerStarted {
+				t.Fatalf("expected layer %d to be started and then processed, got %v", i, e)
+			}
+			if i == len(layers)-1 {
+				if e[1].Type != BuildEventLayerSkipped || e[1].Reason == "" {
+					t.Fatalf("expected small layer to be skipped with a reason, got %v", e[1])
+				}
+				continue
+			}
+			if e[1].Type != BuildEventLayerBuilt || e[1].Reused != reused {
+				t.Fatalf("expected layer %d to be built with reused=%v, got %v", i, reused, e[1])
+			}
+			if e[1].Ztoc.Digest != index.Index.Blobs[i].Digest || e[1].Ztoc.Size != index.Index.Blobs[i].Size {
+				t.Fatalf("unexpected ztoc of layer %d: %v", i, e[1].Ztoc)
+			}
+			if e[1].SpanCount < 2 {
+				t.Fatalf("expected layer %d to have several spans, got %d", i, e[1].SpanCount)
+			}
+		}
+	}
+
+	delete(registry.blobs, layers[0].Digest)
+	if _, events, err := build(WithForceRebuild(true)); err == nil {
+		t.Fatalf("expected error building index of image with a missing layer")
+	} else if e := events[layers[0].Digest]; len(e) != 2 || e[1].Type != BuildEventLayerFailed || e[1].Err == nil {
+		t.Fatalf("expected missing layer to fail, got %v", e)
+	}
+}
+
+func TestBuildIndexCreated(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(true)
+	registry.pushImage(t, "registry.example.com/image:latest", buildTestLayers(t, 2))
+	img, provider, err := ResolveRemoteImage(ctx, registry, registry.ref)
+	if err != nil {
+		t.Fatalf("cannot resolve image: %v", err)
+	}
+	artifactsDb, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	build := func(opts ...BuildOption) *IndexWithMetadata {
+		opts = append(opts, WithSpanSize(65536), WithMinLayerSize(0))
+		builder, err := NewIndexBuilder(provider, memory.New(), artifactsDb, opts...)
+		if err != nil {
+			t.Fatalf("cannot create index builder: %v", err)
+		}
+		index, err := builder.Build(ctx, img)
+		if err != nil {
+			t.Fatalf("cannot build index: %v", err)
+		}
+		return index
+	}
+	manifest := func(index *IndexWithMetadata) []byte {
+		b, err := MarshalIndex(index.Index)
+		if err != nil {
+			t.Fatalf("cannot marshal index: %v", err)
+		}
+		return b
+	}
+
+	// without a creation time, the same image is always indexed the same way.
+	first := build()
+	if created, ok := first.Index.Annotations[ocispec.AnnotationCreated]; ok {
+		t.Fatalf("expected no creation time by default, got %s", created)
+	}
+	if !bytes.Equal(manifest(first), manifest(build())) {
+		t.Fatalf("expected identical indices of the same image")
+	}
+
+	created := time.Date(2024, 3, 1, 12, 30, 0, 0, time.FixedZone("", 3600))
+	index := build(WithCreated(created))
+	if actual := index.Index.Annotations[ocispec.AnnotationCreated]; actual != "2024-03-01T11:30:00Z" {
+		t.Fatalf("unexpected creation time: %s", actual)
+	}
+}
+
+func TestBuildOptionsResourceLimits(t *testing.T) {
+	for _, opt := range []BuildOption{WithMaxConcurrency(-1), WithDiskBudget(-1)} {
+		if _, err := NewIndexBuilder(newFakeContentStore(), memory.New(), nil, opt); err == nil {
+			t.Fatalf("expected error creating index builder with a negative limit")
+		}
+	}
+}
+
 func TestNewIndex(t *testing.T) {
 	testcases := []struct {
 		name        string
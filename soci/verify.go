@@ -0,0 +1,168 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// IndexVerification is the result of verifying a SOCI index against its image.
+type IndexVerification struct {
+	// Err is the error verifying the SOCI index itself, e.g. when its subject isn't the image manifest.
+	Err error
+	// Layers are the results of verifying the ztocs of the SOCI index, in the order of the SOCI index.
+	Layers []LayerVerification
+}
+
+// Failed returns whether the SOCI index or any of its ztocs failed verification.
+func (v *IndexVerification) Failed() bool {
+	if v.Err != nil {
+		return true
+	}
+	for _, l := range v.Layers {
+		if l.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// LayerVerification is the result of verifying the ztoc of an image layer.
+type LayerVerification struct {
+	// Layer is the digest of the image layer of the ztoc.
+	Layer digest.Digest
+	// Ztoc is the descriptor of the ztoc.
+	Ztoc ocispec.Descriptor
+	// LayerChecked is set if the layer was available locally, and its spans and files were
+	// checked against the ztoc.
+	LayerChecked bool
+	// Err is the error verifying the ztoc, or nil if it passed.
+	Err error
+}
+
+// VerifyIndex checks that the SOCI index `indexDesc` in `blobStore` is consistent with the image
+// manifest `manifestDesc` in `cs`. The subject of the SOCI index must be the image manifest, and
+// every ztoc must exist, be valid, and be for a layer of the image. When a layer is available in
+// `cs`, the digest of every span and the files of the layer are checked against its ztoc too.
+// An error is returned if the SOCI index or the image manifest cannot be read; verification failures
+// are reported in the returned `IndexVerification`.
+func VerifyIndex(ctx context.Context, cs content.Provider, blobStore store.BasicStore, manifestDesc, indexDesc ocispec.Descriptor) (*IndexVerification, error) {
+	r, err := blobStore.Fetch(ctx, indexDesc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch SOCI index %s: %w", indexDesc.Digest, err)
+	}
+	defer r.Close()
+	var index Index
+	if err := DecodeIndex(r, &index); err != nil {
+		return nil, fmt.Errorf("cannot parse SOCI index %s: %w", indexDesc.Digest, err)
+	}
+
+	b, err := content.ReadBlob(ctx, cs, manifestDesc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image manifest %s: %w", manifestDesc.Digest, err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, fmt.Errorf("cannot parse image manifest %s: %w", manifestDesc.Digest, err)
+	}
+
+	var v IndexVerification
+	switch {
+	case index.Subject == nil:
+		v.Err = errors.New("SOCI index has no subject")
+	case index.Subject.Digest != manifestDesc.Digest || index.Subject.Size != manifestDesc.Size:
+		v.Err = fmt.Errorf("SOCI index subject %s doesn't match image manifest %s", index.Subject.Digest, manifestDesc.Digest)
+	}
+
+	layers := make(map[digest.Digest]ocispec.Descriptor, len(manifest.Layers))
+	for _, l := range manifest.Layers {
+		layers[l.Digest] = l
+	}
+	for _, ztocDesc := range index.Blobs {
+		v.Layers = append(v.Layers, verifyLayer(ctx, cs, blobStore, layers, ztocDesc))
+	}
+	return &v, nil
+}
+
+// verifyLayer checks the ztoc `ztocDesc` against its layer in `layers`.
+func verifyLayer(ctx context.Context, cs content.Provider, blobStore store.BasicStore, layers map[digest.Digest]ocispec.Descriptor, ztocDesc ocispec.Descriptor) LayerVerification {
+	result := LayerVerification{Ztoc: ztocDesc}
+	layerDigest, err := digest.Parse(ztocDesc.Annotations[IndexAnnotationImageLayerDigest])
+	if err != nil {
+		result.Err = fmt.Errorf("invalid image layer digest annotation: %w", err)
+		return result
+	}
+	result.Layer = layerDigest
+	layer, ok := layers[layerDigest]
+	if !ok {
+		result.Err = fmt.Errorf("%s isn't a layer of the image", layerDigest)
+		return result
+	}
+
+	if err := ztocDesc.Digest.Validate(); err != nil {
+		result.Err = fmt.Errorf("invalid ztoc digest: %w", err)
+		return result
+	}
+	// ztocs are pushed to the blob store by digest and size only.
+	r, err := blobStore.Fetch(ctx, ocispec.Descriptor{Digest: ztocDesc.Digest, Size: ztocDesc.Size})
+	if err != nil {
+		result.Err = fmt.Errorf("cannot fetch ztoc: %w", err)
+		return result
+	}
+	defer r.Close()
+	verifier := ztocDesc.Digest.Verifier()
+	toc, err := ztoc.Unmarshal(io.TeeReader(r, verifier))
+	if err != nil {
+		result.Err = fmt.Errorf("cannot parse ztoc: %w", err)
+		return result
+	}
+	if !verifier.Verified() {
+		result.Err = fmt.Errorf("ztoc content doesn't match digest %s", ztocDesc.Digest)
+		return result
+	}
+	if int64(toc.CompressedArchiveSize) != layer.Size {
+		result.Err = fmt.Errorf("ztoc is for a layer of %d bytes, image layer has %d", toc.CompressedArchiveSize, layer.Size)
+		return result
+	}
+
+	ra, err := cs.ReaderAt(ctx, layer)
+	if err != nil {
+		if !errdefs.IsNotFound(err) {
+			result.Err = fmt.Errorf("cannot read layer: %w", err)
+		}
+		return result
+	}
+	defer ra.Close()
+	result.LayerChecked = true
+	if err := toc.VerifySpans(ra, ra.Size()); err != nil {
+		result.Err = err
+		return result
+	}
+	result.Err = toc.VerifyTOC(io.NewSectionReader(ra, 0, ra.Size()))
+	return result
+}
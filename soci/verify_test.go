@@ -0,0 +1,214 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+// missingLayerProvider is a content.Provider without the layer `missing`.
+type missingLayerProvider struct {
+	content.Provider
+	missing digest.Digest
+}
+
+func (p missingLayerProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	if desc.Digest == p.missing {
+		return nil, errdefs.ErrNotFound
+	}
+	return p.Provider.ReaderAt(ctx, desc)
+}
+
+func TestVerifyIndex(t *testing.T) {
+	ctx := context.Background()
+	cs, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("cannot create content store: %v", err)
+	}
+	push := func(mediaType string, b []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(b), desc); err != nil {
+			t.Fatalf("cannot write %s: %v", desc.Digest, err)
+		}
+		return desc
+	}
+	var layers []ocispec.Descriptor
+	for _, layer := range buildTestLayers(t, 2) {
+		layers = append(layers, push(ocispec.MediaTypeImageLayerGzip, layer))
+	}
+	manifest, err := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    push(ocispec.MediaTypeImageConfig, []byte("{}")),
+		Layers:    layers,
+	})
+	if err != nil {
+		t.Fatalf("cannot marshal manifest: %v", err)
+	}
+	manifestDesc := push(ocispec.MediaTypeImageManifest, manifest)
+	otherManifestDesc := push(ocispec.MediaTypeImageManifest, []byte("{}"))
+
+	artifactsDb, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	blobStore := memory.New()
+	builder, err := NewIndexBuilder(cs, blobStore, artifactsDb, WithSpanSize(65536), WithMinLayerSize(0))
+	if err != nil {
+		t.Fatalf("cannot create index builder: %v", err)
+	}
+	built, err := builder.Build(ctx, images.Image{Name: "example.com/image:latest", Target: manifestDesc})
+	if err != nil {
+		t.Fatalf("cannot build index: %v", err)
+	}
+
+	// corruptZtoc pushes a copy of the ztoc `desc` with a wrong span digest.
+	corruptZtoc := func(t *testing.T, desc ocispec.Descriptor) ocispec.Descriptor {
+		r, err := blobStore.Fetch(ctx, ocispec.Descriptor{Digest: desc.Digest, Size: desc.Size})
+		if err != nil {
+			t.Fatalf("cannot fetch ztoc: %v", err)
+		}
+		defer r.Close()
+		zt, err := ztoc.Unmarshal(r)
+		if err != nil {
+			t.Fatalf("cannot parse ztoc: %v", err)
+		}
+		zt.SpanDigests[0] = digest.FromString("corrupted")
+		zr, corrupted, err := ztoc.Marshal(zt)
+		if err != nil {
+			t.Fatalf("cannot marshal ztoc: %v", err)
+		}
+		if err := blobStore.Push(ctx, corrupted, zr); err != nil {
+			t.Fatalf("cannot push ztoc: %v", err)
+		}
+		corrupted.MediaType = desc.MediaType
+		corrupted.Annotations = desc.Annotations
+		return corrupted
+	}
+
+	testCases := []struct {
+		name            string
+		manifestDesc    ocispec.Descriptor
+		missingLayer    digest.Digest
+		modifyBlobs     func(t *testing.T, blobs []ocispec.Descriptor)
+		expectIndexErr  bool
+		expectLayerErrs []bool
+		expectChecked   []bool
+	}{
+		{
+			name:            "consistent index",
+			manifestDesc:    manifestDesc,
+			expectLayerErrs: []bool{false, false},
+			expectChecked:   []bool{true, true},
+		},
+		{
+			name:            "layer not available locally",
+			manifestDesc:    manifestDesc,
+			missingLayer:    layers[1].Digest,
+			expectLayerErrs: []bool{false, false},
+			expectChecked:   []bool{true, false},
+		},
+		{
+			name:            "subject isn't the image manifest",
+			manifestDesc:    otherManifestDesc,
+			expectIndexErr:  true,
+			expectLayerErrs: []bool{true, true},
+			expectChecked:   []bool{false, false},
+		},
+		{
+			name:         "ztoc for a layer of another image",
+			manifestDesc: manifestDesc,
+			modifyBlobs: func(t *testing.T, blobs []ocispec.Descriptor) {
+				blobs[0].Annotations = map[string]string{IndexAnnotationImageLayerDigest: digest.FromString("other layer").String()}
+			},
+			expectLayerErrs: []bool{true, false},
+			expectChecked:   []bool{false, true},
+		},
+		{
+			name:         "missing ztoc",
+			manifestDesc: manifestDesc,
+			modifyBlobs: func(t *testing.T, blobs []ocispec.Descriptor) {
+				blobs[1].Digest = digest.FromString("missing ztoc")
+			},
+			expectLayerErrs: []bool{false, true},
+			expectChecked:   []bool{true, false},
+		},
+		{
+			name:         "span digest doesn't match layer",
+			manifestDesc: manifestDesc,
+			modifyBlobs: func(t *testing.T, blobs []ocispec.Descriptor) {
+				blobs[0] = corruptZtoc(t, blobs[0])
+			},
+			expectLayerErrs: []bool{true, false},
+			expectChecked:   []bool{true, true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			blobs := append([]ocispec.Descriptor(nil), built.Index.Blobs...)
+			if tc.modifyBlobs != nil {
+				tc.modifyBlobs(t, blobs)
+			}
+			b, err := MarshalIndex(NewIndex(blobs, built.Index.Subject, built.Index.Annotations))
+			if err != nil {
+				t.Fatalf("cannot marshal index: %v", err)
+			}
+			indexDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(b), Size: int64(len(b))}
+			if exists, _ := blobStore.Exists(ctx, indexDesc); !exists {
+				if err := blobStore.Push(ctx, indexDesc, bytes.NewReader(b)); err != nil {
+					t.Fatalf("cannot push index: %v", err)
+				}
+			}
+
+			v, err := VerifyIndex(ctx, missingLayerProvider{Provider: cs, missing: tc.missingLayer}, blobStore, tc.manifestDesc, indexDesc)
+			if err != nil {
+				t.Fatalf("cannot verify index: %v", err)
+			}
+			if (v.Err != nil) != tc.expectIndexErr {
+				t.Fatalf("unexpected index error %v", v.Err)
+			}
+			if len(v.Layers) != len(tc.expectLayerErrs) {
+				t.Fatalf("expected %d layers, got %d", len(tc.expectLayerErrs), len(v.Layers))
+			}
+			failed := tc.expectIndexErr
+			for i, l := range v.Layers {
+				if (l.Err != nil) != tc.expectLayerErrs[i] {
+					t.Fatalf("unexpected error of layer %d: %v", i, l.Err)
+				}
+				if l.LayerChecked != tc.expectChecked[i] {
+					t.Fatalf("layer %d checked: %v, expected %v", i, l.LayerChecked, tc.expectChecked[i])
+				}
+				failed = failed || tc.expectLayerErrs[i]
+			}
+			if v.Failed() != failed {
+				t.Fatalf("expected failed=%v", failed)
+			}
+		})
+	}
+}
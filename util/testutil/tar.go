@@ -61,6 +61,10 @@ type BuildTarOptions struct {
 	GzipComment  string
 	GzipFilename string
 	GzipExtra    []byte
+
+	// GzipMemberSize is the size of uncompressed data after which BuildTarGz starts a new
+	// gzip member. If it's 0, a single gzip member is written.
+	GzipMemberSize int
 }
 
 // BuildTarOption is an option used during building blob.
@@ -91,6 +95,68 @@ func WithGzipExtra(extra []byte) BuildTarOption {
 	}
 }
 
+// WithGzipMemberSize is an option to compress a tar.gz in concatenated gzip members
+// of `size` bytes of uncompressed data, like a multi-member gzip layer.
+func WithGzipMemberSize(size int) BuildTarOption {
+	return func(o *BuildTarOptions) {
+		o.GzipMemberSize = size
+	}
+}
+
+// appendTarEntries appends `ents` to `tw`, which writes to `w`.
+func appendTarEntries(tw *tar.Writer, w io.Writer, ents []TarEntry, opts BuildTarOptions) error {
+	for _, ent := range ents {
+		raw, ok := ent.(rawTarEntry)
+		if !ok {
+			if err := ent.AppendTar(tw, opts); err != nil {
+				return err
+			}
+			continue
+		}
+		// the padding of the previous entry must be written before the raw entry.
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		if err := raw.appendRawTar(w, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gzipMembersWriter compresses data in gzip members of `memberSize` bytes of uncompressed data.
+type gzipMembersWriter struct {
+	gw         *gzip.Writer
+	w          io.Writer
+	memberSize int
+	written    int
+}
+
+func (m *gzipMembersWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if m.written == m.memberSize {
+			if err := m.gw.Close(); err != nil {
+				return n, err
+			}
+			m.gw.Reset(m.w)
+			m.written = 0
+		}
+		chunk := p
+		if len(chunk) > m.memberSize-m.written {
+			chunk = chunk[:m.memberSize-m.written]
+		}
+		k, err := m.gw.Write(chunk)
+		n += k
+		m.written += k
+		if err != nil {
+			return n, err
+		}
+		p = p[k:]
+	}
+	return n, nil
+}
+
 // BuildTar builds a tar given a list of tar entries and returns an io.Reader
 func BuildTar(ents []TarEntry, opts ...BuildTarOption) io.Reader {
 	var bo BuildTarOptions
@@ -100,11 +166,9 @@ func BuildTar(ents []TarEntry, opts ...BuildTarOption) io.Reader {
 	pr, pw := io.Pipe()
 	go func() {
 		tw := tar.NewWriter(pw)
-		for _, ent := range ents {
-			if err := ent.AppendTar(tw, bo); err != nil {
-				pw.CloseWithError(err)
-				return
-			}
+		if err := appendTarEntries(tw, pw, ents, bo); err != nil {
+			pw.CloseWithError(err)
+			return
 		}
 		if err := tw.Close(); err != nil {
 			pw.CloseWithError(err)
@@ -131,13 +195,15 @@ func BuildTarGz(ents []TarEntry, compressionLevel int, opts ...BuildTarOption) i
 		gw.Comment = bo.GzipComment
 		gw.Name = bo.GzipFilename
 		gw.Extra = bo.GzipExtra
-		tw := tar.NewWriter(gw)
+		var w io.Writer = gw
+		if bo.GzipMemberSize > 0 {
+			w = &gzipMembersWriter{gw: gw, w: pw, memberSize: bo.GzipMemberSize}
+		}
+		tw := tar.NewWriter(w)
 
-		for _, ent := range ents {
-			if err := ent.AppendTar(tw, bo); err != nil {
-				pw.CloseWithError(err)
-				return
-			}
+		if err := appendTarEntries(tw, w, ents, bo); err != nil {
+			pw.CloseWithError(err)
+			return
 		}
 
 		if err := tw.Close(); err != nil {
@@ -167,11 +233,9 @@ func BuildTarZstd(ents []TarEntry, compressionLevel int, opts ...BuildTarOption)
 			return
 		}
 		tw := tar.NewWriter(zw)
-		for _, ent := range ents {
-			if err := ent.AppendTar(tw, bo); err != nil {
-				pw.CloseWithError(err)
-				return
-			}
+		if err := appendTarEntries(tw, zw, ents, bo); err != nil {
+			pw.CloseWithError(err)
+			return
 		}
 		if err := tw.Close(); err != nil {
 			pw.CloseWithError(err)
@@ -223,6 +287,23 @@ func GetFilesAndContentsWithinTarGz(tarGz string) (map[string][]byte, []string,
 	return getFilesAndContentsFromTarReader(tr)
 }
 
+// GetFilesAndContentsWithinTarZstd takes a path to a zstd compressed tar archive and returns a list of its files and their contents
+func GetFilesAndContentsWithinTarZstd(tarZstd string) (map[string][]byte, []string, error) {
+	f, err := os.Open(tarZstd)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	return getFilesAndContentsFromTarReader(tr)
+}
+
 // GetFilesAndContentsWithinTar takes a path to a tar archive and returns a list of its files and their contents
 func GetFilesAndContentsWithinTar(tarFile string) (map[string][]byte, []string, error) {
 	f, err := os.Open(tarFile)
@@ -244,7 +325,7 @@ func getFilesAndContentsFromTarReader(tr *tar.Reader) (map[string][]byte, []stri
 		if err == io.EOF {
 			break
 		}
-		if header.Typeflag == tar.TypeReg {
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeGNUSparse {
 			files = append(files, header.Name)
 			contents, err := io.ReadAll(tr)
 			if err != nil {
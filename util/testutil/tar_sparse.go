@@ -0,0 +1,223 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package testutil
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// rawTarEntry is a tar entry that `tar.Writer` can't write, such as a sparse file.
+// BuildTar, BuildTarGz and BuildTarZstd write its blocks to the writer underlying the tar writer.
+type rawTarEntry interface {
+	TarEntry
+	appendRawTar(w io.Writer, opts BuildTarOptions) error
+}
+
+// SparseFormat is a format of sparse files in tar archives.
+type SparseFormat int
+
+const (
+	// SparseFormatGNU is the old GNU format, where the sparse map is in the header of a type 'S' entry.
+	SparseFormatGNU SparseFormat = iota
+	// SparseFormatPAX01 is the GNU PAX format 0.1, where the sparse map is a PAX record.
+	SparseFormatPAX01
+	// SparseFormatPAX10 is the GNU PAX format 1.0, where the sparse map is at the start of the file data.
+	SparseFormatPAX10
+)
+
+// SparseFragment is a fragment of data of a sparse file.
+type SparseFragment struct {
+	Offset int64
+	Data   string
+}
+
+// SparseFile is a sparse file entry of `size` bytes where only `fragments` are stored and the
+// rest of the file is holes. Since `tar.Writer` can't write sparse files, BuildTar, BuildTarGz and
+// BuildTarZstd write the entry in `format`, while AppendTar writes a regular file with zeroed holes.
+func SparseFile(name string, size int64, fragments []SparseFragment, format SparseFormat) TarEntry {
+	fragments = append([]SparseFragment(nil), fragments...)
+	sort.Slice(fragments, func(i, j int) bool {
+		return fragments[i].Offset < fragments[j].Offset
+	})
+	return &sparseFile{name: name, size: size, fragments: fragments, format: format}
+}
+
+// SparseFileContents returns the content of a sparse file of `size` bytes with `fragments`.
+func SparseFileContents(size int64, fragments []SparseFragment) []byte {
+	b := make([]byte, size)
+	for _, f := range fragments {
+		copy(b[f.Offset:], f.Data)
+	}
+	return b
+}
+
+type sparseFile struct {
+	name      string
+	size      int64
+	fragments []SparseFragment
+	format    SparseFormat
+}
+
+func (f *sparseFile) AppendTar(tw *tar.Writer, opts BuildTarOptions) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     opts.Prefix + f.name,
+		Mode:     0644,
+		Size:     f.size,
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(SparseFileContents(f.size, f.fragments))
+	return err
+}
+
+func (f *sparseFile) appendRawTar(w io.Writer, opts BuildTarOptions) error {
+	name := opts.Prefix + f.name
+	// like GNU tar, a sparse map ends with an empty fragment at the end of a file ending with a hole.
+	var (
+		sparseMap [][2]int64
+		data      strings.Builder
+	)
+	for _, frag := range f.fragments {
+		sparseMap = append(sparseMap, [2]int64{frag.Offset, int64(len(frag.Data))})
+		data.WriteString(frag.Data)
+	}
+	if n := len(f.fragments); n == 0 || f.fragments[n-1].Offset+int64(len(f.fragments[n-1].Data)) < f.size {
+		sparseMap = append(sparseMap, [2]int64{f.size, 0})
+	}
+
+	var blocks []byte
+	switch f.format {
+	case SparseFormatGNU:
+		hdr := rawTarHeader(name, tar.TypeGNUSparse, int64(data.Len()), true)
+		copy(hdr[483:495], formatOctal(f.size, 12))
+		// 4 entries fit in the header, and 21 in every extension block following it.
+		var extensions []byte
+		entries, isExtended := hdr[386:482], hdr[482:483]
+		for len(sparseMap) > 0 {
+			n := len(entries) / 24
+			if n > len(sparseMap) {
+				n = len(sparseMap)
+			}
+			for i, e := range sparseMap[:n] {
+				copy(entries[i*24:], formatOctal(e[0], 12))
+				copy(entries[i*24+12:], formatOctal(e[1], 12))
+			}
+			sparseMap = sparseMap[n:]
+			if len(sparseMap) > 0 {
+				isExtended[0] = 1
+				extensions = append(extensions, make([]byte, 512)...)
+				blk := extensions[len(extensions)-512:]
+				entries, isExtended = blk[:504], blk[504:505]
+			}
+		}
+		blocks = append(finishRawTarHeader(hdr), extensions...)
+	case SparseFormatPAX01:
+		var m []string
+		for _, e := range sparseMap {
+			m = append(m, strconv.FormatInt(e[0], 10), strconv.FormatInt(e[1], 10))
+		}
+		blocks = paxHeader(name, [][2]string{
+			{"GNU.sparse.map", strings.Join(m, ",")},
+			{"GNU.sparse.name", name},
+			{"GNU.sparse.numblocks", strconv.Itoa(len(sparseMap))},
+			{"GNU.sparse.size", strconv.FormatInt(f.size, 10)},
+		})
+		blocks = append(blocks, finishRawTarHeader(rawTarHeader("GNUSparseFile.0/"+name, tar.TypeReg, int64(data.Len()), false))...)
+	case SparseFormatPAX10:
+		m := fmt.Sprintf("%d\n", len(sparseMap))
+		for _, e := range sparseMap {
+			m += fmt.Sprintf("%d\n%d\n", e[0], e[1])
+		}
+		mapBlocks := padToBlock([]byte(m))
+		blocks = paxHeader(name, [][2]string{
+			{"GNU.sparse.major", "1"},
+			{"GNU.sparse.minor", "0"},
+			{"GNU.sparse.name", name},
+			{"GNU.sparse.realsize", strconv.FormatInt(f.size, 10)},
+		})
+		blocks = append(blocks, finishRawTarHeader(rawTarHeader("GNUSparseFile.0/"+name, tar.TypeReg, int64(len(mapBlocks)+data.Len()), false))...)
+		blocks = append(blocks, mapBlocks...)
+	default:
+		return fmt.Errorf("unknown sparse format %d", f.format)
+	}
+	blocks = append(blocks, padToBlock([]byte(data.String()))...)
+	_, err := w.Write(blocks)
+	return err
+}
+
+// rawTarHeader returns a header block of the ustar format, or of the GNU format if `gnu` is set.
+// The checksum is computed by `finishRawTarHeader`.
+func rawTarHeader(name string, typeflag byte, size int64, gnu bool) []byte {
+	hdr := make([]byte, 512)
+	copy(hdr[0:100], name)
+	copy(hdr[100:108], formatOctal(0644, 8))
+	copy(hdr[108:116], formatOctal(0, 8))
+	copy(hdr[116:124], formatOctal(0, 8))
+	copy(hdr[124:136], formatOctal(size, 12))
+	copy(hdr[136:148], formatOctal(0, 12))
+	hdr[156] = typeflag
+	if gnu {
+		copy(hdr[257:265], "ustar  \x00")
+	} else {
+		copy(hdr[257:265], "ustar\x0000")
+	}
+	return hdr
+}
+
+// finishRawTarHeader sets the checksum of a header block.
+func finishRawTarHeader(hdr []byte) []byte {
+	copy(hdr[148:156], "        ")
+	var sum int64
+	for _, c := range hdr {
+		sum += int64(c)
+	}
+	copy(hdr[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return hdr
+}
+
+// paxHeader returns the blocks of a PAX extended header with `records`.
+func paxHeader(name string, records [][2]string) []byte {
+	var b strings.Builder
+	for _, r := range records {
+		rec := fmt.Sprintf(" %s=%s\n", r[0], r[1])
+		// the length of a record includes the length of its decimal length.
+		n := len(rec)
+		for n != len(rec)+len(strconv.Itoa(n)) {
+			n = len(rec) + len(strconv.Itoa(n))
+		}
+		b.WriteString(strconv.Itoa(n) + rec)
+	}
+	hdr := finishRawTarHeader(rawTarHeader("PaxHeaders.0/"+name, tar.TypeXHeader, int64(b.Len()), false))
+	return append(hdr, padToBlock([]byte(b.String()))...)
+}
+
+func formatOctal(v int64, width int) string {
+	return fmt.Sprintf("%0*o\x00", width-1, v)
+}
+
+func padToBlock(b []byte) []byte {
+	if n := len(b) % 512; n != 0 {
+		b = append(b, make([]byte, 512-n)...)
+	}
+	return b
+}
@@ -0,0 +1,121 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// StreamBoundary is a point in a compressed stream from which decompression can start
+// without any state, i.e. the start of a gzip member or of a zstd frame. Formats such as
+// eStargz and zstd:chunked record these points in their embedded TOC.
+type StreamBoundary struct {
+	CompressedOffset   Offset
+	UncompressedOffset Offset
+}
+
+// NewZinfoFromStreamBoundaries creates a zinfo struct whose spans start at a subset of
+// `boundaries`, picked by `planner`, without decompressing the stream. `boundaries` must
+// contain the start of the stream. For gzip, `r` is only used to read the member headers
+// at the boundaries where a span starts.
+//
+// Gzip zinfo is always built by the pure go implementation. Since no data precedes a
+// checkpoint within its member, gzip checkpoints built this way have empty windows.
+func NewZinfoFromStreamBoundaries(compressionAlgo string, r io.ReaderAt, boundaries []StreamBoundary, planner SpanPlanner) (Zinfo, error) {
+	starts, err := planStreamBoundaries(boundaries, planner)
+	if err != nil {
+		return nil, err
+	}
+
+	switch compressionAlgo {
+	case Gzip:
+		checkpoints := make([]gzipCheckpoint, 0, len(starts))
+		for _, b := range starts {
+			in, err := gzipMemberDataOffset(r, b.CompressedOffset)
+			if err != nil {
+				return nil, fmt.Errorf("invalid gzip member at offset %d: %w", b.CompressedOffset, err)
+			}
+			checkpoints = append(checkpoints, gzipCheckpoint{
+				in:     in,
+				out:    b.UncompressedOffset,
+				window: make([]byte, gzipWindowSize),
+			})
+		}
+		return &GoGzipZinfo{
+			version:     gzipZinfoVersionTwo,
+			spanSize:    planner.SpanSize(),
+			checkpoints: checkpoints,
+			// every gzip stream boundary starts a member.
+			members: len(boundaries),
+		}, nil
+	case Zstd:
+		checkpoints := make([]zstdCheckpoint, 0, len(starts))
+		for _, b := range starts {
+			checkpoints = append(checkpoints, zstdCheckpoint{
+				in:  b.CompressedOffset,
+				out: b.UncompressedOffset,
+			})
+		}
+		return &ZstdZinfo{
+			version:     zinfoVersion,
+			spanSize:    planner.SpanSize(),
+			checkpoints: checkpoints,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unexpected compression algorithm: %s", compressionAlgo)
+	}
+}
+
+// planStreamBoundaries sorts `boundaries` and returns those at which `planner` starts a span.
+func planStreamBoundaries(boundaries []StreamBoundary, planner SpanPlanner) ([]StreamBoundary, error) {
+	sorted := make([]StreamBoundary, len(boundaries))
+	copy(sorted, boundaries)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].CompressedOffset < sorted[j].CompressedOffset
+	})
+	if len(sorted) == 0 || sorted[0].CompressedOffset != 0 || sorted[0].UncompressedOffset != 0 {
+		return nil, fmt.Errorf("stream boundaries must include the start of the stream")
+	}
+
+	starts := []StreamBoundary{sorted[0]}
+	for _, b := range sorted[1:] {
+		last := starts[len(starts)-1]
+		if b.UncompressedOffset < last.UncompressedOffset {
+			return nil, fmt.Errorf("stream boundary at compressed offset %d precedes the previous boundary in the uncompressed stream", b.CompressedOffset)
+		}
+		if b.CompressedOffset == last.CompressedOffset || b.UncompressedOffset == last.UncompressedOffset {
+			continue
+		}
+		if planner.StartsSpan(last.UncompressedOffset, b.UncompressedOffset) {
+			starts = append(starts, b)
+		}
+	}
+	return starts, nil
+}
+
+// gzipMemberDataOffset returns the offset of the deflate stream of the gzip member at `offset`.
+func gzipMemberDataOffset(r io.ReaderAt, offset Offset) (Offset, error) {
+	d := newGzipInflater(bufio.NewReader(io.NewSectionReader(r, int64(offset), math.MaxInt64-int64(offset))))
+	if err := d.readHeader(); err != nil {
+		return 0, err
+	}
+	return offset + Offset(d.consumed), nil
+}
@@ -0,0 +1,157 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeMultiMemberGzipTestFile compresses each extent of `data` as a separate gzip member,
+// writes the result to a temp file and returns the boundaries of the members.
+func writeMultiMemberGzipTestFile(t *testing.T, data []byte, extents []Extent) ([]byte, string, []StreamBoundary) {
+	var (
+		buf        bytes.Buffer
+		boundaries []StreamBoundary
+	)
+	for i, e := range extents {
+		boundaries = append(boundaries, StreamBoundary{
+			CompressedOffset:   Offset(buf.Len()),
+			UncompressedOffset: e.Start,
+		})
+		w := gzip.NewWriter(&buf)
+		// vary the header size across members.
+		if i%2 == 0 {
+			w.Name = "member"
+		}
+		if _, err := w.Write(data[e.Start:e.End]); err != nil {
+			t.Fatalf("failed to compress data: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("failed to compress data: %v", err)
+		}
+	}
+	filename := filepath.Join(t.TempDir(), "multi-member.gz")
+	if err := os.WriteFile(filename, buf.Bytes(), 0600); err != nil {
+		t.Fatalf("failed to write gzip file: %v", err)
+	}
+	return buf.Bytes(), filename, boundaries
+}
+
+func TestGzipZinfoFromStreamBoundaries(t *testing.T) {
+	t.Parallel()
+	data := gzipTestData(11, 1<<20)
+	extents := randomExtents(11, len(data), 48<<10)
+	compressed, filename, boundaries := writeMultiMemberGzipTestFile(t, data, extents)
+
+	zinfo, err := NewZinfoFromStreamBoundaries(Gzip, bytes.NewReader(compressed), boundaries, NewFixedSpanPlanner(128<<10))
+	if err != nil {
+		t.Fatalf("failed to build zinfo from stream boundaries: %v", err)
+	}
+	blob, err := zinfo.Bytes()
+	if err != nil {
+		t.Fatalf("failed to serialize zinfo: %v", err)
+	}
+	if zinfo.MaxSpanID() < 4 {
+		t.Fatalf("expected the stream to be split in several spans, got %d", zinfo.MaxSpanID()+1)
+	}
+
+	compressedSize := Offset(len(compressed))
+	uncompressedSize := Offset(len(data))
+	for _, impl := range testGzipImplementations() {
+		impl := impl
+		t.Run(string(impl), func(t *testing.T) {
+			zinfo, err := newGzipZinfoWithImplementation(impl, blob)
+			if err != nil {
+				t.Fatalf("failed to read zinfo: %v", err)
+			}
+			defer zinfo.Close()
+
+			var spanID SpanID
+			for spanID = 0; spanID <= zinfo.MaxSpanID(); spanID++ {
+				start := zinfo.StartUncompressedOffset(spanID)
+				end := zinfo.EndUncompressedOffset(spanID, uncompressedSize)
+				buf := compressed[zinfo.StartCompressedOffset(spanID):zinfo.EndCompressedOffset(spanID, compressedSize)]
+				extracted, err := zinfo.ExtractDataFromBuffer(buf, end-start, start, spanID)
+				if err != nil {
+					t.Fatalf("failed to extract span %d: %v", spanID, err)
+				}
+				if !bytes.Equal(extracted, data[start:end]) {
+					t.Fatalf("span %d extracted from buffer does not match the original data", spanID)
+				}
+			}
+
+			// extract ranges that cross several members from the middle of a span.
+			for _, r := range []Extent{{Start: 1000, End: 300 << 10}, {Start: 500 << 10, End: uncompressedSize}} {
+				extracted, err := zinfo.ExtractDataFromFile(filename, r.End-r.Start, r.Start)
+				if err != nil {
+					t.Fatalf("failed to extract [%d, %d) from file: %v", r.Start, r.End, err)
+				}
+				if !bytes.Equal(extracted, data[r.Start:r.End]) {
+					t.Fatalf("data [%d, %d) extracted from file does not match the original data", r.Start, r.End)
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidStreamBoundaries(t *testing.T) {
+	t.Parallel()
+	data := gzipTestData(12, 64<<10)
+	compressed, _, boundaries := writeMultiMemberGzipTestFile(t, data, randomExtents(12, len(data), 16<<10))
+
+	testCases := []struct {
+		name       string
+		boundaries []StreamBoundary
+	}{
+		{
+			name:       "no boundaries",
+			boundaries: nil,
+		},
+		{
+			name:       "missing start of the stream",
+			boundaries: boundaries[1:],
+		},
+		{
+			name: "boundary not at a gzip member",
+			boundaries: []StreamBoundary{
+				boundaries[0],
+				{CompressedOffset: boundaries[1].CompressedOffset + 1, UncompressedOffset: 32 << 10},
+			},
+		},
+		{
+			name: "boundaries out of order",
+			boundaries: []StreamBoundary{
+				boundaries[0],
+				{CompressedOffset: boundaries[2].CompressedOffset, UncompressedOffset: boundaries[1].UncompressedOffset},
+				{CompressedOffset: boundaries[1].CompressedOffset, UncompressedOffset: boundaries[2].UncompressedOffset},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewZinfoFromStreamBoundaries(Gzip, bytes.NewReader(compressed), tc.boundaries, NewFixedSpanPlanner(1)); err == nil {
+				t.Fatalf("expected error building zinfo from invalid stream boundaries")
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// GzipImplementation is the implementation used to build and read gzip zinfo.
+type GzipImplementation string
+
+const (
+	// GzipImplementationCgo uses zlib through cgo. It's only available when built with cgo.
+	GzipImplementationCgo GzipImplementation = "cgo"
+	// GzipImplementationGo uses a pure go implementation.
+	GzipImplementationGo GzipImplementation = "go"
+)
+
+// DefaultGzipImplementation is the gzip implementation used unless another one is selected
+// with `SetGzipImplementation`. It's `GzipImplementationCgo` when built with cgo and
+// `GzipImplementationGo` otherwise (e.g. `CGO_ENABLED=0`).
+const DefaultGzipImplementation = defaultGzipImplementation
+
+var gzipImplementation atomic.Value
+
+func init() {
+	gzipImplementation.Store(DefaultGzipImplementation)
+}
+
+// SetGzipImplementation selects the implementation used for gzip zinfo created after the call.
+// An empty value selects `DefaultGzipImplementation`.
+//
+// The cgo implementation can only build zinfo from a file with spans of a fixed size, so zinfo
+// built from a stream or with a `SpanPlanner` is always built by the go implementation. Both
+// implementations build identical zinfo, and the zinfo built is read with the selected one.
+func SetGzipImplementation(impl GzipImplementation) error {
+	switch impl {
+	case "":
+		impl = DefaultGzipImplementation
+	case GzipImplementationGo:
+	case GzipImplementationCgo:
+		if !cgoGzipSupported {
+			return fmt.Errorf("gzip implementation %q is not supported in this build", impl)
+		}
+	default:
+		return fmt.Errorf("unknown gzip implementation %q; supported: %s, %s", impl, GzipImplementationCgo, GzipImplementationGo)
+	}
+	gzipImplementation.Store(impl)
+	return nil
+}
+
+// GetGzipImplementation returns the implementation currently used for gzip zinfo.
+func GetGzipImplementation() GzipImplementation {
+	return gzipImplementation.Load().(GzipImplementation)
+}
+
+func newGzipZinfoWithImplementation(impl GzipImplementation, zinfoBytes []byte) (Zinfo, error) {
+	if impl == GzipImplementationCgo {
+		return newCgoGzipZinfo(zinfoBytes)
+	}
+	return newGoGzipZinfo(zinfoBytes)
+}
+
+func newGzipZinfoFromFileWithImplementation(impl GzipImplementation, gzipFile string, spanSize int64) (Zinfo, error) {
+	if impl == GzipImplementationCgo {
+		return newCgoGzipZinfoFromFile(gzipFile, spanSize)
+	}
+	return newGoGzipZinfoFromFile(gzipFile, spanSize)
+}
+
+// gzipMemberCounter is implemented by the gzip zinfo of both implementations.
+type gzipMemberCounter interface {
+	gzipMembers() int
+	setGzipMembers(members int)
+}
+
+// GzipMembers returns the number of members of the gzip stream indexed by `zinfo`. It's only
+// known for gzip zinfo built from a layer, and 0 is returned for zinfo read from a ztoc or
+// zinfo of other compression algorithms.
+func GzipMembers(zinfo Zinfo) int {
+	if c, ok := zinfo.(gzipMemberCounter); ok {
+		return c.gzipMembers()
+	}
+	return 0
+}
+
+// withGzipImplementation returns `zinfo`, built by the go implementation, as a zinfo of the
+// selected implementation.
+func withGzipImplementation(zinfo *GoGzipZinfo) (Zinfo, error) {
+	impl := GetGzipImplementation()
+	if impl == GzipImplementationGo {
+		return zinfo, nil
+	}
+	zinfoBytes, err := zinfo.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	converted, err := newGzipZinfoWithImplementation(impl, zinfoBytes)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := converted.(gzipMemberCounter); ok {
+		c.setGzipMembers(zinfo.members)
+	}
+	return converted, nil
+}
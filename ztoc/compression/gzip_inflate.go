@@ -0,0 +1,614 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/bits"
+)
+
+// This file contains a minimal DEFLATE decoder (RFC 1951) used by `GoGzipZinfo`.
+// Unlike `compress/flate`, it stops at every deflate block boundary and exposes
+// the exact bit position and the sliding window at that point, which is the information
+// zlib exposes through `inflate(..., Z_BLOCK)`. It can also resume decompression from
+// such a position, which `compress/flate` can't do if the position isn't byte aligned.
+// The decoding logic is based on zlib's `contrib/puff/puff.c`.
+
+const (
+	// huffPrimaryBits is the number of bits resolved by a single table lookup.
+	// Longer codes fall back to bit-by-bit canonical decoding.
+	huffPrimaryBits = 9
+	huffMaxBits     = 15
+)
+
+var (
+	errGzipHeader       = errors.New("invalid gzip header")
+	errGzipChecksum     = errors.New("incorrect gzip data check")
+	errDeflateBlockType = errors.New("invalid deflate block type")
+	errDeflateStored    = errors.New("invalid deflate stored block lengths")
+	errDeflateCode      = errors.New("invalid deflate code")
+	errDeflateDistance  = errors.New("invalid deflate distance too far back")
+	errDeflateLengths   = errors.New("invalid deflate code lengths")
+)
+
+var (
+	deflateLengthBase  = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	deflateLengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	deflateDistBase    = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	deflateDistExtra   = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+	// order of code length code lengths in a dynamic block header
+	deflateCodeLengthOrder = [19]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+	fixedLitHuffman, fixedDistHuffman = buildFixedHuffman()
+)
+
+// huffman is a canonical huffman code.
+type huffman struct {
+	count  [huffMaxBits + 1]uint16 // number of symbols of each length
+	symbol [288]uint16             // symbols ordered by length, then by value
+	// table maps the next `huffPrimaryBits` bits of input to `symbol<<4 | length`.
+	// An entry is 0 if the code is longer than `huffPrimaryBits`.
+	table [1 << huffPrimaryBits]uint16
+}
+
+func (h *huffman) build(lengths []uint8) error {
+	h.count = [huffMaxBits + 1]uint16{}
+	h.table = [1 << huffPrimaryBits]uint16{}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+	h.count[0] = 0
+
+	// an over-subscribed code can't be decoded; incomplete codes are allowed.
+	left := 1
+	for l := 1; l <= huffMaxBits; l++ {
+		left <<= 1
+		left -= int(h.count[l])
+		if left < 0 {
+			return errDeflateLengths
+		}
+	}
+
+	var offs [huffMaxBits + 1]uint16
+	for l := 1; l < huffMaxBits; l++ {
+		offs[l+1] = offs[l] + h.count[l]
+	}
+	for sym, l := range lengths {
+		if l != 0 {
+			h.symbol[offs[l]] = uint16(sym)
+			offs[l]++
+		}
+	}
+
+	code, idx := 0, 0
+	for l := 1; l <= huffPrimaryBits; l++ {
+		for k := 0; k < int(h.count[l]); k++ {
+			entry := h.symbol[idx]<<4 | uint16(l)
+			reversed := int(bits.Reverse16(uint16(code)) >> (16 - l))
+			for j := reversed; j < len(h.table); j += 1 << l {
+				h.table[j] = entry
+			}
+			code++
+			idx++
+		}
+		code <<= 1
+	}
+	return nil
+}
+
+func buildFixedHuffman() (*huffman, *huffman) {
+	var lengths [288]uint8
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	lit := new(huffman)
+	lit.build(lengths[:])
+
+	for i := 0; i < 30; i++ {
+		lengths[i] = 5
+	}
+	dist := new(huffman)
+	dist.build(lengths[:30])
+	return lit, dist
+}
+
+// gzipInflater decompresses a gzip stream one deflate block at a time.
+type gzipInflater struct {
+	r        io.ByteReader
+	consumed int64  // number of bytes read from `r`
+	bitBuf   uint64 // bits read from `r` but not consumed yet
+	nbits    uint   // number of bits in `bitBuf`
+
+	window [gzipWindowSize]byte // circular buffer containing the last 32KiB of output
+	wpos   int                  // next write position in `window`
+	out    int64                // number of bytes decompressed so far
+
+	crc       uint32    // checksum of the data decompressed from the current member
+	memberOut int64     // value of `out` at the start of the current member
+	flushPos  int       // position in `window` up to which data has been added to `crc` and written to `w`
+	w         io.Writer // if not nil, uncompressed data is written to `w`
+	writeErr  error
+
+	// If `dst` is not nil, uncompressed data from `dstStart` is appended to `dst` until it's full.
+	dst      []byte
+	dstStart int64
+
+	lit, dist, codeLen huffman
+}
+
+func newGzipInflater(r io.ByteReader) *gzipInflater {
+	return &gzipInflater{r: r}
+}
+
+// newGzipInflaterAt creates a `gzipInflater` that resumes decompression from a checkpoint.
+// `r` must be positioned at the start of the checkpoint in the compressed stream
+// (i.e. at the byte containing the `bits` remaining bits, if any).
+func newGzipInflaterAt(r io.ByteReader, start, out Offset, bits uint8, window []byte) (*gzipInflater, error) {
+	d := &gzipInflater{
+		r:        r,
+		consumed: int64(start),
+		out:      int64(out),
+	}
+	if bits != 0 {
+		c, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		d.bitBuf = uint64(c >> (8 - bits))
+		d.nbits = uint(bits)
+	}
+	copy(d.window[:], window)
+	return d, nil
+}
+
+// extract decompresses until `size` bytes starting at `offset` in the uncompressed stream
+// have been decompressed or the stream ends, and returns the decompressed bytes.
+// Decompression continues into the following members of a multi-member gzip stream.
+func (d *gzipInflater) extract(offset, size int64) ([]byte, error) {
+	d.dst = make([]byte, 0, size)
+	d.dstStart = offset
+	for !d.dstFull() {
+		final, err := d.inflateBlock()
+		if err != nil {
+			return nil, err
+		}
+		if final && !d.nextMember() {
+			break
+		}
+	}
+	return d.dst, nil
+}
+
+// nextMember skips the trailer of the member that just ended and the header of the
+// following member. It returns false if no member follows. Like `gzip -d`, data that
+// isn't a gzip member after the last member is ignored.
+func (d *gzipInflater) nextMember() bool {
+	d.alignToByte()
+	if _, err := d.getBits(32); err != nil {
+		return false
+	}
+	if _, err := d.getBits(32); err != nil {
+		return false
+	}
+	return d.readHeader() == nil
+}
+
+func (d *gzipInflater) dstFull() bool {
+	return d.dst != nil && len(d.dst) == cap(d.dst)
+}
+
+func (d *gzipInflater) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	d.consumed++
+	return c, nil
+}
+
+func (d *gzipInflater) getBits(n uint) (uint32, error) {
+	for d.nbits < n {
+		c, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+		d.bitBuf |= uint64(c) << d.nbits
+		d.nbits += 8
+	}
+	v := uint32(d.bitBuf & (1<<n - 1))
+	d.bitBuf >>= n
+	d.nbits -= n
+	return v, nil
+}
+
+// alignToByte drops the remaining bits of the current byte.
+func (d *gzipInflater) alignToByte() {
+	d.bitBuf >>= d.nbits % 8
+	d.nbits -= d.nbits % 8
+}
+
+// position returns the offset of the first full byte following the current bit position,
+// and the number of bits of the byte before it that haven't been consumed yet.
+func (d *gzipInflater) position() (Offset, uint8) {
+	bitPos := d.consumed*8 - int64(d.nbits)
+	in := (bitPos + 7) / 8
+	return Offset(in), uint8(in*8 - bitPos)
+}
+
+// lastWindow returns the last 32KiB of uncompressed data, which is zero-padded
+// at the front if less than 32KiB have been decompressed.
+func (d *gzipInflater) lastWindow() []byte {
+	w := make([]byte, gzipWindowSize)
+	n := copy(w, d.window[d.wpos:])
+	copy(w[n:], d.window[:d.wpos])
+	return w
+}
+
+func (d *gzipInflater) writeByte(c byte) {
+	if d.dst != nil && d.out >= d.dstStart && len(d.dst) < cap(d.dst) {
+		d.dst = append(d.dst, c)
+	}
+	d.window[d.wpos] = c
+	d.wpos++
+	d.out++
+	if d.wpos == gzipWindowSize {
+		d.flush()
+		d.wpos, d.flushPos = 0, 0
+	}
+}
+
+// flush adds the uncompressed data in `window` that hasn't been flushed yet
+// to the checksum and writes it to `w`.
+func (d *gzipInflater) flush() {
+	data := d.window[d.flushPos:d.wpos]
+	d.crc = crc32.Update(d.crc, crc32.IEEETable, data)
+	if d.w != nil && d.writeErr == nil {
+		_, d.writeErr = d.w.Write(data)
+	}
+	d.flushPos = d.wpos
+}
+
+// readHeader reads a gzip member header. It can follow the trailer of a previous member,
+// so bytes are read through the bit buffer.
+func (d *gzipInflater) readHeader() error {
+	var hdr [10]byte
+	for i := range hdr {
+		c, err := d.headerByte()
+		if err != nil {
+			return err
+		}
+		hdr[i] = c
+	}
+	if hdr[0] != 0x1f || hdr[1] != 0x8b || hdr[2] != 8 {
+		return errGzipHeader
+	}
+	flags := hdr[3]
+	if flags&0xe0 != 0 {
+		return fmt.Errorf("%w: unknown header flags set", errGzipHeader)
+	}
+	if flags&0x04 != 0 { // FEXTRA
+		xlen, err := d.getBits(16)
+		if err != nil {
+			return err
+		}
+		for i := uint32(0); i < xlen; i++ {
+			if _, err := d.headerByte(); err != nil {
+				return err
+			}
+		}
+	}
+	for _, flag := range []byte{0x08, 0x10} { // FNAME, FCOMMENT
+		if flags&flag == 0 {
+			continue
+		}
+		for {
+			c, err := d.headerByte()
+			if err != nil {
+				return err
+			}
+			if c == 0 {
+				break
+			}
+		}
+	}
+	if flags&0x02 != 0 { // FHCRC
+		if _, err := d.getBits(16); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// headerByte reads a byte of a gzip header, which is always byte aligned.
+func (d *gzipInflater) headerByte() (byte, error) {
+	c, err := d.getBits(8)
+	return byte(c), err
+}
+
+// readTrailer reads the gzip trailer following the final deflate block and
+// verifies the checksum and size of the uncompressed data.
+func (d *gzipInflater) readTrailer() error {
+	d.flush()
+	if d.writeErr != nil {
+		return d.writeErr
+	}
+
+	d.alignToByte()
+	crc, err := d.getBits(32)
+	if err != nil {
+		return err
+	}
+	size, err := d.getBits(32)
+	if err != nil {
+		return err
+	}
+	if crc != d.crc || size != uint32(d.out-d.memberOut) {
+		return errGzipChecksum
+	}
+	d.crc = 0
+	d.memberOut = d.out
+	return nil
+}
+
+// inflateBlock decompresses a single deflate block and reports whether it was the final block.
+func (d *gzipInflater) inflateBlock() (bool, error) {
+	hdr, err := d.getBits(3)
+	if err != nil {
+		return false, err
+	}
+	final := hdr&1 == 1
+	switch hdr >> 1 {
+	case 0:
+		err = d.storedBlock()
+	case 1:
+		err = d.codesBlock(fixedLitHuffman, fixedDistHuffman)
+	case 2:
+		if err = d.dynamicTables(); err == nil {
+			err = d.codesBlock(&d.lit, &d.dist)
+		}
+	default:
+		err = errDeflateBlockType
+	}
+	if err == nil {
+		err = d.writeErr
+	}
+	return final, err
+}
+
+func (d *gzipInflater) storedBlock() error {
+	d.alignToByte()
+	length, err := d.getBits(16)
+	if err != nil {
+		return err
+	}
+	nlength, err := d.getBits(16)
+	if err != nil {
+		return err
+	}
+	if length != ^nlength&0xffff {
+		return errDeflateStored
+	}
+	// the bit buffer is byte aligned, so drain it before reading from the input directly.
+	for ; length > 0 && d.nbits > 0; length-- {
+		c, _ := d.getBits(8)
+		d.writeByte(byte(c))
+	}
+	for ; length > 0 && !d.dstFull(); length-- {
+		c, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		d.writeByte(c)
+	}
+	return nil
+}
+
+func (d *gzipInflater) dynamicTables() error {
+	nlen, err := d.getBits(5)
+	if err != nil {
+		return err
+	}
+	ndist, err := d.getBits(5)
+	if err != nil {
+		return err
+	}
+	ncode, err := d.getBits(4)
+	if err != nil {
+		return err
+	}
+	nlen += 257
+	ndist++
+	ncode += 4
+	if nlen > 286 || ndist > 30 {
+		return errDeflateLengths
+	}
+
+	var lengths [286 + 30]uint8
+	for i := uint32(0); i < ncode; i++ {
+		l, err := d.getBits(3)
+		if err != nil {
+			return err
+		}
+		lengths[deflateCodeLengthOrder[i]] = uint8(l)
+	}
+	if err := d.codeLen.build(lengths[:19]); err != nil {
+		return err
+	}
+
+	total := int(nlen + ndist)
+	lengths = [286 + 30]uint8{}
+	for idx := 0; idx < total; {
+		sym, err := d.decodeSymbol(&d.codeLen)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[idx] = uint8(sym)
+			idx++
+			continue
+		}
+
+		var (
+			l      uint8
+			repeat uint32
+		)
+		switch sym {
+		case 16:
+			if idx == 0 {
+				return errDeflateLengths
+			}
+			l = lengths[idx-1]
+			repeat, err = d.getBits(2)
+			repeat += 3
+		case 17:
+			repeat, err = d.getBits(3)
+			repeat += 3
+		default:
+			repeat, err = d.getBits(7)
+			repeat += 11
+		}
+		if err != nil {
+			return err
+		}
+		if idx+int(repeat) > total {
+			return errDeflateLengths
+		}
+		for ; repeat > 0; repeat-- {
+			lengths[idx] = l
+			idx++
+		}
+	}
+
+	// a block without an end-of-block code can't be decoded
+	if lengths[256] == 0 {
+		return errDeflateLengths
+	}
+	if err := d.lit.build(lengths[:nlen]); err != nil {
+		return err
+	}
+	return d.dist.build(lengths[nlen:total])
+}
+
+func (d *gzipInflater) codesBlock(lit, dist *huffman) error {
+	for {
+		sym, err := d.decodeSymbol(lit)
+		if err != nil {
+			return err
+		}
+		if sym < 256 {
+			d.writeByte(byte(sym))
+			if d.dstFull() {
+				return nil
+			}
+			continue
+		}
+		if sym == 256 {
+			return nil
+		}
+
+		sym -= 257
+		if sym >= len(deflateLengthBase) {
+			return errDeflateCode
+		}
+		extra, err := d.getBits(uint(deflateLengthExtra[sym]))
+		if err != nil {
+			return err
+		}
+		length := int(deflateLengthBase[sym]) + int(extra)
+
+		sym, err = d.decodeSymbol(dist)
+		if err != nil {
+			return err
+		}
+		if sym >= len(deflateDistBase) {
+			return errDeflateCode
+		}
+		extra, err = d.getBits(uint(deflateDistExtra[sym]))
+		if err != nil {
+			return err
+		}
+		distance := int(deflateDistBase[sym]) + int(extra)
+		if int64(distance) > d.out {
+			return errDeflateDistance
+		}
+
+		for ; length > 0; length-- {
+			d.writeByte(d.window[(d.wpos-distance+gzipWindowSize)%gzipWindowSize])
+		}
+		if d.dstFull() {
+			return nil
+		}
+	}
+}
+
+func (d *gzipInflater) decodeSymbol(h *huffman) (int, error) {
+	// fill the bit buffer for a table lookup. Running out of input here is not
+	// an error since the next code may be shorter than `huffPrimaryBits`.
+	for d.nbits < huffPrimaryBits {
+		c, err := d.r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		d.consumed++
+		d.bitBuf |= uint64(c) << d.nbits
+		d.nbits += 8
+	}
+	if entry := h.table[d.bitBuf&(1<<huffPrimaryBits-1)]; entry != 0 {
+		if l := uint(entry & 0xf); l <= d.nbits {
+			d.bitBuf >>= l
+			d.nbits -= l
+			return int(entry >> 4), nil
+		}
+	}
+
+	// slow path for long codes: decode one bit at a time.
+	code, first, index := 0, 0, 0
+	for l := 1; l <= huffMaxBits; l++ {
+		b, err := d.getBits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= int(b)
+		count := int(h.count[l])
+		if code-count < first {
+			return int(h.symbol[index+(code-first)]), nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+	return 0, errDeflateCode
+}
@@ -0,0 +1,191 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Gzip zinfo with compressed checkpoint windows. Every checkpoint holds a 32KiB window,
+// so windows make up almost all of a gzip zinfo. They are compressed independently with
+// raw deflate so that a window can be decompressed only when its span is extracted.
+//
+// The blob starts with a header:
+//   - 4 bytes, `gzipCompressedWindowsMarker`. Blobs of earlier versions start with the
+//     number of checkpoints, which is never negative, so the two can't be confused.
+//   - 4 bytes, number of checkpoints
+//   - 8 bytes, span size
+//
+// followed by the checkpoints:
+//   - 8 bytes, compressed offset
+//   - 8 bytes, uncompressed offset
+//   - 1 byte, bits
+//   - 4 bytes, size of the compressed window
+//   - the compressed window
+const (
+	gzipZinfoVersionThree = 3
+
+	gzipCompressedWindowsMarker        = -gzipZinfoVersionThree
+	gzipCompressedBlobHeaderSize       = 4 + 4 + 8
+	gzipCompressedCheckpointHeaderSize = 8 + 8 + 1 + 4
+)
+
+// CompressGzipCheckpointWindows converts a gzip zinfo blob to the encoding with compressed
+// checkpoint windows. Blobs that already use this encoding are returned unchanged.
+// Both gzip implementations can read the converted blob.
+func CompressGzipCheckpointWindows(zinfoBytes []byte) ([]byte, error) {
+	if hasCompressedGzipWindows(zinfoBytes) {
+		return zinfoBytes, nil
+	}
+	zinfo, err := newGoGzipZinfo(zinfoBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := zinfo.compressWindows(); err != nil {
+		return nil, err
+	}
+	return zinfo.Bytes()
+}
+
+// decompressGzipCheckpointWindows converts a gzip zinfo blob with compressed checkpoint
+// windows to a version 2 blob, which is the format read by `gzip_zinfo.c`.
+func decompressGzipCheckpointWindows(zinfoBytes []byte) ([]byte, error) {
+	zinfo, err := newGoGzipZinfo(zinfoBytes)
+	if err != nil {
+		return nil, err
+	}
+	for j := range zinfo.checkpoints {
+		window, err := zinfo.checkpointWindow(SpanID(j))
+		if err != nil {
+			return nil, err
+		}
+		zinfo.checkpoints[j].window = window
+	}
+	zinfo.version = gzipZinfoVersionTwo
+	return zinfo.Bytes()
+}
+
+// hasCompressedGzipWindows returns whether a gzip zinfo blob stores compressed checkpoint windows.
+func hasCompressedGzipWindows(zinfoBytes []byte) bool {
+	return len(zinfoBytes) >= 4 && int32(binary.LittleEndian.Uint32(zinfoBytes[0:4])) == gzipCompressedWindowsMarker
+}
+
+// newGoGzipZinfoWithCompressedWindows creates a new instance of `GoGzipZinfo` from a zinfo
+// blob with compressed checkpoint windows. Windows stay compressed in memory.
+func newGoGzipZinfoWithCompressedWindows(zinfoBytes []byte) (*GoGzipZinfo, error) {
+	if len(zinfoBytes) < gzipCompressedBlobHeaderSize {
+		return nil, fmt.Errorf("cannot convert blob to gzip_zinfo")
+	}
+	numCheckpoints := int32(binary.LittleEndian.Uint32(zinfoBytes[4:8]))
+	spanSize := int64(binary.LittleEndian.Uint64(zinfoBytes[8:16]))
+	// every checkpoint takes at least its header, which bounds the allocation below.
+	if numCheckpoints < 0 || int64(numCheckpoints)*gzipCompressedCheckpointHeaderSize > int64(len(zinfoBytes)) {
+		return nil, fmt.Errorf("cannot convert blob to gzip_zinfo")
+	}
+
+	checkpoints := make([]gzipCheckpoint, numCheckpoints)
+	cur := zinfoBytes[gzipCompressedBlobHeaderSize:]
+	for i := range checkpoints {
+		if len(cur) < gzipCompressedCheckpointHeaderSize {
+			return nil, fmt.Errorf("cannot convert blob to gzip_zinfo")
+		}
+		windowSize := int64(binary.LittleEndian.Uint32(cur[17:21]))
+		end := gzipCompressedCheckpointHeaderSize + windowSize
+		if int64(len(cur)) < end {
+			return nil, fmt.Errorf("cannot convert blob to gzip_zinfo")
+		}
+		checkpoints[i] = gzipCheckpoint{
+			in:     Offset(binary.LittleEndian.Uint64(cur[0:8])),
+			out:    Offset(binary.LittleEndian.Uint64(cur[8:16])),
+			bits:   cur[16],
+			window: cur[gzipCompressedCheckpointHeaderSize:end:end],
+		}
+		cur = cur[end:]
+	}
+	if len(cur) != 0 {
+		return nil, fmt.Errorf("cannot convert blob to gzip_zinfo")
+	}
+
+	return &GoGzipZinfo{
+		version:     gzipZinfoVersionThree,
+		spanSize:    spanSize,
+		checkpoints: checkpoints,
+	}, nil
+}
+
+// bytesWithCompressedWindows returns the byte slice containing the zinfo with compressed checkpoint windows.
+func (i *GoGzipZinfo) bytesWithCompressedWindows() ([]byte, error) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, int32(gzipCompressedWindowsMarker))
+	binary.Write(&buf, binary.LittleEndian, int32(len(i.checkpoints)))
+	binary.Write(&buf, binary.LittleEndian, i.spanSize)
+	for _, cp := range i.checkpoints {
+		binary.Write(&buf, binary.LittleEndian, int64(cp.in))
+		binary.Write(&buf, binary.LittleEndian, int64(cp.out))
+		buf.WriteByte(cp.bits)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(cp.window)))
+		buf.Write(cp.window)
+	}
+	return buf.Bytes(), nil
+}
+
+// compressWindows compresses the checkpoint windows of the zinfo in place.
+func (i *GoGzipZinfo) compressWindows() error {
+	if i.version == gzipZinfoVersionThree {
+		return nil
+	}
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return err
+	}
+	for j := range i.checkpoints {
+		buf.Reset()
+		w.Reset(&buf)
+		if _, err := w.Write(i.checkpoints[j].window); err != nil {
+			return fmt.Errorf("failed to compress checkpoint window: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("failed to compress checkpoint window: %w", err)
+		}
+		i.checkpoints[j].window = bytes.Clone(buf.Bytes())
+	}
+	i.version = gzipZinfoVersionThree
+	return nil
+}
+
+// checkpointWindow returns the uncompressed window of the checkpoint at the start of `spanID`.
+func (i *GoGzipZinfo) checkpointWindow(spanID SpanID) ([]byte, error) {
+	window := i.checkpoints[spanID].window
+	if i.version != gzipZinfoVersionThree {
+		return window, nil
+	}
+	r := flate.NewReader(bytes.NewReader(window))
+	defer r.Close()
+	uncompressed := make([]byte, gzipWindowSize)
+	if _, err := io.ReadFull(r, uncompressed); err != nil {
+		return nil, fmt.Errorf("invalid compressed window of span %d: %w", spanID, err)
+	}
+	if n, _ := r.Read(make([]byte, 1)); n != 0 {
+		return nil, fmt.Errorf("invalid compressed window of span %d: window is larger than %d bytes", spanID, gzipWindowSize)
+	}
+	return uncompressed, nil
+}
@@ -0,0 +1,154 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+// testGzipImplementations returns the gzip implementations supported by this build.
+func testGzipImplementations() []GzipImplementation {
+	if cgoGzipSupported {
+		return []GzipImplementation{GzipImplementationCgo, GzipImplementationGo}
+	}
+	return []GzipImplementation{GzipImplementationGo}
+}
+
+func TestCompressGzipCheckpointWindows(t *testing.T) {
+	t.Parallel()
+	data := gzipTestData(4, 2<<20)
+	compressed, filename := writeGzipTestFile(t, data, gzip.DefaultCompression)
+	zinfo, err := newGoGzipZinfoFromFile(filename, 64<<10)
+	if err != nil {
+		t.Fatalf("failed to build gzip zinfo: %v", err)
+	}
+	blob, err := zinfo.Bytes()
+	if err != nil {
+		t.Fatalf("failed to serialize gzip zinfo: %v", err)
+	}
+	compressedBlob, err := CompressGzipCheckpointWindows(blob)
+	if err != nil {
+		t.Fatalf("failed to compress checkpoint windows: %v", err)
+	}
+	if len(compressedBlob)*2 > len(blob) {
+		t.Fatalf("zinfo with compressed windows is too large; got %d bytes, uncompressed windows take %d bytes", len(compressedBlob), len(blob))
+	}
+
+	again, err := CompressGzipCheckpointWindows(compressedBlob)
+	if err != nil {
+		t.Fatalf("failed to compress checkpoint windows twice: %v", err)
+	}
+	if !bytes.Equal(again, compressedBlob) {
+		t.Fatalf("compressing checkpoint windows twice changed the zinfo")
+	}
+	decompressedBlob, err := decompressGzipCheckpointWindows(compressedBlob)
+	if err != nil {
+		t.Fatalf("failed to decompress checkpoint windows: %v", err)
+	}
+	if !bytes.Equal(decompressedBlob, blob) {
+		t.Fatalf("decompressing checkpoint windows doesn't restore the original zinfo")
+	}
+
+	for _, impl := range testGzipImplementations() {
+		impl := impl
+		t.Run(string(impl), func(t *testing.T) {
+			zinfo, err := newGzipZinfoWithImplementation(impl, compressedBlob)
+			if err != nil {
+				t.Fatalf("failed to read zinfo with compressed windows: %v", err)
+			}
+			defer zinfo.Close()
+
+			b, err := zinfo.Bytes()
+			if err != nil {
+				t.Fatalf("failed to serialize zinfo: %v", err)
+			}
+			if !bytes.Equal(b, compressedBlob) {
+				t.Fatalf("zinfo with compressed windows isn't serialized to the same bytes")
+			}
+
+			compressedSize := Offset(len(compressed))
+			uncompressedSize := Offset(len(data))
+			var spanID SpanID
+			for spanID = 0; spanID <= zinfo.MaxSpanID(); spanID++ {
+				start := zinfo.StartUncompressedOffset(spanID)
+				end := zinfo.EndUncompressedOffset(spanID, uncompressedSize)
+				buf := compressed[zinfo.StartCompressedOffset(spanID):zinfo.EndCompressedOffset(spanID, compressedSize)]
+				extracted, err := zinfo.ExtractDataFromBuffer(buf, end-start, start, spanID)
+				if err != nil {
+					t.Fatalf("failed to extract span %d: %v", spanID, err)
+				}
+				if !bytes.Equal(extracted, data[start:end]) {
+					t.Fatalf("span %d extracted from buffer does not match the original data", spanID)
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidGzipZinfoWithCompressedWindows(t *testing.T) {
+	t.Parallel()
+	data := gzipTestData(5, 256<<10)
+	_, filename := writeGzipTestFile(t, data, gzip.DefaultCompression)
+	zinfo, err := newGoGzipZinfoFromFile(filename, 64<<10)
+	if err != nil {
+		t.Fatalf("failed to build gzip zinfo: %v", err)
+	}
+	blob, err := zinfo.Bytes()
+	if err != nil {
+		t.Fatalf("failed to serialize gzip zinfo: %v", err)
+	}
+	compressedBlob, err := CompressGzipCheckpointWindows(blob)
+	if err != nil {
+		t.Fatalf("failed to compress checkpoint windows: %v", err)
+	}
+
+	// the window of the last checkpoint is at the end of the blob.
+	corruptWindow := bytes.Clone(compressedBlob)
+	corruptWindow[len(corruptWindow)-4] ^= 0xff
+	testCases := []struct {
+		name string
+		blob []byte
+	}{
+		{
+			name: "truncated header",
+			blob: compressedBlob[:gzipCompressedBlobHeaderSize-1],
+		},
+		{
+			name: "truncated checkpoint",
+			blob: compressedBlob[:len(compressedBlob)-1],
+		},
+		{
+			name: "trailing data",
+			blob: append(bytes.Clone(compressedBlob), 0),
+		},
+		{
+			name: "corrupt window",
+			blob: corruptWindow,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := decompressGzipCheckpointWindows(tc.blob); err == nil {
+				t.Fatalf("expected error reading invalid zinfo with compressed windows")
+			}
+		})
+	}
+}
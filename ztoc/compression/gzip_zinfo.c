@@ -1,3 +1,5 @@
+//go:build cgo
+
 /*
    Copyright The Soci Snapshotter Authors.
 
@@ -75,6 +77,20 @@ inline int32_t decode_int32(int32_t source) {
 
 static int min(int lhs, int rhs) { return lhs < rhs ? lhs : rhs; }
 
+#define GZIP_TRAILER_SIZE 8
+
+/* Prepares `strm` to decompress the member following the one that just ended
+   in a multi-member gzip stream (e.g. eStargz). Extraction starts in raw mode at
+   a checkpoint, so the trailer of that member must be skipped by the caller,
+   while zlib reads the headers and trailers of the following members itself.
+   Returns the number of trailer bytes to skip. */
+static int next_member(z_stream *strm, int *gzip_mode) {
+    if (*gzip_mode)
+        return inflateReset(strm) == Z_OK ? 0 : -1;
+    *gzip_mode = 1;
+    return inflateReset2(strm, 31) == Z_OK ? GZIP_TRAILER_SIZE : -1;
+}
+
 int init_flate(z_stream *strm, int windowBits) {
     int ret;
     strm->zalloc = Z_NULL;
@@ -173,6 +189,7 @@ static struct gzip_zinfo *add_checkpoint(struct gzip_zinfo *index, uint8_t bits,
         }
         index->size = 8;
         index->have = 0;
+        index->members = 0;
     } else if (index->have == index->size) {
         /* if list is full, make it bigger */
         index->size <<= 1;
@@ -199,9 +216,10 @@ static struct gzip_zinfo *add_checkpoint(struct gzip_zinfo *index, uint8_t bits,
     return index;
 }
 
-/* Pretty much the same as from zran.c */
+/* Pretty much the same as from zran.c, except that the following members of a
+   multi-member gzip stream are indexed too */
 int generate_zinfo_from_fp(FILE* in, offset_t span, struct gzip_zinfo** idx) {
-    int ret;
+    int ret, member_end, members;
     offset_t totin, totout;        /* our own total counters to avoid 4GB limit */
     offset_t last;                 /* totout value of last access point */
     struct gzip_zinfo *index;       /* access points being generated */
@@ -220,6 +238,8 @@ int generate_zinfo_from_fp(FILE* in, offset_t span, struct gzip_zinfo** idx) {
     totin = totout = last = 0;
     index = NULL;               /* will be allocated by first add_checkpoint() */
     strm.avail_out = 0;
+    member_end = 0;
+    members = 0;
     do {
         /* get some compressed data from input file */
         memset(input, 0, CHUNK);
@@ -229,6 +249,11 @@ int generate_zinfo_from_fp(FILE* in, offset_t span, struct gzip_zinfo** idx) {
             goto build_index_error;
         }
         if (strm.avail_in == 0) {
+            /* the stream ends after the last member */
+            if (member_end) {
+                ret = Z_STREAM_END;
+                break;
+            }
             ret = Z_DATA_ERROR;
             goto build_index_error;
         }
@@ -251,10 +276,27 @@ int generate_zinfo_from_fp(FILE* in, offset_t span, struct gzip_zinfo** idx) {
             totout -= strm.avail_out;
             if (ret == Z_NEED_DICT)
                 ret = Z_DATA_ERROR;
+            /* like gzip -d, data that isn't a gzip member after the last member is ignored */
+            if (ret == Z_DATA_ERROR && member_end) {
+                ret = Z_STREAM_END;
+                break;
+            }
             if (ret == Z_MEM_ERROR || ret == Z_DATA_ERROR)
                 goto build_index_error;
-            if (ret == Z_STREAM_END)
-                break;
+            if (ret == Z_STREAM_END) {
+                /* continue with the following member of a multi-member stream, if any */
+                if (inflateReset(&strm) != Z_OK) {
+                    ret = Z_MEM_ERROR;
+                    goto build_index_error;
+                }
+                member_end = 1;
+                members++;
+                ret = Z_OK;
+                continue;
+            }
+            /* the header of the following member has been read */
+            if (strm.data_type & 128)
+                member_end = 0;
 
             /* if at end of block, consider adding an index entry (note that if
                data_type indicates an end-of-block, then all of the
@@ -287,6 +329,7 @@ int generate_zinfo_from_fp(FILE* in, offset_t span, struct gzip_zinfo** idx) {
     index->size = encode_int32(index->size);
     index->span_size = encode_offset(span);
     index->version = encode_int32(ZINFO_VERSION_CUR);
+    index->members = members;
     *idx = index;
     return sz;
 
@@ -307,7 +350,8 @@ int generate_zinfo_from_file(const char *filepath, offset_t span, struct gzip_zi
 }
 
 int extract_data_from_fp(FILE *in, struct gzip_zinfo *index, offset_t offset, void *buffer, int len) {
-    int ret, skip;
+    int ret, skip, gzip_mode, trailer, member_end;
+    unsigned have;
     z_stream strm;
     struct gzip_checkpoint *here;
     unsigned char input[CHUNK], discard[WINSIZE];
@@ -344,6 +388,9 @@ int extract_data_from_fp(FILE *in, struct gzip_zinfo *index, offset_t offset, vo
     offset -= decode_offset(here->out);
     strm.avail_in = 0;
     skip = 1;                               /* while skipping to offset */
+    gzip_mode = 0;
+    trailer = 0;
+    member_end = 0;
     do {
         /* define where to put uncompressed data, and how much */
         if (offset == 0 && skip) {          /* at offset now */
@@ -369,18 +416,45 @@ int extract_data_from_fp(FILE *in, struct gzip_zinfo *index, offset_t offset, vo
                     goto extract_ret;
                 }
                 if (strm.avail_in == 0) {
+                    /* the stream ends after the last member */
+                    if (member_end) {
+                        ret = Z_STREAM_END;
+                        break;
+                    }
                     ret = Z_DATA_ERROR;
                     goto extract_ret;
                 }
                 strm.next_in = input;
             }
+            if (trailer > 0) {
+                have = min(trailer, strm.avail_in);
+                strm.next_in += have;
+                strm.avail_in -= have;
+                trailer -= have;
+                continue;
+            }
+            have = strm.avail_out;
             ret = inflate(&strm, Z_NO_FLUSH);       /* normal inflate */
+            if (strm.avail_out != have)
+                member_end = 0;
             if (ret == Z_NEED_DICT)
                 ret = Z_DATA_ERROR;
+            /* data that isn't a gzip member after the last member ends the stream */
+            if (ret == Z_DATA_ERROR && member_end) {
+                ret = Z_STREAM_END;
+                break;
+            }
             if (ret == Z_MEM_ERROR || ret == Z_DATA_ERROR)
                 goto extract_ret;
-            if (ret == Z_STREAM_END)
-                break;
+            if (ret == Z_STREAM_END) {
+                trailer = next_member(&strm, &gzip_mode);
+                if (trailer < 0) {
+                    ret = Z_MEM_ERROR;
+                    goto extract_ret;
+                }
+                member_end = 1;
+                ret = Z_OK;
+            }
         } while (strm.avail_out != 0);
 
         /* if reach end of stream, then don't keep trying to get more */
@@ -413,7 +487,8 @@ int extract_data_from_file(const char* file, struct gzip_zinfo* index, offset_t
 int extract_data_from_buffer(void *d, offset_t datalen,
                              struct gzip_zinfo *index, offset_t offset,
                              void *buffer, offset_t len, int first_checkpoint) {
-    int ret, skip;
+    int ret, skip, gzip_mode, trailer, member_end;
+    unsigned have;
     z_stream strm;
     unsigned char input[CHUNK], discard[WINSIZE];
     uchar *buf = buffer;
@@ -439,6 +514,9 @@ int extract_data_from_buffer(void *d, offset_t datalen,
     offset -= decode_offset(index->list[first_checkpoint].out);
     strm.avail_in = 0;
     skip = 1; /* while skipping to offset */
+    gzip_mode = 0;
+    trailer = 0;
+    member_end = 0;
     int remaining = datalen;
     do {
         /* define where to put uncompressed data, and how much */
@@ -465,14 +543,45 @@ int extract_data_from_buffer(void *d, offset_t datalen,
                 data += read;
                 strm.avail_in = read;
                 strm.next_in = input;
+                if (read == 0) {
+                    /* the stream ends after the last member */
+                    if (member_end) {
+                        ret = Z_STREAM_END;
+                        break;
+                    }
+                    ret = Z_DATA_ERROR;
+                    goto extract_ret;
+                }
             }
+            if (trailer > 0) {
+                have = min(trailer, strm.avail_in);
+                strm.next_in += have;
+                strm.avail_in -= have;
+                trailer -= have;
+                continue;
+            }
+            have = strm.avail_out;
             ret = inflate(&strm, Z_NO_FLUSH); /* normal inflate */
+            if (strm.avail_out != have)
+                member_end = 0;
             if (ret == Z_NEED_DICT)
                 ret = Z_DATA_ERROR;
+            /* data that isn't a gzip member after the last member ends the stream */
+            if (ret == Z_DATA_ERROR && member_end) {
+                ret = Z_STREAM_END;
+                break;
+            }
             if (ret == Z_MEM_ERROR || ret == Z_DATA_ERROR)
                 goto extract_ret;
-            if (ret == Z_STREAM_END)
-                break;
+            if (ret == Z_STREAM_END) {
+                trailer = next_member(&strm, &gzip_mode);
+                if (trailer < 0) {
+                    ret = Z_MEM_ERROR;
+                    goto extract_ret;
+                }
+                member_end = 1;
+                ret = Z_OK;
+            }
         } while (strm.avail_out != 0);
 
         /* if reach end of stream, then don't keep trying to get more */
@@ -597,6 +706,7 @@ struct gzip_zinfo* blob_to_zinfo(void* buf, offset_t len) {
     index->have = size;
     index->size = size;
     index->span_size = span_size;
+    index->members = 0;
 
     return index;
 }
@@ -1,3 +1,5 @@
+//go:build cgo
+
 /*
    Copyright The Soci Snapshotter Authors.
 
@@ -25,25 +27,40 @@ import "C"
 
 import (
 	"fmt"
+	"io"
 	"unsafe"
 )
 
 // GzipZinfo is a go struct wrapper of the gzip zinfo's C implementation.
 type GzipZinfo struct {
 	cZinfo *C.struct_gzip_zinfo
+	// compressedWindows is set if the zinfo was read from a blob with compressed
+	// checkpoint windows, so that it's serialized to the same encoding.
+	compressedWindows bool
 }
 
 // newGzipZinfo creates a new instance of `GzipZinfo` from cZinfo byte blob on zTOC.
+// Compressed checkpoint windows are decompressed since the C implementation
+// only reads uncompressed windows.
 func newGzipZinfo(zinfoBytes []byte) (*GzipZinfo, error) {
 	if len(zinfoBytes) == 0 {
 		return nil, fmt.Errorf("empty checkpoints")
 	}
+	compressedWindows := hasCompressedGzipWindows(zinfoBytes)
+	if compressedWindows {
+		var err error
+		zinfoBytes, err = decompressGzipCheckpointWindows(zinfoBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
 	cZinfo := C.blob_to_zinfo(unsafe.Pointer(&zinfoBytes[0]), C.off_t(len(zinfoBytes)))
 	if cZinfo == nil {
 		return nil, fmt.Errorf("cannot convert blob to gzip_zinfo")
 	}
 	return &GzipZinfo{
-		cZinfo: cZinfo,
+		cZinfo:            cZinfo,
+		compressedWindows: compressedWindows,
 	}, nil
 }
 
@@ -82,6 +99,9 @@ func (i *GzipZinfo) Bytes() ([]byte, error) {
 	if int(ret) <= 0 {
 		return nil, fmt.Errorf("could not serialize gzip zinfo to byte array; gzip error: %v", ret)
 	}
+	if i.compressedWindows {
+		return CompressGzipCheckpointWindows(bytes)
+	}
 	return bytes, nil
 }
 
@@ -95,6 +115,14 @@ func (i *GzipZinfo) SpanSize() Offset {
 	return Offset(i.cZinfo.span_size)
 }
 
+func (i *GzipZinfo) gzipMembers() int {
+	return int(i.cZinfo.members)
+}
+
+func (i *GzipZinfo) setGzipMembers(members int) {
+	i.cZinfo.members = C.int32_t(members)
+}
+
 // UncompressedOffsetToSpanID returns the ID of the span containing the data pointed by uncompressed offset.
 func (i *GzipZinfo) UncompressedOffsetToSpanID(offset Offset) SpanID {
 	return SpanID(C.pt_index_from_ucmp_offset(i.cZinfo, C.long(offset)))
@@ -125,6 +153,9 @@ func (i *GzipZinfo) ExtractDataFromBuffer(compressedBuf []byte, uncompressedSize
 	if ret <= 0 {
 		return bytes, fmt.Errorf("error extracting data; return code: %v", ret)
 	}
+	if Offset(ret) < uncompressedSize {
+		return nil, fmt.Errorf("error extracting data: %w", io.ErrUnexpectedEOF)
+	}
 
 	return bytes, nil
 }
@@ -145,6 +176,9 @@ func (i *GzipZinfo) ExtractDataFromFile(fileName string, uncompressedSize, uncom
 	if ret <= 0 {
 		return nil, fmt.Errorf("unable to extract data; return code = %v", ret)
 	}
+	if Offset(ret) < uncompressedSize {
+		return nil, fmt.Errorf("unable to extract data: %w", io.ErrUnexpectedEOF)
+	}
 
 	return bytes, nil
 }
@@ -96,6 +96,7 @@ struct gzip_zinfo {
     int32_t size;           /* number of list entries allocated */
     struct gzip_checkpoint *list; /* allocated list */
     offset_t span_size;
+    int32_t members;        /* number of gzip members indexed, or 0 if unknown */
 };
 
 // zinfo - metadata starts.
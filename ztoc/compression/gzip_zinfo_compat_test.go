@@ -0,0 +1,265 @@
+//go:build cgo
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// TestGzipZinfoCompatibility verifies that the cgo and the pure go gzip zinfo
+// generate identical zinfo and extract identical data.
+func TestGzipZinfoCompatibility(t *testing.T) {
+	t.Parallel()
+	data := gzipTestData(3, 3<<20)
+	testCases := []struct {
+		name     string
+		level    int
+		spanSize int64
+		// if not zero, the data is compressed in gzip members of at most `memberSize` bytes.
+		memberSize int
+		padding    int
+	}{
+		{
+			name:     "default compression",
+			level:    gzip.DefaultCompression,
+			spanSize: 64 << 10,
+		},
+		{
+			name:     "best speed",
+			level:    gzip.BestSpeed,
+			spanSize: 1 << 20,
+		},
+		{
+			name:     "huffman only",
+			level:    gzip.HuffmanOnly,
+			spanSize: 128 << 10,
+		},
+		{
+			name:     "no compression",
+			level:    gzip.NoCompression,
+			spanSize: 64 << 10,
+		},
+		{
+			name:     "span size smaller than a deflate block",
+			level:    gzip.BestCompression,
+			spanSize: 1,
+		},
+		{
+			name:       "multiple members",
+			level:      gzip.DefaultCompression,
+			spanSize:   64 << 10,
+			memberSize: 512 << 10,
+		},
+		{
+			name:       "multiple members smaller than the span size",
+			level:      gzip.DefaultCompression,
+			spanSize:   1 << 20,
+			memberSize: 64 << 10,
+		},
+		{
+			name:       "multiple members followed by zero padding",
+			level:      gzip.DefaultCompression,
+			spanSize:   64 << 10,
+			memberSize: 1 << 20,
+			padding:    1024,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var compressed []byte
+			var filename string
+			members := 1
+			if tc.memberSize == 0 {
+				compressed, filename = writeGzipTestFile(t, data, tc.level)
+			} else {
+				extents := randomExtents(5, len(data), tc.memberSize)
+				compressed, filename, _ = writeMultiMemberGzipTestFile(t, data, extents)
+				members = len(extents)
+			}
+			if tc.padding > 0 {
+				compressed = append(compressed, make([]byte, tc.padding)...)
+				if err := os.WriteFile(filename, compressed, 0644); err != nil {
+					t.Fatalf("failed to pad gzip file: %v", err)
+				}
+			}
+
+			cZinfo, err := newGzipZinfoFromFile(filename, tc.spanSize)
+			if err != nil {
+				t.Fatalf("failed to build cgo gzip zinfo: %v", err)
+			}
+			defer cZinfo.Close()
+			goZinfo, err := newGoGzipZinfoFromFile(filename, tc.spanSize)
+			if err != nil {
+				t.Fatalf("failed to build go gzip zinfo: %v", err)
+			}
+
+			cBytes, err := cZinfo.Bytes()
+			if err != nil {
+				t.Fatalf("failed to serialize cgo gzip zinfo: %v", err)
+			}
+			goBytes, err := goZinfo.Bytes()
+			if err != nil {
+				t.Fatalf("failed to serialize go gzip zinfo: %v", err)
+			}
+			if !bytes.Equal(cBytes, goBytes) {
+				t.Fatalf("go gzip zinfo does not match cgo gzip zinfo")
+			}
+			if GzipMembers(cZinfo) != members || GzipMembers(goZinfo) != members {
+				t.Fatalf("expected %d gzip members, got %d (cgo) and %d (go)", members, GzipMembers(cZinfo), GzipMembers(goZinfo))
+			}
+
+			// zinfo serialized by one implementation must be readable by the other.
+			fromC, err := newGoGzipZinfo(cBytes)
+			if err != nil {
+				t.Fatalf("failed to deserialize cgo gzip zinfo with go: %v", err)
+			}
+			fromGo, err := newGzipZinfo(goBytes)
+			if err != nil {
+				t.Fatalf("failed to deserialize go gzip zinfo with cgo: %v", err)
+			}
+			defer fromGo.Close()
+
+			zinfos := []Zinfo{cZinfo, goZinfo, fromC, fromGo}
+			compressedSize := Offset(len(compressed))
+			uncompressedSize := Offset(len(data))
+			var spanID SpanID
+			for spanID = 0; spanID <= cZinfo.MaxSpanID(); spanID++ {
+				for _, zinfo := range zinfos {
+					if zinfo.MaxSpanID() != cZinfo.MaxSpanID() ||
+						zinfo.StartCompressedOffset(spanID) != cZinfo.StartCompressedOffset(spanID) ||
+						zinfo.EndCompressedOffset(spanID, compressedSize) != cZinfo.EndCompressedOffset(spanID, compressedSize) ||
+						zinfo.StartUncompressedOffset(spanID) != cZinfo.StartUncompressedOffset(spanID) ||
+						zinfo.EndUncompressedOffset(spanID, uncompressedSize) != cZinfo.EndUncompressedOffset(spanID, uncompressedSize) {
+						t.Fatalf("span %d offsets don't match between gzip zinfo implementations", spanID)
+					}
+				}
+
+				start := cZinfo.StartUncompressedOffset(spanID)
+				end := cZinfo.EndUncompressedOffset(spanID, uncompressedSize)
+				buf := compressed[cZinfo.StartCompressedOffset(spanID):cZinfo.EndCompressedOffset(spanID, compressedSize)]
+				for _, zinfo := range zinfos {
+					extracted, err := zinfo.ExtractDataFromBuffer(buf, end-start, start, spanID)
+					if err != nil {
+						t.Fatalf("failed to extract span %d from buffer: %v", spanID, err)
+					}
+					if !bytes.Equal(extracted, data[start:end]) {
+						t.Fatalf("span %d extracted from buffer does not match the original data", spanID)
+					}
+				}
+			}
+
+			r := rand.New(rand.NewSource(4))
+			for i := 0; i < 20; i++ {
+				offset := Offset(r.Int63n(int64(uncompressedSize)))
+				size := Offset(r.Int63n(int64(uncompressedSize-offset))) + 1
+				if spanOffset := cZinfo.UncompressedOffsetToSpanID(offset); goZinfo.UncompressedOffsetToSpanID(offset) != spanOffset {
+					t.Fatalf("offset %d should belong to span %d", offset, spanOffset)
+				}
+				for _, zinfo := range zinfos {
+					extracted, err := zinfo.ExtractDataFromFile(filename, size, offset)
+					if err != nil {
+						t.Fatalf("failed to extract data from file: %v", err)
+					}
+					if !bytes.Equal(extracted, data[offset:offset+size]) {
+						t.Fatalf("data extracted from file does not match the original data")
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestGzipZinfoShortExtract verifies that both gzip zinfo implementations fail to extract
+// data past the end of the stream or from a truncated span instead of padding it with zeros.
+func TestGzipZinfoShortExtract(t *testing.T) {
+	t.Parallel()
+	data := gzipTestData(3, 1<<20)
+	compressed, filename := writeGzipTestFile(t, data, gzip.DefaultCompression)
+	cZinfo, err := newGzipZinfoFromFile(filename, 64<<10)
+	if err != nil {
+		t.Fatalf("failed to build cgo gzip zinfo: %v", err)
+	}
+	defer cZinfo.Close()
+	goZinfo, err := newGoGzipZinfoFromFile(filename, 64<<10)
+	if err != nil {
+		t.Fatalf("failed to build go gzip zinfo: %v", err)
+	}
+
+	uncompressedSize := Offset(len(data))
+	lastSpan := cZinfo.MaxSpanID()
+	start := cZinfo.StartUncompressedOffset(lastSpan)
+	spanStart := int(cZinfo.StartCompressedOffset(lastSpan))
+	truncated := compressed[spanStart : spanStart+(len(compressed)-spanStart)/2]
+	for name, zinfo := range map[string]Zinfo{"cgo": cZinfo, "go": goZinfo} {
+		if _, err := zinfo.ExtractDataFromFile(filename, 20, uncompressedSize-10); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("%s: expected unexpected EOF extracting data past the end of the stream, got %v", name, err)
+		}
+		if _, err := zinfo.ExtractDataFromBuffer(truncated, uncompressedSize-start, start, lastSpan); err == nil {
+			t.Fatalf("%s: expected error extracting data from a truncated span", name)
+		}
+	}
+}
+
+// TestGzipZinfoImplementationFromReader verifies that gzip zinfo built from a stream or with a
+// span planner, which is always built by the go implementation, is read with the selected one.
+func TestGzipZinfoImplementationFromReader(t *testing.T) {
+	defer SetGzipImplementation(DefaultGzipImplementation)
+	data := gzipTestData(3, 1<<20)
+	compressed, filename := writeGzipTestFile(t, data, gzip.DefaultCompression)
+
+	for _, impl := range []GzipImplementation{GzipImplementationCgo, GzipImplementationGo} {
+		if err := SetGzipImplementation(impl); err != nil {
+			t.Fatalf("failed to set gzip implementation: %v", err)
+		}
+		fromReader, err := NewZinfoFromReader(Gzip, bytes.NewReader(compressed), 64<<10, nil, nil)
+		if err != nil {
+			t.Fatalf("failed to build gzip zinfo from reader: %v", err)
+		}
+		fromPlanner, err := NewZinfoFromFileWithSpanPlanner(Gzip, filename, NewFixedSpanPlanner(64<<10))
+		if err != nil {
+			t.Fatalf("failed to build gzip zinfo with span planner: %v", err)
+		}
+		for _, zinfo := range []Zinfo{fromReader, fromPlanner} {
+			_, isGo := zinfo.(*GoGzipZinfo)
+			if isGo != (impl == GzipImplementationGo) {
+				t.Fatalf("expected gzip zinfo of implementation %s, got %T", impl, zinfo)
+			}
+			if members := GzipMembers(zinfo); members != 1 {
+				t.Fatalf("expected 1 gzip member, got %d", members)
+			}
+			extracted, err := zinfo.ExtractDataFromFile(filename, 1000, 5000)
+			if err != nil {
+				t.Fatalf("failed to extract data from file: %v", err)
+			}
+			if !bytes.Equal(extracted, data[5000:6000]) {
+				t.Fatalf("data extracted from file does not match the original data")
+			}
+			zinfo.Close()
+		}
+	}
+}
@@ -0,0 +1,349 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Gzip zinfo constants. They must be kept consistent with `gzip_zinfo.h`.
+const (
+	gzipWindowSize           = 1 << 15
+	gzipPackedCheckpointSize = 8 + 8 + 1 + gzipWindowSize
+	gzipBlobHeaderSize       = 4 + 8
+
+	gzipZinfoVersionOne = 1
+	gzipZinfoVersionTwo = 2
+	// gzipZinfoVersionThree (compressed checkpoint windows) is
+	// handled in go only, see `gzip_window_compression.go`.
+)
+
+// gzipCheckpoint is a point in a gzip stream from which decompression can start.
+type gzipCheckpoint struct {
+	in     Offset // offset of the first full byte in the compressed stream
+	out    Offset // offset in the uncompressed stream
+	bits   uint8  // number of bits (1-7) from the byte at `in - 1`, or 0
+	window []byte // preceding 32KiB of uncompressed data, compressed in version 3 zinfo
+}
+
+// GoGzipZinfo is a pure go implementation of gzip zinfo. It generates, reads
+// and writes exactly the same zinfo as `GzipZinfo`, so the two implementations
+// can be used interchangeably on the same ztocs.
+type GoGzipZinfo struct {
+	version     int32
+	spanSize    int64
+	checkpoints []gzipCheckpoint
+	members     int // number of gzip members indexed, or 0 if unknown
+}
+
+// newGoGzipZinfo creates a new instance of `GoGzipZinfo` from the zinfo byte blob on zTOC.
+func newGoGzipZinfo(zinfoBytes []byte) (*GoGzipZinfo, error) {
+	if len(zinfoBytes) == 0 {
+		return nil, fmt.Errorf("empty checkpoints")
+	}
+	if hasCompressedGzipWindows(zinfoBytes) {
+		return newGoGzipZinfoWithCompressedWindows(zinfoBytes)
+	}
+	if len(zinfoBytes) < gzipBlobHeaderSize {
+		return nil, fmt.Errorf("cannot convert blob to gzip_zinfo")
+	}
+
+	numCheckpoints := int32(binary.LittleEndian.Uint32(zinfoBytes[0:4]))
+	spanSize := int64(binary.LittleEndian.Uint64(zinfoBytes[4:12]))
+	if numCheckpoints < 0 {
+		return nil, fmt.Errorf("cannot convert blob to gzip_zinfo")
+	}
+
+	// v1 blobs don't contain the first checkpoint, which was assumed to always be
+	// right after a 10 byte gzip header.
+	var version int32
+	claimedSize := int64(gzipPackedCheckpointSize)*int64(numCheckpoints) + gzipBlobHeaderSize
+	switch int64(len(zinfoBytes)) {
+	case claimedSize:
+		version = gzipZinfoVersionTwo
+	case claimedSize - gzipPackedCheckpointSize:
+		version = gzipZinfoVersionOne
+	default:
+		return nil, fmt.Errorf("cannot convert blob to gzip_zinfo")
+	}
+
+	checkpoints := make([]gzipCheckpoint, numCheckpoints)
+	cur := zinfoBytes[gzipBlobHeaderSize:]
+	for i := range checkpoints {
+		if i == 0 && version == gzipZinfoVersionOne {
+			checkpoints[i] = gzipCheckpoint{
+				in:     10,
+				window: make([]byte, gzipWindowSize),
+			}
+			continue
+		}
+		checkpoints[i] = gzipCheckpoint{
+			in:     Offset(binary.LittleEndian.Uint64(cur[0:8])),
+			out:    Offset(binary.LittleEndian.Uint64(cur[8:16])),
+			bits:   cur[16],
+			window: cur[17:gzipPackedCheckpointSize:gzipPackedCheckpointSize],
+		}
+		cur = cur[gzipPackedCheckpointSize:]
+	}
+
+	return &GoGzipZinfo{
+		version:     version,
+		spanSize:    spanSize,
+		checkpoints: checkpoints,
+	}, nil
+}
+
+// newGoGzipZinfoFromFile creates a new instance of `GoGzipZinfo` given gzip file name and span size.
+func newGoGzipZinfoFromFile(gzipFile string, spanSize int64) (*GoGzipZinfo, error) {
+	f, err := os.Open(gzipFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return newGoGzipZinfoFromReader(f, NewFixedSpanPlanner(spanSize), nil, nil)
+}
+
+// newGoGzipZinfoFromReader creates a new instance of `GoGzipZinfo` by reading a gzip stream once.
+// Spans are placed by `planner`. The uncompressed data is written to `uncompressed` if it's not nil,
+// and `onSpan` is called for every new span if it's not nil.
+func newGoGzipZinfoFromReader(r io.Reader, planner SpanPlanner, uncompressed io.Writer, onSpan SpanFunc) (*GoGzipZinfo, error) {
+	checkpoints, members, err := generateGzipCheckpoints(bufio.NewReader(r), planner, uncompressed, onSpan)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate gzip zinfo: %w", err)
+	}
+	return &GoGzipZinfo{
+		version:     gzipZinfoVersionTwo,
+		spanSize:    planner.SpanSize(),
+		checkpoints: checkpoints,
+		members:     members,
+	}, nil
+}
+
+// generateGzipCheckpoints decompresses all the members of a gzip stream and creates a checkpoint
+// at the start of the first deflate block and at the block boundaries where `planner` starts a span.
+// The start of the first block of a member other than the first one is a block boundary too.
+// With a fixed span planner, this matches `generate_zinfo_from_fp` in `gzip_zinfo.c`.
+// The number of members is returned along with the checkpoints.
+func generateGzipCheckpoints(r io.ByteReader, planner SpanPlanner, uncompressed io.Writer, onSpan SpanFunc) ([]gzipCheckpoint, int, error) {
+	d := newGzipInflater(r)
+	d.w = uncompressed
+	if err := d.readHeader(); err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		checkpoints []gzipCheckpoint
+		last        int64
+		members     int
+	)
+	for {
+		if d.out == 0 || planner.StartsSpan(Offset(last), Offset(d.out)) {
+			in, bits := d.position()
+			checkpoints = append(checkpoints, gzipCheckpoint{
+				in:     in,
+				out:    Offset(d.out),
+				bits:   bits,
+				window: d.lastWindow(),
+			})
+			last = d.out
+			if onSpan != nil {
+				// a span starts at the byte containing its first bit, which it shares with the previous span.
+				start := in
+				if bits != 0 {
+					start--
+				}
+				if err := onSpan(start, in); err != nil {
+					return nil, 0, err
+				}
+			}
+		}
+		final, err := d.inflateBlock()
+		if err != nil {
+			return nil, 0, err
+		}
+		if !final {
+			continue
+		}
+		if err := d.readTrailer(); err != nil {
+			return nil, 0, err
+		}
+		members++
+		// like `gzip -d`, data that isn't a gzip member after the last member is ignored.
+		if err := d.readHeader(); err != nil {
+			return checkpoints, members, nil
+		}
+	}
+}
+
+// Close is a no-op since `GoGzipZinfo` doesn't hold any resources.
+func (i *GoGzipZinfo) Close() {}
+
+// Bytes returns the byte slice containing the zinfo.
+func (i *GoGzipZinfo) Bytes() ([]byte, error) {
+	if i.version == gzipZinfoVersionThree {
+		return i.bytesWithCompressedWindows()
+	}
+
+	// v1 zinfo skips the first checkpoint so that it's reserialized to exactly the same bytes.
+	checkpoints := i.checkpoints
+	if i.version == gzipZinfoVersionOne && len(checkpoints) > 0 {
+		checkpoints = checkpoints[1:]
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(gzipBlobHeaderSize + len(checkpoints)*gzipPackedCheckpointSize)
+	binary.Write(&buf, binary.LittleEndian, int32(len(i.checkpoints)))
+	binary.Write(&buf, binary.LittleEndian, i.spanSize)
+	for _, cp := range checkpoints {
+		binary.Write(&buf, binary.LittleEndian, int64(cp.in))
+		binary.Write(&buf, binary.LittleEndian, int64(cp.out))
+		buf.WriteByte(cp.bits)
+		buf.Write(cp.window)
+	}
+	return buf.Bytes(), nil
+}
+
+// MaxSpanID returns the max span ID.
+func (i *GoGzipZinfo) MaxSpanID() SpanID {
+	return SpanID(len(i.checkpoints) - 1)
+}
+
+// SpanSize returns the span size of the constructed ztoc.
+func (i *GoGzipZinfo) SpanSize() Offset {
+	return Offset(i.spanSize)
+}
+
+func (i *GoGzipZinfo) gzipMembers() int {
+	return i.members
+}
+
+func (i *GoGzipZinfo) setGzipMembers(members int) {
+	i.members = members
+}
+
+// UncompressedOffsetToSpanID returns the ID of the span containing the data pointed by uncompressed offset.
+func (i *GoGzipZinfo) UncompressedOffsetToSpanID(offset Offset) SpanID {
+	idx := sort.Search(len(i.checkpoints), func(j int) bool {
+		return i.checkpoints[j].out > offset
+	})
+	if idx == 0 {
+		return 0
+	}
+	return SpanID(idx - 1)
+}
+
+// ExtractDataFromBuffer takes in the compressed bytes of the spans starting at `spanID`
+// and returns the decompressed bytes.
+func (i *GoGzipZinfo) ExtractDataFromBuffer(compressedBuf []byte, uncompressedSize, uncompressedOffset Offset, spanID SpanID) ([]byte, error) {
+	if len(compressedBuf) == 0 {
+		return nil, fmt.Errorf("empty compressed buffer")
+	}
+	if uncompressedSize < 0 {
+		return nil, fmt.Errorf("invalid uncompressed size: %d", uncompressedSize)
+	}
+	if uncompressedSize == 0 {
+		return []byte{}, nil
+	}
+	if spanID < 0 || spanID > i.MaxSpanID() {
+		return nil, fmt.Errorf("invalid span id: %d", spanID)
+	}
+	return i.extractData(bytes.NewReader(compressedBuf), uncompressedSize, uncompressedOffset, spanID)
+}
+
+// ExtractDataFromFile returns the decompressed bytes given the name of the .tar.gz file,
+// offset and the size in uncompressed stream.
+func (i *GoGzipZinfo) ExtractDataFromFile(fileName string, uncompressedSize, uncompressedOffset Offset) ([]byte, error) {
+	if uncompressedSize < 0 {
+		return nil, fmt.Errorf("invalid uncompressed size: %d", uncompressedSize)
+	}
+	if uncompressedSize == 0 {
+		return []byte{}, nil
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	spanID := i.UncompressedOffsetToSpanID(uncompressedOffset)
+	if _, err := f.Seek(int64(i.StartCompressedOffset(spanID)), io.SeekStart); err != nil {
+		return nil, err
+	}
+	return i.extractData(bufio.NewReader(f), uncompressedSize, uncompressedOffset, spanID)
+}
+
+// extractData decompresses `size` bytes at `offset` in the uncompressed stream from `r`,
+// which must be positioned at the start of `spanID` in the compressed stream.
+func (i *GoGzipZinfo) extractData(r io.ByteReader, size, offset Offset, spanID SpanID) ([]byte, error) {
+	cp := i.checkpoints[spanID]
+	window, err := i.checkpointWindow(spanID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to extract data: %w", err)
+	}
+	d, err := newGzipInflaterAt(r, i.StartCompressedOffset(spanID), cp.out, cp.bits, window)
+	if err != nil {
+		return nil, fmt.Errorf("unable to extract data: %w", err)
+	}
+	extracted, err := d.extract(int64(offset), int64(size))
+	if err != nil {
+		return nil, fmt.Errorf("unable to extract data: %w", err)
+	}
+	// the stream ended before `size` bytes were decompressed, e.g. because the span is truncated.
+	if Offset(len(extracted)) < size {
+		return nil, fmt.Errorf("unable to extract data: %w", io.ErrUnexpectedEOF)
+	}
+	return extracted, nil
+}
+
+// StartCompressedOffset returns the start offset of the span in the compressed stream.
+func (i *GoGzipZinfo) StartCompressedOffset(spanID SpanID) Offset {
+	cp := i.checkpoints[spanID]
+	if cp.bits != 0 {
+		return cp.in - 1
+	}
+	return cp.in
+}
+
+// EndCompressedOffset returns the end offset of the span in the compressed stream. If
+// it's the last span, returns the size of the compressed stream.
+func (i *GoGzipZinfo) EndCompressedOffset(spanID SpanID, fileSize Offset) Offset {
+	if spanID == i.MaxSpanID() {
+		return fileSize
+	}
+	return i.checkpoints[spanID+1].in
+}
+
+// StartUncompressedOffset returns the start offset of the span in the uncompressed stream.
+func (i *GoGzipZinfo) StartUncompressedOffset(spanID SpanID) Offset {
+	return i.checkpoints[spanID].out
+}
+
+// EndUncompressedOffset returns the end offset of the span in the uncompressed stream. If
+// it's the last span, returns the size of the uncompressed stream.
+func (i *GoGzipZinfo) EndUncompressedOffset(spanID SpanID, fileSize Offset) Offset {
+	if spanID == i.MaxSpanID() {
+		return fileSize
+	}
+	return i.checkpoints[spanID+1].out
+}
@@ -0,0 +1,292 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// gzipTestData returns data that compresses into a mix of stored and huffman coded deflate blocks.
+func gzipTestData(seed int64, size int) []byte {
+	r := rand.New(rand.NewSource(seed))
+	data := make([]byte, 0, size)
+	words := []string{"soci ", "snapshotter ", "lazy ", "loading ", "ztoc ", "span ", "\n"}
+	for len(data) < size {
+		if r.Intn(4) == 0 {
+			chunk := make([]byte, r.Intn(4096))
+			r.Read(chunk)
+			data = append(data, chunk...)
+			continue
+		}
+		for i := r.Intn(1024); i > 0; i-- {
+			data = append(data, words[r.Intn(len(words))]...)
+		}
+	}
+	return data[:size]
+}
+
+// writeGzipTestFile compresses data with the given level and writes it to a temp file.
+func writeGzipTestFile(t *testing.T, data []byte, level int) ([]byte, string) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		t.Fatalf("failed to create gzip writer: %v", err)
+	}
+	// set optional header fields so the first deflate block doesn't start at offset 10.
+	w.Name = "layer.tar"
+	w.Comment = "soci"
+	w.Extra = []byte("extra")
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("failed to compress data: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to compress data: %v", err)
+	}
+
+	f, err := os.CreateTemp(t.TempDir(), "gzip-zinfo-*.gz")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		t.Fatalf("failed to write temp file: %v", err)
+	}
+	return buf.Bytes(), f.Name()
+}
+
+func TestNewGoGzipZinfo(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name        string
+		zinfoBytes  []byte
+		expectError bool
+	}{
+		{
+			name:        "nil zinfoBytes should return error",
+			zinfoBytes:  nil,
+			expectError: true,
+		},
+		{
+			name:        "empty zinfoBytes should return error",
+			zinfoBytes:  []byte{},
+			expectError: true,
+		},
+		{
+			name:        "zinfoBytes with less than 'header size' bytes header should return error",
+			zinfoBytes:  []byte{00},
+			expectError: true,
+		},
+		{
+			name: "zinfoBytes with too few checkpoints should return error",
+			zinfoBytes: []byte{
+				0xFF, 00, 00, 00, // 255 checkpoints
+				00, 00, 00, 00, 00, 00, 00, 00, // span size 0
+			},
+			expectError: true,
+		},
+		{
+			name: "zinfoBytes with zero checkpoints should succeed",
+			zinfoBytes: []byte{
+				00, 00, 00, 00, // 0 checkpoints
+				00, 00, 00, 00, 00, 00, 00, 00, // span size 0
+			},
+			expectError: false,
+		},
+		{
+			name: "zinfoBytes v1 with zero checkpoints should succeed",
+			zinfoBytes: []byte{
+				01, 00, 00, 00, // 1 checkpoint
+				00, 00, 00, 00, 00, 00, 00, 00, // span size 0
+			},
+			expectError: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newGoGzipZinfo(tc.zinfoBytes)
+			if tc.expectError != (err != nil) {
+				t.Fatalf("expect error: %t, actual error: %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestGoGzipZinfoFromFile(t *testing.T) {
+	t.Parallel()
+	data := gzipTestData(1, 1<<20)
+	testCases := []struct {
+		name     string
+		level    int
+		spanSize int64
+	}{
+		{
+			name:     "default compression",
+			level:    gzip.DefaultCompression,
+			spanSize: 64 << 10,
+		},
+		{
+			name:     "best compression",
+			level:    gzip.BestCompression,
+			spanSize: 100 << 10,
+		},
+		{
+			name:     "huffman only",
+			level:    gzip.HuffmanOnly,
+			spanSize: 64 << 10,
+		},
+		{
+			name:     "no compression",
+			level:    gzip.NoCompression,
+			spanSize: 64 << 10,
+		},
+		{
+			name:     "span size larger than the stream",
+			level:    gzip.DefaultCompression,
+			spanSize: 2 << 20,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			compressed, filename := writeGzipTestFile(t, data, tc.level)
+			zinfo, err := newGoGzipZinfoFromFile(filename, tc.spanSize)
+			if err != nil {
+				t.Fatalf("failed to build gzip zinfo: %v", err)
+			}
+			if tc.spanSize > int64(len(data)) && zinfo.MaxSpanID() != 0 {
+				t.Fatalf("expected a single span, got %d", zinfo.MaxSpanID()+1)
+			}
+
+			// roundtrip the zinfo to make sure serialization preserves the checkpoints
+			b, err := zinfo.Bytes()
+			if err != nil {
+				t.Fatalf("failed to serialize gzip zinfo: %v", err)
+			}
+			zinfo, err = newGoGzipZinfo(b)
+			if err != nil {
+				t.Fatalf("failed to deserialize gzip zinfo: %v", err)
+			}
+
+			compressedSize := Offset(len(compressed))
+			uncompressedSize := Offset(len(data))
+			var spanID SpanID
+			for spanID = 0; spanID <= zinfo.MaxSpanID(); spanID++ {
+				start := zinfo.StartUncompressedOffset(spanID)
+				end := zinfo.EndUncompressedOffset(spanID, uncompressedSize)
+				if zinfo.UncompressedOffsetToSpanID(start) != spanID {
+					t.Fatalf("offset %d should belong to span %d", start, spanID)
+				}
+				buf := compressed[zinfo.StartCompressedOffset(spanID):zinfo.EndCompressedOffset(spanID, compressedSize)]
+				extracted, err := zinfo.ExtractDataFromBuffer(buf, end-start, start, spanID)
+				if err != nil {
+					t.Fatalf("failed to extract span %d from buffer: %v", spanID, err)
+				}
+				if !bytes.Equal(extracted, data[start:end]) {
+					t.Fatalf("span %d extracted from buffer does not match the original data", spanID)
+				}
+			}
+
+			offset := uncompressedSize / 3
+			size := uncompressedSize / 2
+			extracted, err := zinfo.ExtractDataFromFile(filename, size, offset)
+			if err != nil {
+				t.Fatalf("failed to extract data from file: %v", err)
+			}
+			if !bytes.Equal(extracted, data[offset:offset+size]) {
+				t.Fatalf("data extracted from file does not match the original data")
+			}
+		})
+	}
+}
+
+func TestGoGzipZinfoV1Roundtrip(t *testing.T) {
+	t.Parallel()
+	data := gzipTestData(2, 256<<10)
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	compressed := buf.Bytes()
+
+	f, err := os.CreateTemp(t.TempDir(), "gzip-zinfo-*.gz")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	f.Write(compressed)
+	f.Close()
+
+	zinfo, err := newGoGzipZinfoFromFile(f.Name(), 32<<10)
+	if err != nil {
+		t.Fatalf("failed to build gzip zinfo: %v", err)
+	}
+	v2, err := zinfo.Bytes()
+	if err != nil {
+		t.Fatalf("failed to serialize gzip zinfo: %v", err)
+	}
+
+	// A v1 zinfo is a v2 zinfo without the first checkpoint, which was assumed to be right after a 10 byte header.
+	v1 := append(append([]byte{}, v2[:gzipBlobHeaderSize]...), v2[gzipBlobHeaderSize+gzipPackedCheckpointSize:]...)
+	v1Zinfo, err := newGoGzipZinfo(v1)
+	if err != nil {
+		t.Fatalf("failed to deserialize v1 gzip zinfo: %v", err)
+	}
+	if v1Zinfo.MaxSpanID() != zinfo.MaxSpanID() {
+		t.Fatalf("unexpected max span id. expected: %d, actual: %d", zinfo.MaxSpanID(), v1Zinfo.MaxSpanID())
+	}
+	b, err := v1Zinfo.Bytes()
+	if err != nil {
+		t.Fatalf("failed to serialize v1 gzip zinfo: %v", err)
+	}
+	if !bytes.Equal(b, v1) {
+		t.Fatalf("v1 gzip zinfo was not reserialized to the same bytes")
+	}
+
+	extracted, err := v1Zinfo.ExtractDataFromFile(f.Name(), Offset(len(data)), 0)
+	if err != nil {
+		t.Fatalf("failed to extract data from file: %v", err)
+	}
+	if !bytes.Equal(extracted, data) {
+		t.Fatalf("data extracted from file does not match the original data")
+	}
+}
+
+func TestSetGzipImplementation(t *testing.T) {
+	defer SetGzipImplementation(DefaultGzipImplementation)
+
+	if err := SetGzipImplementation("foo"); err == nil {
+		t.Fatalf("expected error for unknown gzip implementation")
+	}
+	if err := SetGzipImplementation(GzipImplementationGo); err != nil {
+		t.Fatalf("failed to set gzip implementation: %v", err)
+	}
+	if GetGzipImplementation() != GzipImplementationGo {
+		t.Fatalf("unexpected gzip implementation: %s", GetGzipImplementation())
+	}
+	if err := SetGzipImplementation(""); err != nil {
+		t.Fatalf("failed to reset gzip implementation: %v", err)
+	}
+	if GetGzipImplementation() != DefaultGzipImplementation {
+		t.Fatalf("unexpected gzip implementation: %s", GetGzipImplementation())
+	}
+}
@@ -0,0 +1,164 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"sort"
+)
+
+// SpanPlanner decides where spans start while a zinfo is built.
+type SpanPlanner interface {
+	// SpanSize returns the nominal span size, which is recorded in the zinfo.
+	SpanSize() int64
+	// StartsSpan reports whether a new span should start at uncompressed offset `offset`
+	// given that the current span starts at `spanStart`. It's called in increasing order
+	// of `offset` for formats where spans can only start at specific offsets (e.g. at
+	// deflate block boundaries in gzip).
+	StartsSpan(spanStart, offset Offset) bool
+	// NextSpanStart returns the uncompressed offset of the span following the span that
+	// starts at `spanStart` for formats where a span can start at any offset (e.g. tar).
+	NextSpanStart(spanStart Offset) Offset
+}
+
+// fixedSpanPlanner starts a new span every `spanSize` bytes of uncompressed data.
+type fixedSpanPlanner struct {
+	spanSize int64
+}
+
+// NewFixedSpanPlanner returns a `SpanPlanner` that starts a new span as soon as
+// `spanSize` bytes of uncompressed data are in the current span.
+func NewFixedSpanPlanner(spanSize int64) SpanPlanner {
+	return fixedSpanPlanner{spanSize: spanSize}
+}
+
+func (p fixedSpanPlanner) SpanSize() int64 {
+	return p.spanSize
+}
+
+func (p fixedSpanPlanner) StartsSpan(spanStart, offset Offset) bool {
+	return int64(offset-spanStart) > p.spanSize
+}
+
+func (p fixedSpanPlanner) NextSpanStart(spanStart Offset) Offset {
+	return spanStart + Offset(p.spanSize)
+}
+
+// Extent is the range [Start, End) of an entry (e.g. a tar header and the file content following it)
+// in the uncompressed stream.
+type Extent struct {
+	Start Offset
+	End   Offset
+}
+
+// adaptiveSpanPlanner moves span boundaries by up to `tolerance` bytes so that
+// they don't split entries that fit in a single span.
+type adaptiveSpanPlanner struct {
+	spanSize  int64
+	tolerance int64
+	entries   []Extent
+}
+
+// NewAdaptiveSpanPlanner returns a `SpanPlanner` that aligns spans with entry boundaries.
+// A span ends between `spanSize - tolerance` and `spanSize + tolerance` bytes after it
+// starts, preferably at an offset that doesn't split an entry. Entries larger than
+// `spanSize` straddle spans anyway, so they are split as if spans had a fixed size.
+// `tolerance` must be smaller than `spanSize`.
+func NewAdaptiveSpanPlanner(spanSize, tolerance int64, entries []Extent) SpanPlanner {
+	sorted := make([]Extent, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+	return &adaptiveSpanPlanner{
+		spanSize:  spanSize,
+		tolerance: tolerance,
+		entries:   sorted,
+	}
+}
+
+func (p *adaptiveSpanPlanner) SpanSize() int64 {
+	return p.spanSize
+}
+
+func (p *adaptiveSpanPlanner) StartsSpan(spanStart, offset Offset) bool {
+	size := int64(offset - spanStart)
+	if size < p.spanSize-p.tolerance {
+		return false
+	}
+	if size > p.spanSize+p.tolerance {
+		return true
+	}
+	e, ok := p.entryAt(offset)
+	if !ok {
+		return true
+	}
+	if p.isLarge(e) {
+		return size > p.spanSize
+	}
+	return false
+}
+
+func (p *adaptiveSpanPlanner) NextSpanStart(spanStart Offset) Offset {
+	target := spanStart + Offset(p.spanSize)
+	e, ok := p.entryAt(target)
+	if !ok || p.isLarge(e) {
+		return target
+	}
+
+	// find the entry boundary closest to the target within the tolerance.
+	lo, hi := target-Offset(p.tolerance), target+Offset(p.tolerance)
+	best, found := target, false
+	i := sort.Search(len(p.entries), func(i int) bool {
+		return p.entries[i].Start >= lo
+	})
+	for ; i < len(p.entries) && p.entries[i].Start <= hi; i++ {
+		start := p.entries[i].Start
+		if start <= spanStart {
+			continue
+		}
+		if !found || abs(start-target) < abs(best-target) {
+			best, found = start, true
+		}
+	}
+	return best
+}
+
+// entryAt returns the entry that would be split by a span starting at `offset`.
+func (p *adaptiveSpanPlanner) entryAt(offset Offset) (Extent, bool) {
+	i := sort.Search(len(p.entries), func(i int) bool {
+		return p.entries[i].Start >= offset
+	})
+	if i == 0 {
+		return Extent{}, false
+	}
+	e := p.entries[i-1]
+	if offset < e.End {
+		return e, true
+	}
+	return Extent{}, false
+}
+
+func (p *adaptiveSpanPlanner) isLarge(e Extent) bool {
+	return int64(e.End-e.Start) > p.spanSize
+}
+
+func abs(o Offset) Offset {
+	if o < 0 {
+		return -o
+	}
+	return o
+}
@@ -0,0 +1,249 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testSpanPlannerEntries are entries used to test a span planner with a span size of 100 and a tolerance of 10.
+var testSpanPlannerEntries = []Extent{
+	{Start: 0, End: 50},
+	{Start: 50, End: 95},
+	{Start: 95, End: 105},
+	{Start: 105, End: 400}, // larger than a span
+	{Start: 400, End: 420},
+}
+
+func TestAdaptiveSpanPlannerStartsSpan(t *testing.T) {
+	t.Parallel()
+	planner := NewAdaptiveSpanPlanner(100, 10, testSpanPlannerEntries)
+	testCases := []struct {
+		name      string
+		spanStart Offset
+		offset    Offset
+		expected  bool
+	}{
+		{
+			name:      "span smaller than span size minus tolerance doesn't end",
+			spanStart: 0,
+			offset:    80,
+			expected:  false,
+		},
+		{
+			name:      "span larger than span size plus tolerance ends",
+			spanStart: 0,
+			offset:    111,
+			expected:  true,
+		},
+		{
+			name:      "span ends at an entry boundary within the tolerance",
+			spanStart: 0,
+			offset:    95,
+			expected:  true,
+		},
+		{
+			name:      "span doesn't end inside a small entry within the tolerance",
+			spanStart: 0,
+			offset:    100,
+			expected:  false,
+		},
+		{
+			name:      "span doesn't end inside a large entry before span size",
+			spanStart: 105,
+			offset:    200,
+			expected:  false,
+		},
+		{
+			name:      "span ends inside a large entry after span size",
+			spanStart: 105,
+			offset:    206,
+			expected:  true,
+		},
+		{
+			name:      "span ends after the last entry within the tolerance",
+			spanStart: 400,
+			offset:    495,
+			expected:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := planner.StartsSpan(tc.spanStart, tc.offset); actual != tc.expected {
+				t.Fatalf("unexpected result for span start %d and offset %d; expected %t, got %t", tc.spanStart, tc.offset, tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestAdaptiveSpanPlannerNextSpanStart(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name      string
+		entries   []Extent
+		spanStart Offset
+		expected  Offset
+	}{
+		{
+			name:      "span ends at the closest entry boundary within the tolerance",
+			entries:   testSpanPlannerEntries,
+			spanStart: 0,
+			expected:  95,
+		},
+		{
+			name:      "span ends at span size inside a large entry",
+			entries:   testSpanPlannerEntries,
+			spanStart: 105,
+			expected:  205,
+		},
+		{
+			name:      "span ends at span size after the last entry",
+			entries:   testSpanPlannerEntries,
+			spanStart: 400,
+			expected:  500,
+		},
+		{
+			name:      "span ends at span size if there is no entry boundary within the tolerance",
+			entries:   []Extent{{Start: 0, End: 30}, {Start: 30, End: 130}},
+			spanStart: 0,
+			expected:  100,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			planner := NewAdaptiveSpanPlanner(100, 10, tc.entries)
+			if actual := planner.NextSpanStart(tc.spanStart); actual != tc.expected {
+				t.Fatalf("unexpected next span start after %d; expected %d, got %d", tc.spanStart, tc.expected, actual)
+			}
+		})
+	}
+}
+
+// randomExtents splits [0, size) into consecutive extents of random sizes up to maxSize.
+func randomExtents(seed int64, size, maxSize int) []Extent {
+	r := rand.New(rand.NewSource(seed))
+	var extents []Extent
+	for start := 0; start < size; {
+		end := start + 1 + r.Intn(maxSize)
+		if end > size {
+			end = size
+		}
+		extents = append(extents, Extent{Start: Offset(start), End: Offset(end)})
+		start = end
+	}
+	return extents
+}
+
+func TestZinfoWithAdaptiveSpanPlanner(t *testing.T) {
+	t.Parallel()
+	data := gzipTestData(7, 2<<20)
+	entries := randomExtents(7, len(data), 32<<10)
+
+	compressed, gzipFile := writeGzipTestFile(t, data, gzip.DefaultCompression)
+	tarFile := filepath.Join(t.TempDir(), "layer.tar")
+	if err := os.WriteFile(tarFile, data, 0600); err != nil {
+		t.Fatalf("failed to write tar file: %v", err)
+	}
+
+	testCases := []struct {
+		name       string
+		algorithm  string
+		filename   string
+		compressed []byte
+		// validSpanStart reports whether `start` is where `planner` places the span following the span at `prevStart`.
+		validSpanStart func(planner SpanPlanner, prevStart, start Offset) bool
+	}{
+		{
+			name:       "gzip",
+			algorithm:  Gzip,
+			filename:   gzipFile,
+			compressed: compressed,
+			validSpanStart: func(planner SpanPlanner, prevStart, start Offset) bool {
+				return planner.StartsSpan(prevStart, start)
+			},
+		},
+		{
+			name:       "tar",
+			algorithm:  Uncompressed,
+			filename:   tarFile,
+			compressed: data,
+			validSpanStart: func(planner SpanPlanner, prevStart, start Offset) bool {
+				return planner.NextSpanStart(prevStart) == start
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			planner := NewAdaptiveSpanPlanner(128<<10, 16<<10, entries)
+			zinfo, err := NewZinfoFromFileWithSpanPlanner(tc.algorithm, tc.filename, planner)
+			if err != nil {
+				t.Fatalf("failed to build zinfo: %v", err)
+			}
+			defer zinfo.Close()
+
+			// roundtrip the zinfo to make sure serialization preserves the spans
+			b, err := zinfo.Bytes()
+			if err != nil {
+				t.Fatalf("failed to serialize zinfo: %v", err)
+			}
+			zinfo, err = NewZinfo(tc.algorithm, b)
+			if err != nil {
+				t.Fatalf("failed to deserialize zinfo: %v", err)
+			}
+			if zinfo.SpanSize() != 128<<10 {
+				t.Fatalf("unexpected span size; expected %d, got %d", 128<<10, zinfo.SpanSize())
+			}
+
+			compressedSize := Offset(len(tc.compressed))
+			uncompressedSize := Offset(len(data))
+			var spanID SpanID
+			for spanID = 0; spanID <= zinfo.MaxSpanID(); spanID++ {
+				start := zinfo.StartUncompressedOffset(spanID)
+				end := zinfo.EndUncompressedOffset(spanID, uncompressedSize)
+				if spanID > 0 {
+					prevStart := zinfo.StartUncompressedOffset(spanID - 1)
+					if !tc.validSpanStart(planner, prevStart, start) {
+						t.Fatalf("span %d starts at %d, which isn't planned after the span starting at %d", spanID, start, prevStart)
+					}
+				}
+				if zinfo.UncompressedOffsetToSpanID(start) != spanID || zinfo.UncompressedOffsetToSpanID(end-1) != spanID {
+					t.Fatalf("offsets [%d, %d) should belong to span %d", start, end, spanID)
+				}
+
+				buf := tc.compressed[zinfo.StartCompressedOffset(spanID):zinfo.EndCompressedOffset(spanID, compressedSize)]
+				extracted, err := zinfo.ExtractDataFromBuffer(buf, end-start, start, spanID)
+				if err != nil {
+					t.Fatalf("failed to extract span %d: %v", spanID, err)
+				}
+				if !bytes.Equal(extracted, data[start:end]) {
+					t.Fatalf("span %d extracted from buffer does not match the original data", spanID)
+				}
+			}
+		})
+	}
+}
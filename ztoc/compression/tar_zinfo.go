@@ -18,7 +18,9 @@ package compression
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"sort"
 
 	zinfo_flatbuffers "github.com/awslabs/soci-snapshotter/ztoc/compression/fbs/zinfo"
 	flatbuffers "github.com/google/flatbuffers/go"
@@ -31,13 +33,15 @@ const (
 
 // TarZinfo implements the `Zinfo` interface for uncompressed tar files.
 // It only needs a span size and tar file size, since a tar file is already
-// uncompressed.
+// uncompressed. If spans don't have a fixed size (e.g. they were placed by an
+// adaptive `SpanPlanner`), the start offset of every span is recorded as well.
 // For tar file, `compressed`-related concepts (e.g., `CompressedArchiveSize`)
 // are only to santisfy the `Zinfo` interface and equal to their `uncompressed`-equivalent.
 type TarZinfo struct {
-	version  int32
-	spanSize int64
-	size     int64
+	version    int32
+	spanSize   int64
+	size       int64
+	spanStarts []int64
 }
 
 // newTarZinfo creates a new instance of `TarZinfo` from serialized bytes.
@@ -54,6 +58,12 @@ func newTarZinfo(zinfoBytes []byte) (zinfo *TarZinfo, err error) {
 	zinfo.version = zinfoFlatbuf.Version()
 	zinfo.spanSize = zinfoFlatbuf.SpanSize()
 	zinfo.size = zinfoFlatbuf.Size()
+	if n := zinfoFlatbuf.SpanStartsLength(); n > 0 {
+		zinfo.spanStarts = make([]int64, n)
+		for j := 0; j < n; j++ {
+			zinfo.spanStarts[j] = zinfoFlatbuf.SpanStarts(j)
+		}
+	}
 
 	return zinfo, nil
 }
@@ -72,6 +82,63 @@ func newTarZinfoFromFile(tarFile string, spanSize int64) (*TarZinfo, error) {
 	}, nil
 }
 
+// newTarZinfoFromReader creates a new instance of `TarZinfo` by reading a tar stream once.
+// Spans are placed by `planner`. The stream is written to `uncompressed` if it's not nil,
+// and `onSpan` is called for every new span if it's not nil.
+func newTarZinfoFromReader(r io.Reader, planner SpanPlanner, uncompressed io.Writer, onSpan SpanFunc) (*TarZinfo, error) {
+	spanSize := planner.SpanSize()
+	if spanSize <= 0 {
+		return nil, fmt.Errorf("invalid span size: %d", spanSize)
+	}
+
+	var (
+		size       int64
+		next       int64 // start offset of the next span
+		spanStarts []int64
+		fixed      = true // whether all spans so far have size `spanSize`
+		buf        = make([]byte, 32*1024)
+	)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			size += int64(n)
+			// a span only exists if it contains at least 1 byte.
+			for next < size {
+				if onSpan != nil {
+					if err := onSpan(Offset(next), Offset(next)); err != nil {
+						return nil, err
+					}
+				}
+				fixed = fixed && next == int64(len(spanStarts))*spanSize
+				spanStarts = append(spanStarts, next)
+				next = int64(planner.NextSpanStart(Offset(next)))
+			}
+			if uncompressed != nil {
+				if _, err := uncompressed.Write(buf[:n]); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// span starts are only needed if they can't be computed from the span size.
+	if fixed {
+		spanStarts = nil
+	}
+	return &TarZinfo{
+		version:    zinfoVersion,
+		spanSize:   spanSize,
+		size:       size,
+		spanStarts: spanStarts,
+	}, nil
+}
+
 // Close doesn't do anything since there is nothing to close/release.
 func (i *TarZinfo) Close() {}
 
@@ -86,10 +153,21 @@ func (i *TarZinfo) Bytes() (fb []byte, err error) {
 	}()
 
 	builder := flatbuffers.NewBuilder(0)
+	var spanStarts flatbuffers.UOffsetT
+	if len(i.spanStarts) > 0 {
+		zinfo_flatbuffers.TarZinfoStartSpanStartsVector(builder, len(i.spanStarts))
+		for j := len(i.spanStarts) - 1; j >= 0; j-- {
+			builder.PrependInt64(i.spanStarts[j])
+		}
+		spanStarts = builder.EndVector(len(i.spanStarts))
+	}
 	zinfo_flatbuffers.TarZinfoStart(builder)
 	zinfo_flatbuffers.TarZinfoAddVersion(builder, i.version)
 	zinfo_flatbuffers.TarZinfoAddSpanSize(builder, i.spanSize)
 	zinfo_flatbuffers.TarZinfoAddSize(builder, i.size)
+	if len(i.spanStarts) > 0 {
+		zinfo_flatbuffers.TarZinfoAddSpanStarts(builder, spanStarts)
+	}
 	tarZinfoFlatbuf := zinfo_flatbuffers.TarZinfoEnd(builder)
 	builder.Finish(tarZinfoFlatbuf)
 	return builder.FinishedBytes(), nil
@@ -97,6 +175,9 @@ func (i *TarZinfo) Bytes() (fb []byte, err error) {
 
 // MaxSpanID returns the max span ID.
 func (i *TarZinfo) MaxSpanID() SpanID {
+	if i.spanStarts != nil {
+		return SpanID(len(i.spanStarts) - 1)
+	}
 	res := SpanID(i.size / i.spanSize)
 	if i.size%i.spanSize == 0 {
 		res--
@@ -111,6 +192,15 @@ func (i *TarZinfo) SpanSize() Offset {
 
 // UncompressedOffsetToSpanID returns the ID of the span containing the data pointed by uncompressed offset.
 func (i *TarZinfo) UncompressedOffsetToSpanID(offset Offset) SpanID {
+	if i.spanStarts != nil {
+		idx := sort.Search(len(i.spanStarts), func(j int) bool {
+			return i.spanStarts[j] > int64(offset)
+		})
+		if idx == 0 {
+			return 0
+		}
+		return SpanID(idx - 1)
+	}
 	return SpanID(int64(offset) / i.spanSize)
 }
 
@@ -187,5 +277,8 @@ func (i *TarZinfo) EndUncompressedOffset(spanID SpanID, fileSize Offset) Offset
 }
 
 func (i *TarZinfo) spanIDToOffset(spanID SpanID) Offset {
+	if i.spanStarts != nil {
+		return Offset(i.spanStarts[spanID])
+	}
 	return Offset(i.spanSize * int64(spanID))
 }
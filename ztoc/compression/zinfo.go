@@ -18,6 +18,8 @@ package compression
 
 import (
 	"fmt"
+	"io"
+	"os"
 )
 
 // Zinfo is the interface for dealing with compressed data efficiently. It chunks
@@ -82,9 +84,9 @@ type Zinfo interface {
 func NewZinfo(compressionAlgo string, zinfoBytes []byte) (Zinfo, error) {
 	switch compressionAlgo {
 	case Gzip:
-		return newGzipZinfo(zinfoBytes)
+		return newGzipZinfoWithImplementation(GetGzipImplementation(), zinfoBytes)
 	case Zstd:
-		return nil, fmt.Errorf("not implemented: %s", Zstd)
+		return newZstdZinfo(zinfoBytes)
 	case Uncompressed, Unknown:
 		return newTarZinfo(zinfoBytes)
 	default:
@@ -92,18 +94,82 @@ func NewZinfo(compressionAlgo string, zinfoBytes []byte) (Zinfo, error) {
 	}
 }
 
+// SpanFunc is called while a zinfo is built from a stream every time a new span starts.
+// `start` is the offset of the new span in the compressed stream, and `prevEnd` is the
+// end offset of the previous span, which can be after `start` if the two spans share bytes
+// (e.g. gzip spans that don't start at a byte boundary). All the bytes before `prevEnd` have
+// already been read from the stream when `SpanFunc` is called.
+type SpanFunc func(start, prevEnd Offset) error
+
+// NewZinfoFromReader creates a zinfo struct by reading a compressed stream once.
+// This is used when the compressed stream is not stored in a file (e.g. when it's
+// read from a content store). The uncompressed stream is written to `uncompressed`
+// (if not nil) while the zinfo is built, and `onSpan` (if not nil) is called every time
+// a new span starts so that span data can be processed without reading the stream again.
+//
+// Gzip zinfo is always built by the pure go implementation, since the cgo implementation
+// can only read from files. The two implementations build identical zinfo, and it's returned
+// as a zinfo of the selected implementation.
+func NewZinfoFromReader(compressionAlgo string, r io.Reader, spanSize int64, uncompressed io.Writer, onSpan SpanFunc) (Zinfo, error) {
+	switch compressionAlgo {
+	case Gzip:
+		zinfo, err := newGoGzipZinfoFromReader(r, NewFixedSpanPlanner(spanSize), uncompressed, onSpan)
+		if err != nil {
+			return nil, err
+		}
+		return withGzipImplementation(zinfo)
+	case Zstd:
+		return newZstdZinfoFromReader(r, spanSize, uncompressed, onSpan)
+	case Uncompressed, Unknown:
+		return newTarZinfoFromReader(r, NewFixedSpanPlanner(spanSize), uncompressed, onSpan)
+	default:
+		return nil, fmt.Errorf("unexpected compression algorithm: %s", compressionAlgo)
+	}
+}
+
 // NewZinfoFromFile creates a zinfo struct given a compressed file and a span size.
 // This is often used when you have a compressed file (e.g. gzip) and want to create
 // a new zinfo for it.
 func NewZinfoFromFile(compressionAlgo string, filename string, spanSize int64) (Zinfo, error) {
 	switch compressionAlgo {
 	case Gzip:
-		return newGzipZinfoFromFile(filename, spanSize)
+		return newGzipZinfoFromFileWithImplementation(GetGzipImplementation(), filename, spanSize)
 	case Zstd:
-		return nil, fmt.Errorf("not implemented: %s", Zstd)
+		return newZstdZinfoFromFile(filename, spanSize)
 	case Uncompressed:
 		return newTarZinfoFromFile(filename, spanSize)
 	default:
 		return nil, fmt.Errorf("unexpected compression algorithm: %s", compressionAlgo)
 	}
 }
+
+// NewZinfoFromFileWithSpanPlanner creates a zinfo struct given a compressed file and a
+// `SpanPlanner` that decides where spans start.
+//
+// Gzip zinfo is always built by the pure go implementation, since the cgo implementation
+// only supports spans of a fixed size. It's returned as a zinfo of the selected implementation. Spans of zstd zinfo can only start at frame boundaries,
+// so zstd zinfo is built with the span size of `planner` only.
+func NewZinfoFromFileWithSpanPlanner(compressionAlgo string, filename string, planner SpanPlanner) (Zinfo, error) {
+	if compressionAlgo == Zstd {
+		return newZstdZinfoFromFile(filename, planner.SpanSize())
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch compressionAlgo {
+	case Gzip:
+		zinfo, err := newGoGzipZinfoFromReader(f, planner, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		return withGzipImplementation(zinfo)
+	case Uncompressed:
+		return newTarZinfoFromReader(f, planner, nil, nil)
+	default:
+		return nil, fmt.Errorf("unexpected compression algorithm: %s", compressionAlgo)
+	}
+}
@@ -0,0 +1,469 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	zinfo_flatbuffers "github.com/awslabs/soci-snapshotter/ztoc/compression/fbs/zinfo"
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// zstdFrameMagic is the magic number at the start of every zstd frame.
+	zstdFrameMagic = 0xFD2FB528
+	// zstdSkippableFrameMagic is the magic number of skippable frames. The lowest
+	// 4 bits can take any value, so it must be compared using `zstdSkippableFrameMask`.
+	zstdSkippableFrameMagic = 0x184D2A50
+	zstdSkippableFrameMask  = 0xFFFFFFF0
+
+	zstdBlockTypeRLE      = 1
+	zstdBlockTypeReserved = 3
+)
+
+var errInvalidZstdFrame = errors.New("invalid zstd frame")
+
+// zstdCheckpoint marks the start of a span in a zstd stream. Spans always start
+// at a frame boundary, so no decompressor state needs to be stored.
+type zstdCheckpoint struct {
+	in  Offset // offset of the first frame of the span in the compressed stream
+	out Offset // offset of the first byte of the span in the uncompressed stream
+}
+
+// ZstdZinfo implements the `Zinfo` interface for zstd compressed files.
+//
+// Unlike gzip, zstd frames are independently decompressible, so a span is
+// a run of consecutive frames and each checkpoint is just a pair of offsets.
+// A new span is started at the first frame boundary after the current span
+// has accumulated at least `spanSize` uncompressed bytes. As a result, a layer
+// consisting of a single zstd frame contains a single span.
+type ZstdZinfo struct {
+	version     int32
+	spanSize    int64
+	checkpoints []zstdCheckpoint
+}
+
+// newZstdZinfo creates a new instance of `ZstdZinfo` from serialized bytes.
+func newZstdZinfo(zinfoBytes []byte) (zinfo *ZstdZinfo, err error) {
+	if len(zinfoBytes) == 0 {
+		return nil, fmt.Errorf("empty checkpoints")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			zinfo = nil
+			err = fmt.Errorf("cannot unmarshal zstd zinfo: %v", r)
+		}
+	}()
+
+	zinfoFlatbuf := zinfo_flatbuffers.GetRootAsZstdZinfo(zinfoBytes, 0)
+	numCheckpoints := zinfoFlatbuf.CheckpointsLength()
+	if numCheckpoints == 0 {
+		return nil, fmt.Errorf("zstd zinfo must contain at least one checkpoint")
+	}
+
+	zinfo = &ZstdZinfo{
+		version:     zinfoFlatbuf.Version(),
+		spanSize:    zinfoFlatbuf.SpanSize(),
+		checkpoints: make([]zstdCheckpoint, numCheckpoints),
+	}
+	checkpoint := new(zinfo_flatbuffers.ZstdCheckpoint)
+	for i := 0; i < numCheckpoints; i++ {
+		zinfoFlatbuf.Checkpoints(checkpoint, i)
+		zinfo.checkpoints[i] = zstdCheckpoint{
+			in:  Offset(checkpoint.CompressedOffset()),
+			out: Offset(checkpoint.UncompressedOffset()),
+		}
+	}
+	return zinfo, nil
+}
+
+// newZstdZinfoFromFile creates a new instance of `ZstdZinfo` given zstd file name and span size.
+func newZstdZinfoFromFile(zstdFile string, spanSize int64) (*ZstdZinfo, error) {
+	f, err := os.Open(zstdFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file for reading: %w", err)
+	}
+	defer f.Close()
+
+	return newZstdZinfoFromReader(f, spanSize, nil, nil)
+}
+
+// newZstdZinfoFromReader creates a new instance of `ZstdZinfo` by reading a zstd stream once.
+// The uncompressed data is written to `uncompressed` if it's not nil, and `onSpan` is called
+// for every new span if it's not nil.
+func newZstdZinfoFromReader(r io.Reader, spanSize int64, uncompressed io.Writer, onSpan SpanFunc) (*ZstdZinfo, error) {
+	if spanSize <= 0 {
+		return nil, fmt.Errorf("invalid span size: %d", spanSize)
+	}
+	if uncompressed == nil {
+		uncompressed = io.Discard
+	}
+
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+
+	zinfo := &ZstdZinfo{
+		version:     zinfoVersion,
+		spanSize:    spanSize,
+		checkpoints: []zstdCheckpoint{{in: 0, out: 0}},
+	}
+	if onSpan != nil {
+		if err := onSpan(0, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	br := bufio.NewReader(r)
+	var in, out Offset
+	for {
+		if _, err := br.Peek(1); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		frame, err := newZstdFrameReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("could not read zstd frame at offset %d: %w", in, err)
+		}
+		if frame.skippable {
+			// skippable frames carry no data, so they are attached to the current span.
+			if _, err := io.Copy(io.Discard, frame); err != nil {
+				return nil, fmt.Errorf("could not read zstd frame at offset %d: %w", in, err)
+			}
+			in += Offset(frame.size)
+			continue
+		}
+
+		last := zinfo.checkpoints[len(zinfo.checkpoints)-1]
+		if int64(out-last.out) >= spanSize {
+			zinfo.checkpoints = append(zinfo.checkpoints, zstdCheckpoint{in: in, out: out})
+			if onSpan != nil {
+				if err := onSpan(in, in); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if err := decoder.Reset(frame); err != nil {
+			return nil, err
+		}
+		n, err := io.Copy(uncompressed, decoder)
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress zstd frame at offset %d: %w", in, err)
+		}
+		// make sure the whole frame is consumed, even if the decoder stopped early.
+		if _, err := io.Copy(io.Discard, frame); err != nil {
+			return nil, fmt.Errorf("could not read zstd frame at offset %d: %w", in, err)
+		}
+		in += Offset(frame.size)
+		out += Offset(n)
+	}
+
+	return zinfo, nil
+}
+
+// zstdFrameReader reads exactly one zstd frame from a stream. Only frame and
+// block headers are parsed to find the end of the frame; block contents are returned as is.
+// See https://github.com/facebook/zstd/blob/dev/doc/zstd_compression_format.md#frames
+type zstdFrameReader struct {
+	r         *bufio.Reader
+	skippable bool
+	size      int64 // number of bytes of the frame read so far
+
+	pending     []byte // parsed headers that haven't been returned yet
+	remaining   int    // bytes of the current block, skippable frame, or checksum left to return
+	lastBlock   bool
+	hasChecksum bool
+	done        bool
+}
+
+// newZstdFrameReader parses the header of the frame at the start of `r`.
+func newZstdFrameReader(r *bufio.Reader) (*zstdFrameReader, error) {
+	fr := &zstdFrameReader{r: r}
+
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, err
+	}
+	fr.pending = append(fr.pending, buf[:]...)
+	magic := binary.LittleEndian.Uint32(buf[:])
+
+	if magic&zstdSkippableFrameMask == zstdSkippableFrameMagic {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return nil, err
+		}
+		fr.pending = append(fr.pending, buf[:]...)
+		fr.skippable = true
+		fr.remaining = int(binary.LittleEndian.Uint32(buf[:]))
+		fr.lastBlock = true
+		return fr, nil
+	}
+	if magic != zstdFrameMagic {
+		return nil, fmt.Errorf("%w: unexpected magic number %#x", errInvalidZstdFrame, magic)
+	}
+
+	descriptor, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	fr.pending = append(fr.pending, descriptor)
+
+	singleSegment := descriptor&0x20 != 0
+	fr.hasChecksum = descriptor&0x04 != 0
+	headerSize := []int{0, 1, 2, 4}[descriptor&0x03] // dictionary ID
+	if !singleSegment {
+		headerSize++ // window descriptor
+	}
+	switch descriptor >> 6 { // frame content size
+	case 0:
+		if singleSegment {
+			headerSize++
+		}
+	case 1:
+		headerSize += 2
+	case 2:
+		headerSize += 4
+	case 3:
+		headerSize += 8
+	}
+	// the frame header is followed by at least one block, so `remaining` is used to read the header as is.
+	fr.remaining = headerSize
+	return fr, nil
+}
+
+func (fr *zstdFrameReader) Read(p []byte) (int, error) {
+	for {
+		if len(fr.pending) > 0 {
+			n := copy(p, fr.pending)
+			fr.pending = fr.pending[n:]
+			fr.size += int64(n)
+			return n, nil
+		}
+		if fr.remaining > 0 {
+			if len(p) > fr.remaining {
+				p = p[:fr.remaining]
+			}
+			n, err := fr.r.Read(p)
+			fr.remaining -= n
+			fr.size += int64(n)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		if fr.done {
+			return 0, io.EOF
+		}
+		if err := fr.next(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// next parses the next block header, or the checksum after the last block.
+func (fr *zstdFrameReader) next() error {
+	if fr.lastBlock {
+		if fr.hasChecksum {
+			fr.remaining = 4
+			fr.hasChecksum = false
+			return nil
+		}
+		fr.done = true
+		return nil
+	}
+
+	var buf [3]byte
+	if _, err := io.ReadFull(fr.r, buf[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	fr.pending = append(fr.pending, buf[:]...)
+	header := uint32(buf[0]) | uint32(buf[1])<<8 | uint32(buf[2])<<16
+	fr.lastBlock = header&1 != 0
+	blockType := (header >> 1) & 0x03
+	blockSize := int(header >> 3)
+
+	switch blockType {
+	case zstdBlockTypeRLE:
+		// an RLE block contains a single byte that is repeated `blockSize` times
+		blockSize = 1
+	case zstdBlockTypeReserved:
+		return fmt.Errorf("%w: reserved block type", errInvalidZstdFrame)
+	}
+	fr.remaining = blockSize
+	return nil
+}
+
+// Close doesn't do anything since there is nothing to close/release.
+func (i *ZstdZinfo) Close() {}
+
+// Bytes returns the byte slice containing the `ZstdZinfo`.
+func (i *ZstdZinfo) Bytes() (fb []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fb = nil
+			err = fmt.Errorf("failed to generate zstd zinfo flatbuf bytes: %v", r)
+		}
+	}()
+
+	builder := flatbuffers.NewBuilder(0)
+	zinfo_flatbuffers.ZstdZinfoStartCheckpointsVector(builder, len(i.checkpoints))
+	for j := len(i.checkpoints) - 1; j >= 0; j-- {
+		zinfo_flatbuffers.CreateZstdCheckpoint(builder, int64(i.checkpoints[j].in), int64(i.checkpoints[j].out))
+	}
+	checkpoints := builder.EndVector(len(i.checkpoints))
+
+	zinfo_flatbuffers.ZstdZinfoStart(builder)
+	zinfo_flatbuffers.ZstdZinfoAddVersion(builder, i.version)
+	zinfo_flatbuffers.ZstdZinfoAddSpanSize(builder, i.spanSize)
+	zinfo_flatbuffers.ZstdZinfoAddCheckpoints(builder, checkpoints)
+	zstdZinfoFlatbuf := zinfo_flatbuffers.ZstdZinfoEnd(builder)
+	builder.Finish(zstdZinfoFlatbuf)
+	return builder.FinishedBytes(), nil
+}
+
+// MaxSpanID returns the max span ID.
+func (i *ZstdZinfo) MaxSpanID() SpanID {
+	return SpanID(len(i.checkpoints) - 1)
+}
+
+// SpanSize returns the span size of the constructed zinfo.
+func (i *ZstdZinfo) SpanSize() Offset {
+	return Offset(i.spanSize)
+}
+
+// UncompressedOffsetToSpanID returns the ID of the span containing the data pointed by uncompressed offset.
+func (i *ZstdZinfo) UncompressedOffsetToSpanID(offset Offset) SpanID {
+	// find the first span that starts after `offset`; the span before it contains `offset`.
+	idx := sort.Search(len(i.checkpoints), func(j int) bool {
+		return i.checkpoints[j].out > offset
+	})
+	if idx == 0 {
+		return 0
+	}
+	return SpanID(idx - 1)
+}
+
+// ExtractDataFromBuffer decompresses `compressedBuf`, which starts at the first frame of `spanID`,
+// and returns the `uncompressedSize` bytes starting at `uncompressedOffset`.
+func (i *ZstdZinfo) ExtractDataFromBuffer(compressedBuf []byte, uncompressedSize, uncompressedOffset Offset, spanID SpanID) ([]byte, error) {
+	if len(compressedBuf) == 0 {
+		return nil, fmt.Errorf("empty compressed buffer")
+	}
+	if uncompressedSize < 0 {
+		return nil, fmt.Errorf("invalid uncompressed size: %d", uncompressedSize)
+	}
+	if uncompressedSize == 0 {
+		return []byte{}, nil
+	}
+	if spanID < 0 || spanID > i.MaxSpanID() {
+		return nil, fmt.Errorf("invalid span id: %d", spanID)
+	}
+	return extractZstdData(bytes.NewReader(compressedBuf), uncompressedSize, uncompressedOffset-i.StartUncompressedOffset(spanID))
+}
+
+// ExtractDataFromFile decompresses the zstd file starting from the span containing `uncompressedOffset`
+// and returns the `uncompressedSize` bytes starting at `uncompressedOffset`.
+func (i *ZstdZinfo) ExtractDataFromFile(fileName string, uncompressedSize, uncompressedOffset Offset) ([]byte, error) {
+	if uncompressedSize < 0 {
+		return nil, fmt.Errorf("invalid uncompressed size: %d", uncompressedSize)
+	}
+	if uncompressedSize == 0 {
+		return []byte{}, nil
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fstat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	spanID := i.UncompressedOffsetToSpanID(uncompressedOffset)
+	start := i.StartCompressedOffset(spanID)
+	sr := io.NewSectionReader(f, int64(start), fstat.Size()-int64(start))
+	return extractZstdData(sr, uncompressedSize, uncompressedOffset-i.StartUncompressedOffset(spanID))
+}
+
+// extractZstdData decompresses the zstd stream `r`, skips the first `skip` bytes
+// of uncompressed data and returns the following `uncompressedSize` bytes.
+func extractZstdData(r io.Reader, uncompressedSize, skip Offset) ([]byte, error) {
+	if skip < 0 {
+		return nil, fmt.Errorf("invalid offset within span: %d", skip)
+	}
+
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+
+	if _, err := io.CopyN(io.Discard, decoder, int64(skip)); err != nil {
+		return nil, fmt.Errorf("unable to extract data: %w", err)
+	}
+	data := make([]byte, uncompressedSize)
+	if _, err := io.ReadFull(decoder, data); err != nil {
+		return nil, fmt.Errorf("unable to extract data: %w", err)
+	}
+	return data, nil
+}
+
+// StartCompressedOffset returns the start offset of the span in the compressed stream.
+func (i *ZstdZinfo) StartCompressedOffset(spanID SpanID) Offset {
+	return i.checkpoints[spanID].in
+}
+
+// EndCompressedOffset returns the end offset of the span in the compressed stream. If
+// it's the last span, returns the size of the compressed stream.
+func (i *ZstdZinfo) EndCompressedOffset(spanID SpanID, fileSize Offset) Offset {
+	if spanID == i.MaxSpanID() {
+		return fileSize
+	}
+	return i.checkpoints[spanID+1].in
+}
+
+// StartUncompressedOffset returns the start offset of the span in the uncompressed stream.
+func (i *ZstdZinfo) StartUncompressedOffset(spanID SpanID) Offset {
+	return i.checkpoints[spanID].out
+}
+
+// EndUncompressedOffset returns the end offset of the span in the uncompressed stream. If
+// it's the last span, returns the size of the uncompressed stream.
+func (i *ZstdZinfo) EndUncompressedOffset(spanID SpanID, fileSize Offset) Offset {
+	if spanID == i.MaxSpanID() {
+		return fileSize
+	}
+	return i.checkpoints[spanID+1].out
+}
@@ -0,0 +1,180 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNewZstdZinfo(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name        string
+		zinfoBytes  []byte
+		expectError bool
+	}{
+		{
+			name:        "nil zinfoBytes should return error",
+			zinfoBytes:  nil,
+			expectError: true,
+		},
+		{
+			name:        "empty zinfoBytes should return error",
+			zinfoBytes:  []byte{},
+			expectError: true,
+		},
+		{
+			name:        "malformed zinfoBytes should return error",
+			zinfoBytes:  []byte{0xFF, 0xFF, 0xFF, 0xFF},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newZstdZinfo(tc.zinfoBytes)
+			if tc.expectError != (err != nil) {
+				t.Fatalf("expect error: %t, actual error: %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+// buildZstdFrames compresses each chunk into its own zstd frame and concatenates
+// the frames. A skippable frame is inserted between every pair of frames.
+func buildZstdFrames(t *testing.T, chunks [][]byte) []byte {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("failed to create zstd encoder: %v", err)
+	}
+	defer enc.Close()
+
+	var buf []byte
+	for i, chunk := range chunks {
+		if i > 0 {
+			skippable := make([]byte, 8+3)
+			binary.LittleEndian.PutUint32(skippable[0:4], zstdSkippableFrameMagic+uint32(i%16))
+			binary.LittleEndian.PutUint32(skippable[4:8], 3)
+			buf = append(buf, skippable...)
+		}
+		buf = enc.EncodeAll(chunk, buf)
+	}
+	return buf
+}
+
+func TestZstdZinfoMultipleFrames(t *testing.T) {
+	t.Parallel()
+	r := rand.New(rand.NewSource(1))
+	var (
+		chunks       [][]byte
+		uncompressed []byte
+	)
+	for i := 0; i < 8; i++ {
+		chunk := make([]byte, 1000+r.Intn(5000))
+		r.Read(chunk)
+		chunks = append(chunks, chunk)
+		uncompressed = append(uncompressed, chunk...)
+	}
+	compressed := buildZstdFrames(t, chunks)
+
+	f, err := os.CreateTemp("", "zstd-zinfo-*.zst")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(compressed); err != nil {
+		t.Fatalf("failed to write temp file: %v", err)
+	}
+	f.Close()
+
+	testCases := []struct {
+		name      string
+		spanSize  int64
+		maxSpanID SpanID
+	}{
+		{
+			name:      "span size smaller than any frame creates one span per frame",
+			spanSize:  1,
+			maxSpanID: SpanID(len(chunks) - 1),
+		},
+		{
+			name:      "span size larger than the stream creates a single span",
+			spanSize:  int64(len(uncompressed)) + 1,
+			maxSpanID: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			zinfo, err := newZstdZinfoFromFile(f.Name(), tc.spanSize)
+			if err != nil {
+				t.Fatalf("failed to build zstd zinfo: %v", err)
+			}
+			if zinfo.MaxSpanID() != tc.maxSpanID {
+				t.Fatalf("unexpected max span id. expected: %d, actual: %d", tc.maxSpanID, zinfo.MaxSpanID())
+			}
+
+			// roundtrip the zinfo to make sure serialization preserves the checkpoints
+			b, err := zinfo.Bytes()
+			if err != nil {
+				t.Fatalf("failed to serialize zstd zinfo: %v", err)
+			}
+			zinfo, err = newZstdZinfo(b)
+			if err != nil {
+				t.Fatalf("failed to deserialize zstd zinfo: %v", err)
+			}
+
+			compressedSize := Offset(len(compressed))
+			uncompressedSize := Offset(len(uncompressed))
+			var spanID SpanID
+			for spanID = 0; spanID <= zinfo.MaxSpanID(); spanID++ {
+				start := zinfo.StartUncompressedOffset(spanID)
+				end := zinfo.EndUncompressedOffset(spanID, uncompressedSize)
+				if zinfo.UncompressedOffsetToSpanID(start) != spanID {
+					t.Fatalf("offset %d should belong to span %d", start, spanID)
+				}
+
+				buf := compressed[zinfo.StartCompressedOffset(spanID):zinfo.EndCompressedOffset(spanID, compressedSize)]
+				data, err := zinfo.ExtractDataFromBuffer(buf, end-start, start, spanID)
+				if err != nil {
+					t.Fatalf("failed to extract span %d from buffer: %v", spanID, err)
+				}
+				if !bytes.Equal(data, uncompressed[start:end]) {
+					t.Fatalf("span %d extracted from buffer does not match the original data", spanID)
+				}
+			}
+
+			// extract a range crossing frame boundaries
+			offset := Offset(len(chunks[0]) / 2)
+			size := uncompressedSize - 2*offset
+			data, err := zinfo.ExtractDataFromFile(f.Name(), size, offset)
+			if err != nil {
+				t.Fatalf("failed to extract data from file: %v", err)
+			}
+			if !bytes.Equal(data, uncompressed[offset:offset+size]) {
+				t.Fatalf("data extracted from file does not match the original data")
+			}
+		})
+	}
+}
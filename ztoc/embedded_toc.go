@@ -0,0 +1,113 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"errors"
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// errNoEmbeddedTOC is returned by an `embeddedTOCImporter` when a layer
+// isn't in the format it supports.
+var errNoEmbeddedTOC = errors.New("layer has no embedded TOC")
+
+// embeddedTOC is the information needed to build a ztoc that is derived from
+// the TOC embedded in a layer, without decompressing the layer.
+type embeddedTOC struct {
+	toc                     TOC
+	uncompressedArchiveSize compression.Offset
+	// boundaries are the points at which decompression can start, at least one
+	// at the start of the layer and one at the start of each file's content.
+	boundaries []compression.StreamBoundary
+}
+
+// embeddedTOCImporter reads the TOC embedded in a layer blob of `size` bytes.
+// It returns `errNoEmbeddedTOC` if the layer isn't in the format it supports.
+type embeddedTOCImporter func(r io.ReaderAt, size int64, digests bool) (*embeddedTOC, error)
+
+// embeddedTOCImporters are the importers of layer formats with an embedded TOC,
+// by the compression algorithm of the layer.
+var embeddedTOCImporters = map[string]embeddedTOCImporter{
+	compression.Gzip: importEstargzTOC,
+	compression.Zstd: importZstdChunkedTOC,
+}
+
+// buildZtocFromEmbeddedTOC builds a `Ztoc` from the TOC embedded in an eStargz or zstd:chunked
+// layer. Spans start at the boundaries recorded in the embedded TOC, so the layer doesn't
+// need to be decompressed. It returns `errNoEmbeddedTOC` if the layer has no embedded TOC.
+func (b *Builder) buildZtocFromEmbeddedTOC(r io.ReaderAt, size int64, span int64, opt buildConfig) (*Ztoc, error) {
+	importer, ok := embeddedTOCImporters[opt.algorithm]
+	if !ok {
+		return nil, errNoEmbeddedTOC
+	}
+	et, err := importer(r, size, opt.includeFileDigests())
+	if err != nil {
+		return nil, err
+	}
+
+	planner := compression.NewFixedSpanPlanner(span)
+	if opt.spanStrategy == SpanStrategyAdaptive {
+		planner = newAdaptiveSpanPlanner(span, opt.spanTolerance, et.toc, et.uncompressedArchiveSize)
+	}
+	index, err := compression.NewZinfoFromStreamBoundaries(opt.algorithm, r, et.boundaries, planner)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+
+	digests, err := getPerSpanDigestsFromReaderAt(r, size, index)
+	if err != nil {
+		return nil, err
+	}
+	checkpoints, err := index.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	compressionInfo, err := opt.encodeCompressionInfo(et.toc, CompressionInfo{
+		MaxSpanID:            index.MaxSpanID(),
+		SpanDigests:          digests,
+		Checkpoints:          checkpoints,
+		CompressionAlgorithm: opt.algorithm,
+		gzipMembers:          compression.GzipMembers(index),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Ztoc{
+		Version:                 opt.version,
+		TOC:                     et.toc,
+		CompressedArchiveSize:   compression.Offset(size),
+		UncompressedArchiveSize: et.uncompressedArchiveSize,
+		BuildToolIdentifier:     b.buildToolIdentifier,
+		CompressionInfo:         compressionInfo,
+	}, nil
+}
+
+// readFullAt reads exactly `len(p)` bytes at offset `off`.
+func readFullAt(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
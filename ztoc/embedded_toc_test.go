@@ -0,0 +1,455 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/klauspost/compress/zstd"
+)
+
+// embeddedTOCTestChunkSize is the size of the file content chunks of test eStargz and zstd:chunked layers.
+const embeddedTOCTestChunkSize = 64 << 10
+
+// contentChunks returns the offsets of the content chunks of the regular files in `md`,
+// along with the index of the file of each chunk.
+func contentChunks(md []FileMetadata) (offsets []compression.Offset, files []int) {
+	for i, fm := range md {
+		if fm.Type != "reg" {
+			continue
+		}
+		for off := compression.Offset(0); off < fm.UncompressedSize; off += embeddedTOCTestChunkSize {
+			offsets = append(offsets, fm.UncompressedOffset+off)
+			files = append(files, i)
+		}
+	}
+	return offsets, files
+}
+
+// buildEstargz converts an uncompressed tar layer to eStargz the way stargz-snapshotter does.
+func buildEstargz(t *testing.T, tarData []byte) []byte {
+	md, _, err := metadataFromTarReader(bytes.NewReader(tarData), true)
+	if err != nil {
+		t.Fatalf("failed to read tar: %v", err)
+	}
+	// eStargz doesn't keep the end of the tar archive, the TOC member has its own.
+	var end compression.Offset
+	if len(md) > 0 {
+		last := md[len(md)-1]
+		end = AlignToTarBlock(last.UncompressedOffset + last.UncompressedSize)
+	}
+
+	chunkOffsets, _ := contentChunks(md)
+	memberStarts := append([]compression.Offset{0}, chunkOffsets...)
+	var (
+		blob           bytes.Buffer
+		memberOffsets  = make(map[compression.Offset]int64)
+		unames, gnames = make(map[int]string), make(map[int]string)
+	)
+	for i, start := range memberStarts {
+		memberEnd := end
+		if i+1 < len(memberStarts) {
+			memberEnd = memberStarts[i+1]
+		}
+		memberOffsets[start] = int64(blob.Len())
+		writeGzipMember(t, &blob, tarData[start:memberEnd])
+	}
+
+	// names are only recorded when they change for an ID.
+	nameIfChanged := func(names map[int]string, id int, name string) string {
+		if name == "" || names[id] == name {
+			return ""
+		}
+		names[id] = name
+		return name
+	}
+	var toc estargzTOC
+	toc.Version = 1
+	for _, fm := range md {
+		e := &estargzTOCEntry{
+			Name:     fm.Name,
+			Type:     fm.Type,
+			LinkName: fm.Linkname,
+			Mode:     fm.Mode,
+			UID:      fm.UID,
+			GID:      fm.GID,
+			Uname:    nameIfChanged(unames, fm.UID, fm.Uname),
+			Gname:    nameIfChanged(gnames, fm.GID, fm.Gname),
+			DevMajor: int(fm.Devmajor),
+			DevMinor: int(fm.Devminor),
+		}
+		if !fm.ModTime.IsZero() && fm.ModTime.Unix() != 0 {
+			e.ModTime3339 = fm.ModTime.UTC().Round(time.Second).Format(time.RFC3339)
+		}
+		for k, v := range Xattrs(fm.PAXHeaders) {
+			if e.Xattrs == nil {
+				e.Xattrs = make(map[string][]byte)
+			}
+			e.Xattrs[k] = []byte(v)
+		}
+		if fm.Type != "reg" {
+			toc.Entries = append(toc.Entries, e)
+			continue
+		}
+		e.Size = int64(fm.UncompressedSize)
+		e.Digest = fm.Digest.String()
+		for off := compression.Offset(0); off < fm.UncompressedSize; off += embeddedTOCTestChunkSize {
+			if off > 0 {
+				e = &estargzTOCEntry{Name: fm.Name, Type: "chunk", ChunkOffset: int64(off)}
+			}
+			e.Offset = memberOffsets[fm.UncompressedOffset+off]
+			toc.Entries = append(toc.Entries, e)
+		}
+		if fm.UncompressedSize == 0 {
+			toc.Entries = append(toc.Entries, e)
+		}
+	}
+
+	tocJSON, err := json.Marshal(toc)
+	if err != nil {
+		t.Fatalf("failed to encode eStargz TOC: %v", err)
+	}
+	var tocTar bytes.Buffer
+	tw := tar.NewWriter(&tocTar)
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: estargzTOCTarName, Size: int64(len(tocJSON))}); err != nil {
+		t.Fatalf("failed to write eStargz TOC: %v", err)
+	}
+	tw.Write(tocJSON)
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to write eStargz TOC: %v", err)
+	}
+	tocOffset := blob.Len()
+	writeGzipMember(t, &blob, tocTar.Bytes())
+
+	extra := []byte{'S', 'G', estargzTOCOffsetSize, 0}
+	extra = append(extra, fmt.Sprintf("%016xSTARGZ", tocOffset)...)
+	footerOffset := blob.Len()
+	writeEstargzFooter(&blob, extra)
+	if blob.Len()-footerOffset != estargzFooterSize {
+		t.Fatalf("unexpected eStargz footer size %d", blob.Len()-footerOffset)
+	}
+	return blob.Bytes()
+}
+
+func writeGzipMember(t *testing.T, w io.Writer, data []byte) {
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("failed to compress data: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to compress data: %v", err)
+	}
+}
+
+// writeEstargzFooter writes an empty gzip member with `extra` in its header. The member is written
+// byte by byte rather than with compress/gzip, whose encoding of empty data depends on the Go version,
+// so that the footer has the size of the eStargz spec.
+func writeEstargzFooter(w *bytes.Buffer, extra []byte) {
+	// gzip header with the FEXTRA flag.
+	w.Write([]byte{0x1f, 0x8b, 8, 0x04, 0, 0, 0, 0, 0, 0xff})
+	binary.Write(w, binary.LittleEndian, uint16(len(extra)))
+	w.Write(extra)
+	// an empty, final stored deflate block.
+	w.Write([]byte{0x01, 0x00, 0x00, 0xff, 0xff})
+	// CRC-32 and size of the empty data.
+	w.Write(make([]byte, 8))
+}
+
+// buildZstdChunked converts an uncompressed tar layer to zstd:chunked the way containers/storage does.
+func buildZstdChunked(t *testing.T, tarData []byte) []byte {
+	md, _, err := metadataFromTarReader(bytes.NewReader(tarData), true)
+	if err != nil {
+		t.Fatalf("failed to read tar: %v", err)
+	}
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("failed to create zstd encoder: %v", err)
+	}
+	defer encoder.Close()
+
+	// a frame starts at every content chunk, and after the content of every file.
+	chunkOffsets, chunkFiles := contentChunks(md)
+	frameStarts := []compression.Offset{0, compression.Offset(len(tarData))}
+	frameStarts = append(frameStarts, chunkOffsets...)
+	for _, fm := range md {
+		frameStarts = append(frameStarts, fm.UncompressedOffset+fm.UncompressedSize)
+	}
+	sort.Slice(frameStarts, func(i, j int) bool {
+		return frameStarts[i] < frameStarts[j]
+	})
+	var (
+		blob         bytes.Buffer
+		frameOffsets = make(map[compression.Offset]int64)
+	)
+	for i := 0; i+1 < len(frameStarts); i++ {
+		start, end := frameStarts[i], frameStarts[i+1]
+		if start == end {
+			continue
+		}
+		frameOffsets[start] = int64(blob.Len())
+		blob.Write(encoder.EncodeAll(tarData[start:end], nil))
+	}
+
+	var manifest zstdChunkedManifest
+	manifest.Version = 1
+	for i, fm := range md {
+		if fm.Type != "reg" {
+			manifest.Entries = append(manifest.Entries, zstdChunkedManifestEntry{Type: fm.Type, Name: fm.Name})
+			continue
+		}
+		manifest.Entries = append(manifest.Entries, zstdChunkedManifestEntry{
+			Type:   "reg",
+			Name:   fm.Name,
+			Size:   int64(fm.UncompressedSize),
+			Digest: fm.Digest.String(),
+			Offset: frameOffsets[fm.UncompressedOffset],
+		})
+		for j, off := range chunkOffsets {
+			if chunkFiles[j] == i && off != fm.UncompressedOffset {
+				manifest.Entries = append(manifest.Entries, zstdChunkedManifestEntry{
+					Type:        "chunk",
+					Name:        fm.Name,
+					Offset:      frameOffsets[off],
+					ChunkOffset: int64(off - fm.UncompressedOffset),
+				})
+			}
+		}
+	}
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("failed to encode zstd:chunked manifest: %v", err)
+	}
+
+	var (
+		tarSplit bytes.Buffer
+		pos      compression.Offset
+	)
+	enc := json.NewEncoder(&tarSplit)
+	for _, fm := range md {
+		enc.Encode(tarSplitEntry{Type: tarSplitSegmentType, Payload: tarData[pos:fm.UncompressedOffset]})
+		enc.Encode(tarSplitEntry{Type: tarSplitFileType, Name: fm.Name, Size: int64(fm.UncompressedSize)})
+		pos = fm.UncompressedOffset + fm.UncompressedSize
+	}
+	enc.Encode(tarSplitEntry{Type: tarSplitSegmentType, Payload: tarData[pos:]})
+
+	writeSkippableFrame := func(data []byte) int64 {
+		binary.Write(&blob, binary.LittleEndian, uint32(zstdSkippableFrameMagic))
+		binary.Write(&blob, binary.LittleEndian, uint32(len(data)))
+		offset := int64(blob.Len())
+		blob.Write(data)
+		return offset
+	}
+	compressedManifest := encoder.EncodeAll(manifestJSON, nil)
+	manifestOffset := writeSkippableFrame(compressedManifest)
+	compressedTarSplit := encoder.EncodeAll(tarSplit.Bytes(), nil)
+	tarSplitOffset := writeSkippableFrame(compressedTarSplit)
+
+	footer := make([]byte, zstdChunkedFooterSize)
+	for i, v := range []int64{
+		manifestOffset, int64(len(compressedManifest)), int64(len(manifestJSON)), zstdChunkedManifestTypeCRFS,
+		tarSplitOffset, int64(len(compressedTarSplit)), int64(tarSplit.Len()),
+	} {
+		binary.LittleEndian.PutUint64(footer[8*i:], uint64(v))
+	}
+	copy(footer[8*7:], zstdChunkedFrameMagic)
+	writeSkippableFrame(footer)
+	return blob.Bytes()
+}
+
+func TestBuildZtocFromEmbeddedTOC(t *testing.T) {
+	modTime := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	tarEntries := []testutil.TarEntry{
+		testutil.Dir("dir/", testutil.WithDirModTime(modTime)),
+		testutil.File("dir/small", "soci snapshotter", testutil.WithFileModTime(modTime)),
+		testutil.File("dir/empty", "", testutil.WithFileModTime(modTime)),
+		testutil.File("dir/large", string(testutil.RandomByteData(300000)), testutil.WithFileModTime(modTime), testutil.WithFileOwner(1000, 1000)),
+		testutil.Symlink("link", "dir/small"),
+		testutil.Link("hardlink", "dir/small"),
+		testutil.File("xattrs", "xattrs", testutil.WithFileModTime(modTime), testutil.WithFileXattrs(map[string]string{"user.soci": "snapshotter"})),
+		testutil.File(strings.Repeat("long/", 40)+"name", "long name", testutil.WithFileModTime(modTime)),
+		testutil.Fifo("fifo"),
+		testutil.File("medium", strings.Repeat("soci snapshotter\n", 20000), testutil.WithFileModTime(modTime)),
+	}
+	tarData, err := io.ReadAll(testutil.BuildTar(tarEntries))
+	if err != nil {
+		t.Fatalf("failed to build tar: %v", err)
+	}
+	_, contents, fileNames, err := tarContents(tarData)
+	if err != nil {
+		t.Fatalf("failed to read tar: %v", err)
+	}
+
+	testCases := []struct {
+		name      string
+		algorithm string
+		convert   func(*testing.T, []byte) []byte
+	}{
+		{
+			name:      "estargz",
+			algorithm: compression.Gzip,
+			convert:   buildEstargz,
+		},
+		{
+			name:      "zstd:chunked",
+			algorithm: compression.Zstd,
+			convert:   buildZstdChunked,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			layer := tc.convert(t, tarData)
+			filename := filepath.Join(t.TempDir(), "layer")
+			if err := os.WriteFile(filename, layer, 0600); err != nil {
+				t.Fatalf("failed to write layer: %v", err)
+			}
+
+			for _, strategy := range []SpanStrategy{SpanStrategyFixed, SpanStrategyAdaptive} {
+				builder := NewBuilder("test")
+				opts := []BuildOption{WithCompression(tc.algorithm), WithSpanStrategy(strategy), WithZtocVersion(Version12)}
+				imported, err := builder.BuildZtoc(filename, 100000, opts...)
+				if err != nil {
+					t.Fatalf("can't build ztoc: %v", err)
+				}
+				scanned, err := builder.BuildZtoc(filename, 100000, append(opts, WithEmbeddedTOC(false))...)
+				if err != nil {
+					t.Fatalf("can't build ztoc without the embedded TOC: %v", err)
+				}
+				streamed, err := builder.BuildZtocFromReader(io.NewSectionReader(bytes.NewReader(layer), 0, int64(len(layer))), 100000, opts...)
+				if err != nil {
+					t.Fatalf("can't build ztoc from reader: %v", err)
+				}
+
+				if !reflect.DeepEqual(imported.TOC, scanned.TOC) {
+					t.Fatalf("TOC imported from the layer doesn't match the TOC built by reading the layer")
+				}
+				if imported.UncompressedArchiveSize != scanned.UncompressedArchiveSize || imported.CompressedArchiveSize != scanned.CompressedArchiveSize {
+					t.Fatalf("unexpected archive sizes; expected %d and %d, got %d and %d", scanned.CompressedArchiveSize, scanned.UncompressedArchiveSize,
+						imported.CompressedArchiveSize, imported.UncompressedArchiveSize)
+				}
+				if !reflect.DeepEqual(streamed, imported) {
+					t.Fatalf("ztoc built from reader doesn't match ztoc built from file")
+				}
+				if imported.MaxSpanID == 0 {
+					t.Fatalf("expected the layer to be split in several spans")
+				}
+
+				for _, name := range fileNames {
+					extracted, err := imported.ExtractFile(io.NewSectionReader(bytes.NewReader(layer), 0, int64(len(layer))), name)
+					if err != nil {
+						t.Fatalf("can't extract %s: %v", name, err)
+					}
+					if !bytes.Equal(extracted, contents[name]) {
+						diffIdx := getPositionOfFirstDiffInByteSlice(extracted, contents[name])
+						t.Fatalf("file %s extracted bytes != original bytes; byte %d is different", name, diffIdx)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestImportInconsistentEstargzTOC(t *testing.T) {
+	// eStargz only records modification times to the second, so the TOC
+	// can't be used to rebuild the PAX header of the file.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	content := []byte("soci snapshotter")
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "file",
+		Mode:     0644,
+		Size:     int64(len(content)),
+		ModTime:  time.Unix(1680674828, 500),
+		Format:   tar.FormatPAX,
+	}); err != nil {
+		t.Fatalf("failed to build tar: %v", err)
+	}
+	tw.Write(content)
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to build tar: %v", err)
+	}
+	layer := buildEstargz(t, buf.Bytes())
+	if _, err := importEstargzTOC(bytes.NewReader(layer), int64(len(layer)), true); err == nil {
+		t.Fatalf("expected error importing eStargz TOC that doesn't match the layer")
+	}
+
+	filename := filepath.Join(t.TempDir(), "layer")
+	if err := os.WriteFile(filename, layer, 0600); err != nil {
+		t.Fatalf("failed to write layer: %v", err)
+	}
+	ztoc, err := NewBuilder("test").BuildZtoc(filename, 100000, WithZtocVersion(Version12))
+	if err != nil {
+		t.Fatalf("can't build ztoc: %v", err)
+	}
+	if len(ztoc.FileMetadata) != 2 || ztoc.FileMetadata[0].Name != "file" || ztoc.FileMetadata[1].Name != estargzTOCTarName {
+		t.Fatalf("unexpected TOC of eStargz layer: %v", ztoc.FileMetadata)
+	}
+}
+
+func TestNoEmbeddedTOC(t *testing.T) {
+	for _, tc := range testZtocs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tarFilePath, _, _ := tc.tarGenerator(t, "no-embedded-toc", []testutil.TarEntry{
+				testutil.File("file", string(testutil.RandomByteData(100000))),
+			})
+			defer os.Remove(tarFilePath)
+			data, err := os.ReadFile(tarFilePath)
+			if err != nil {
+				t.Fatalf("can't read layer: %v", err)
+			}
+			ztoc, err := NewBuilder("test").buildZtocFromEmbeddedTOC(bytes.NewReader(data), int64(len(data)), 65536, buildConfig{algorithm: tc.compressionAlgo})
+			if ztoc != nil || err != errNoEmbeddedTOC {
+				t.Fatalf("expected %v, got %v", errNoEmbeddedTOC, err)
+			}
+		})
+	}
+}
+
+// tarContents returns the metadata of a tar, the content of its regular files and their names.
+func tarContents(tarData []byte) ([]FileMetadata, map[string][]byte, []string, error) {
+	md, _, err := metadataFromTarReader(bytes.NewReader(tarData), false)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	contents := make(map[string][]byte)
+	var names []string
+	for _, fm := range md {
+		if fm.Type == "reg" {
+			contents[fm.Name] = tarData[fm.UncompressedOffset : fm.UncompressedOffset+fm.UncompressedSize]
+			names = append(names, fm.Name)
+		}
+	}
+	return md, contents, names, nil
+}
@@ -0,0 +1,426 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+)
+
+// eStargz is a gzip layer made of many gzip members: every file content chunk is compressed
+// in its own member, and the tar headers following a chunk are in the same member as the chunk.
+// The layer ends with a member containing the TOC, as a tar entry named `estargzTOCTarName`,
+// followed by a footer pointing to the TOC.
+// See https://github.com/containerd/stargz-snapshotter/blob/main/docs/estargz.md
+const (
+	estargzTOCTarName = "stargz.index.json"
+
+	// estargzFooterSize is the size of the footer, an empty gzip member whose header has an extra
+	// field with an "SG" subfield containing the TOC offset. Legacy footers are smaller because
+	// the extra field contains the TOC offset directly.
+	estargzFooterSize       = 51
+	estargzLegacyFooterSize = 47
+	// estargzTOCOffsetSize is the size of the TOC offset in the footer, formatted as "%016xSTARGZ".
+	estargzTOCOffsetSize = 16 + 6
+
+	gzipTrailerSize = 8
+	// minGzipMemberSize is the size of a gzip member without optional header fields and data.
+	minGzipMemberSize = 10 + 2 + gzipTrailerSize
+)
+
+// estargzTypeflags maps the types of eStargz TOC entries to tar typeflags.
+var estargzTypeflags = map[string]byte{
+	"dir":      tar.TypeDir,
+	"reg":      tar.TypeReg,
+	"symlink":  tar.TypeSymlink,
+	"hardlink": tar.TypeLink,
+	"char":     tar.TypeChar,
+	"block":    tar.TypeBlock,
+	"fifo":     tar.TypeFifo,
+}
+
+// estargzTOC is the TOC of an eStargz layer.
+type estargzTOC struct {
+	Version int                `json:"version"`
+	Entries []*estargzTOCEntry `json:"entries"`
+}
+
+// estargzTOCEntry is an entry of an eStargz TOC. Regular files whose content is
+// split in several chunks have an extra entry of type "chunk" for every chunk but the first.
+type estargzTOCEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime3339 string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	DevMajor    int               `json:"devMajor,omitempty"`
+	DevMinor    int               `json:"devMinor,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	// Offset is the offset of the gzip member containing the content (chunk) of the entry.
+	Offset      int64 `json:"offset,omitempty"`
+	ChunkOffset int64 `json:"chunkOffset,omitempty"`
+}
+
+// importEstargzTOC reads the TOC of an eStargz layer. The uncompressed offset of every gzip
+// member is computed from the uncompressed sizes in the member trailers, which places file
+// contents. Tar headers are rebuilt from the TOC to place the entries between file contents.
+// The TOC member is decompressed to get the metadata of the TOC itself.
+func importEstargzTOC(r io.ReaderAt, size int64, digests bool) (*embeddedTOC, error) {
+	tocOffset, footerSize, err := readEstargzFooter(r, size)
+	if err != nil {
+		return nil, err
+	}
+	footerOffset := size - footerSize
+	if tocOffset < 0 || tocOffset > footerOffset-minGzipMemberSize {
+		return nil, fmt.Errorf("invalid eStargz TOC offset %d", tocOffset)
+	}
+	toc, tocMetadata, tocTarSize, err := readEstargzTOC(io.NewSectionReader(r, tocOffset, footerOffset-tocOffset), digests)
+	if err != nil {
+		return nil, err
+	}
+
+	// every file content chunk starts a gzip member.
+	memberOffsets := []int64{0, tocOffset}
+	for _, e := range toc.Entries {
+		if e.Type == "chunk" || (e.Type == "reg" && e.Size > 0) {
+			if e.Offset <= 0 || e.Offset >= tocOffset {
+				return nil, fmt.Errorf("invalid offset %d of eStargz entry %s", e.Offset, e.Name)
+			}
+			memberOffsets = append(memberOffsets, e.Offset)
+		}
+	}
+	boundaries, err := estargzMemberBoundaries(r, memberOffsets)
+	if err != nil {
+		return nil, err
+	}
+	uncompressedOffsets := make(map[int64]compression.Offset, len(boundaries))
+	for _, b := range boundaries {
+		uncompressedOffsets[int64(b.CompressedOffset)] = b.UncompressedOffset
+	}
+	tocUncompressedOffset := uncompressedOffsets[tocOffset]
+
+	var (
+		layout         tarHeaderLayout
+		unames, gnames = make(map[int]string), make(map[int]string)
+		file           *estargzTOCEntry // the last regular file with content
+		contentOffset  compression.Offset
+	)
+	for _, e := range toc.Entries {
+		if e.Type == "chunk" {
+			if file == nil || e.Name != file.Name || uncompressedOffsets[e.Offset] != contentOffset+compression.Offset(e.ChunkOffset) {
+				return nil, fmt.Errorf("eStargz chunk of %s at offset %d doesn't match the layer", e.Name, e.Offset)
+			}
+			continue
+		}
+
+		hdr, err := e.tarHeader(unames, gnames)
+		if err != nil {
+			return nil, err
+		}
+		var dgst digest.Digest
+		if digests && hdr.Typeflag == tar.TypeReg {
+			if dgst, err = e.contentDigest(); err != nil {
+				return nil, err
+			}
+		}
+		if hdr.Size > 0 {
+			if e.ChunkOffset != 0 {
+				return nil, fmt.Errorf("first eStargz chunk of %s has offset %d", e.Name, e.ChunkOffset)
+			}
+			file, contentOffset = e, uncompressedOffsets[e.Offset]
+		}
+		if err := layout.add(hdr, dgst, contentOffset); err != nil {
+			return nil, err
+		}
+	}
+	if err := layout.place(tocUncompressedOffset); err != nil {
+		return nil, err
+	}
+
+	md := layout.md
+	for _, fm := range tocMetadata {
+		fm.TarHeaderOffset += tocUncompressedOffset
+		fm.UncompressedOffset += tocUncompressedOffset
+		md = append(md, fm)
+	}
+	return &embeddedTOC{
+		toc:                     TOC{FileMetadata: md},
+		uncompressedArchiveSize: tocUncompressedOffset + tocTarSize,
+		boundaries:              boundaries,
+	}, nil
+}
+
+// readEstargzFooter returns the TOC offset and the size of the footer of an eStargz layer.
+func readEstargzFooter(r io.ReaderAt, size int64) (int64, int64, error) {
+	for _, footerSize := range []int64{estargzFooterSize, estargzLegacyFooterSize} {
+		if size < footerSize {
+			continue
+		}
+		footer := make([]byte, footerSize)
+		if err := readFullAt(r, footer, size-footerSize); err != nil {
+			return 0, 0, err
+		}
+		if tocOffset, ok := parseEstargzFooter(footer); ok {
+			return tocOffset, footerSize, nil
+		}
+	}
+	return 0, 0, errNoEmbeddedTOC
+}
+
+// parseEstargzFooter parses the TOC offset in the gzip header of an eStargz footer.
+func parseEstargzFooter(footer []byte) (int64, bool) {
+	if len(footer) < 12 || footer[0] != 0x1f || footer[1] != 0x8b || footer[2] != 8 || footer[3]&0x04 == 0 {
+		return 0, false
+	}
+	xlen := int(binary.LittleEndian.Uint16(footer[10:12]))
+	if 12+xlen > len(footer) {
+		return 0, false
+	}
+	extra := footer[12 : 12+xlen]
+	if len(extra) == 4+estargzTOCOffsetSize && extra[0] == 'S' && extra[1] == 'G' &&
+		binary.LittleEndian.Uint16(extra[2:4]) == estargzTOCOffsetSize {
+		extra = extra[4:]
+	}
+	if len(extra) != estargzTOCOffsetSize || !bytes.HasSuffix(extra, []byte("STARGZ")) {
+		return 0, false
+	}
+	tocOffset, err := strconv.ParseInt(string(extra[:16]), 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return tocOffset, true
+}
+
+// readEstargzTOC decompresses the TOC member of an eStargz layer. It returns the TOC, the metadata
+// of the tar entries in the member and the size of the tar stream in the member.
+func readEstargzTOC(r io.Reader, digests bool) (*estargzTOC, []FileMetadata, compression.Offset, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("could not read eStargz TOC: %w", err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("could not read eStargz TOC: %w", err)
+	}
+
+	tr := tar.NewReader(bytes.NewReader(data))
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("could not read eStargz TOC: %w", err)
+	}
+	if hdr.Name != estargzTOCTarName {
+		return nil, nil, 0, fmt.Errorf("unexpected eStargz TOC entry %s", hdr.Name)
+	}
+	var toc estargzTOC
+	if err := json.NewDecoder(tr).Decode(&toc); err != nil {
+		return nil, nil, 0, fmt.Errorf("could not decode eStargz TOC: %w", err)
+	}
+
+	md, tarSize, err := metadataFromTarReader(bytes.NewReader(data), digests)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return &toc, md, tarSize, nil
+}
+
+// estargzMemberBoundaries returns the compressed and uncompressed offsets of the gzip members
+// at `offsets`, which must include every gzip member of the layer until the last one in `offsets`.
+// The uncompressed size of each member is read from its trailer.
+func estargzMemberBoundaries(r io.ReaderAt, offsets []int64) ([]compression.StreamBoundary, error) {
+	sort.Slice(offsets, func(i, j int) bool {
+		return offsets[i] < offsets[j]
+	})
+	var (
+		boundaries []compression.StreamBoundary
+		buf        [4 + 3]byte // uncompressed size in the trailer and magic number of the next member
+		u          compression.Offset
+	)
+	for i, offset := range offsets {
+		if i > 0 && offset == offsets[i-1] {
+			continue
+		}
+		if i > 0 {
+			if offset-offsets[i-1] < minGzipMemberSize {
+				return nil, fmt.Errorf("invalid gzip member at offset %d", offsets[i-1])
+			}
+			if err := readFullAt(r, buf[:], offset-4); err != nil {
+				return nil, err
+			}
+			u += compression.Offset(binary.LittleEndian.Uint32(buf[:4]))
+		} else if err := readFullAt(r, buf[4:], offset); err != nil {
+			return nil, err
+		}
+		if buf[4] != 0x1f || buf[5] != 0x8b || buf[6] != 8 {
+			return nil, fmt.Errorf("no gzip member at offset %d", offset)
+		}
+		boundaries = append(boundaries, compression.StreamBoundary{
+			CompressedOffset:   compression.Offset(offset),
+			UncompressedOffset: u,
+		})
+	}
+	return boundaries, nil
+}
+
+// tarHeader rebuilds the tar header of the entry. `unames` and `gnames` map user and group IDs
+// to the last names seen, since eStargz only records the name of an ID when it changes.
+func (e *estargzTOCEntry) tarHeader(unames, gnames map[int]string) (*tar.Header, error) {
+	typeflag, ok := estargzTypeflags[e.Type]
+	if !ok {
+		return nil, fmt.Errorf("unsupported eStargz entry type %q", e.Type)
+	}
+	if e.Uname != "" {
+		unames[e.UID] = e.Uname
+	}
+	if e.Gname != "" {
+		gnames[e.GID] = e.Gname
+	}
+	// eStargz doesn't record modification times at the epoch.
+	modTime := time.Unix(0, 0)
+	if e.ModTime3339 != "" {
+		var err error
+		if modTime, err = time.Parse(time.RFC3339, e.ModTime3339); err != nil {
+			return nil, fmt.Errorf("invalid modification time of eStargz entry %s: %w", e.Name, err)
+		}
+	}
+
+	hdr := &tar.Header{
+		Typeflag: typeflag,
+		Name:     e.Name,
+		Linkname: e.LinkName,
+		Mode:     e.Mode,
+		Uid:      e.UID,
+		Gid:      e.GID,
+		Uname:    unames[e.UID],
+		Gname:    gnames[e.GID],
+		ModTime:  modTime,
+		Devmajor: int64(e.DevMajor),
+		Devminor: int64(e.DevMinor),
+	}
+	if typeflag == tar.TypeReg {
+		hdr.Size = e.Size
+	}
+	if len(e.Xattrs) > 0 {
+		hdr.PAXRecords = make(map[string]string, len(e.Xattrs))
+		for k, v := range e.Xattrs {
+			hdr.PAXRecords[schilyXattrPrefix+k] = string(v)
+		}
+	}
+	return hdr, nil
+}
+
+// contentDigest returns the digest of the content of a regular file.
+func (e *estargzTOCEntry) contentDigest() (digest.Digest, error) {
+	if e.Digest == "" && e.Size == 0 {
+		return digest.Canonical.FromBytes(nil), nil
+	}
+	dgst, err := digest.Parse(e.Digest)
+	if err != nil {
+		return "", fmt.Errorf("invalid digest of eStargz entry %s: %w", e.Name, err)
+	}
+	return dgst, nil
+}
+
+// tarHeaderLayout places the tar entries of a layer from the offsets of file contents.
+// Embedded TOCs record where file contents are, but not where tar headers are, so headers
+// are rebuilt from the TOC and the sizes of the headers between two file contents must add up.
+type tarHeaderLayout struct {
+	md      []FileMetadata
+	pending []tarHeaderBlocks  // entries whose headers haven't been placed yet
+	next    compression.Offset // offset of the next tar header
+}
+
+// tarHeaderBlocks is a tar header rebuilt from an embedded TOC.
+type tarHeaderBlocks struct {
+	metadata FileMetadata
+	size     compression.Offset
+}
+
+// add adds the entry with header `hdr`. If the entry has content, `contentOffset` is the
+// offset of its content, which places all the entries added since the previous content.
+func (l *tarHeaderLayout) add(hdr *tar.Header, dgst digest.Digest, contentOffset compression.Offset) error {
+	blocks, err := newTarHeaderBlocks(hdr)
+	if err != nil {
+		return err
+	}
+	blocks.metadata.Digest = dgst
+	l.pending = append(l.pending, blocks)
+	if hdr.Size == 0 {
+		return nil
+	}
+	if err := l.place(contentOffset); err != nil {
+		return err
+	}
+	l.next = AlignToTarBlock(contentOffset + compression.Offset(hdr.Size))
+	return nil
+}
+
+// place places the headers of the pending entries right before `end`.
+func (l *tarHeaderLayout) place(end compression.Offset) error {
+	offset := l.next
+	for _, h := range l.pending {
+		offset += h.size
+	}
+	if offset != end {
+		return fmt.Errorf("tar headers before offset %d don't match the embedded TOC", end)
+	}
+	offset = l.next
+	for _, h := range l.pending {
+		h.metadata.TarHeaderOffset = offset
+		offset += h.size
+		h.metadata.UncompressedOffset = offset
+		l.md = append(l.md, h.metadata)
+	}
+	l.pending = l.pending[:0]
+	l.next = end
+	return nil
+}
+
+// newTarHeaderBlocks writes `hdr` like a tar writer and reads it back, so that
+// the metadata is the same as if the header were read from the layer.
+func newTarHeaderBlocks(hdr *tar.Header) (tarHeaderBlocks, error) {
+	var buf bytes.Buffer
+	if err := tar.NewWriter(&buf).WriteHeader(hdr); err != nil {
+		return tarHeaderBlocks{}, err
+	}
+	size := compression.Offset(buf.Len())
+	readBack, err := tar.NewReader(&buf).Next()
+	if err != nil {
+		return tarHeaderBlocks{}, err
+	}
+	metadata, err := fileMetadataFromHeader(readBack, 0, 0)
+	if err != nil {
+		return tarHeaderBlocks{}, err
+	}
+	return tarHeaderBlocks{metadata: metadata, size: size}, nil
+}
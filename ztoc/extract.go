@@ -0,0 +1,301 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/continuity/fs"
+)
+
+var (
+	errFileReaderClosed = errors.New("file reader is closed")
+	errNegativeOffset   = errors.New("negative offset")
+
+	// sparseHole is read in place of the holes of sparse files, which aren't stored.
+	sparseHole [64 << 10]byte
+)
+
+// OpenFile opens a file of the compressed data (as a reader) for streaming. Unlike `ExtractFile`,
+// the file content isn't held in memory: spans are fetched and decompressed one at a time as the
+// file is read, so at most a span of compressed and uncompressed data is held at once.
+// The returned reader must be closed to release the zinfo.
+func (zt Ztoc) OpenFile(r *io.SectionReader, filename string) (io.ReadSeekCloser, error) {
+	entry, err := zt.GetMetadataEntry(filename)
+	if err != nil {
+		return nil, err
+	}
+	return zt.openEntry(r, entry)
+}
+
+// openEntry returns a reader of the content of the file `entry`, like `OpenFile`.
+func (zt Ztoc) openEntry(r *io.SectionReader, entry MetadataEntry) (io.ReadSeekCloser, error) {
+	zinfo, err := zt.Zinfo()
+	if err != nil {
+		return nil, err
+	}
+	return &fileReader{
+		r:                       r,
+		zinfo:                   zinfo,
+		entry:                   entry,
+		compressedArchiveSize:   zt.CompressedArchiveSize,
+		uncompressedArchiveSize: zt.UncompressedArchiveSize,
+	}, nil
+}
+
+// fileReader reads the content of a file from the compressed data span by span.
+type fileReader struct {
+	r                       *io.SectionReader
+	zinfo                   compression.Zinfo
+	entry                   MetadataEntry
+	compressedArchiveSize   compression.Offset
+	uncompressedArchiveSize compression.Offset
+
+	// pos is the read position relative to the start of the file.
+	pos compression.Offset
+	// buf is the decompressed part of the file from the last span read,
+	// starting at `bufOffset` relative to the start of the file.
+	buf       []byte
+	bufOffset compression.Offset
+	closed    bool
+}
+
+func (fr *fileReader) Read(p []byte) (int, error) {
+	if fr.closed {
+		return 0, errFileReaderClosed
+	}
+	if fr.pos >= fr.entry.UncompressedSize {
+		return 0, io.EOF
+	}
+	if fr.pos < fr.bufOffset || fr.pos >= fr.bufOffset+compression.Offset(len(fr.buf)) {
+		if err := fr.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, fr.buf[fr.pos-fr.bufOffset:])
+	fr.pos += compression.Offset(n)
+	return n, nil
+}
+
+// fill decompresses the part of the file in the span containing the read position.
+// If the read position is in a hole of a sparse file, the buffer is filled with zeros instead.
+func (fr *fileReader) fill() error {
+	segment := SparseSegments(fr.entry.SparseMap, fr.pos, fr.entry.UncompressedSize-fr.pos)[0]
+	if segment.Hole {
+		if segment.Length > compression.Offset(len(sparseHole)) {
+			segment.Length = compression.Offset(len(sparseHole))
+		}
+		fr.buf = sparseHole[:segment.Length]
+		fr.bufOffset = fr.pos
+		return nil
+	}
+
+	start := fr.entry.UncompressedOffset + segment.DataOffset
+	spanID := fr.zinfo.UncompressedOffsetToSpanID(start)
+	end := fr.zinfo.EndUncompressedOffset(spanID, fr.uncompressedArchiveSize)
+	if segmentEnd := start + segment.Length; end > segmentEnd {
+		end = segmentEnd
+	}
+
+	compressedStart := fr.zinfo.StartCompressedOffset(spanID)
+	compressedEnd := fr.zinfo.EndCompressedOffset(spanID, fr.compressedArchiveSize)
+	compressedBuf := make([]byte, compressedEnd-compressedStart)
+	n, err := fr.r.ReadAt(compressedBuf, int64(compressedStart))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n != len(compressedBuf) {
+		return fmt.Errorf("unexpected data size. read = %d, expected = %d", n, len(compressedBuf))
+	}
+
+	buf, err := fr.zinfo.ExtractDataFromBuffer(compressedBuf, end-start, start, spanID)
+	if err != nil {
+		return err
+	}
+	if len(buf) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	fr.buf = buf
+	fr.bufOffset = fr.pos
+	return nil
+}
+
+func (fr *fileReader) Seek(offset int64, whence int) (int64, error) {
+	if fr.closed {
+		return 0, errFileReaderClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += int64(fr.pos)
+	case io.SeekEnd:
+		offset += int64(fr.entry.UncompressedSize)
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	fr.pos = compression.Offset(offset)
+	return offset, nil
+}
+
+func (fr *fileReader) Close() error {
+	if !fr.closed {
+		fr.closed = true
+		fr.buf = nil
+		fr.zinfo.Close()
+	}
+	return nil
+}
+
+// ExtractDir extracts the subtree of the compressed data (as a reader) rooted at directory `dir`
+// to the directory `dest`, such that the content of `dir` ends up in `dest`. An empty `dir` or "/"
+// extracts the whole archive. Regular files are streamed with `OpenFile`. Directories, regular
+// files, symlinks and hard links are extracted, other file types are skipped. Entries can't
+// be extracted outside of `dest`, even through symlinks in the archive.
+func (zt Ztoc) ExtractDir(r *io.SectionReader, dir string, dest string) error {
+	idx := zt.PathIndex()
+	if _, err := idx.ListDir(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	root := CleanEntryName(dir)
+	// directory permissions and times are set once their content is extracted.
+	var dirs []FileMetadata
+	var dirPaths []string
+	for _, md := range zt.FileMetadata {
+		rel, ok := subtreePath(root, md.Name)
+		if !ok {
+			continue
+		}
+		target, err := zt.extractEntry(r, idx, md, root, rel, dest)
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", md.Name, err)
+		}
+		if md.Type == "dir" {
+			dirs = append(dirs, md)
+			dirPaths = append(dirPaths, target)
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setFileAttributes(dirPaths[i], dirs[i]); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", dirs[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// subtreePath returns the path of the entry `name` relative to the directory `root`,
+// and whether the entry is in the subtree rooted at `root`.
+func subtreePath(root, name string) (string, bool) {
+	name = CleanEntryName(name)
+	switch {
+	case root == "":
+		return name, true
+	case name == root:
+		return "", true
+	case strings.HasPrefix(name, root+"/"):
+		return name[len(root)+1:], true
+	}
+	return "", false
+}
+
+// extractEntry extracts the entry `md` to path `rel` in `dest` and returns the path it was
+// extracted to. `root` is the name of the extracted directory, which hard links are relative to.
+// `idx` is the path index of the TOC.
+func (zt Ztoc) extractEntry(r *io.SectionReader, idx *PathIndex, md FileMetadata, root, rel, dest string) (string, error) {
+	if rel == "" {
+		return dest, nil
+	}
+	parent, err := fs.RootPath(dest, filepath.Dir(rel))
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", err
+	}
+	target := filepath.Join(parent, filepath.Base(rel))
+	// like tar, a later entry replaces an earlier one.
+	if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && md.Type == "dir") {
+		if err := os.RemoveAll(target); err != nil {
+			return "", err
+		}
+	}
+
+	switch md.Type {
+	case "dir":
+		return target, os.MkdirAll(target, 0755)
+	case "reg":
+		if err := zt.extractRegularFile(r, idx, md.Name, target); err != nil {
+			return "", err
+		}
+	case "symlink":
+		return target, os.Symlink(md.Linkname, target)
+	case "hardlink":
+		if link, ok := subtreePath(root, md.Linkname); ok && link != "" {
+			if source, err := fs.RootPath(dest, link); err == nil {
+				if err := os.Link(source, target); err == nil {
+					return target, nil
+				}
+			}
+		}
+		// the link target is outside of the extracted directory.
+		if err := zt.extractRegularFile(r, idx, md.Name, target); err != nil {
+			return "", err
+		}
+	default:
+		return target, nil
+	}
+	return target, setFileAttributes(target, md)
+}
+
+func setFileAttributes(target string, md FileMetadata) error {
+	if err := os.Chmod(target, md.FileMode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(target, md.ModTime, md.ModTime)
+}
+
+func (zt Ztoc) extractRegularFile(r *io.SectionReader, idx *PathIndex, name, target string) error {
+	entry, err := idx.GetMetadataEntry(name)
+	if err != nil {
+		return err
+	}
+	fr, err := zt.openEntry(r, entry)
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, fr); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,225 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+)
+
+func TestOpenFile(t *testing.T) {
+	for _, tc := range testZtocs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			testOpenFile(t, tc.compressionAlgo, tc.tarGenerator)
+		})
+	}
+}
+
+func testOpenFile(t *testing.T, compressionAlgo string, generator tarGenerator) {
+	tarEntries := []testutil.TarEntry{
+		testutil.File("smallfile", string(testutil.RandomByteDataRange(1, 100))),
+		testutil.File("emptyfile", ""),
+		testutil.File("largefile", string(testutil.RandomByteDataRange(350000, 500000))),
+		testutil.Link("hardlink", "largefile"),
+	}
+	tarFilePath, m, fileNames := generator(t, "open-file", tarEntries)
+	defer os.Remove(tarFilePath)
+	m["hardlink"] = m["largefile"]
+	fileNames = append(fileNames, "hardlink")
+
+	file, err := os.Open(tarFilePath)
+	if err != nil {
+		t.Fatalf("could not open the tar file: %v", err)
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		t.Fatalf("could not stat the tar file: %v", err)
+	}
+
+	ztoc, err := NewBuilder("test").BuildZtoc(tarFilePath, 65536, WithCompression(compressionAlgo))
+	if err != nil {
+		t.Fatalf("can't build ztoc: %v", err)
+	}
+
+	for _, name := range fileNames {
+		original := m[name]
+		fr, err := ztoc.OpenFile(io.NewSectionReader(file, 0, fi.Size()), name)
+		if err != nil {
+			t.Fatalf("can't open %s: %v", name, err)
+		}
+		defer fr.Close()
+
+		extracted, err := io.ReadAll(fr)
+		if err != nil {
+			t.Fatalf("can't read %s: %v", name, err)
+		}
+		if !bytes.Equal(extracted, original) {
+			diffIdx := getPositionOfFirstDiffInByteSlice(extracted, original)
+			t.Fatalf("file %s read bytes != original bytes; byte %d is different", name, diffIdx)
+		}
+
+		for _, off := range []int64{int64(len(original)) / 2, 0, int64(len(original)) - 1, int64(len(original))} {
+			if off < 0 {
+				continue
+			}
+			if _, err := fr.Seek(off, io.SeekStart); err != nil {
+				t.Fatalf("can't seek %s to %d: %v", name, off, err)
+			}
+			buf := make([]byte, 70000)
+			n, err := io.ReadFull(fr, buf)
+			if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+				t.Fatalf("can't read %s at %d: %v", name, off, err)
+			}
+			end := off + 70000
+			if end > int64(len(original)) {
+				end = int64(len(original))
+			}
+			if !bytes.Equal(buf[:n], original[off:end]) {
+				t.Fatalf("file %s read at %d != original bytes", name, off)
+			}
+		}
+
+		if _, err := fr.Seek(-1, io.SeekStart); err == nil {
+			t.Fatalf("expected error seeking to a negative offset")
+		}
+		if err := fr.Close(); err != nil {
+			t.Fatalf("can't close %s: %v", name, err)
+		}
+		if _, err := fr.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("expected error reading closed file")
+		}
+	}
+
+	if _, err := ztoc.OpenFile(io.NewSectionReader(file, 0, fi.Size()), "missing"); err == nil {
+		t.Fatalf("expected error opening a file that doesn't exist")
+	}
+}
+
+func TestExtractDir(t *testing.T) {
+	for _, tc := range testZtocs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			testExtractDir(t, tc.compressionAlgo, tc.tarGenerator)
+		})
+	}
+}
+
+func testExtractDir(t *testing.T, compressionAlgo string, generator tarGenerator) {
+	modTime := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	tarEntries := []testutil.TarEntry{
+		testutil.Dir("outside/"),
+		testutil.File("outside/file", "outside"),
+		testutil.Dir("app/", testutil.WithDirMode(0700)),
+		testutil.File("app/file", string(testutil.RandomByteDataRange(350000, 500000)), testutil.WithFileModTime(modTime), testutil.WithFileMode(0600)),
+		testutil.Dir("app/sub/"),
+		testutil.File("app/sub/file", "soci"),
+		testutil.Symlink("app/link", "sub/file"),
+		testutil.Link("app/hardlink", "app/sub/file"),
+		testutil.Link("app/outside-hardlink", "outside/file"),
+		// this symlink must not let the next entry escape the destination directory.
+		testutil.Symlink("app/escape", "../../../.."),
+		testutil.File("app/escape/escaped", "escaped"),
+		testutil.Fifo("app/fifo"),
+		testutil.File("apple", "not in app"),
+	}
+	tarFilePath, _, _ := generator(t, "extract-dir", tarEntries)
+	defer os.Remove(tarFilePath)
+
+	file, err := os.Open(tarFilePath)
+	if err != nil {
+		t.Fatalf("could not open the tar file: %v", err)
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		t.Fatalf("could not stat the tar file: %v", err)
+	}
+
+	ztoc, err := NewBuilder("test").BuildZtoc(tarFilePath, 65536, WithCompression(compressionAlgo))
+	if err != nil {
+		t.Fatalf("can't build ztoc: %v", err)
+	}
+	content, err := ztoc.ExtractFile(io.NewSectionReader(file, 0, fi.Size()), "app/file")
+	if err != nil {
+		t.Fatalf("can't extract app/file: %v", err)
+	}
+
+	tmp := t.TempDir()
+	dest := filepath.Join(tmp, "a", "b")
+	if err := ztoc.ExtractDir(io.NewSectionReader(file, 0, fi.Size()), "/app/", dest); err != nil {
+		t.Fatalf("can't extract directory: %v", err)
+	}
+
+	expectedFiles := map[string][]byte{
+		"file":             content,
+		"sub/file":         []byte("soci"),
+		"link":             []byte("soci"),
+		"hardlink":         []byte("soci"),
+		"outside-hardlink": []byte("outside"),
+		"escaped":          []byte("escaped"),
+	}
+	for name, expected := range expectedFiles {
+		actual, err := os.ReadFile(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatalf("can't read extracted %s: %v", name, err)
+		}
+		if !bytes.Equal(actual, expected) {
+			t.Fatalf("extracted %s doesn't match the original", name)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "link")); err != nil || target != "sub/file" {
+		t.Fatalf("unexpected symlink target %q: %v", target, err)
+	}
+	for _, name := range []string{"fifo", "apple", "outside"} {
+		if _, err := os.Lstat(filepath.Join(dest, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s should not have been extracted", name)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(filepath.Dir(tmp), "escaped")); !os.IsNotExist(err) {
+		t.Fatalf("file escaped the destination directory")
+	}
+
+	fileInfo, err := os.Stat(filepath.Join(dest, "file"))
+	if err != nil {
+		t.Fatalf("can't stat extracted file: %v", err)
+	}
+	if fileInfo.Mode().Perm() != 0600 || !fileInfo.ModTime().Equal(modTime) {
+		t.Fatalf("unexpected mode %v and modification time %v", fileInfo.Mode(), fileInfo.ModTime())
+	}
+	dirInfo, err := os.Stat(dest)
+	if err != nil {
+		t.Fatalf("can't stat destination: %v", err)
+	}
+	if dirInfo.Mode().Perm() != 0700 {
+		t.Fatalf("unexpected mode of the extracted directory %v", dirInfo.Mode())
+	}
+
+	if err := ztoc.ExtractDir(io.NewSectionReader(file, 0, fi.Size()), "app/file", t.TempDir()); err == nil {
+		t.Fatalf("expected error extracting a file as a directory")
+	}
+	if err := ztoc.ExtractDir(io.NewSectionReader(file, 0, fi.Size()), "missing", t.TempDir()); err == nil {
+		t.Fatalf("expected error extracting a directory that doesn't exist")
+	}
+}
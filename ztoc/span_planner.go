@@ -0,0 +1,102 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// SpanStrategy defines how `ztoc.Builder` places spans in a layer.
+type SpanStrategy string
+
+const (
+	// SpanStrategyFixed starts a new span every span size bytes of uncompressed data.
+	SpanStrategyFixed SpanStrategy = "fixed"
+	// SpanStrategyAdaptive picks the span size per layer based on the layer size and
+	// file count, and moves span boundaries to tar entry boundaries (within a tolerance)
+	// so that small files don't straddle spans.
+	SpanStrategyAdaptive SpanStrategy = "adaptive"
+)
+
+const (
+	// DefaultSpanTolerance is the default fraction of the span size by which
+	// the adaptive span strategy can move a span boundary.
+	DefaultSpanTolerance = 0.1
+	// maxSpanTolerance is the largest supported span tolerance.
+	maxSpanTolerance = 0.5
+
+	// adaptiveFilesPerSpan is the average number of files the adaptive
+	// span strategy aims to put in a span.
+	adaptiveFilesPerSpan = 64
+	// adaptiveSpanSizeFactor bounds the span size picked by the adaptive span strategy
+	// to [spanSize / adaptiveSpanSizeFactor, spanSize * adaptiveSpanSizeFactor].
+	adaptiveSpanSizeFactor = 4
+	// adaptiveMaxSpans is the number of spans above which the adaptive span strategy
+	// increases the span size to limit the size of the zinfo.
+	adaptiveMaxSpans = 1024
+)
+
+// ParseSpanStrategy parses a span strategy name.
+func ParseSpanStrategy(s string) (SpanStrategy, error) {
+	switch strategy := SpanStrategy(s); strategy {
+	case SpanStrategyFixed, SpanStrategyAdaptive:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unsupported span strategy %q, supported: %s, %s", s, SpanStrategyFixed, SpanStrategyAdaptive)
+	}
+}
+
+// adaptiveSpanSize picks the span size of a layer so that a span holds about
+// `adaptiveFilesPerSpan` files on average, while keeping the number of spans
+// under `adaptiveMaxSpans` when possible. The result stays within a factor of
+// `adaptiveSpanSizeFactor` of the configured `spanSize`.
+func adaptiveSpanSize(spanSize int64, uncompressedArchiveSize compression.Offset, numFiles int) int64 {
+	if numFiles < 1 {
+		numFiles = 1
+	}
+	size := int64(uncompressedArchiveSize) / int64(numFiles) * adaptiveFilesPerSpan
+	if minSize := int64(uncompressedArchiveSize) / adaptiveMaxSpans; size < minSize {
+		size = minSize
+	}
+	if minSize := spanSize / adaptiveSpanSizeFactor; size < minSize {
+		size = minSize
+	}
+	if maxSize := spanSize * adaptiveSpanSizeFactor; size > maxSize {
+		size = maxSize
+	}
+	return size
+}
+
+// newAdaptiveSpanPlanner creates a `compression.SpanPlanner` that aligns spans
+// with the boundaries of the tar entries in `toc`.
+func newAdaptiveSpanPlanner(spanSize int64, tolerance float64, toc TOC, uncompressedArchiveSize compression.Offset) compression.SpanPlanner {
+	var numFiles int
+	entries := make([]compression.Extent, 0, len(toc.FileMetadata))
+	for _, fm := range toc.FileMetadata {
+		if fm.Type == "reg" {
+			numFiles++
+		}
+		entries = append(entries, compression.Extent{
+			Start: fm.TarHeaderOffset,
+			End:   fm.UncompressedOffset + fm.DataSize(),
+		})
+	}
+	spanSize = adaptiveSpanSize(spanSize, uncompressedArchiveSize, numFiles)
+	return compression.NewAdaptiveSpanPlanner(spanSize, int64(float64(spanSize)*tolerance), entries)
+}
@@ -0,0 +1,112 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+func TestAdaptiveSpanSize(t *testing.T) {
+	const spanSize = 4 << 20
+	testCases := []struct {
+		name                    string
+		uncompressedArchiveSize compression.Offset
+		numFiles                int
+		expected                int64
+	}{
+		{
+			name:                    "span holds adaptiveFilesPerSpan files on average",
+			uncompressedArchiveSize: 1 << 30,
+			numFiles:                32768,
+			expected:                2 << 20,
+		},
+		{
+			name:                    "span size is bounded by the number of spans",
+			uncompressedArchiveSize: 8 << 30,
+			numFiles:                1 << 20,
+			expected:                8 << 20,
+		},
+		{
+			name:                    "many small files are bounded by the minimum span size",
+			uncompressedArchiveSize: 64 << 20,
+			numFiles:                1 << 20,
+			expected:                spanSize / adaptiveSpanSizeFactor,
+		},
+		{
+			name:                    "few large files are bounded by the maximum span size",
+			uncompressedArchiveSize: 1 << 30,
+			numFiles:                4,
+			expected:                spanSize * adaptiveSpanSizeFactor,
+		},
+		{
+			name:                    "layer without files",
+			uncompressedArchiveSize: 1 << 20,
+			numFiles:                0,
+			expected:                spanSize * adaptiveSpanSizeFactor,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actual := adaptiveSpanSize(spanSize, tc.uncompressedArchiveSize, tc.numFiles)
+			if actual != tc.expected {
+				t.Fatalf("unexpected span size; expected %d, got %d", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestParseSpanStrategy(t *testing.T) {
+	testCases := []struct {
+		name        string
+		strategy    string
+		expected    SpanStrategy
+		expectError bool
+	}{
+		{
+			name:     "fixed",
+			strategy: "fixed",
+			expected: SpanStrategyFixed,
+		},
+		{
+			name:     "adaptive",
+			strategy: "adaptive",
+			expected: SpanStrategyAdaptive,
+		},
+		{
+			name:        "unsupported",
+			strategy:    "random",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ParseSpanStrategy(tc.strategy)
+			if tc.expectError != (err != nil) {
+				t.Fatalf("expect error: %t, actual error: %v", tc.expectError, err)
+			}
+			if actual != tc.expected {
+				t.Fatalf("unexpected span strategy; expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
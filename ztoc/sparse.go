@@ -0,0 +1,358 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// SparseEntry is a fragment of data of a sparse file. The regions of a sparse file
+// that aren't covered by a fragment are holes, which read as zeros. The fragments are
+// stored back to back in the tar archive, from the start of the content of the file.
+type SparseEntry struct {
+	Offset compression.Offset // Offset of the fragment in the file
+	Length compression.Offset // Length of the fragment
+}
+
+// SparseSegment is a part of a range of a file, which is either a hole or data
+// stored in the tar archive at `DataOffset` relative to the start of the file content.
+type SparseSegment struct {
+	Hole       bool
+	DataOffset compression.Offset
+	Length     compression.Offset
+}
+
+// SparseSegments splits the `length` bytes at `offset` of a file with sparse map `sparseMap`
+// into holes and stored data, in order. A file without sparse map isn't sparse, so the range
+// is a single segment of data.
+func SparseSegments(sparseMap []SparseEntry, offset, length compression.Offset) []SparseSegment {
+	if sparseMap == nil {
+		return []SparseSegment{{DataOffset: offset, Length: length}}
+	}
+	var (
+		segments   []SparseSegment
+		dataOffset compression.Offset
+		end        = offset + length
+	)
+	for _, e := range sparseMap {
+		if offset >= end {
+			break
+		}
+		fragmentEnd := e.Offset + e.Length
+		if fragmentEnd <= offset {
+			dataOffset += e.Length
+			continue
+		}
+		if e.Offset > offset {
+			holeEnd := e.Offset
+			if holeEnd > end {
+				holeEnd = end
+			}
+			segments = append(segments, SparseSegment{Hole: true, Length: holeEnd - offset})
+			offset = holeEnd
+		}
+		if fragmentEnd > end {
+			fragmentEnd = end
+		}
+		if fragmentEnd > offset {
+			segments = append(segments, SparseSegment{
+				DataOffset: dataOffset + offset - e.Offset,
+				Length:     fragmentEnd - offset,
+			})
+			offset = fragmentEnd
+		}
+		dataOffset += e.Length
+	}
+	if offset < end {
+		segments = append(segments, SparseSegment{Hole: true, Length: end - offset})
+	}
+	return segments
+}
+
+// sparseDataSize returns the size of the data of a file of `size` bytes stored in the tar archive.
+func sparseDataSize(sparseMap []SparseEntry, size compression.Offset) compression.Offset {
+	if sparseMap == nil {
+		return size
+	}
+	var dataSize compression.Offset
+	for _, e := range sparseMap {
+		dataSize += e.Length
+	}
+	return dataSize
+}
+
+// expandSparse returns the content of a file of `size` bytes given the `data` of its fragments.
+func expandSparse(data []byte, sparseMap []SparseEntry, size compression.Offset) []byte {
+	if sparseMap == nil {
+		return data
+	}
+	content := make([]byte, size)
+	for _, e := range sparseMap {
+		n := copy(content[e.Offset:e.Offset+e.Length], data)
+		data = data[n:]
+	}
+	return content
+}
+
+// validateSparseMap checks that the fragments of a sparse file of `size` bytes are sorted,
+// don't overlap and are within the file.
+func validateSparseMap(sparseMap []SparseEntry, size compression.Offset) error {
+	var end compression.Offset
+	for _, e := range sparseMap {
+		if e.Offset < end || e.Length < 0 || e.Offset+e.Length > size {
+			return fmt.Errorf("invalid sparse map entry (offset %d, length %d) of file of %d bytes", e.Offset, e.Length, size)
+		}
+		end = e.Offset + e.Length
+	}
+	return nil
+}
+
+// checkSparseFiles returns an error wrapping `ErrVersionTooOld` if `toc` has sparse
+// files and ztocs of `version` can't represent them.
+func (toc TOC) checkSparseFiles(version Version) error {
+	if version.atLeast(Version12) {
+		return nil
+	}
+	for _, md := range toc.FileMetadata {
+		if md.SparseMap != nil {
+			return fmt.Errorf("%w %s: %s is a sparse file, which requires ztoc version %s or later", ErrVersionTooOld, version, md.Name, Version12)
+		}
+	}
+	return nil
+}
+
+// tarHeaderRecorder records the bytes read from `r` from offset `start` while recording,
+// which is used to keep the raw header blocks of tar entries that `tar.Reader` doesn't expose.
+type tarHeaderRecorder struct {
+	r         io.Reader
+	pos       compression.Offset
+	start     compression.Offset
+	recording bool
+	buf       []byte
+}
+
+func (hr *tarHeaderRecorder) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	if hr.recording && hr.pos+compression.Offset(n) > hr.start {
+		from := compression.Offset(0)
+		if hr.start > hr.pos {
+			from = hr.start - hr.pos
+		}
+		hr.buf = append(hr.buf, p[from:n]...)
+	}
+	hr.pos += compression.Offset(n)
+	return n, err
+}
+
+// record starts recording the bytes read from `start`, dropping the bytes recorded previously.
+func (hr *tarHeaderRecorder) record(start compression.Offset) {
+	hr.buf = hr.buf[:0]
+	hr.start = start
+	hr.recording = true
+}
+
+// stop stops recording and returns the recorded bytes, which are valid until the next `record`.
+func (hr *tarHeaderRecorder) stop() []byte {
+	hr.recording = false
+	return hr.buf
+}
+
+const (
+	tarBlockSize = 512
+
+	// The old GNU sparse format stores 4 entries in the header and 21 entries in every
+	// extension block following it. An entry is a 12 bytes offset and a 12 bytes length.
+	gnuSparseEntrySize           = 24
+	gnuSparseHeaderOffset        = 386
+	gnuSparseHeaderEntries       = 4
+	gnuSparseHeaderIsExtended    = 482
+	gnuSparseExtensionEntries    = 21
+	gnuSparseExtensionIsExtended = 504
+)
+
+var errSparseHeader = errors.New("invalid sparse file header")
+
+// sparseMapFromTar returns the sparse map of a tar entry read by `tar.Reader` with header `hdr`,
+// or nil if the entry isn't a sparse file. `raw` contains the blocks of the entry read by
+// `tar.Reader.Next`, from its first header block. The old GNU format and the GNU PAX formats
+// 0.0, 0.1 and 1.0 are supported, like in `tar.Reader`. Since the content of a sparse file
+// can be a single hole, the map of a sparse file always contains at least one entry.
+func sparseMapFromTar(hdr *tar.Header, raw []byte) ([]SparseEntry, error) {
+	var (
+		sparseMap []SparseEntry
+		err       error
+	)
+	major, minor := hdr.PAXRecords["GNU.sparse.major"], hdr.PAXRecords["GNU.sparse.minor"]
+	switch {
+	case hdr.Typeflag == tar.TypeGNUSparse:
+		sparseMap, err = parseOldGNUSparseMap(raw)
+	case major == "1" && minor == "0":
+		sparseMap, err = parsePAX1SparseMap(raw)
+	case major == "0" && (minor == "0" || minor == "1"),
+		major == "" && minor == "" && hdr.PAXRecords["GNU.sparse.map"] != "":
+		// `tar.Reader` converts the sparse map of the 0.0 format to the one of the 0.1 format.
+		sparseMap, err = parsePAX0SparseMap(hdr.PAXRecords["GNU.sparse.map"])
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w of %s: %v", errSparseHeader, hdr.Name, err)
+	}
+	if len(sparseMap) == 0 {
+		sparseMap = []SparseEntry{{Offset: compression.Offset(hdr.Size)}}
+	}
+	return sparseMap, nil
+}
+
+// parseOldGNUSparseMap parses the sparse map of a type 'S' entry from its header block
+// and the extension blocks following it.
+func parseOldGNUSparseMap(raw []byte) ([]SparseEntry, error) {
+	pos, err := mainTarHeaderPosition(raw)
+	if err != nil {
+		return nil, err
+	}
+	var sparseMap []SparseEntry
+	blk := raw[pos : pos+tarBlockSize]
+	entries, numEntries, isExtended := blk[gnuSparseHeaderOffset:], gnuSparseHeaderEntries, blk[gnuSparseHeaderIsExtended]
+	for {
+		for i := 0; i < numEntries; i++ {
+			entry := entries[i*gnuSparseEntrySize : (i+1)*gnuSparseEntrySize]
+			if entry[0] == 0 {
+				break
+			}
+			offset, err := parseTarNumber(entry[:12])
+			if err != nil {
+				return nil, err
+			}
+			length, err := parseTarNumber(entry[12:])
+			if err != nil {
+				return nil, err
+			}
+			sparseMap = append(sparseMap, SparseEntry{Offset: compression.Offset(offset), Length: compression.Offset(length)})
+		}
+		if isExtended == 0 {
+			return sparseMap, nil
+		}
+		pos += tarBlockSize
+		if pos+tarBlockSize > len(raw) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		blk = raw[pos : pos+tarBlockSize]
+		entries, numEntries, isExtended = blk, gnuSparseExtensionEntries, blk[gnuSparseExtensionIsExtended]
+	}
+}
+
+// parsePAX1SparseMap parses the sparse map of the GNU PAX format 1.0, which is stored
+// in the blocks following the header as decimal numbers separated by newlines: the
+// number of entries, then the offset and length of every entry.
+func parsePAX1SparseMap(raw []byte) ([]SparseEntry, error) {
+	pos, err := mainTarHeaderPosition(raw)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(string(raw[pos+tarBlockSize:]), "\n")
+	n, err := strconv.ParseInt(fields[0], 10, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || int64(len(fields)) < 2*n+1 {
+		return nil, fmt.Errorf("truncated sparse map of %d entries", n)
+	}
+	return parseSparseEntries(fields[1 : 2*n+1])
+}
+
+// parsePAX0SparseMap parses the sparse map of the GNU PAX formats 0.x, which is the
+// value of the GNU.sparse.map record: the offset and length of every entry separated by commas.
+func parsePAX0SparseMap(s string) ([]SparseEntry, error) {
+	if s == "" {
+		return nil, nil
+	}
+	fields := strings.Split(s, ",")
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("odd number of fields in sparse map %q", s)
+	}
+	return parseSparseEntries(fields)
+}
+
+func parseSparseEntries(fields []string) ([]SparseEntry, error) {
+	sparseMap := make([]SparseEntry, 0, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		offset, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		sparseMap = append(sparseMap, SparseEntry{Offset: compression.Offset(offset), Length: compression.Offset(length)})
+	}
+	return sparseMap, nil
+}
+
+// mainTarHeaderPosition returns the position in `raw` of the header block of a tar entry,
+// which follows its PAX and GNU long name headers.
+func mainTarHeaderPosition(raw []byte) (int, error) {
+	pos := 0
+	for pos+tarBlockSize <= len(raw) {
+		blk := raw[pos : pos+tarBlockSize]
+		switch blk[156] {
+		case tar.TypeXHeader, tar.TypeXGlobalHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+			size, err := parseTarNumber(blk[124:136])
+			if err != nil {
+				return 0, err
+			}
+			pos += tarBlockSize + int(AlignToTarBlock(compression.Offset(size)))
+		default:
+			return pos, nil
+		}
+	}
+	return 0, io.ErrUnexpectedEOF
+}
+
+// parseTarNumber parses a numeric field of a tar header, which is either
+// octal or, for numbers that don't fit, base-256 with the high bit of the first byte set.
+func parseTarNumber(b []byte) (int64, error) {
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		if b[0]&0x40 != 0 {
+			return 0, fmt.Errorf("negative number in tar header")
+		}
+		var n int64
+		for i, c := range b {
+			if i == 0 {
+				c &= 0x7f
+			}
+			if n>>55 != 0 {
+				return 0, fmt.Errorf("number in tar header overflows")
+			}
+			n = n<<8 | int64(c)
+		}
+		return n, nil
+	}
+	s := strings.Trim(string(b), " \x00")
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 8, 64)
+}
@@ -0,0 +1,321 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestSparseSegments(t *testing.T) {
+	sparseMap := []SparseEntry{
+		{Offset: 10, Length: 5},
+		{Offset: 15, Length: 5},
+		{Offset: 30, Length: 10},
+		{Offset: 50, Length: 0},
+	}
+	testCases := []struct {
+		name      string
+		sparseMap []SparseEntry
+		offset    compression.Offset
+		length    compression.Offset
+		expected  []SparseSegment
+	}{
+		{
+			name:     "file that isn't sparse",
+			offset:   7,
+			length:   100,
+			expected: []SparseSegment{{DataOffset: 7, Length: 100}},
+		},
+		{
+			name:      "whole file",
+			sparseMap: sparseMap,
+			offset:    0,
+			length:    50,
+			expected: []SparseSegment{
+				{Hole: true, Length: 10},
+				{DataOffset: 0, Length: 5},
+				{DataOffset: 5, Length: 5},
+				{Hole: true, Length: 10},
+				{DataOffset: 10, Length: 10},
+				{Hole: true, Length: 10},
+			},
+		},
+		{
+			name:      "range inside a fragment",
+			sparseMap: sparseMap,
+			offset:    32,
+			length:    3,
+			expected:  []SparseSegment{{DataOffset: 12, Length: 3}},
+		},
+		{
+			name:      "range inside a hole",
+			sparseMap: sparseMap,
+			offset:    21,
+			length:    4,
+			expected:  []SparseSegment{{Hole: true, Length: 4}},
+		},
+		{
+			name:      "range across a hole",
+			sparseMap: sparseMap,
+			offset:    18,
+			length:    14,
+			expected: []SparseSegment{
+				{DataOffset: 8, Length: 2},
+				{Hole: true, Length: 10},
+				{DataOffset: 10, Length: 2},
+			},
+		},
+		{
+			name:      "file that is a single hole",
+			sparseMap: []SparseEntry{{Offset: 20}},
+			offset:    5,
+			length:    15,
+			expected:  []SparseSegment{{Hole: true, Length: 15}},
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := SparseSegments(tc.sparseMap, tc.offset, tc.length); !reflect.DeepEqual(actual, tc.expected) {
+				t.Fatalf("expected segments %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestSparseFiles(t *testing.T) {
+	for _, tc := range testZtocs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			testSparseFiles(t, tc.compressionAlgo, tc.tarGenerator)
+		})
+	}
+}
+
+func testSparseFiles(t *testing.T, compressionAlgo string, generator tarGenerator) {
+	// more fragments than fit in the header of the old GNU format.
+	var fragments []testutil.SparseFragment
+	for i := int64(0); i < 30; i++ {
+		fragments = append(fragments, testutil.SparseFragment{
+			Offset: i * 20000,
+			Data:   string(testutil.RandomByteDataRange(1000, 5000)),
+		})
+	}
+	smallFragments := []testutil.SparseFragment{
+		{Offset: 100, Data: "soci"},
+		{Offset: 1000, Data: "snapshotter"},
+	}
+	tarEntries := []testutil.TarEntry{
+		testutil.File("before", string(testutil.RandomByteDataRange(1, 1000))),
+		testutil.SparseFile("gnu", 700000, fragments, testutil.SparseFormatGNU),
+		testutil.SparseFile("pax01", 700000, fragments, testutil.SparseFormatPAX01),
+		testutil.SparseFile("pax10", 700000, fragments, testutil.SparseFormatPAX10),
+		testutil.SparseFile("small", 1011, smallFragments, testutil.SparseFormatPAX10),
+		testutil.SparseFile("hole", 100000, nil, testutil.SparseFormatGNU),
+		testutil.File("after", string(testutil.RandomByteDataRange(1, 1000))),
+	}
+	tarFilePath, m, fileNames := generator(t, "sparse", tarEntries)
+	defer os.Remove(tarFilePath)
+	if len(fileNames) != len(tarEntries) {
+		t.Fatalf("expected %d files, got %d", len(tarEntries), len(fileNames))
+	}
+
+	// older snapshotters ignore sparse maps, so earlier ztoc versions can't have sparse files.
+	for _, version := range []Version{Version09, Version10, Version11} {
+		_, err := NewBuilder("test").BuildZtoc(tarFilePath, 65536, WithCompression(compressionAlgo), WithZtocVersion(version))
+		if !errors.Is(err, ErrVersionTooOld) {
+			t.Fatalf("expected %v building ztoc version %s, got %v", ErrVersionTooOld, version, err)
+		}
+	}
+
+	built, err := NewBuilder("test").BuildZtoc(tarFilePath, 65536, WithCompression(compressionAlgo), WithZtocVersion(Version12))
+	if err != nil {
+		t.Fatalf("can't build ztoc: %v", err)
+	}
+	older := *built
+	older.Version = Version10
+	if _, _, err := Marshal(&older); !errors.Is(err, ErrVersionTooOld) {
+		t.Fatalf("expected %v marshaling sparse files in ztoc version %s, got %v", ErrVersionTooOld, older.Version, err)
+	}
+	r, _, err := Marshal(built)
+	if err != nil {
+		t.Fatalf("can't marshal ztoc: %v", err)
+	}
+	unmarshaled, err := Unmarshal(r)
+	if err != nil {
+		t.Fatalf("can't unmarshal ztoc: %v", err)
+	}
+	for i := range built.FileMetadata {
+		if !built.FileMetadata[i].Equal(unmarshaled.FileMetadata[i]) {
+			t.Fatalf("metadata of %s changed by serialization", built.FileMetadata[i].Name)
+		}
+	}
+
+	file, err := os.Open(tarFilePath)
+	if err != nil {
+		t.Fatalf("could not open the tar file: %v", err)
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		t.Fatalf("could not stat the tar file: %v", err)
+	}
+
+	for _, ztoc := range []*Ztoc{built, unmarshaled} {
+		for _, fm := range ztoc.FileMetadata {
+			original := m[fm.Name]
+			sparse := fm.Name != "before" && fm.Name != "after"
+			if (fm.SparseMap != nil) != sparse {
+				t.Fatalf("unexpected sparse map of %s: %v", fm.Name, fm.SparseMap)
+			}
+			if fm.UncompressedSize != compression.Offset(len(original)) {
+				t.Fatalf("unexpected size of %s; expected %d, got %d", fm.Name, len(original), fm.UncompressedSize)
+			}
+			if sparse && fm.DataSize() >= fm.UncompressedSize {
+				t.Fatalf("holes of %s are included in its data size", fm.Name)
+			}
+			if fm.Digest != digest.FromBytes(original) {
+				t.Fatalf("unexpected digest of %s", fm.Name)
+			}
+
+			extracted, err := ztoc.ExtractFile(io.NewSectionReader(file, 0, fi.Size()), fm.Name)
+			if err != nil {
+				t.Fatalf("can't extract %s: %v", fm.Name, err)
+			}
+			if !bytes.Equal(extracted, original) {
+				t.Fatalf("extracted %s doesn't match the original", fm.Name)
+			}
+
+			fr, err := ztoc.OpenFile(io.NewSectionReader(file, 0, fi.Size()), fm.Name)
+			if err != nil {
+				t.Fatalf("can't open %s: %v", fm.Name, err)
+			}
+			streamed, err := io.ReadAll(fr)
+			fr.Close()
+			if err != nil {
+				t.Fatalf("can't read %s: %v", fm.Name, err)
+			}
+			if !bytes.Equal(streamed, original) {
+				t.Fatalf("%s read with OpenFile doesn't match the original", fm.Name)
+			}
+
+			if compressionAlgo == compression.Gzip {
+				extracted, err := ztoc.ExtractFromTarGz(tarFilePath, fm.Name)
+				if err != nil {
+					t.Fatalf("can't extract %s from tar.gz: %v", fm.Name, err)
+				}
+				if extracted != string(original) {
+					t.Fatalf("%s extracted from tar.gz doesn't match the original", fm.Name)
+				}
+			}
+		}
+	}
+}
+
+func TestMultiMemberGzip(t *testing.T) {
+	var tarEntries []testutil.TarEntry
+	for _, name := range []string{"file1", "file2", "file3", "file4"} {
+		tarEntries = append(tarEntries, testutil.File(name, string(testutil.RandomByteDataRange(100000, 300000))))
+	}
+	const memberSize = 150000
+	tarReader := testutil.BuildTarGz(tarEntries, gzip.DefaultCompression, testutil.WithGzipMemberSize(memberSize))
+	tarFilePath, _, err := testutil.WriteTarToTempFile("multi-member.tar.gz", tarReader)
+	if err != nil {
+		t.Fatalf("cannot prepare the .tar.gz file for testing: %v", err)
+	}
+	defer os.Remove(tarFilePath)
+	m, fileNames, err := testutil.GetFilesAndContentsWithinTarGz(tarFilePath)
+	if err != nil {
+		t.Fatalf("failed to get files and contents of the tar.gz file: %v", err)
+	}
+
+	file, err := os.Open(tarFilePath)
+	if err != nil {
+		t.Fatalf("could not open the tar file: %v", err)
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		t.Fatalf("could not stat the tar file: %v", err)
+	}
+
+	gr, err := gzip.NewReader(io.NewSectionReader(file, 0, fi.Size()))
+	if err != nil {
+		t.Fatalf("could not decompress the tar file: %v", err)
+	}
+	uncompressed, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("could not decompress the tar file: %v", err)
+	}
+
+	for _, strategy := range []SpanStrategy{SpanStrategyFixed, SpanStrategyAdaptive} {
+		// older snapshotters stop reading at the end of a gzip member.
+		opts := []BuildOption{WithCompression(compression.Gzip), WithSpanStrategy(strategy), WithZtocVersion(Version11)}
+		if _, err := NewBuilder("test").BuildZtoc(tarFilePath, 65536, opts...); !errors.Is(err, ErrVersionTooOld) {
+			t.Fatalf("expected %v building ztoc version %s, got %v", ErrVersionTooOld, Version11, err)
+		}
+		if _, err := NewBuilder("test").BuildZtocFromReader(io.NewSectionReader(file, 0, fi.Size()), 65536, opts...); !errors.Is(err, ErrVersionTooOld) {
+			t.Fatalf("expected %v building ztoc version %s from reader, got %v", ErrVersionTooOld, Version11, err)
+		}
+
+		ztoc, err := NewBuilder("test").BuildZtoc(tarFilePath, 65536, WithCompression(compression.Gzip), WithSpanStrategy(strategy), WithZtocVersion(Version12))
+		if err != nil {
+			t.Fatalf("can't build ztoc of multi-member gzip: %v", err)
+		}
+		if ztoc.UncompressedArchiveSize != compression.Offset(len(uncompressed)) {
+			t.Fatalf("the ztoc doesn't cover all the gzip members: %d bytes, expected %d", ztoc.UncompressedArchiveSize, len(uncompressed))
+		}
+		zinfo, err := ztoc.Zinfo()
+		if err != nil {
+			t.Fatalf("can't get zinfo: %v", err)
+		}
+		// every member must be extracted from the spans, whatever their size.
+		for start := 0; start < len(uncompressed); start += memberSize {
+			end := start + memberSize
+			if end > len(uncompressed) {
+				end = len(uncompressed)
+			}
+			member, err := zinfo.ExtractDataFromFile(tarFilePath, compression.Offset(end-start), compression.Offset(start))
+			if err != nil {
+				t.Fatalf("can't extract the gzip member at %d: %v", start, err)
+			}
+			if !bytes.Equal(member, uncompressed[start:end]) {
+				t.Fatalf("the gzip member at %d doesn't match the original", start)
+			}
+		}
+		zinfo.Close()
+		for _, name := range fileNames {
+			extracted, err := ztoc.ExtractFile(io.NewSectionReader(file, 0, fi.Size()), name)
+			if err != nil {
+				t.Fatalf("can't extract %s: %v", name, err)
+			}
+			if !bytes.Equal(extracted, m[name]) {
+				t.Fatalf("extracted %s doesn't match the original", name)
+			}
+		}
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/awslabs/soci-snapshotter/util/ioutils"
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
 )
 
 // TarProvider creates a tar reader from a compressed file reader (e.g., a gzip file reader),
@@ -39,7 +40,12 @@ func TarProviderGzip(compressedReader *os.File) (io.Reader, error) {
 
 // TarProviderZstd creates a tar reader from zstd reader.
 func TarProviderZstd(compressedReader *os.File) (io.Reader, error) {
-	return zstd.NewReader(compressedReader)
+	decoder, err := zstd.NewReader(compressedReader)
+	if err != nil {
+		return nil, err
+	}
+	// the returned reader releases the decoder's goroutines when it is closed.
+	return decoder.IOReadCloser(), nil
 }
 
 // TarProviderTar return the tar file directly as the input to
@@ -77,13 +83,23 @@ func (tb TocBuilder) CheckCompressionAlgorithm(algorithm string) bool {
 }
 
 // TocFromFile creates a `TOC` given a layer blob filename and the compression
-// algorithm used by the layer.
+// algorithm used by the layer. The content digest of every regular file is included.
 func (tb TocBuilder) TocFromFile(algorithm, filename string) (TOC, compression.Offset, error) {
+	return tb.tocFromFile(algorithm, filename, true)
+}
+
+// TocFromReader creates a `TOC` given an uncompressed tar stream.
+// The content digest of every regular file is included.
+func (tb TocBuilder) TocFromReader(r io.Reader) (TOC, compression.Offset, error) {
+	return tb.tocFromReader(r, true)
+}
+
+func (tb TocBuilder) tocFromFile(algorithm, filename string, digests bool) (TOC, compression.Offset, error) {
 	if !tb.CheckCompressionAlgorithm(algorithm) {
 		return TOC{}, 0, fmt.Errorf("unsupported compression algorithm: %s", algorithm)
 	}
 
-	fm, uncompressedArchiveSize, err := tb.getFileMetadata(algorithm, filename)
+	fm, uncompressedArchiveSize, err := tb.getFileMetadata(algorithm, filename, digests)
 	if err != nil {
 		return TOC{}, 0, err
 	}
@@ -91,9 +107,17 @@ func (tb TocBuilder) TocFromFile(algorithm, filename string) (TOC, compression.O
 	return TOC{FileMetadata: fm}, uncompressedArchiveSize, nil
 }
 
+func (tb TocBuilder) tocFromReader(r io.Reader, digests bool) (TOC, compression.Offset, error) {
+	fm, uncompressedArchiveSize, err := metadataFromTarReader(r, digests)
+	if err != nil {
+		return TOC{}, 0, err
+	}
+	return TOC{FileMetadata: fm}, uncompressedArchiveSize, nil
+}
+
 // getFileMetadata creates `FileMetadata` for each file within the compressed file
 // and calculate the uncompressed size of the passed file.
-func (tb TocBuilder) getFileMetadata(algorithm, filename string) ([]FileMetadata, compression.Offset, error) {
+func (tb TocBuilder) getFileMetadata(algorithm, filename string, digests bool) ([]FileMetadata, compression.Offset, error) {
 	// read compress file and create compress tar reader.
 	compressFile, err := os.Open(filename)
 	if err != nil {
@@ -105,8 +129,11 @@ func (tb TocBuilder) getFileMetadata(algorithm, filename string) ([]FileMetadata
 	if err != nil {
 		return nil, 0, err
 	}
+	if closer, ok := compressTarReader.(io.Closer); ok {
+		defer closer.Close()
+	}
 
-	md, uncompressFileSize, err := metadataFromTarReader(compressTarReader)
+	md, uncompressFileSize, err := metadataFromTarReader(compressTarReader, digests)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -114,15 +141,20 @@ func (tb TocBuilder) getFileMetadata(algorithm, filename string) ([]FileMetadata
 }
 
 // metadataFromTarReader reads every file from tar reader `sr` and creates
-// `FileMetadata` for each file.
-func metadataFromTarReader(r io.Reader) ([]FileMetadata, compression.Offset, error) {
-	pt := ioutils.NewPositionTrackerReader(r)
+// `FileMetadata` for each file. If `digests` is set, the content of every
+// regular file is hashed and recorded in `FileMetadata.Digest`.
+// The sparse map of sparse files is parsed from their raw tar headers.
+func metadataFromTarReader(r io.Reader, digests bool) ([]FileMetadata, compression.Offset, error) {
+	hr := &tarHeaderRecorder{r: r}
+	pt := ioutils.NewPositionTrackerReader(hr)
 	tarRdr := tar.NewReader(pt)
 	var md []FileMetadata
 	// the first tar header occurs at offset 0
 	var tarHeaderOffset compression.Offset
 	for {
+		hr.record(tarHeaderOffset)
 		hdr, err := tarRdr.Next()
+		raw := hr.stop()
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -130,35 +162,54 @@ func metadataFromTarReader(r io.Reader) ([]FileMetadata, compression.Offset, err
 			return nil, 0, fmt.Errorf("error while reading tar header: %w", err)
 		}
 
-		fileType, err := getType(hdr)
+		metadataEntry, err := fileMetadataFromHeader(hdr, tarHeaderOffset, compression.Offset(pt.CurrentPos()))
 		if err != nil {
 			return nil, 0, err
 		}
-
-		metadataEntry := FileMetadata{
-			Name:               hdr.Name,
-			Type:               fileType,
-			UncompressedOffset: compression.Offset(pt.CurrentPos()),
-			UncompressedSize:   compression.Offset(hdr.Size),
-			TarHeaderOffset:    tarHeaderOffset,
-			Linkname:           hdr.Linkname,
-			Mode:               hdr.Mode,
-			UID:                hdr.Uid,
-			GID:                hdr.Gid,
-			Uname:              hdr.Uname,
-			Gname:              hdr.Gname,
-			ModTime:            hdr.ModTime,
-			Devmajor:           hdr.Devmajor,
-			Devminor:           hdr.Devminor,
-			PAXHeaders:         hdr.PAXRecords,
+		metadataEntry.SparseMap, err = sparseMapFromTar(hdr, raw)
+		if err != nil {
+			return nil, 0, err
+		}
+		if digests && metadataEntry.Type == "reg" {
+			digester := digest.Canonical.Digester()
+			if _, err := io.Copy(digester.Hash(), tarRdr); err != nil {
+				return nil, 0, fmt.Errorf("error while reading content of %s: %w", hdr.Name, err)
+			}
+			metadataEntry.Digest = digester.Digest()
 		}
 		md = append(md, metadataEntry)
 		// The next file's tar header can be found immediately after the current file + padding
-		tarHeaderOffset = AlignToTarBlock(metadataEntry.UncompressedOffset + metadataEntry.UncompressedSize)
+		tarHeaderOffset = AlignToTarBlock(metadataEntry.UncompressedOffset + metadataEntry.DataSize())
 	}
 	return md, compression.Offset(pt.CurrentPos()), nil
 }
 
+// fileMetadataFromHeader creates the `FileMetadata` of a tar entry whose header
+// starts at `tarHeaderOffset` and whose content starts at `uncompressedOffset`.
+func fileMetadataFromHeader(hdr *tar.Header, tarHeaderOffset, uncompressedOffset compression.Offset) (FileMetadata, error) {
+	fileType, err := getType(hdr)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	return FileMetadata{
+		Name:               hdr.Name,
+		Type:               fileType,
+		UncompressedOffset: uncompressedOffset,
+		UncompressedSize:   compression.Offset(hdr.Size),
+		TarHeaderOffset:    tarHeaderOffset,
+		Linkname:           hdr.Linkname,
+		Mode:               hdr.Mode,
+		UID:                hdr.Uid,
+		GID:                hdr.Gid,
+		Uname:              hdr.Uname,
+		Gname:              hdr.Gname,
+		ModTime:            hdr.ModTime,
+		Devmajor:           hdr.Devmajor,
+		Devminor:           hdr.Devminor,
+		PAXHeaders:         hdr.PAXRecords,
+	}, nil
+}
+
 func getType(header *tar.Header) (fileType string, e error) {
 	switch header.Typeflag {
 	case tar.TypeLink:
@@ -167,7 +218,7 @@ func getType(header *tar.Header) (fileType string, e error) {
 		fileType = "symlink"
 	case tar.TypeDir:
 		fileType = "dir"
-	case tar.TypeReg:
+	case tar.TypeReg, tar.TypeGNUSparse:
 		fileType = "reg"
 	case tar.TypeChar:
 		fileType = "char"
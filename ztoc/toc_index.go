@@ -0,0 +1,175 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// maxLinkDepth is the maximum number of hard links followed by `GetMetadataEntry`.
+const maxLinkDepth = 255
+
+// PathIndex is an index of the paths of a TOC, built by `TOC.PathIndex`. It's a snapshot
+// of the TOC, so entries added to the TOC after the index is built aren't in the index.
+type PathIndex struct {
+	md []FileMetadata
+	// paths are the clean names of the entries, sorted, with the position
+	// of their entry in the TOC. The last entry with a given name wins, like in tar.
+	paths []indexedPath
+	// children are the sorted base names of the children of every directory,
+	// including directories that only exist as the parent of other entries.
+	children map[string][]string
+}
+
+type indexedPath struct {
+	name string
+	i    int
+}
+
+// CleanEntryName normalizes the name of a tar entry to a relative path without trailing
+// slash, such that names recorded by different tools can be compared. The root directory
+// is the empty string. Paths are looked up in the TOC by their clean name.
+func CleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// PathIndex builds the path index of the TOC, to list its entries or to look up many paths.
+// Looking up a single path with `TOC.Lookup` is cheaper than building the index.
+func (toc TOC) PathIndex() *PathIndex {
+	md := toc.FileMetadata
+	idx := &PathIndex{md: md}
+	positions := make(map[string]int, len(md))
+	for i := range md {
+		positions[CleanEntryName(md[i].Name)] = i
+	}
+	idx.paths = make([]indexedPath, 0, len(positions))
+	for name, i := range positions {
+		idx.paths = append(idx.paths, indexedPath{name: name, i: i})
+	}
+	sort.Slice(idx.paths, func(i, j int) bool {
+		return idx.paths[i].name < idx.paths[j].name
+	})
+
+	idx.children = map[string][]string{"": nil}
+	seen := map[string]bool{"": true}
+	for _, p := range idx.paths {
+		if _, ok := idx.children[p.name]; !ok && md[p.i].Type == "dir" {
+			idx.children[p.name] = nil
+		}
+		for name := p.name; !seen[name]; {
+			seen[name] = true
+			parent := parentEntryName(name)
+			idx.children[parent] = append(idx.children[parent], path.Base(name))
+			name = parent
+		}
+	}
+	for _, c := range idx.children {
+		sort.Strings(c)
+	}
+	return idx
+}
+
+// parentEntryName returns the clean name of the parent directory of the clean name `name`.
+func parentEntryName(name string) string {
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+// Lookup returns the metadata of the entry with path `name`. Paths are compared by their
+// `CleanEntryName`, so "dir", "/dir" and "./dir/" are the same path. Hard links aren't followed.
+func (toc TOC) Lookup(name string) (FileMetadata, bool) {
+	name = CleanEntryName(name)
+	for i := len(toc.FileMetadata) - 1; i >= 0; i-- {
+		if CleanEntryName(toc.FileMetadata[i].Name) == name {
+			return toc.FileMetadata[i], true
+		}
+	}
+	return FileMetadata{}, false
+}
+
+// Lookup returns the metadata of the entry with path `name`, like `TOC.Lookup`.
+func (idx *PathIndex) Lookup(name string) (FileMetadata, bool) {
+	name = CleanEntryName(name)
+	i := idx.search(name)
+	if i == len(idx.paths) || idx.paths[i].name != name {
+		return FileMetadata{}, false
+	}
+	return idx.md[idx.paths[i].i], true
+}
+
+// GetMetadataEntry gets MetadataEntry given a filename, like `TOC.GetMetadataEntry`.
+func (idx *PathIndex) GetMetadataEntry(filename string) (MetadataEntry, error) {
+	return getMetadataEntry(idx.Lookup, filename)
+}
+
+// ListDir returns the sorted base names of the children of directory `dir`, including
+// directories that have no entry of their own in the TOC. The root directory is "" or "/".
+func (idx *PathIndex) ListDir(dir string) ([]string, error) {
+	dir = CleanEntryName(dir)
+	children, ok := idx.children[dir]
+	if !ok {
+		if _, exists := idx.Lookup(dir); exists {
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil, fmt.Errorf("directory %s does not exist in metadata", dir)
+	}
+	return append([]string(nil), children...), nil
+}
+
+// ListPrefix returns the metadata of the entries whose clean name starts with `prefix`,
+// sorted by name. A `prefix` ending with "/" lists the subtree of a directory.
+func (idx *PathIndex) ListPrefix(prefix string) []FileMetadata {
+	prefix = strings.TrimPrefix(prefix, "/")
+	var md []FileMetadata
+	for i := idx.search(prefix); i < len(idx.paths) && strings.HasPrefix(idx.paths[i].name, prefix); i++ {
+		md = append(md, idx.md[idx.paths[i].i])
+	}
+	return md
+}
+
+// Glob returns the metadata of the entries whose clean name matches `pattern`, sorted by name.
+// The pattern syntax is the one of `path.Match`, and a leading "/" is ignored.
+func (idx *PathIndex) Glob(pattern string) ([]FileMetadata, error) {
+	pattern = strings.TrimPrefix(pattern, "/")
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	// only the names starting with the literal prefix of the pattern can match.
+	prefix := pattern
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		prefix = pattern[:i]
+	}
+	var md []FileMetadata
+	for i := idx.search(prefix); i < len(idx.paths) && strings.HasPrefix(idx.paths[i].name, prefix); i++ {
+		if ok, _ := path.Match(pattern, idx.paths[i].name); ok {
+			md = append(md, idx.md[idx.paths[i].i])
+		}
+	}
+	return md, nil
+}
+
+// search returns the position of the first path not less than `name`.
+func (idx *PathIndex) search(name string) int {
+	return sort.Search(len(idx.paths), func(i int) bool {
+		return idx.paths[i].name >= name
+	})
+}
@@ -0,0 +1,175 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testIndexedTOC() []FileMetadata {
+	return []FileMetadata{
+		{Name: "./", Type: "dir"},
+		{Name: "./bin/", Type: "dir"},
+		{Name: "./bin/sh", Type: "reg", UncompressedOffset: 1024, UncompressedSize: 10},
+		{Name: "./bin/bash", Type: "hardlink", Linkname: "bin/sh"},
+		{Name: "usr/lib/libc.so", Type: "reg", UncompressedOffset: 2048, UncompressedSize: 20},
+		{Name: "usr/lib/libm.so", Type: "reg", UncompressedOffset: 3072, UncompressedSize: 30},
+		{Name: "usr/lib/libm.a", Type: "reg", UncompressedOffset: 4096, UncompressedSize: 40},
+		{Name: "usr/lib-extra/", Type: "dir"},
+		{Name: "empty/", Type: "dir"},
+		{Name: "loop1", Type: "hardlink", Linkname: "loop2"},
+		{Name: "loop2", Type: "hardlink", Linkname: "loop1"},
+		// a later entry replaces an earlier one with the same path.
+		{Name: "bin/sh", Type: "reg", UncompressedOffset: 5120, UncompressedSize: 50},
+	}
+}
+
+func names(md []FileMetadata) []string {
+	var n []string
+	for _, m := range md {
+		n = append(n, m.Name)
+	}
+	return n
+}
+
+func TestPathIndex(t *testing.T) {
+	toc := TOC{FileMetadata: testIndexedTOC()}
+	idx := toc.PathIndex()
+	// paths are looked up the same way with and without an index.
+	lookups := map[string]interface {
+		Lookup(string) (FileMetadata, bool)
+		GetMetadataEntry(string) (MetadataEntry, error)
+	}{
+		"toc":   toc,
+		"index": idx,
+	}
+	for name, toc := range lookups {
+		toc := toc
+		t.Run("lookup "+name, func(t *testing.T) {
+			testCases := []struct {
+				name     string
+				expected string
+				found    bool
+			}{
+				{name: "bin/sh", expected: "bin/sh", found: true},
+				{name: "/bin/sh", expected: "bin/sh", found: true},
+				{name: "./bin/../bin/sh", expected: "bin/sh", found: true},
+				{name: "/", expected: "./", found: true},
+				{name: "bin", expected: "./bin/", found: true},
+				{name: "usr/lib", found: false},
+				{name: "missing", found: false},
+			}
+			for _, tc := range testCases {
+				md, ok := toc.Lookup(tc.name)
+				if ok != tc.found || md.Name != tc.expected {
+					t.Fatalf("lookup of %q: expected %q (%v), got %q (%v)", tc.name, tc.expected, tc.found, md.Name, ok)
+				}
+			}
+			entry, err := toc.GetMetadataEntry("/bin/bash")
+			if err != nil {
+				t.Fatalf("can't get metadata entry: %v", err)
+			}
+			if entry.UncompressedOffset != 5120 || entry.UncompressedSize != 50 {
+				t.Fatalf("unexpected metadata entry of hard link %v", entry)
+			}
+			if _, err := toc.GetMetadataEntry("loop1"); err == nil {
+				t.Fatalf("expected error following a hard link loop")
+			}
+		})
+	}
+
+	t.Run("list dir", func(t *testing.T) {
+		testCases := []struct {
+			dir      string
+			expected []string
+			err      bool
+		}{
+			{dir: "", expected: []string{"bin", "empty", "loop1", "loop2", "usr"}},
+			{dir: "/", expected: []string{"bin", "empty", "loop1", "loop2", "usr"}},
+			{dir: "./bin/", expected: []string{"bash", "sh"}},
+			{dir: "usr", expected: []string{"lib", "lib-extra"}},
+			{dir: "usr/lib", expected: []string{"libc.so", "libm.a", "libm.so"}},
+			{dir: "empty", expected: nil},
+			{dir: "bin/sh", err: true},
+			{dir: "missing", err: true},
+		}
+		for _, tc := range testCases {
+			children, err := idx.ListDir(tc.dir)
+			if (err != nil) != tc.err {
+				t.Fatalf("list of %q: unexpected error %v", tc.dir, err)
+			}
+			if !reflect.DeepEqual(children, tc.expected) {
+				t.Fatalf("list of %q: expected %v, got %v", tc.dir, tc.expected, children)
+			}
+		}
+	})
+
+	t.Run("list prefix", func(t *testing.T) {
+		testCases := []struct {
+			prefix   string
+			expected []string
+		}{
+			{prefix: "/usr/lib/", expected: []string{"usr/lib/libc.so", "usr/lib/libm.a", "usr/lib/libm.so"}},
+			{prefix: "usr/lib", expected: []string{"usr/lib-extra/", "usr/lib/libc.so", "usr/lib/libm.a", "usr/lib/libm.so"}},
+			{prefix: "bin", expected: []string{"./bin/", "./bin/bash", "bin/sh"}},
+			{prefix: "missing", expected: nil},
+		}
+		for _, tc := range testCases {
+			if actual := names(idx.ListPrefix(tc.prefix)); !reflect.DeepEqual(actual, tc.expected) {
+				t.Fatalf("list of prefix %q: expected %v, got %v", tc.prefix, tc.expected, actual)
+			}
+		}
+	})
+
+	t.Run("glob", func(t *testing.T) {
+		testCases := []struct {
+			pattern  string
+			expected []string
+		}{
+			{pattern: "/usr/lib/*.so", expected: []string{"usr/lib/libc.so", "usr/lib/libm.so"}},
+			{pattern: "usr/*/libm.?", expected: []string{"usr/lib/libm.a"}},
+			{pattern: "*/sh", expected: []string{"bin/sh"}},
+			{pattern: "loop[12]", expected: []string{"loop1", "loop2"}},
+			{pattern: "usr/lib", expected: nil},
+		}
+		for _, tc := range testCases {
+			md, err := idx.Glob(tc.pattern)
+			if err != nil {
+				t.Fatalf("glob of %q: unexpected error %v", tc.pattern, err)
+			}
+			if actual := names(md); !reflect.DeepEqual(actual, tc.expected) {
+				t.Fatalf("glob of %q: expected %v, got %v", tc.pattern, tc.expected, actual)
+			}
+		}
+		if _, err := idx.Glob("usr/[lib"); err == nil {
+			t.Fatalf("expected error with a malformed pattern")
+		}
+	})
+}
+
+func TestPathIndexIsSnapshot(t *testing.T) {
+	toc := TOC{FileMetadata: testIndexedTOC()}
+	idx := toc.PathIndex()
+	toc.FileMetadata = append(toc.FileMetadata, FileMetadata{Name: "new", Type: "reg"})
+	if _, ok := idx.Lookup("new"); ok {
+		t.Fatalf("expected entry added to the TOC after the index was built not to be indexed")
+	}
+	if _, ok := toc.Lookup("new"); !ok {
+		t.Fatalf("entry added to the TOC not found")
+	}
+}
@@ -0,0 +1,107 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	// ErrSpanDigestMismatch is returned when the spans of a layer don't match the span digests of its ztoc.
+	ErrSpanDigestMismatch = errors.New("span digests don't match layer")
+	// ErrTOCMismatch is returned when the files of a layer don't match the TOC of its ztoc.
+	ErrTOCMismatch = errors.New("TOC doesn't match layer")
+)
+
+// VerifySpans checks that the digest of every span of the compressed layer `r` of `size` bytes
+// matches the span digests of the ztoc.
+func (zt Ztoc) VerifySpans(r io.ReaderAt, size int64) error {
+	if compression.Offset(size) != zt.CompressedArchiveSize {
+		return fmt.Errorf("%w: layer size is %d, ztoc expects %d", ErrSpanDigestMismatch, size, zt.CompressedArchiveSize)
+	}
+	zinfo, err := zt.Zinfo()
+	if err != nil {
+		return err
+	}
+	defer zinfo.Close()
+
+	digests, err := getPerSpanDigestsFromReaderAt(r, size, zinfo)
+	if err != nil {
+		return err
+	}
+	if len(digests) != len(zt.SpanDigests) {
+		return fmt.Errorf("%w: layer has %d spans, ztoc has %d span digests", ErrSpanDigestMismatch, len(digests), len(zt.SpanDigests))
+	}
+	for i, dgst := range digests {
+		if dgst != zt.SpanDigests[i] {
+			return fmt.Errorf("%w: span %d has digest %s, ztoc expects %s", ErrSpanDigestMismatch, i, dgst, zt.SpanDigests[i])
+		}
+	}
+	return nil
+}
+
+// VerifyTOC checks that the TOC of the ztoc matches the files of the compressed layer `r`.
+// The layer is decompressed and its tar archive walked as if the ztoc were built again,
+// including the content digest of regular files for ztoc versions recording them.
+func (zt Ztoc) VerifyTOC(r io.Reader) error {
+	tarReader, err := decompressLayer(zt.CompressionAlgorithm, r)
+	if err != nil {
+		return err
+	}
+	defer tarReader.Close()
+
+	md, uncompressedArchiveSize, err := metadataFromTarReader(tarReader, zt.Version != Version09)
+	if err != nil {
+		return err
+	}
+	if len(md) != len(zt.FileMetadata) {
+		return fmt.Errorf("%w: layer has %d files, ztoc has %d", ErrTOCMismatch, len(md), len(zt.FileMetadata))
+	}
+	for i, expected := range zt.FileMetadata {
+		if !expected.Equal(md[i]) {
+			return fmt.Errorf("%w: metadata of %s doesn't match", ErrTOCMismatch, expected.Name)
+		}
+	}
+	if uncompressedArchiveSize != zt.UncompressedArchiveSize {
+		return fmt.Errorf("%w: uncompressed layer size is %d, ztoc expects %d", ErrTOCMismatch, uncompressedArchiveSize, zt.UncompressedArchiveSize)
+	}
+	return nil
+}
+
+// decompressLayer returns the tar archive of a layer compressed with `algorithm`.
+func decompressLayer(algorithm string, r io.Reader) (io.ReadCloser, error) {
+	switch algorithm {
+	case compression.Gzip:
+		return gzip.NewReader(r)
+	case compression.Zstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case compression.Uncompressed:
+		return io.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm: %s", algorithm)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+)
+
+func TestVerifyZtoc(t *testing.T) {
+	for _, tc := range testZtocs {
+		testVerifyZtoc(t, tc.compressionAlgo, tc.tarGenerator)
+	}
+}
+
+func testVerifyZtoc(t *testing.T, compressionAlgo string, generator tarGenerator) {
+	tarEntries := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/file1", string(testutil.RandomByteData(100000))),
+		testutil.File("file2", string(testutil.RandomByteData(250000))),
+		testutil.Symlink("link", "dir/file1"),
+	}
+	tarFilePath, _, _ := generator(t, "verify", tarEntries)
+	defer os.Remove(tarFilePath)
+	layer, err := os.ReadFile(tarFilePath)
+	if err != nil {
+		t.Fatalf("cannot read layer: %v", err)
+	}
+
+	testCases := []struct {
+		name             string
+		version          Version
+		modifyZtoc       func(*Ztoc)
+		modifyLayer      func([]byte) []byte
+		expectedSpansErr error
+		expectedTOCErr   error
+	}{
+		{
+			name:    "matching layer",
+			version: Version10,
+		},
+		{
+			name:    "matching layer without file digests",
+			version: Version09,
+		},
+		{
+			name:    "modified file metadata",
+			version: Version10,
+			modifyZtoc: func(zt *Ztoc) {
+				zt.FileMetadata[1].Name = "dir/other"
+			},
+			expectedTOCErr: ErrTOCMismatch,
+		},
+		{
+			name:    "modified span digest",
+			version: Version10,
+			modifyZtoc: func(zt *Ztoc) {
+				zt.SpanDigests[0] = zt.SpanDigests[len(zt.SpanDigests)-1]
+				zt.SpanDigests[len(zt.SpanDigests)-1] = ""
+			},
+			expectedSpansErr: ErrSpanDigestMismatch,
+		},
+		{
+			name:    "truncated layer",
+			version: Version10,
+			modifyLayer: func(b []byte) []byte {
+				return b[:len(b)/2]
+			},
+			expectedSpansErr: ErrSpanDigestMismatch,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(fmt.Sprintf("%s-%s", compressionAlgo, tc.name), func(t *testing.T) {
+			zt, err := NewBuilder("test").BuildZtoc(tarFilePath, 65536, WithCompression(compressionAlgo), WithZtocVersion(tc.version))
+			if err != nil {
+				t.Fatalf("cannot build ztoc: %v", err)
+			}
+			r, _, err := Marshal(zt)
+			if err != nil {
+				t.Fatalf("cannot marshal ztoc: %v", err)
+			}
+			zt, err = Unmarshal(r)
+			if err != nil {
+				t.Fatalf("cannot unmarshal ztoc: %v", err)
+			}
+			if tc.modifyZtoc != nil {
+				tc.modifyZtoc(zt)
+			}
+			b := layer
+			if tc.modifyLayer != nil {
+				b = tc.modifyLayer(append([]byte(nil), layer...))
+			}
+
+			err = zt.VerifySpans(bytes.NewReader(b), int64(len(b)))
+			if !errors.Is(err, tc.expectedSpansErr) {
+				t.Fatalf("unexpected span verification error, expected %v, got %v", tc.expectedSpansErr, err)
+			}
+			if tc.modifyLayer != nil {
+				// a truncated layer cannot be decompressed.
+				return
+			}
+			err = zt.VerifyTOC(bytes.NewReader(b))
+			if !errors.Is(err, tc.expectedTOCErr) {
+				t.Fatalf("unexpected TOC verification error, expected %v, got %v", tc.expectedTOCErr, err)
+			}
+		})
+	}
+}
@@ -32,6 +32,22 @@ type ZinfoBuilder interface {
 	ZinfoFromFile(filename string, spanSize int64) (zinfo CompressionInfo, fs compression.Offset, err error)
 }
 
+// StreamingZinfoBuilder is implemented by `ZinfoBuilder`s that can build zinfo
+// with a single pass over a compressed stream.
+type StreamingZinfoBuilder interface {
+	// ZinfoFromReader builds zinfo given a compressed tar stream and span size, and calculate the size of the stream.
+	// The uncompressed tar stream is written to `uncompressed` while the zinfo is built.
+	ZinfoFromReader(r io.Reader, spanSize int64, uncompressed io.Writer) (zinfo CompressionInfo, fs compression.Offset, err error)
+}
+
+// PlannedZinfoBuilder is implemented by `ZinfoBuilder`s that can let a
+// `compression.SpanPlanner` decide where spans start.
+type PlannedZinfoBuilder interface {
+	// ZinfoFromFileWithSpanPlanner builds zinfo given a compressed tar filename and a span planner,
+	// and calculate the size of the file.
+	ZinfoFromFileWithSpanPlanner(filename string, planner compression.SpanPlanner) (zinfo CompressionInfo, fs compression.Offset, err error)
+}
+
 type gzipZinfoBuilder struct{}
 
 // ZinfoFromFile creates zinfo for a gzip file. The underlying zinfo object (i.e. `GzipZinfo`)
@@ -63,9 +79,65 @@ func (gzb gzipZinfoBuilder) ZinfoFromFile(filename string, spanSize int64) (zinf
 		SpanDigests:          digests,
 		Checkpoints:          checkpoints,
 		CompressionAlgorithm: compression.Gzip,
+		gzipMembers:          compression.GzipMembers(index),
+	}, fs, nil
+}
+
+// ZinfoFromReader creates zinfo for a gzip stream.
+func (gzb gzipZinfoBuilder) ZinfoFromReader(r io.Reader, spanSize int64, uncompressed io.Writer) (zinfo CompressionInfo, fs compression.Offset, err error) {
+	return zinfoFromReader(compression.Gzip, r, spanSize, uncompressed)
+}
+
+// ZinfoFromFileWithSpanPlanner creates zinfo for a gzip file with spans placed by `planner`.
+func (gzb gzipZinfoBuilder) ZinfoFromFileWithSpanPlanner(filename string, planner compression.SpanPlanner) (zinfo CompressionInfo, fs compression.Offset, err error) {
+	return zinfoFromFileWithSpanPlanner(compression.Gzip, filename, planner)
+}
+
+type zstdZinfoBuilder struct{}
+
+// ZinfoFromFile creates zinfo for a zstd file. The underlying zinfo object (i.e. `ZstdZinfo`)
+// is stored in `CompressionInfo.Checkpoints` as byte slice.
+func (zzb zstdZinfoBuilder) ZinfoFromFile(filename string, spanSize int64) (zinfo CompressionInfo, fs compression.Offset, err error) {
+	index, err := compression.NewZinfoFromFile(compression.Zstd, filename, spanSize)
+	if err != nil {
+		return
+	}
+	defer index.Close()
+
+	fs, err = getFileSize(filename)
+	if err != nil {
+		return
+	}
+
+	digests, err := getPerSpanDigests(filename, int64(fs), index)
+	if err != nil {
+		return
+	}
+
+	checkpoints, err := index.Bytes()
+	if err != nil {
+		return
+	}
+
+	return CompressionInfo{
+		MaxSpanID:            index.MaxSpanID(),
+		SpanDigests:          digests,
+		Checkpoints:          checkpoints,
+		CompressionAlgorithm: compression.Zstd,
 	}, fs, nil
 }
 
+// ZinfoFromReader creates zinfo for a zstd stream.
+func (zzb zstdZinfoBuilder) ZinfoFromReader(r io.Reader, spanSize int64, uncompressed io.Writer) (zinfo CompressionInfo, fs compression.Offset, err error) {
+	return zinfoFromReader(compression.Zstd, r, spanSize, uncompressed)
+}
+
+// ZinfoFromFileWithSpanPlanner creates zinfo for a zstd file. Spans can only start at
+// frame boundaries, so only the span size of `planner` is used.
+func (zzb zstdZinfoBuilder) ZinfoFromFileWithSpanPlanner(filename string, planner compression.SpanPlanner) (zinfo CompressionInfo, fs compression.Offset, err error) {
+	return zinfoFromFileWithSpanPlanner(compression.Zstd, filename, planner)
+}
+
 type tarZinfoBuilder struct{}
 
 func (tzb tarZinfoBuilder) ZinfoFromFile(filename string, spanSize int64) (zinfo CompressionInfo, fs compression.Offset, err error) {
@@ -98,6 +170,145 @@ func (tzb tarZinfoBuilder) ZinfoFromFile(filename string, spanSize int64) (zinfo
 	}, fs, nil
 }
 
+// ZinfoFromReader creates zinfo for a tar stream.
+func (tzb tarZinfoBuilder) ZinfoFromReader(r io.Reader, spanSize int64, uncompressed io.Writer) (zinfo CompressionInfo, fs compression.Offset, err error) {
+	return zinfoFromReader(compression.Uncompressed, r, spanSize, uncompressed)
+}
+
+// ZinfoFromFileWithSpanPlanner creates zinfo for a tar file with spans placed by `planner`.
+func (tzb tarZinfoBuilder) ZinfoFromFileWithSpanPlanner(filename string, planner compression.SpanPlanner) (zinfo CompressionInfo, fs compression.Offset, err error) {
+	return zinfoFromFileWithSpanPlanner(compression.Uncompressed, filename, planner)
+}
+
+// zinfoFromFileWithSpanPlanner builds zinfo for a file with spans placed by `planner`.
+func zinfoFromFileWithSpanPlanner(algorithm, filename string, planner compression.SpanPlanner) (CompressionInfo, compression.Offset, error) {
+	index, err := compression.NewZinfoFromFileWithSpanPlanner(algorithm, filename, planner)
+	if err != nil {
+		return CompressionInfo{}, 0, err
+	}
+	defer index.Close()
+
+	fs, err := getFileSize(filename)
+	if err != nil {
+		return CompressionInfo{}, 0, err
+	}
+
+	digests, err := getPerSpanDigests(filename, int64(fs), index)
+	if err != nil {
+		return CompressionInfo{}, 0, err
+	}
+
+	checkpoints, err := index.Bytes()
+	if err != nil {
+		return CompressionInfo{}, 0, err
+	}
+
+	return CompressionInfo{
+		MaxSpanID:            index.MaxSpanID(),
+		SpanDigests:          digests,
+		Checkpoints:          checkpoints,
+		CompressionAlgorithm: algorithm,
+		gzipMembers:          compression.GzipMembers(index),
+	}, fs, nil
+}
+
+// zinfoFromReader builds zinfo and computes the per span digests with a single pass over `r`.
+func zinfoFromReader(algorithm string, r io.Reader, spanSize int64, uncompressed io.Writer) (CompressionInfo, compression.Offset, error) {
+	sd := newSpanDigester(r)
+	index, err := compression.NewZinfoFromReader(algorithm, sd, spanSize, uncompressed, sd.startSpan)
+	if err != nil {
+		return CompressionInfo{}, 0, err
+	}
+	defer index.Close()
+
+	digests, fs, err := sd.finish()
+	if err != nil {
+		return CompressionInfo{}, 0, err
+	}
+	if len(digests) != int(index.MaxSpanID())+1 {
+		return CompressionInfo{}, 0, fmt.Errorf("unexpected number of span digests; expected: %d, actual: %d", index.MaxSpanID()+1, len(digests))
+	}
+
+	checkpoints, err := index.Bytes()
+	if err != nil {
+		return CompressionInfo{}, 0, err
+	}
+
+	return CompressionInfo{
+		MaxSpanID:            index.MaxSpanID(),
+		SpanDigests:          digests,
+		Checkpoints:          checkpoints,
+		CompressionAlgorithm: algorithm,
+		gzipMembers:          compression.GzipMembers(index),
+	}, fs, nil
+}
+
+// spanDigesterLookahead is the number of bytes `spanDigester` keeps after they are read
+// from the stream, in case they belong to a span that hasn't started yet.
+// It must be larger than the number of bytes zinfo builders read ahead from the stream.
+const spanDigesterLookahead = 1 << 16
+
+// spanDigester computes the digest of each span of a compressed stream while
+// it's read by a zinfo builder, so the stream only needs to be read once.
+type spanDigester struct {
+	r        io.Reader
+	size     int64  // number of bytes read from `r`
+	buf      []byte // bytes read from `r` that haven't been added to `digester`
+	bufStart int64  // offset of `buf` in the stream
+
+	digester digest.Digester // digester of the current span; nil before the first span starts
+	digests  []digest.Digest
+}
+
+func newSpanDigester(r io.Reader) *spanDigester {
+	return &spanDigester{r: r}
+}
+
+func (sd *spanDigester) Read(p []byte) (int, error) {
+	n, err := sd.r.Read(p)
+	sd.buf = append(sd.buf, p[:n]...)
+	sd.size += int64(n)
+	if sd.digester != nil && len(sd.buf) > 2*spanDigesterLookahead {
+		// bytes this far behind can't belong to a span that hasn't started yet.
+		flush := len(sd.buf) - spanDigesterLookahead
+		sd.digester.Hash().Write(sd.buf[:flush])
+		sd.buf = sd.buf[:copy(sd.buf, sd.buf[flush:])]
+		sd.bufStart += int64(flush)
+	}
+	return n, err
+}
+
+// startSpan is a `compression.SpanFunc` that completes the digest of the current span
+// and starts the digest of the next one.
+func (sd *spanDigester) startSpan(start, prevEnd compression.Offset) error {
+	if int64(start) < sd.bufStart || int64(prevEnd) < sd.bufStart || int64(prevEnd) > sd.size || start > prevEnd {
+		return fmt.Errorf("unable to compute span digest; start=%d, end=%d, buffered=[%d, %d)", start, prevEnd, sd.bufStart, sd.size)
+	}
+	if sd.digester != nil {
+		sd.digester.Hash().Write(sd.buf[:int64(prevEnd)-sd.bufStart])
+		sd.digests = append(sd.digests, sd.digester.Digest())
+	}
+	sd.digester = digest.Canonical.Digester()
+	sd.buf = sd.buf[:copy(sd.buf, sd.buf[int64(start)-sd.bufStart:])]
+	sd.bufStart = int64(start)
+	return nil
+}
+
+// finish reads the rest of the stream, completes the digest of the last span
+// and returns the digests of all spans along with the size of the stream.
+func (sd *spanDigester) finish() ([]digest.Digest, compression.Offset, error) {
+	if _, err := io.Copy(io.Discard, sd); err != nil {
+		return nil, 0, err
+	}
+	if sd.digester != nil {
+		sd.digester.Hash().Write(sd.buf)
+		sd.digests = append(sd.digests, sd.digester.Digest())
+		sd.digester = nil
+		sd.buf = nil
+	}
+	return sd.digests, compression.Offset(sd.size), nil
+}
+
 func getPerSpanDigests(filename string, fileSize int64, index compression.Zinfo) ([]digest.Digest, error) {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -105,17 +316,26 @@ func getPerSpanDigests(filename string, fileSize int64, index compression.Zinfo)
 	}
 	defer file.Close()
 
+	digests, err := getPerSpanDigestsFromReaderAt(file, fileSize, index)
+	if err != nil {
+		return nil, fmt.Errorf("%w, file=%s", err, filename)
+	}
+	return digests, nil
+}
+
+// getPerSpanDigestsFromReaderAt computes the digest of every span of a compressed stream of `size` bytes.
+func getPerSpanDigestsFromReaderAt(r io.ReaderAt, size int64, index compression.Zinfo) ([]digest.Digest, error) {
 	var digests []digest.Digest
 	var i compression.SpanID
 	maxSpanID := index.MaxSpanID()
 	for i = 0; i <= maxSpanID; i++ {
 		startOffset := index.StartCompressedOffset(i)
-		endOffset := index.EndCompressedOffset(i, compression.Offset(fileSize))
+		endOffset := index.EndCompressedOffset(i, compression.Offset(size))
 
-		section := io.NewSectionReader(file, int64(startOffset), int64(endOffset-startOffset))
+		section := io.NewSectionReader(r, int64(startOffset), int64(endOffset-startOffset))
 		dgst, err := digest.FromReader(section)
 		if err != nil {
-			return nil, fmt.Errorf("unable to compute digest for section; start=%d, end=%d, file=%s, size=%d", startOffset, endOffset, filename, fileSize)
+			return nil, fmt.Errorf("unable to compute digest for section; start=%d, end=%d, size=%d", startOffset, endOffset, size)
 		}
 		digests = append(digests, dgst)
 	}
@@ -0,0 +1,300 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+// zstd:chunked is a zstd layer in which the content of every file (chunk) starts a new zstd frame.
+// After the tar stream, the layer contains skippable frames with a manifest of the files (the TOC),
+// a tar-split of the layer, and a footer pointing to both. The tar-split records the raw bytes of
+// the tar stream except file contents, so the exact layout of the tar stream can be rebuilt.
+// See https://github.com/containers/storage/blob/main/pkg/chunked/compressor/compressor.go
+const (
+	// zstdChunkedFooterSize is the size of the footer data, which is in a skippable frame at the end of the layer.
+	// Earlier versions of the format don't have a tar-split and have smaller footers, which aren't supported.
+	zstdChunkedFooterSize = 64
+	// zstdSkippableFrameHeaderSize is the size of the magic number and the frame size of a skippable frame.
+	zstdSkippableFrameHeaderSize = 8
+	zstdSkippableFrameMagic      = 0x184D2A50
+
+	zstdChunkedManifestTypeCRFS = 1
+	zstdFrameMagic              = 0xFD2FB528
+
+	// tar-split entry types.
+	tarSplitFileType    = 1
+	tarSplitSegmentType = 2
+)
+
+// zstdChunkedFrameMagic is at the end of the footer of zstd:chunked layers.
+var zstdChunkedFrameMagic = []byte("GNUlInUx")
+
+// zstdChunkedFooter is the footer of a zstd:chunked layer. Offsets point to the data of skippable frames.
+type zstdChunkedFooter struct {
+	manifestOffset             int64
+	manifestLengthCompressed   int64
+	manifestLengthUncompressed int64
+	manifestType               uint64
+	tarSplitOffset             int64
+	tarSplitLengthCompressed   int64
+	tarSplitLengthUncompressed int64
+}
+
+// zstdChunkedManifest is the manifest (TOC) of a zstd:chunked layer.
+type zstdChunkedManifest struct {
+	Version int                        `json:"version"`
+	Entries []zstdChunkedManifestEntry `json:"entries"`
+}
+
+// zstdChunkedManifestEntry is an entry of a zstd:chunked manifest. Regular files whose content is
+// split in several chunks have an extra entry of type "chunk" for every chunk but the first.
+type zstdChunkedManifestEntry struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size,omitempty"`
+	Digest string `json:"digest,omitempty"`
+	// Offset is the offset of the zstd frame at the start of the content (chunk) of the entry.
+	Offset      int64 `json:"offset,omitempty"`
+	ChunkOffset int64 `json:"chunkOffset,omitempty"`
+}
+
+// tarSplitEntry is an entry of a tar-split: either a segment of raw bytes
+// of the tar stream, or the content of a file.
+type tarSplitEntry struct {
+	Type    int    `json:"type"`
+	Name    string `json:"name,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Payload []byte `json:"payload"`
+}
+
+// importZstdChunkedTOC reads the manifest and the tar-split of a zstd:chunked layer. The TOC is
+// built from the tar stream rebuilt from the tar-split with zeroed file contents, and the content
+// digests come from the manifest. Every file content (chunk) recorded in the manifest is a frame boundary.
+func importZstdChunkedTOC(r io.ReaderAt, size int64, digests bool) (*embeddedTOC, error) {
+	footer, err := readZstdChunkedFooter(r, size)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+
+	manifestData, err := readZstdChunkedMetadata(r, decoder, footer.manifestOffset, footer.manifestLengthCompressed, footer.manifestLengthUncompressed)
+	if err != nil {
+		return nil, fmt.Errorf("could not read zstd:chunked manifest: %w", err)
+	}
+	var manifest zstdChunkedManifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return nil, fmt.Errorf("could not decode zstd:chunked manifest: %w", err)
+	}
+	tarSplit, err := readZstdChunkedMetadata(r, decoder, footer.tarSplitOffset, footer.tarSplitLengthCompressed, footer.tarSplitLengthUncompressed)
+	if err != nil {
+		return nil, fmt.Errorf("could not read zstd:chunked tar-split: %w", err)
+	}
+	tarStream, err := newTarSplitReader(tarSplit)
+	if err != nil {
+		return nil, err
+	}
+	md, uncompressedArchiveSize, err := metadataFromTarReader(tarStream, false)
+	if err != nil {
+		return nil, fmt.Errorf("could not read zstd:chunked tar-split: %w", err)
+	}
+
+	// manifest entries of regular files are in the same order as in the tar stream.
+	var (
+		files         []int // indices of regular files in `md`
+		file          FileMetadata
+		boundaries    = []compression.StreamBoundary{{}}
+		frameMagicBuf [4]byte
+	)
+	for i, fm := range md {
+		if fm.Type == "reg" {
+			files = append(files, i)
+		}
+	}
+	for _, e := range manifest.Entries {
+		switch e.Type {
+		case "reg":
+			if len(files) == 0 || CleanEntryName(e.Name) != CleanEntryName(md[files[0]].Name) {
+				return nil, fmt.Errorf("zstd:chunked manifest entry %s doesn't match the tar-split", e.Name)
+			}
+			fm := &md[files[0]]
+			files = files[1:]
+			// the chunks of sparse files don't map to the data stored in the tar stream.
+			if fm.SparseMap != nil {
+				return nil, fmt.Errorf("sparse file %s in zstd:chunked layer is not supported", e.Name)
+			}
+			if digests {
+				if fm.Digest, err = e.contentDigest(); err != nil {
+					return nil, err
+				}
+			}
+			file = *fm
+			if fm.UncompressedSize == 0 {
+				continue
+			}
+		case "chunk":
+			if CleanEntryName(e.Name) != CleanEntryName(file.Name) {
+				return nil, fmt.Errorf("zstd:chunked chunk of %s doesn't follow its file", e.Name)
+			}
+		default:
+			continue
+		}
+
+		if e.Offset <= 0 || e.Offset >= size || e.ChunkOffset < 0 || compression.Offset(e.ChunkOffset) >= file.UncompressedSize {
+			return nil, fmt.Errorf("invalid offset of zstd:chunked entry %s", e.Name)
+		}
+		if err := readFullAt(r, frameMagicBuf[:], e.Offset); err != nil {
+			return nil, err
+		}
+		if binary.LittleEndian.Uint32(frameMagicBuf[:]) != zstdFrameMagic {
+			return nil, fmt.Errorf("no zstd frame at the offset of zstd:chunked entry %s", e.Name)
+		}
+		boundaries = append(boundaries, compression.StreamBoundary{
+			CompressedOffset:   compression.Offset(e.Offset),
+			UncompressedOffset: file.UncompressedOffset + compression.Offset(e.ChunkOffset),
+		})
+	}
+	if len(files) != 0 {
+		return nil, fmt.Errorf("zstd:chunked manifest is missing %d regular files", len(files))
+	}
+
+	return &embeddedTOC{
+		toc:                     TOC{FileMetadata: md},
+		uncompressedArchiveSize: uncompressedArchiveSize,
+		boundaries:              boundaries,
+	}, nil
+}
+
+// readZstdChunkedFooter reads the footer of a zstd:chunked layer.
+func readZstdChunkedFooter(r io.ReaderAt, size int64) (*zstdChunkedFooter, error) {
+	if size < zstdSkippableFrameHeaderSize+zstdChunkedFooterSize {
+		return nil, errNoEmbeddedTOC
+	}
+	buf := make([]byte, zstdSkippableFrameHeaderSize+zstdChunkedFooterSize)
+	if err := readFullAt(r, buf, size-int64(len(buf))); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(buf[0:4]) != zstdSkippableFrameMagic ||
+		binary.LittleEndian.Uint32(buf[4:8]) != zstdChunkedFooterSize ||
+		!bytes.Equal(buf[len(buf)-len(zstdChunkedFrameMagic):], zstdChunkedFrameMagic) {
+		return nil, errNoEmbeddedTOC
+	}
+
+	data := buf[zstdSkippableFrameHeaderSize:]
+	field := func(i int) uint64 {
+		return binary.LittleEndian.Uint64(data[8*i : 8*(i+1)])
+	}
+	footer := &zstdChunkedFooter{
+		manifestOffset:             int64(field(0)),
+		manifestLengthCompressed:   int64(field(1)),
+		manifestLengthUncompressed: int64(field(2)),
+		manifestType:               field(3),
+		tarSplitOffset:             int64(field(4)),
+		tarSplitLengthCompressed:   int64(field(5)),
+		tarSplitLengthUncompressed: int64(field(6)),
+	}
+	if footer.manifestType != zstdChunkedManifestTypeCRFS {
+		return nil, fmt.Errorf("unsupported zstd:chunked manifest type %d", footer.manifestType)
+	}
+	if footer.tarSplitLengthCompressed == 0 {
+		return nil, fmt.Errorf("zstd:chunked layer without tar-split is not supported")
+	}
+	return footer, nil
+}
+
+// readZstdChunkedMetadata reads and decompresses the data of a metadata skippable frame.
+func readZstdChunkedMetadata(r io.ReaderAt, decoder *zstd.Decoder, offset, lengthCompressed, lengthUncompressed int64) ([]byte, error) {
+	if offset <= 0 || lengthCompressed <= 0 || lengthUncompressed < 0 {
+		return nil, fmt.Errorf("invalid offset %d or length %d", offset, lengthCompressed)
+	}
+	compressed := make([]byte, lengthCompressed)
+	if err := readFullAt(r, compressed, offset); err != nil {
+		return nil, err
+	}
+	data, err := decoder.DecodeAll(compressed, make([]byte, 0, lengthUncompressed))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != lengthUncompressed {
+		return nil, fmt.Errorf("unexpected uncompressed length; expected: %d, actual: %d", lengthUncompressed, len(data))
+	}
+	return data, nil
+}
+
+// newTarSplitReader returns the tar stream described by a tar-split, with zeroed file contents.
+func newTarSplitReader(tarSplit []byte) (io.Reader, error) {
+	var readers []io.Reader
+	scanner := bufio.NewScanner(bytes.NewReader(tarSplit))
+	// segments can be as large as a tar header with long PAX records.
+	scanner.Buffer(nil, len(tarSplit)+1)
+	for scanner.Scan() {
+		var e tarSplitEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("could not decode zstd:chunked tar-split: %w", err)
+		}
+		switch e.Type {
+		case tarSplitSegmentType:
+			readers = append(readers, bytes.NewReader(e.Payload))
+		case tarSplitFileType:
+			if e.Size < 0 {
+				return nil, fmt.Errorf("invalid size of %s in zstd:chunked tar-split", e.Name)
+			}
+			readers = append(readers, io.LimitReader(zeroReader{}, e.Size))
+		default:
+			return nil, fmt.Errorf("unsupported zstd:chunked tar-split entry type %d", e.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read zstd:chunked tar-split: %w", err)
+	}
+	return io.MultiReader(readers...), nil
+}
+
+// contentDigest returns the digest of the content of a regular file.
+func (e *zstdChunkedManifestEntry) contentDigest() (digest.Digest, error) {
+	if e.Digest == "" && e.Size == 0 {
+		return digest.Canonical.FromBytes(nil), nil
+	}
+	dgst, err := digest.Parse(e.Digest)
+	if err != nil {
+		return "", fmt.Errorf("invalid digest of zstd:chunked entry %s: %w", e.Name, err)
+	}
+	return dgst, nil
+}
+
+// zeroReader reads an infinite stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
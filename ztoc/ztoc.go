@@ -19,6 +19,7 @@ package ztoc
 import (
 	"archive/tar"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -36,8 +37,53 @@ type Version string
 // Ztoc versions available.
 const (
 	Version09 Version = "0.9"
+	// Version10 adds a content digest to the metadata of regular files.
+	Version10 Version = "1.0"
+	// Version11 compresses the checkpoint windows of gzip zinfo, which makes
+	// ztocs of gzip layers much smaller. Earlier versions of the snapshotter
+	// can't read gzip zinfo of Version11 ztocs.
+	Version11 Version = "1.1"
+	// Version12 adds the sparse map of sparse files, and supports layers made of
+	// multiple gzip members (e.g. eStargz). Earlier versions of the snapshotter
+	// read the wrong data from such layers, so their ztocs can't be built with
+	// earlier versions.
+	Version12 Version = "1.2"
+
+	// DefaultVersion is the version of the ztocs built unless specified otherwise.
+	DefaultVersion = Version10
 )
 
+// versions lists the ztoc versions in the order they were introduced.
+var versions = []Version{Version09, Version10, Version11, Version12}
+
+// ErrVersionTooOld is returned when a layer can't be represented correctly by
+// the version of the ztoc being built or serialized.
+var ErrVersionTooOld = errors.New("layer is not supported by the ztoc version")
+
+// ParseVersion parses a ztoc version that can be built.
+func ParseVersion(s string) (Version, error) {
+	for _, version := range versions {
+		if Version(s) == version {
+			return version, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported ztoc version: %s", s)
+}
+
+// atLeast returns whether `v` is `o` or a version introduced after `o`.
+// Unknown versions are considered newer than all the known ones.
+func (v Version) atLeast(o Version) bool {
+	for _, version := range versions {
+		switch version {
+		case o:
+			return true
+		case v:
+			return false
+		}
+	}
+	return false
+}
+
 // Ztoc is a table of contents for compressed data which consists 2 parts:
 //
 // (1). toc (`TOC`): a table of contents containing file metadata and its
@@ -61,6 +107,10 @@ type CompressionInfo struct {
 	SpanDigests          []digest.Digest
 	Checkpoints          []byte
 	CompressionAlgorithm string
+
+	// gzipMembers is the number of gzip members of the layer, which is only set
+	// by zinfo builders so the ztoc builder can check the ztoc version.
+	gzipMembers int
 }
 
 // TOC is the "ztoc" part of ztoc including metadata of all files in the compressed
@@ -88,6 +138,21 @@ type FileMetadata struct {
 	Devminor int64     // Minor device number (valid for TypeChar or TypeBlock)
 
 	PAXHeaders map[string]string
+
+	// Digest is the digest of the file content. It is only set for regular
+	// files in ztocs of Version10 or later.
+	Digest digest.Digest
+
+	// SparseMap is the map of the data fragments of a sparse file, whose holes aren't
+	// stored in the tar archive. It is nil for files that aren't sparse.
+	// `UncompressedSize` is the size of a sparse file including its holes.
+	SparseMap []SparseEntry
+}
+
+// DataSize returns the size of the content of the file stored in the tar archive,
+// which is smaller than `UncompressedSize` for sparse files.
+func (src FileMetadata) DataSize() compression.Offset {
+	return sparseDataSize(src.SparseMap, src.UncompressedSize)
 }
 
 // FileMode gets file mode for the file metadata
@@ -122,11 +187,20 @@ func (src FileMetadata) Equal(o FileMetadata) bool {
 		src.GID != o.GID ||
 		src.Uname != o.Uname ||
 		src.Gname != o.Gname ||
-		src.ModTime != o.ModTime ||
+		!src.ModTime.Equal(o.ModTime) ||
 		src.Devmajor != o.Devmajor ||
-		src.Devminor != o.Devminor {
+		src.Devminor != o.Devminor ||
+		src.Digest != o.Digest {
 		return false
 	}
+	if (src.SparseMap == nil) != (o.SparseMap == nil) || len(src.SparseMap) != len(o.SparseMap) {
+		return false
+	}
+	for i := range src.SparseMap {
+		if src.SparseMap[i] != o.SparseMap[i] {
+			return false
+		}
+	}
 	if len(src.PAXHeaders) != len(o.PAXHeaders) {
 		return false
 	}
@@ -146,26 +220,42 @@ func (src FileMetadata) Xattrs() map[string]string {
 type MetadataEntry struct {
 	UncompressedSize   compression.Offset
 	UncompressedOffset compression.Offset
+	SparseMap          []SparseEntry
 }
 
-// GetMetadataEntry gets MetadataEntry given a filename.
+// DataSize returns the size of the content of the file stored in the tar archive,
+// which is smaller than `UncompressedSize` for sparse files.
+func (e MetadataEntry) DataSize() compression.Offset {
+	return sparseDataSize(e.SparseMap, e.UncompressedSize)
+}
+
+// GetMetadataEntry gets MetadataEntry given a filename. Hard links are followed.
 func (toc TOC) GetMetadataEntry(filename string) (MetadataEntry, error) {
-	for _, v := range toc.FileMetadata {
-		if v.Name == filename {
-			if v.Linkname != "" {
-				return toc.GetMetadataEntry(v.Linkname)
-			}
+	return getMetadataEntry(toc.Lookup, filename)
+}
+
+// getMetadataEntry gets MetadataEntry given a filename, looking up paths with `lookup`.
+func getMetadataEntry(lookup func(string) (FileMetadata, bool), filename string) (MetadataEntry, error) {
+	name := filename
+	for i := 0; i <= maxLinkDepth; i++ {
+		v, ok := lookup(name)
+		if !ok {
+			return MetadataEntry{}, fmt.Errorf("file %s does not exist in metadata", name)
+		}
+		if v.Linkname == "" {
 			return MetadataEntry{
 				UncompressedSize:   v.UncompressedSize,
 				UncompressedOffset: v.UncompressedOffset,
+				SparseMap:          v.SparseMap,
 			}, nil
 		}
+		name = v.Linkname
 	}
-	return MetadataEntry{}, fmt.Errorf("file %s does not exist in metadata", filename)
+	return MetadataEntry{}, fmt.Errorf("too many links following %s", filename)
 }
 
 // ExtractFile extracts a file from compressed data (as a reader) and returns the
-// byte data.
+// byte data. The holes of sparse files are filled with zeros.
 func (zt Ztoc) ExtractFile(r *io.SectionReader, filename string) ([]byte, error) {
 	entry, err := zt.GetMetadataEntry(filename)
 	if err != nil {
@@ -174,6 +264,10 @@ func (zt Ztoc) ExtractFile(r *io.SectionReader, filename string) ([]byte, error)
 	if entry.UncompressedSize == 0 {
 		return []byte{}, nil
 	}
+	dataSize := entry.DataSize()
+	if dataSize == 0 {
+		return make([]byte, entry.UncompressedSize), nil
+	}
 
 	zinfo, err := zt.Zinfo()
 	if err != nil {
@@ -183,7 +277,7 @@ func (zt Ztoc) ExtractFile(r *io.SectionReader, filename string) ([]byte, error)
 	zt.Checkpoints = nil
 
 	spanStart := zinfo.UncompressedOffsetToSpanID(entry.UncompressedOffset)
-	spanEnd := zinfo.UncompressedOffsetToSpanID(entry.UncompressedOffset + entry.UncompressedSize)
+	spanEnd := zinfo.UncompressedOffsetToSpanID(entry.UncompressedOffset + dataSize)
 	numSpans := spanEnd - spanStart + 1
 
 	checkpoints := make([]compression.Offset, numSpans+1)
@@ -221,12 +315,12 @@ func (zt Ztoc) ExtractFile(r *io.SectionReader, filename string) ([]byte, error)
 		return nil, err
 	}
 
-	bytes, err := zinfo.ExtractDataFromBuffer(buf, entry.UncompressedSize, entry.UncompressedOffset, spanStart)
+	bytes, err := zinfo.ExtractDataFromBuffer(buf, dataSize, entry.UncompressedOffset, spanStart)
 	if err != nil {
 		return nil, err
 	}
 
-	return bytes, nil
+	return expandSparse(bytes, entry.SparseMap, entry.UncompressedSize), nil
 }
 
 // ExtractFromTarGz extracts data given a gzip tar file (`gz`) and its `ztoc`.
@@ -239,6 +333,10 @@ func (zt Ztoc) ExtractFromTarGz(gz string, filename string) (string, error) {
 	if entry.UncompressedSize == 0 {
 		return "", nil
 	}
+	dataSize := entry.DataSize()
+	if dataSize == 0 {
+		return string(make([]byte, entry.UncompressedSize)), nil
+	}
 
 	zinfo, err := zt.Zinfo()
 	if err != nil {
@@ -247,12 +345,45 @@ func (zt Ztoc) ExtractFromTarGz(gz string, filename string) (string, error) {
 	defer zinfo.Close()
 	zt.Checkpoints = nil
 
-	bytes, err := zinfo.ExtractDataFromFile(gz, entry.UncompressedSize, entry.UncompressedOffset)
+	bytes, err := zinfo.ExtractDataFromFile(gz, dataSize, entry.UncompressedOffset)
 	if err != nil {
 		return "", err
 	}
 
-	return string(bytes), nil
+	return string(expandSparse(bytes, entry.SparseMap, entry.UncompressedSize)), nil
+}
+
+// FileSpans returns the IDs of the spans holding the content of the files `names`, in the order
+// of the files and without duplicates. Hard links are followed, and files that don't exist or
+// have no content in the archive are skipped.
+func (zt Ztoc) FileSpans(names []string) ([]compression.SpanID, error) {
+	zinfo, err := zt.Zinfo()
+	if err != nil {
+		return nil, err
+	}
+	defer zinfo.Close()
+
+	var spans []compression.SpanID
+	seen := make(map[compression.SpanID]bool)
+	for _, name := range names {
+		entry, err := zt.GetMetadataEntry(name)
+		if err != nil {
+			continue
+		}
+		dataSize := entry.DataSize()
+		if dataSize == 0 {
+			continue
+		}
+		spanStart := zinfo.UncompressedOffsetToSpanID(entry.UncompressedOffset)
+		spanEnd := zinfo.UncompressedOffsetToSpanID(entry.UncompressedOffset + dataSize - 1)
+		for id := spanStart; id <= spanEnd; id++ {
+			if !seen[id] {
+				seen[id] = true
+				spans = append(spans, id)
+			}
+		}
+	}
+	return spans, nil
 }
 
 // Zinfo deserilizes and returns a Zinfo based on the zinfo bytes and compression
@@ -17,7 +17,10 @@
 package ztoc
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
 
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 )
@@ -34,7 +37,7 @@ type Builder struct {
 }
 
 // NewBuilder creates a `Builder` used to build ztocs. By default it supports gzip,
-// user can register new compression algorithms by calling `RegisterCompressionAlgorithm`.
+// zstd and uncompressed tar, user can register new compression algorithms by calling `RegisterCompressionAlgorithm`.
 func NewBuilder(buildToolIdentifier string) *Builder {
 	builder := Builder{
 		tocBuilder:          NewTocBuilder(),
@@ -42,6 +45,7 @@ func NewBuilder(buildToolIdentifier string) *Builder {
 		buildToolIdentifier: buildToolIdentifier,
 	}
 	builder.RegisterCompressionAlgorithm(compression.Gzip, TarProviderGzip, gzipZinfoBuilder{})
+	builder.RegisterCompressionAlgorithm(compression.Zstd, TarProviderZstd, zstdZinfoBuilder{})
 	builder.RegisterCompressionAlgorithm(compression.Uncompressed, TarProviderTar, tarZinfoBuilder{})
 	builder.RegisterCompressionAlgorithm(compression.Unknown, TarProviderTar, tarZinfoBuilder{})
 
@@ -50,7 +54,13 @@ func NewBuilder(buildToolIdentifier string) *Builder {
 
 // buildConfig contains configuration used when `ztoc.Builder` builds a `Ztoc`.
 type buildConfig struct {
-	algorithm string
+	algorithm     string
+	version       Version
+	spanStrategy  SpanStrategy
+	spanTolerance float64
+	embeddedTOC   bool
+	tempDir       string
+	tempFileGate  func() (release func(), err error)
 }
 
 // BuildOption specifies a change to `buildConfig` when building a ztoc.
@@ -64,10 +74,114 @@ func WithCompression(algorithm string) BuildOption {
 	}
 }
 
+// WithZtocVersion specifies the version of the ztoc to build. Version09 ztocs
+// don't contain file content digests, which makes them faster to build.
+// Version11 ztocs of gzip layers store compressed checkpoint windows. Layers with
+// sparse files or multiple gzip members can only be built with Version12 or later.
+func WithZtocVersion(version Version) BuildOption {
+	return func(opt *buildConfig) error {
+		v, err := ParseVersion(string(version))
+		if err != nil {
+			return err
+		}
+		opt.version = v
+		return nil
+	}
+}
+
+// WithSpanStrategy specifies how spans are placed in the layer. By default, spans have a fixed size.
+func WithSpanStrategy(strategy SpanStrategy) BuildOption {
+	return func(opt *buildConfig) error {
+		if _, err := ParseSpanStrategy(string(strategy)); err != nil {
+			return err
+		}
+		opt.spanStrategy = strategy
+		return nil
+	}
+}
+
+// WithSpanTolerance specifies the fraction of the span size by which the adaptive
+// span strategy can move a span boundary to align it with a tar entry boundary.
+func WithSpanTolerance(tolerance float64) BuildOption {
+	return func(opt *buildConfig) error {
+		if tolerance < 0 || tolerance > maxSpanTolerance {
+			return fmt.Errorf("span tolerance must be between 0 and %v, got: %v", maxSpanTolerance, tolerance)
+		}
+		opt.spanTolerance = tolerance
+		return nil
+	}
+}
+
+// WithEmbeddedTOC specifies whether the TOC embedded in eStargz and zstd:chunked layers is used
+// to build the ztoc instead of decompressing the layer. It's enabled by default. Layers that aren't
+// in either format, or whose embedded TOC doesn't match the layer, are decompressed anyway.
+func WithEmbeddedTOC(enabled bool) BuildOption {
+	return func(opt *buildConfig) error {
+		opt.embeddedTOC = enabled
+		return nil
+	}
+}
+
+// WithTempDir specifies the directory of the temp files that layer blob streams are copied to
+// when they can't be built in a single pass. By default, it's the default directory for temporary files.
+func WithTempDir(dir string) BuildOption {
+	return func(opt *buildConfig) error {
+		opt.tempDir = dir
+		return nil
+	}
+}
+
+// WithTempFileGate specifies a function called before a layer blob stream is copied to a temp file.
+// It may block until there is room for the temp file, and returns a function called once the temp
+// file is removed.
+func WithTempFileGate(gate func() (release func(), err error)) BuildOption {
+	return func(opt *buildConfig) error {
+		opt.tempFileGate = gate
+		return nil
+	}
+}
+
+// includeFileDigests returns whether the ztoc version records file content digests.
+func (c buildConfig) includeFileDigests() bool {
+	return c.version != Version09
+}
+
+// compressGzipWindows returns whether the checkpoint windows of gzip zinfo are compressed.
+func (c buildConfig) compressGzipWindows() bool {
+	return c.algorithm == compression.Gzip && c.version.atLeast(Version11)
+}
+
+// encodeCompressionInfo converts the zinfo built by a `ZinfoBuilder` to the encoding
+// of the ztoc version. An error wrapping `ErrVersionTooOld` is returned if the layer
+// of `toc` can't be represented by the ztoc version.
+func (c buildConfig) encodeCompressionInfo(toc TOC, compressionInfo CompressionInfo) (CompressionInfo, error) {
+	if err := toc.checkSparseFiles(c.version); err != nil {
+		return CompressionInfo{}, err
+	}
+	if compressionInfo.gzipMembers > 1 && !c.version.atLeast(Version12) {
+		return CompressionInfo{}, fmt.Errorf("%w %s: the layer has %d gzip members, which requires ztoc version %s or later",
+			ErrVersionTooOld, c.version, compressionInfo.gzipMembers, Version12)
+	}
+	// the number of gzip members isn't part of the ztoc.
+	compressionInfo.gzipMembers = 0
+	if c.compressGzipWindows() {
+		checkpoints, err := compression.CompressGzipCheckpointWindows(compressionInfo.Checkpoints)
+		if err != nil {
+			return CompressionInfo{}, err
+		}
+		compressionInfo.Checkpoints = checkpoints
+	}
+	return compressionInfo, nil
+}
+
 // defaultBuildConfig creates a `buildConfig` with default values.
 func defaultBuildConfig() buildConfig {
 	return buildConfig{
-		algorithm: compression.Gzip, // use gzip by default
+		algorithm:     compression.Gzip, // use gzip by default
+		version:       DefaultVersion,
+		spanStrategy:  SpanStrategyFixed,
+		spanTolerance: DefaultSpanTolerance,
+		embeddedTOC:   true,
 	}
 }
 
@@ -87,21 +201,53 @@ func (b *Builder) BuildZtoc(filename string, span int64, options ...BuildOption)
 	}
 
 	if !b.CheckCompressionAlgorithm(opt.algorithm) {
-		return nil, fmt.Errorf("unsupported compression algorithm, supported: gzip, got: %s", opt.algorithm)
+		return nil, fmt.Errorf("unsupported compression algorithm, supported: gzip, zstd, uncompressed, got: %s", opt.algorithm)
 	}
 
-	compressionInfo, fs, err := b.zinfoBuilders[opt.algorithm].ZinfoFromFile(filename, span)
+	if opt.embeddedTOC {
+		ztoc, err := b.buildZtocFromEmbeddedTOCFile(filename, span, opt)
+		if err == nil || errors.Is(err, ErrVersionTooOld) {
+			return ztoc, err
+		}
+	}
+
+	zinfoBuilder := b.zinfoBuilders[opt.algorithm]
+	plannedZinfoBuilder, adaptive := zinfoBuilder.(PlannedZinfoBuilder)
+	adaptive = adaptive && opt.spanStrategy == SpanStrategyAdaptive
+
+	var (
+		compressionInfo CompressionInfo
+		fs              compression.Offset
+		err             error
+	)
+	if !adaptive {
+		compressionInfo, fs, err = zinfoBuilder.ZinfoFromFile(filename, span)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	toc, uncompressedArchiveSize, err := b.tocBuilder.tocFromFile(opt.algorithm, filename, opt.includeFileDigests())
 	if err != nil {
 		return nil, err
 	}
 
-	toc, uncompressedArchiveSize, err := b.tocBuilder.TocFromFile(opt.algorithm, filename)
+	// the adaptive span planner needs the TOC to know where tar entries are.
+	if adaptive {
+		planner := newAdaptiveSpanPlanner(span, opt.spanTolerance, toc, uncompressedArchiveSize)
+		compressionInfo, fs, err = plannedZinfoBuilder.ZinfoFromFileWithSpanPlanner(filename, planner)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	compressionInfo, err = opt.encodeCompressionInfo(toc, compressionInfo)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Ztoc{
-		Version:                 Version09,
+		Version:                 opt.version,
 		TOC:                     toc,
 		CompressedArchiveSize:   fs,
 		UncompressedArchiveSize: uncompressedArchiveSize,
@@ -110,6 +256,132 @@ func (b *Builder) BuildZtoc(filename string, span int64, options ...BuildOption)
 	}, nil
 }
 
+// BuildZtocFromReader builds a `Ztoc` given a layer blob stream. The TOC, the zinfo and
+// the span digests are all computed with a single pass over the stream, so the layer doesn't
+// need to be stored on disk. If the `ZinfoBuilder` of the compression algorithm doesn't implement
+// `StreamingZinfoBuilder`, or spans are placed with `SpanStrategyAdaptive` (which needs the TOC
+// before building the zinfo), the stream is copied to a temp file and built with `BuildZtoc`.
+// If `r` also supports random access (e.g. `io.SectionReader`), the TOC embedded in eStargz and
+// zstd:chunked layers is used instead, unless disabled via `WithEmbeddedTOC`.
+// By default it assumes the layer is compressed using `gzip`, unless specified via `WithCompression`.
+func (b *Builder) BuildZtocFromReader(r io.Reader, span int64, options ...BuildOption) (*Ztoc, error) {
+	opt := defaultBuildConfig()
+	for _, f := range options {
+		err := f(&opt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !b.CheckCompressionAlgorithm(opt.algorithm) {
+		return nil, fmt.Errorf("unsupported compression algorithm, supported: gzip, zstd, uncompressed, got: %s", opt.algorithm)
+	}
+
+	if ra, ok := r.(sizedReaderAt); ok && opt.embeddedTOC {
+		// the embedded TOC is read with `ReadAt`, so `r` can still be read from the start if there is none.
+		ztoc, err := b.buildZtocFromEmbeddedTOC(ra, ra.Size(), span, opt)
+		if err == nil || errors.Is(err, ErrVersionTooOld) {
+			return ztoc, err
+		}
+		// the embedded TOC has already been tried.
+		options = append(options, WithEmbeddedTOC(false))
+	}
+
+	zinfoBuilder, ok := b.zinfoBuilders[opt.algorithm].(StreamingZinfoBuilder)
+	if !ok || opt.spanStrategy == SpanStrategyAdaptive {
+		return b.buildZtocFromTempFile(r, span, opt, options...)
+	}
+
+	// the TOC is built concurrently from the uncompressed stream produced by the zinfo builder.
+	pr, pw := io.Pipe()
+	type tocResult struct {
+		toc                     TOC
+		uncompressedArchiveSize compression.Offset
+		err                     error
+	}
+	tocCh := make(chan tocResult, 1)
+	go func() {
+		toc, uncompressedArchiveSize, err := b.tocBuilder.tocFromReader(pr, opt.includeFileDigests())
+		if err == nil {
+			// consume the rest of the stream (e.g. padding after the end of the archive)
+			// so the zinfo builder isn't blocked.
+			_, err = io.Copy(io.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		tocCh <- tocResult{toc, uncompressedArchiveSize, err}
+	}()
+
+	compressionInfo, fs, err := zinfoBuilder.ZinfoFromReader(r, span, pw)
+	pw.CloseWithError(err)
+	res := <-tocCh
+	if err != nil {
+		// if the TOC builder failed, the zinfo builder fails to write the uncompressed stream.
+		if res.err != nil && errors.Is(err, res.err) {
+			return nil, res.err
+		}
+		return nil, err
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	compressionInfo, err = opt.encodeCompressionInfo(res.toc, compressionInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Ztoc{
+		Version:                 opt.version,
+		TOC:                     res.toc,
+		CompressedArchiveSize:   fs,
+		UncompressedArchiveSize: res.uncompressedArchiveSize,
+		BuildToolIdentifier:     b.buildToolIdentifier,
+		CompressionInfo:         compressionInfo,
+	}, nil
+}
+
+// sizedReaderAt is a layer blob stream that supports random access, such as `io.SectionReader`.
+type sizedReaderAt interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// buildZtocFromEmbeddedTOCFile builds a `Ztoc` from the TOC embedded in a layer blob file.
+func (b *Builder) buildZtocFromEmbeddedTOCFile(filename string, span int64, opt buildConfig) (*Ztoc, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return b.buildZtocFromEmbeddedTOC(f, fi.Size(), span, opt)
+}
+
+// buildZtocFromTempFile copies a layer blob stream to a temp file and builds a `Ztoc` from it.
+func (b *Builder) buildZtocFromTempFile(r io.Reader, span int64, opt buildConfig, options ...BuildOption) (*Ztoc, error) {
+	if opt.tempFileGate != nil {
+		release, err := opt.tempFileGate()
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+	tmpFile, err := os.CreateTemp(opt.tempDir, "tmp.*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	if _, err := io.Copy(tmpFile, r); err != nil {
+		return nil, err
+	}
+	return b.BuildZtoc(tmpFile.Name(), span, options...)
+}
+
 // RegisterCompressionAlgorithm supports a new compression algorithm in `ztoc.Builder`.
 func (b *Builder) RegisterCompressionAlgorithm(name string, tarProvider TarProvider, zinfoBuilder ZinfoBuilder) {
 	if b.zinfoBuilders == nil {
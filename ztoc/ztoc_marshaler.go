@@ -35,8 +35,12 @@ import (
 var ErrInvalidTOCEntry = errors.New("invalid toc entry")
 
 // Marshal serializes Ztoc to its flatbuffers schema and returns a reader along with the descriptor (digest and size only).
-// If not successful, it will return an error.
+// If not successful, it will return an error. Ztocs with sparse files can only be serialized with `Version12` or later.
 func Marshal(ztoc *Ztoc) (io.Reader, ocispec.Descriptor, error) {
+	// older snapshotters ignore sparse maps, so they must not be written in ztocs they read.
+	if err := ztoc.checkSparseFiles(ztoc.Version); err != nil {
+		return nil, ocispec.Descriptor{}, err
+	}
 	flatbuf, err := ztocToFlatbuffer(ztoc)
 	if err != nil {
 		return nil, ocispec.Descriptor{}, err
@@ -137,6 +141,28 @@ func flatbufferToTOC(fbtoc *ztoc_flatbuffers.TOC) (TOC, error) {
 			value := string(xattrEntry.Value())
 			me.PAXHeaders[key] = value
 		}
+		if d := metadataEntry.Digest(); len(d) > 0 {
+			dgst, err := digest.Parse(string(d))
+			if err != nil {
+				return toc, fmt.Errorf("invalid digest for file %s: %w", me.Name, err)
+			}
+			me.Digest = dgst
+		}
+		if n := metadataEntry.SparseMapLength(); n > 0 {
+			if n%2 != 0 {
+				return toc, fmt.Errorf("invalid sparse map for file %s", me.Name)
+			}
+			me.SparseMap = make([]SparseEntry, n/2)
+			for j := range me.SparseMap {
+				me.SparseMap[j] = SparseEntry{
+					Offset: compression.Offset(metadataEntry.SparseMap(2 * j)),
+					Length: compression.Offset(metadataEntry.SparseMap(2*j + 1)),
+				}
+			}
+			if err := validateSparseMap(me.SparseMap, me.UncompressedSize); err != nil {
+				return toc, fmt.Errorf("file %s: %w", me.Name, err)
+			}
+		}
 
 		toc.FileMetadata[i] = me
 	}
@@ -156,7 +182,7 @@ func flatbufferToTOC(fbtoc *ztoc_flatbuffers.TOC) (TOC, error) {
 		}
 		tocEntry.TarHeaderOffset = nextTarHeader
 		// The next tar header can be found immediately after the current file + padding
-		nextTarHeader = AlignToTarBlock(tocEntry.UncompressedOffset + tocEntry.UncompressedSize)
+		nextTarHeader = AlignToTarBlock(tocEntry.UncompressedOffset + tocEntry.DataSize())
 	}
 	return toc, nil
 }
@@ -247,6 +273,23 @@ func prepareMetadataOffset(builder *flatbuffers.Builder, me FileMetadata) flatbu
 
 	xattrs := prepareXattrsOffset(me, builder)
 
+	// only add digest if present so that ztocs without file digests
+	// serialize the same way they did before digests were introduced.
+	var dgst flatbuffers.UOffsetT
+	if me.Digest != "" {
+		dgst = builder.CreateString(me.Digest.String())
+	}
+	// likewise, the sparse map is only added for sparse files.
+	var sparseMap flatbuffers.UOffsetT
+	if me.SparseMap != nil {
+		ztoc_flatbuffers.FileMetadataStartSparseMapVector(builder, 2*len(me.SparseMap))
+		for j := len(me.SparseMap) - 1; j >= 0; j-- {
+			builder.PrependInt64(int64(me.SparseMap[j].Length))
+			builder.PrependInt64(int64(me.SparseMap[j].Offset))
+		}
+		sparseMap = builder.EndVector(2 * len(me.SparseMap))
+	}
+
 	ztoc_flatbuffers.FileMetadataStart(builder)
 	ztoc_flatbuffers.FileMetadataAddName(builder, name)
 	ztoc_flatbuffers.FileMetadataAddType(builder, t)
@@ -263,6 +306,12 @@ func prepareMetadataOffset(builder *flatbuffers.Builder, me FileMetadata) flatbu
 	ztoc_flatbuffers.FileMetadataAddDevminor(builder, me.Devminor)
 
 	ztoc_flatbuffers.FileMetadataAddXattrs(builder, xattrs)
+	if me.Digest != "" {
+		ztoc_flatbuffers.FileMetadataAddDigest(builder, dgst)
+	}
+	if me.SparseMap != nil {
+		ztoc_flatbuffers.FileMetadataAddSparseMap(builder, sparseMap)
+	}
 
 	off := ztoc_flatbuffers.FileMetadataEnd(builder)
 	return off
@@ -22,6 +22,7 @@ import (
 
 	ztoc_flatbuffers "github.com/awslabs/soci-snapshotter/ztoc/fbs/ztoc"
 	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/opencontainers/go-digest"
 )
 
 // roundtrip serializes and then immediately deserializes
@@ -57,6 +58,8 @@ func TestPositiveTOCRoundtrip(t *testing.T) {
 		UncompressedSize:   1000,
 		TarHeaderOffset:    testFile1.UncompressedOffset + 512,
 	}
+	testFile1WithDigest := testFile1
+	testFile1WithDigest.Digest = digest.FromString("file1")
 	tests := []struct {
 		name        string
 		toc         TOC
@@ -65,28 +68,43 @@ func TestPositiveTOCRoundtrip(t *testing.T) {
 		{
 			name: "serialize -> deserialize produces same toc",
 			toc: TOC{
-				[]FileMetadata{
+				FileMetadata: []FileMetadata{
 					testFile1,
 					testFile2,
 				},
 			},
 			expectedTOC: TOC{
-				[]FileMetadata{
+				FileMetadata: []FileMetadata{
 					testFile1,
 					testFile2,
 				},
 			},
 		},
+		{
+			name: "serialize -> deserialize preserves file digests",
+			toc: TOC{
+				FileMetadata: []FileMetadata{
+					testFile1WithDigest,
+					testFile2,
+				},
+			},
+			expectedTOC: TOC{
+				FileMetadata: []FileMetadata{
+					testFile1WithDigest,
+					testFile2,
+				},
+			},
+		},
 		{
 			name: "files are reordered by uncompressed offset",
 			toc: TOC{
-				[]FileMetadata{
+				FileMetadata: []FileMetadata{
 					testFile2,
 					testFile1,
 				},
 			},
 			expectedTOC: TOC{
-				[]FileMetadata{
+				FileMetadata: []FileMetadata{
 					testFile1,
 					testFile2,
 				},
@@ -140,7 +158,7 @@ func TestNegativeTOCRoundtrip(t *testing.T) {
 		{
 			name: "overlapping files are invalid",
 			toc: TOC{
-				[]FileMetadata{
+				FileMetadata: []FileMetadata{
 					testFile1,
 					overlapTestFile1,
 				},
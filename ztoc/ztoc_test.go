@@ -19,10 +19,12 @@ package ztoc
 import (
 	"bytes"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/awslabs/soci-snapshotter/util/testutil"
@@ -47,6 +49,20 @@ func buildTarGZ(t testing.TB, tarName string, tarEntries []testutil.TarEntry) (s
 	return tarGzFilePath, m, fileNames
 }
 
+func buildTarZstd(t testing.TB, tarName string, tarEntries []testutil.TarEntry) (string, map[string][]byte, []string) {
+	tarReader := testutil.BuildTarZstd(tarEntries, 3)
+	tarZstdFilePath, _, err := testutil.WriteTarToTempFile(tarName+".tar.zst", tarReader)
+	if err != nil {
+		t.Fatalf("cannot prepare the .tar.zst file for testing")
+	}
+	m, fileNames, err := testutil.GetFilesAndContentsWithinTarZstd(tarZstdFilePath)
+	if err != nil {
+		os.Remove(tarZstdFilePath)
+		t.Fatalf("failed to get tar zstd files and their contents: %v", err)
+	}
+	return tarZstdFilePath, m, fileNames
+}
+
 func buildTar(t testing.TB, tarName string, tarEntries []testutil.TarEntry) (string, map[string][]byte, []string) {
 	tarReader := testutil.BuildTar(tarEntries)
 	tarFilePath, _, err := testutil.WriteTarToTempFile(tarName+".tar", tarReader)
@@ -77,6 +93,11 @@ var testZtocs = []struct {
 		compressionAlgo: compression.Gzip,
 		tarGenerator:    buildTarGZ,
 	},
+	{
+		name:            "zstd",
+		compressionAlgo: compression.Zstd,
+		tarGenerator:    buildTarZstd,
+	},
 	{
 		name:            "uncompressed",
 		compressionAlgo: compression.Uncompressed,
@@ -320,6 +341,443 @@ func testZtocGenerationConsistency(t *testing.T, compressionAlgo string, generat
 
 }
 
+// fileZinfoBuilder is a `ZinfoBuilder` that doesn't implement `StreamingZinfoBuilder`.
+type fileZinfoBuilder struct {
+	builder ZinfoBuilder
+}
+
+func (fzb fileZinfoBuilder) ZinfoFromFile(filename string, spanSize int64) (CompressionInfo, compression.Offset, error) {
+	return fzb.builder.ZinfoFromFile(filename, spanSize)
+}
+
+func TestBuildZtocFromReader(t *testing.T) {
+	for _, tc := range testZtocs {
+		testBuildZtocFromReader(t, tc.compressionAlgo, tc.tarGenerator)
+	}
+}
+
+func testBuildZtocFromReader(t *testing.T, compressionAlgo string, generator tarGenerator) {
+	testcases := []struct {
+		name       string
+		tarEntries []testutil.TarEntry
+		spanSize   int64
+		tarName    string
+	}{
+		{
+			name: "two small files, span_size=64",
+			tarEntries: []testutil.TarEntry{
+				testutil.File("file1", string(testutil.RandomByteData(10))),
+				testutil.File("file2", string(testutil.RandomByteData(15))),
+			},
+			spanSize: 64,
+			tarName:  "testcase0",
+		},
+		{
+			name: "mixed files, span_size=64KiB",
+			tarEntries: []testutil.TarEntry{
+				testutil.Dir("dir/"),
+				testutil.File("dir/file1", string(testutil.RandomByteData(1000000))),
+				testutil.File("file2", string(testutil.RandomByteData(2500000))),
+				testutil.Symlink("link", "dir/file1"),
+				testutil.File("file3", string(testutil.RandomByteData(25))),
+				testutil.File("file4", string(testutil.RandomByteData(88888))),
+			},
+			spanSize: 65536,
+			tarName:  "testcase1",
+		},
+	}
+
+	streamingBuilder := NewBuilder("test")
+	fileBuilder := NewBuilder("test")
+	fileBuilder.RegisterCompressionAlgorithm(compressionAlgo, fileBuilder.tocBuilder.tarProviders[compressionAlgo],
+		fileZinfoBuilder{fileBuilder.zinfoBuilders[compressionAlgo]})
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(fmt.Sprintf("%s-%s", compressionAlgo, tc.name), func(t *testing.T) {
+			tarFilePath, _, _ := generator(t, tc.tarName, tc.tarEntries)
+			defer os.Remove(tarFilePath)
+
+			expected, err := streamingBuilder.BuildZtoc(tarFilePath, tc.spanSize, WithCompression(compressionAlgo))
+			if err != nil {
+				t.Fatalf("can't build ztoc from file: %v", err)
+			}
+
+			for name, builder := range map[string]*Builder{"streaming": streamingBuilder, "temp file": fileBuilder} {
+				f, err := os.Open(tarFilePath)
+				if err != nil {
+					t.Fatalf("can't open tar file: %v", err)
+				}
+				ztoc, err := builder.BuildZtocFromReader(f, tc.spanSize, WithCompression(compressionAlgo))
+				f.Close()
+				if err != nil {
+					t.Fatalf("can't build ztoc from reader (%s): %v", name, err)
+				}
+				if !reflect.DeepEqual(ztoc, expected) {
+					if !bytes.Equal(ztoc.Checkpoints, expected.Checkpoints) {
+						diffIdx := getPositionOfFirstDiffInByteSlice(ztoc.Checkpoints, expected.Checkpoints)
+						t.Fatalf("checkpoints built from reader (%s) differ starting from position %d", name, diffIdx)
+					}
+					t.Fatalf("ztoc built from reader (%s) doesn't match ztoc built from file", name)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildZtocFromReaderInvalidStream(t *testing.T) {
+	ztocBuilder := NewBuilder("test")
+	for _, tc := range testZtocs {
+		if tc.compressionAlgo == compression.Uncompressed {
+			continue
+		}
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ztocBuilder.BuildZtocFromReader(bytes.NewReader([]byte("not a compressed stream")), 64, WithCompression(tc.compressionAlgo))
+			if err == nil {
+				t.Fatalf("expected error building ztoc from an invalid %s stream", tc.compressionAlgo)
+			}
+		})
+	}
+}
+
+func TestBuildZtocFileDigests(t *testing.T) {
+	for _, tc := range testZtocs {
+		testBuildZtocFileDigests(t, tc.compressionAlgo, tc.tarGenerator)
+	}
+}
+
+func testBuildZtocFileDigests(t *testing.T, compressionAlgo string, generator tarGenerator) {
+	tarEntries := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/file1", string(testutil.RandomByteData(100000))),
+		testutil.File("file2", ""),
+		testutil.Symlink("link", "dir/file1"),
+		testutil.File("file3", string(testutil.RandomByteData(25))),
+	}
+	testCases := []struct {
+		name            string
+		options         []BuildOption
+		expectedVersion Version
+		expectDigests   bool
+	}{
+		{
+			name:            "default version records file digests",
+			expectedVersion: Version10,
+			expectDigests:   true,
+		},
+		{
+			name:            "version 1.0 records file digests",
+			options:         []BuildOption{WithZtocVersion(Version10)},
+			expectedVersion: Version10,
+			expectDigests:   true,
+		},
+		{
+			name:            "version 0.9 doesn't record file digests",
+			options:         []BuildOption{WithZtocVersion(Version09)},
+			expectedVersion: Version09,
+			expectDigests:   false,
+		},
+	}
+
+	tarFilePath, m, _ := generator(t, "testcase", tarEntries)
+	defer os.Remove(tarFilePath)
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(fmt.Sprintf("%s-%s", compressionAlgo, tc.name), func(t *testing.T) {
+			options := append([]BuildOption{WithCompression(compressionAlgo)}, tc.options...)
+			built, err := NewBuilder("test").BuildZtoc(tarFilePath, 64, options...)
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			f, err := os.Open(tarFilePath)
+			if err != nil {
+				t.Fatalf("can't open tar file: %v", err)
+			}
+			defer f.Close()
+			streamed, err := NewBuilder("test").BuildZtocFromReader(f, 64, options...)
+			if err != nil {
+				t.Fatalf("can't build ztoc from reader: %v", err)
+			}
+
+			r, _, err := Marshal(built)
+			if err != nil {
+				t.Fatalf("can't marshal ztoc: %v", err)
+			}
+			unmarshaled, err := Unmarshal(r)
+			if err != nil {
+				t.Fatalf("can't unmarshal ztoc: %v", err)
+			}
+
+			for name, ztoc := range map[string]*Ztoc{"built": built, "streamed": streamed, "unmarshaled": unmarshaled} {
+				if ztoc.Version != tc.expectedVersion {
+					t.Fatalf("unexpected version of %s ztoc; expected %s, got %s", name, tc.expectedVersion, ztoc.Version)
+				}
+				for _, fm := range ztoc.FileMetadata {
+					var expected digest.Digest
+					if tc.expectDigests && fm.Type == "reg" {
+						expected = digest.FromBytes(m[fm.Name])
+					}
+					if fm.Digest != expected {
+						t.Fatalf("unexpected digest of %s in %s ztoc; expected %q, got %q", fm.Name, name, expected, fm.Digest)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestWithZtocVersionUnsupported(t *testing.T) {
+	_, err := NewBuilder("test").BuildZtocFromReader(bytes.NewReader(nil), 64, WithZtocVersion("2.0"))
+	if err == nil {
+		t.Fatalf("expected error building ztoc with an unsupported version")
+	}
+}
+
+func TestBuildZtocVersion11(t *testing.T) {
+	for _, tc := range testZtocs {
+		testBuildZtocVersion11(t, tc.compressionAlgo, tc.tarGenerator)
+	}
+}
+
+func testBuildZtocVersion11(t *testing.T, compressionAlgo string, generator tarGenerator) {
+	tarEntries := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/file1", string(testutil.RandomByteData(500000))),
+		testutil.File("file2", strings.Repeat("soci snapshotter\n", 100000)),
+		testutil.Symlink("link", "dir/file1"),
+		testutil.File("file3", string(testutil.RandomByteData(25))),
+	}
+	tarFilePath, m, fileNames := generator(t, "version11", tarEntries)
+	defer os.Remove(tarFilePath)
+
+	t.Run(compressionAlgo, func(t *testing.T) {
+		builder := NewBuilder("test")
+		v10, err := builder.BuildZtoc(tarFilePath, 65536, WithCompression(compressionAlgo), WithZtocVersion(Version10))
+		if err != nil {
+			t.Fatalf("can't build version 1.0 ztoc: %v", err)
+		}
+		f, err := os.Open(tarFilePath)
+		if err != nil {
+			t.Fatalf("can't open tar file: %v", err)
+		}
+		defer f.Close()
+		streamed, err := builder.BuildZtocFromReader(f, 65536, WithCompression(compressionAlgo), WithZtocVersion(Version11))
+		if err != nil {
+			t.Fatalf("can't build version 1.1 ztoc from reader: %v", err)
+		}
+		v11, err := builder.BuildZtoc(tarFilePath, 65536, WithCompression(compressionAlgo), WithZtocVersion(Version11))
+		if err != nil {
+			t.Fatalf("can't build version 1.1 ztoc: %v", err)
+		}
+		if !reflect.DeepEqual(streamed, v11) {
+			t.Fatalf("version 1.1 ztoc built from reader doesn't match ztoc built from file")
+		}
+
+		if v11.Version != Version11 {
+			t.Fatalf("unexpected version; expected %s, got %s", Version11, v11.Version)
+		}
+		if !reflect.DeepEqual(v11.TOC, v10.TOC) || v11.MaxSpanID != v10.MaxSpanID || !reflect.DeepEqual(v11.SpanDigests, v10.SpanDigests) {
+			t.Fatalf("version 1.1 ztoc should only differ from version 1.0 ztoc by its checkpoints")
+		}
+		compressesCheckpoints := compressionAlgo == compression.Gzip
+		if compressesCheckpoints != (len(v11.Checkpoints) < len(v10.Checkpoints)) {
+			t.Fatalf("unexpected checkpoint sizes; version 1.0: %d bytes, version 1.1: %d bytes", len(v10.Checkpoints), len(v11.Checkpoints))
+		}
+
+		r, _, err := Marshal(v11)
+		if err != nil {
+			t.Fatalf("can't marshal ztoc: %v", err)
+		}
+		unmarshaled, err := Unmarshal(r)
+		if err != nil {
+			t.Fatalf("can't unmarshal ztoc: %v", err)
+		}
+		if unmarshaled.Version != Version11 || !bytes.Equal(unmarshaled.Checkpoints, v11.Checkpoints) {
+			t.Fatalf("unmarshaled version 1.1 ztoc doesn't match the original ztoc")
+		}
+
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatalf("can't stat tar file: %v", err)
+		}
+		for _, name := range fileNames {
+			extracted, err := unmarshaled.ExtractFile(io.NewSectionReader(f, 0, fi.Size()), name)
+			if err != nil {
+				t.Fatalf("can't extract %s: %v", name, err)
+			}
+			if !bytes.Equal(extracted, m[name]) {
+				diffIdx := getPositionOfFirstDiffInByteSlice(extracted, m[name])
+				t.Fatalf("file %s extracted bytes != original bytes; byte %d is different", name, diffIdx)
+			}
+		}
+	})
+}
+
+func TestBuildZtocAdaptiveSpans(t *testing.T) {
+	for _, tc := range testZtocs {
+		testBuildZtocAdaptiveSpans(t, tc.compressionAlgo, tc.tarGenerator)
+	}
+}
+
+func testBuildZtocAdaptiveSpans(t *testing.T, compressionAlgo string, generator tarGenerator) {
+	const spanSize = 65536
+	tarEntries := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/largefile", string(testutil.RandomByteData(1000000))),
+	}
+	for i := 0; i < 300; i++ {
+		tarEntries = append(tarEntries, testutil.File(fmt.Sprintf("dir/smallfile%d", i), string(testutil.RandomByteDataRange(100, 3000))))
+	}
+
+	tarFilePath, m, fileNames := generator(t, "adaptive", tarEntries)
+	defer os.Remove(tarFilePath)
+
+	t.Run(compressionAlgo, func(t *testing.T) {
+		options := []BuildOption{WithCompression(compressionAlgo), WithSpanStrategy(SpanStrategyAdaptive)}
+		ztoc, err := NewBuilder("test").BuildZtoc(tarFilePath, spanSize, options...)
+		if err != nil {
+			t.Fatalf("can't build ztoc: %v", err)
+		}
+
+		file, err := os.Open(tarFilePath)
+		if err != nil {
+			t.Fatalf("can't open tar file: %v", err)
+		}
+		defer file.Close()
+		fi, err := file.Stat()
+		if err != nil {
+			t.Fatalf("can't stat tar file: %v", err)
+		}
+
+		for _, f := range fileNames {
+			extracted, err := ztoc.ExtractFile(io.NewSectionReader(file, 0, fi.Size()), f)
+			if err != nil {
+				t.Fatalf("can't extract %s: %v", f, err)
+			}
+			if !bytes.Equal(extracted, m[f]) {
+				diffIdx := getPositionOfFirstDiffInByteSlice(extracted, m[f])
+				t.Fatalf("file %s extracted bytes != original bytes; byte %d is different", f, diffIdx)
+			}
+		}
+
+		// any offset can start a span in a tar, so no small file should straddle spans.
+		if compressionAlgo == compression.Uncompressed {
+			zinfo, err := ztoc.Zinfo()
+			if err != nil {
+				t.Fatalf("can't get zinfo: %v", err)
+			}
+			defer zinfo.Close()
+			for _, fm := range ztoc.FileMetadata {
+				end := fm.UncompressedOffset + fm.UncompressedSize
+				if end-fm.TarHeaderOffset > compression.Offset(zinfo.SpanSize()) {
+					continue
+				}
+				if zinfo.UncompressedOffsetToSpanID(fm.TarHeaderOffset) != zinfo.UncompressedOffsetToSpanID(end-1) {
+					t.Fatalf("file %s straddles spans", fm.Name)
+				}
+			}
+		}
+
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			t.Fatalf("can't seek tar file: %v", err)
+		}
+		streamed, err := NewBuilder("test").BuildZtocFromReader(file, spanSize, options...)
+		if err != nil {
+			t.Fatalf("can't build ztoc from reader: %v", err)
+		}
+		if !reflect.DeepEqual(streamed, ztoc) {
+			t.Fatalf("ztoc built from reader doesn't match ztoc built from file")
+		}
+	})
+}
+
+func TestBuildZtocSpanStrategyOptions(t *testing.T) {
+	testCases := []struct {
+		name    string
+		options []BuildOption
+	}{
+		{
+			name:    "unsupported span strategy",
+			options: []BuildOption{WithSpanStrategy("random")},
+		},
+		{
+			name:    "negative span tolerance",
+			options: []BuildOption{WithSpanTolerance(-0.1)},
+		},
+		{
+			name:    "span tolerance too large",
+			options: []BuildOption{WithSpanTolerance(0.6)},
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewBuilder("test").BuildZtocFromReader(bytes.NewReader(nil), 64, tc.options...)
+			if err == nil {
+				t.Fatalf("expected error building ztoc with invalid options")
+			}
+		})
+	}
+}
+
+func TestBuildZtocFromReaderTempFile(t *testing.T) {
+	for _, tc := range testZtocs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			testBuildZtocFromReaderTempFile(t, tc.compressionAlgo, tc.tarGenerator)
+		})
+	}
+}
+
+func testBuildZtocFromReaderTempFile(t *testing.T, compressionAlgo string, generator tarGenerator) {
+	tarFilePath, _, _ := generator(t, "temp-file", []testutil.TarEntry{
+		testutil.File("file", string(testutil.RandomByteData(100000))),
+	})
+	defer os.Remove(tarFilePath)
+	layer, err := os.ReadFile(tarFilePath)
+	if err != nil {
+		t.Fatalf("can't read layer: %v", err)
+	}
+
+	tempDir := t.TempDir()
+	tempFiles := func() int {
+		entries, err := os.ReadDir(tempDir)
+		if err != nil {
+			t.Fatalf("can't read temp dir: %v", err)
+		}
+		return len(entries)
+	}
+	var gated, released int
+	gate := func() (func(), error) {
+		gated++
+		if n := tempFiles(); n != 0 {
+			t.Fatalf("expected no temp file before the gate is passed, got %d", n)
+		}
+		return func() {
+			released++
+			if n := tempFiles(); n != 0 {
+				t.Fatalf("expected temp file to be removed before release, got %d", n)
+			}
+		}, nil
+	}
+	// adaptive spans need the layer in a temp file.
+	options := []BuildOption{WithCompression(compressionAlgo), WithSpanStrategy(SpanStrategyAdaptive), WithTempDir(tempDir), WithTempFileGate(gate)}
+	if _, err := NewBuilder("test").BuildZtocFromReader(bytes.NewReader(layer), 65536, options...); err != nil {
+		t.Fatalf("can't build ztoc from reader: %v", err)
+	}
+	if gated != 1 || released != 1 {
+		t.Fatalf("expected the gate to be passed and released once, got %d and %d", gated, released)
+	}
+
+	errGate := errors.New("no room for temp file")
+	options = append(options, WithTempFileGate(func() (func(), error) { return nil, errGate }))
+	if _, err := NewBuilder("test").BuildZtocFromReader(bytes.NewReader(layer), 65536, options...); !errors.Is(err, errGate) {
+		t.Fatalf("expected %v, got %v", errGate, err)
+	}
+}
+
 func TestZtocGeneration(t *testing.T) {
 	for _, tc := range testZtocs {
 		testZtocGeneration(t, tc.compressionAlgo, tc.tarGenerator)
@@ -719,6 +1177,92 @@ func testZtocSerialization(t *testing.T, compressionAlgo string, generator tarGe
 
 }
 
+func TestFileSpans(t *testing.T) {
+	for _, tc := range testZtocs {
+		testFileSpans(t, tc.compressionAlgo, tc.tarGenerator)
+	}
+}
+
+func testFileSpans(t *testing.T, compressionAlgo string, generator tarGenerator) {
+	tarEntries := []testutil.TarEntry{
+		testutil.File("first", string(testutil.RandomByteData(200000))),
+		testutil.File("empty", ""),
+		testutil.Dir("dir/"),
+		testutil.File("dir/last", string(testutil.RandomByteData(100000))),
+		testutil.Link("hardlink", "dir/last"),
+	}
+	tarFilePath, _, _ := generator(t, "filespans", tarEntries)
+	defer os.Remove(tarFilePath)
+	zt, err := NewBuilder("test").BuildZtoc(tarFilePath, 65536, WithCompression(compressionAlgo))
+	if err != nil {
+		t.Fatalf("cannot build ztoc: %v", err)
+	}
+	zinfo, err := zt.Zinfo()
+	if err != nil {
+		t.Fatalf("cannot get zinfo: %v", err)
+	}
+	defer zinfo.Close()
+
+	spansOf := func(name string) []compression.SpanID {
+		entry, err := zt.GetMetadataEntry(name)
+		if err != nil {
+			t.Fatalf("cannot get metadata of %s: %v", name, err)
+		}
+		var spans []compression.SpanID
+		for id := compression.SpanID(0); id <= zt.MaxSpanID; id++ {
+			start := zinfo.StartUncompressedOffset(id)
+			end := zinfo.EndUncompressedOffset(id, zt.UncompressedArchiveSize)
+			if start < entry.UncompressedOffset+entry.DataSize() && end > entry.UncompressedOffset {
+				spans = append(spans, id)
+			}
+		}
+		return spans
+	}
+
+	testCases := []struct {
+		name     string
+		files    []string
+		expected []compression.SpanID
+	}{
+		{
+			name:     "files in order",
+			files:    []string{"dir/last", "first"},
+			expected: append(spansOf("dir/last"), spansOf("first")...),
+		},
+		{
+			name:     "duplicate spans are skipped",
+			files:    []string{"first", "first", "/dir/last", "hardlink"},
+			expected: append(spansOf("first"), spansOf("dir/last")...),
+		},
+		{
+			name:     "files without content are skipped",
+			files:    []string{"missing", "empty", "dir"},
+			expected: nil,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(fmt.Sprintf("%s-%s", compressionAlgo, tc.name), func(t *testing.T) {
+			spans, err := zt.FileSpans(tc.files)
+			if err != nil {
+				t.Fatalf("cannot get file spans: %v", err)
+			}
+			// the last span of "first" may hold the start of "dir/last".
+			var expected []compression.SpanID
+			seen := make(map[compression.SpanID]bool)
+			for _, id := range tc.expected {
+				if !seen[id] {
+					seen[id] = true
+					expected = append(expected, id)
+				}
+			}
+			if !reflect.DeepEqual(spans, expected) {
+				t.Fatalf("unexpected spans %v, expected %v", spans, expected)
+			}
+		})
+	}
+}
+
 func TestWriteZtoc(t *testing.T) {
 	testCases := []struct {
 		name                    string